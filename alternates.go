@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+
+	"gopkg.in/errgo.v1"
+)
+
+// maxRemoteAlternateDepth is how deep alternates of the remote's alternates are followed, like git does locally
+const maxRemoteAlternateDepth = 5
+
+// remoteAlternate is an objects directory the remote borrows objects from, with its own sharding
+type remoteAlternate struct {
+	dir      string
+	sharding int
+}
+
+// remoteAlts are the alternates of the remote, its objects/info/alternates and theirs, in the order they are tried.
+// the lines are ipfs paths (/ipfs/$cid/base.git/objects, like a fork pointing at its base) or paths relative to
+// the objects directory listing them. nil until an object the remote doesn't have itself made loadRemoteAlternates run.
+var (
+	remoteAltsMu sync.Mutex
+	remoteAlts   []remoteAlternate
+)
+
+// getAlternateObject reads sha1 from the first alternate of the remote that has it
+func getAlternateObject(sha1 string) (io.ReadCloser, error) {
+	remoteAltsMu.Lock()
+	if remoteAlts == nil {
+		remoteAlts = loadRemoteAlternates(inRepo("objects"), 0, map[string]bool{inRepo("objects"): true}, []remoteAlternate{})
+	}
+	alts := remoteAlts
+	remoteAltsMu.Unlock()
+	for _, alt := range alts {
+		dirs := []string{alt.dir}
+		for i := 0; i < alt.sharding; i++ {
+			dirs = append(dirs, sha1[2*i:2*i+2])
+		}
+		if rc, err := ipfsShell.Cat(path.Join(append(dirs, sha1[2*alt.sharding:])...)); err == nil {
+			log.WithField("sha1", sha1).WithField("alternate", alt.dir).Debug("object from alternate")
+			return rc, nil
+		}
+	}
+	return nil, errgo.Newf("none of the %d alternates has %s", len(alts), sha1)
+}
+
+// loadRemoteAlternates adds the alternates objDir lists to alts, and theirs below them.
+// seen holds the directories added already, so alternates pointing at each other don't loop.
+func loadRemoteAlternates(objDir string, depth int, seen map[string]bool, alts []remoteAlternate) []remoteAlternate {
+	rc, err := ipfsShell.Cat(path.Join(objDir, "info", "alternates"))
+	if err != nil {
+		return alts
+	}
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		log.WithField("dir", objDir).WithField("err", err).Warning("reading alternates failed")
+		return alts
+	}
+	if depth >= maxRemoteAlternateDepth {
+		log.WithField("dir", objDir).Warning("alternates nested too deep, ignoring the rest")
+		return alts
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		dir := strings.TrimSpace(line)
+		if dir == "" || strings.HasPrefix(dir, "#") {
+			continue
+		}
+		if !strings.HasPrefix(dir, "/ipfs/") && !strings.HasPrefix(dir, "/ipns/") {
+			if path.IsAbs(dir) {
+				// a local path of whoever added the repo, not one of ipfs
+				log.WithField("alternate", dir).Debug("skipping local alternate")
+				continue
+			}
+			dir = path.Join(objDir, dir)
+		}
+		dir = path.Clean(dir)
+		if seen[dir] {
+			log.WithField("alternate", dir).Debug("alternates cycle")
+			continue
+		}
+		seen[dir] = true
+		alts = append(alts, remoteAlternate{dir: dir, sharding: alternateSharding(dir)})
+		alts = loadRemoteAlternates(dir, depth+1, seen, alts)
+	}
+	return alts
+}
+
+// alternateSharding is the objectSharding of the alternate dir, from its info/sharding
+func alternateSharding(dir string) int {
+	rc, err := ipfsShell.Cat(path.Join(dir, "info", "sharding"))
+	if err != nil {
+		return 1
+	}
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	n, errParse := parseSharding(string(data))
+	if err != nil || errParse != nil {
+		log.WithField("alternate", dir).Warning("ignoring the object sharding of the alternate")
+		return 1
+	}
+	return n
+}
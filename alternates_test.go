@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// chainCommit adds a commit with one file and parent (if not "") to files and returns it and its objects
+func chainCommit(files map[string]string, content, parent string) (string, []string) {
+	blob, z := looseObject("blob", content)
+	files[objectPath(blob)] = z
+	blobSum, _ := hex.DecodeString(blob)
+	tree, z := looseObject("tree", "100644 file.txt\x00"+string(blobSum))
+	files[objectPath(tree)] = z
+	var parentLine string
+	if parent != "" {
+		parentLine = "parent " + parent + "\n"
+	}
+	commit, z := looseObject("commit", "tree "+tree+"\n"+parentLine+"author a <a@b> 0 +0000\ncommitter a <a@b> 0 +0000\n\n"+content)
+	files[objectPath(commit)] = z
+	return commit, []string{commit, tree, blob}
+}
+
+func TestFetch_remoteAlternatesChain(t *testing.T) {
+	fs, restore := useFakeRepo(t, map[string]string{})
+	defer restore()
+	defer useTmpGitDir(t)()
+
+	// base.git has the first commit, fork.git the second and borrows from base.git,
+	// the remote the third and borrows from fork.git, which also points back at the remote
+	base := map[string]string{"HEAD": "ref: refs/heads/master\n"}
+	c1, objs1 := chainCommit(base, "one\n", "")
+	baseRoot := fs.addTree(base)
+	fork := map[string]string{"objects/info/alternates": "/ipfs/" + baseRoot + "/objects\n../../remote.git/objects\n"}
+	c2, objs2 := chainCommit(fork, "two\n", c1)
+	remote := map[string]string{"HEAD": "ref: refs/heads/master\n", "objects/info/alternates": "# the fork\n../../fork.git/objects\n"}
+	c3, objs3 := chainCommit(remote, "three\n", c2)
+	remote["refs/heads/master"] = c3 + "\n"
+	top := fs.mkdir(map[string]string{"fork.git": fs.addTree(fork), "remote.git": fs.addTree(remote)})
+	ipfsRepoPath = "/ipfs/" + top + "/remote.git"
+
+	var out bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("list\nfetch "+c3+" refs/heads/master\n\n"), &out))
+	for _, obj := range append(append(objs1, objs2...), objs3...) {
+		if _, err := os.Stat(filepath.Join(thisGitRepo, objectPath(obj))); err != nil {
+			t.Errorf("object %s was not fetched: %s", obj, err)
+		}
+	}
+	if len(remoteAlts) != 2 || remoteAlts[0].dir != "/ipfs/"+top+"/fork.git/objects" || remoteAlts[1].dir != "/ipfs/"+baseRoot+"/objects" {
+		t.Errorf("unexpected alternates %v", remoteAlts)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ipfs/go-ipfs-shell"
+	"gopkg.in/errgo.v1"
+)
+
+// names of archived repos we look for at the target path
+var repoArchiveNames = []string{"repo.tar", "repo.tar.gz"}
+
+func isArchiveName(name string) bool {
+	return strings.HasSuffix(name, ".tar") || strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz")
+}
+
+// findRepoArchive returns the ipfs path of a tar'ed repo if the url points at one
+// or if the target directory contains one of the repoArchiveNames.
+// it returns "" for a normal repo layout.
+func findRepoArchive(p string) (string, error) {
+	if isArchiveName(p) {
+		return p, nil
+	}
+	list, err := ipfsShell.List(p)
+	if err != nil {
+		return "", errgo.Notef(err, "findRepoArchive: list(%s) failed", p)
+	}
+	var hasHead bool
+	found := ""
+	for _, lnk := range list {
+		if lnk.Name == "HEAD" {
+			hasHead = true
+		}
+		for _, name := range repoArchiveNames {
+			if isFile(lnk) && lnk.Name == name && found == "" {
+				found = path.Join(p, name)
+			}
+		}
+	}
+	if hasHead {
+		// a real repo wins over an archive next to it
+		return "", nil
+	}
+	return found, nil
+}
+
+// extractRepoArchive downloads the archive at p and unpacks it into a fresh temp dir.
+// it returns the directory that holds the repo (the one with HEAD in it)
+// and the temp dir that needs to be removed afterwards.
+func extractRepoArchive(p string) (repoDir, tmpDir string, err error) {
+	rc, err := ipfsShell.Cat(p)
+	if err != nil {
+		return "", "", errgo.Notef(err, "extractRepoArchive: cat(%s) failed", p)
+	}
+	defer rc.Close()
+	var r io.Reader = rc
+	if !strings.HasSuffix(p, ".tar") {
+		gzr, err := gzip.NewReader(rc)
+		if err != nil {
+			return "", "", errgo.Notef(err, "extractRepoArchive: gzip reader failed")
+		}
+		defer gzr.Close()
+		r = gzr
+	}
+	tmpDir, err = ioutil.TempDir("", "git-remote-ipfs-archive")
+	if err != nil {
+		return "", "", errgo.Notef(err, "extractRepoArchive: tempDir failed")
+	}
+	if err := untar(r, tmpDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", "", errgo.Notef(err, "extractRepoArchive: untar(%s) failed", p)
+	}
+	repoDir, err = findHeadDir(tmpDir)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return "", "", err
+	}
+	log.WithField("archive", p).WithField("dir", repoDir).Debug("extracted repo archive")
+	return repoDir, tmpDir, nil
+}
+
+func untar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errgo.Notef(err, "tar next failed")
+		}
+		target := filepath.Join(dir, filepath.Clean("/"+hdr.Name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return errgo.Notef(err, "mkdirAll(%s) failed", target)
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return errgo.Notef(err, "mkdirAll(%s) failed", target)
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+			if err != nil {
+				return errgo.Notef(err, "create(%s) failed", target)
+			}
+			_, err = io.Copy(f, tr)
+			if errClose := f.Close(); err == nil {
+				err = errClose
+			}
+			if err != nil {
+				return errgo.Notef(err, "writing %s failed", target)
+			}
+		default:
+			log.WithField("name", hdr.Name).Debug("untar: skipping non regular file")
+		}
+	}
+}
+
+// findHeadDir returns dir if it holds a HEAD file or its only sub directory that does,
+// so both a tar of the .git contents and a tar of the .git dir itself work.
+func findHeadDir(dir string) (string, error) {
+	if _, err := os.Stat(filepath.Join(dir, "HEAD")); err == nil {
+		return dir, nil
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", errgo.Notef(err, "findHeadDir: readDir failed")
+	}
+	if len(infos) == 1 && infos[0].IsDir() {
+		sub := filepath.Join(dir, infos[0].Name())
+		if _, err := os.Stat(filepath.Join(sub, "HEAD")); err == nil {
+			return sub, nil
+		}
+	}
+	return "", errgo.New("findHeadDir: archive does not contain a git repo")
+}
+
+// dirShell serves reads below prefix from a local directory and passes everything else on
+type dirShell struct {
+	ipfsAPI
+	prefix string
+	dir    string
+}
+
+// local maps an ipfs path below prefix to the local file
+func (d *dirShell) local(p string) (string, bool) {
+	p = path.Clean(p)
+	if p == d.prefix {
+		return d.dir, true
+	}
+	if strings.HasPrefix(p, d.prefix+"/") {
+		return filepath.Join(d.dir, p[len(d.prefix):]), true
+	}
+	return "", false
+}
+
+func (d *dirShell) Cat(p string) (io.ReadCloser, error) {
+	lp, ok := d.local(p)
+	if !ok {
+		return d.ipfsAPI.Cat(p)
+	}
+	return os.Open(lp)
+}
+
+func (d *dirShell) List(p string) ([]*shell.LsEntry, error) {
+	lp, ok := d.local(p)
+	if !ok {
+		return d.ipfsAPI.List(p)
+	}
+	infos, err := ioutil.ReadDir(lp)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*shell.LsEntry, len(infos))
+	for i, fi := range infos {
+		entries[i] = &shell.LsEntry{Name: fi.Name(), Size: uint64(fi.Size()), Type: unixfsFile}
+		if fi.IsDir() {
+			entries[i].Type = unixfsDir
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func mkTarGz(t *testing.T, prefix string, files map[string]string) string {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for name, data := range files {
+		checkFatal(t, tw.WriteHeader(&tar.Header{Name: prefix + name, Mode: 0600, Size: int64(len(data)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write([]byte(data))
+		checkFatal(t, err)
+	}
+	checkFatal(t, tw.Close())
+	checkFatal(t, gzw.Close())
+	return buf.String()
+}
+
+func TestRepoArchive(t *testing.T) {
+	repo := map[string]string{
+		"HEAD":                  "ref: refs/heads/master\n",
+		"info/refs":             fixtureSha + "\trefs/heads/master\n",
+		"objects/94/17d011822b": "not really zlib",
+	}
+	fs, restore := useFakeRepo(t, map[string]string{
+		"repo.tar.gz": mkTarGz(t, "repo.git/", repo),
+	})
+	defer restore()
+	realShell := ipfsShell
+
+	archive, err := findRepoArchive(ipfsRepoPath)
+	checkFatal(t, err)
+	if archive != ipfsRepoPath+"/repo.tar.gz" {
+		t.Fatalf("archive not detected, got %q", archive)
+	}
+	repoDir, tmpDir, err := extractRepoArchive(archive)
+	checkFatal(t, err)
+	ipfsShell = &dirShell{ipfsAPI: realShell, prefix: ipfsRepoPath, dir: repoDir}
+
+	cats := fs.calls["Cat"]
+	checkFatal(t, listInfoRefs(context.Background(), false))
+	head, err := listHeadRef()
+	checkFatal(t, err)
+	if head != fixtureSha || ref2hash["refs/heads/master"] != fixtureSha {
+		t.Errorf("wrong refs from archive: head %q refs %v", head, ref2hash)
+	}
+	rc, err := fileStore{}.getObject("9417d011822b")
+	checkFatal(t, err)
+	data, err := ioutil.ReadAll(rc)
+	checkFatal(t, err)
+	rc.Close()
+	if string(data) != repo["objects/94/17d011822b"] {
+		t.Errorf("wrong object data: %q", data)
+	}
+	if fs.calls["Cat"] != cats {
+		t.Errorf("expected lookups to be served locally, got %d ipfs cats", fs.calls["Cat"]-cats)
+	}
+
+	cleanups = append(cleanups, func() { os.RemoveAll(tmpDir) })
+	runCleanups()
+	if _, err := os.Stat(tmpDir); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed, stat: %v", tmpDir, err)
+	}
+}
+
+func TestFindRepoArchive_plainRepo(t *testing.T) {
+	_, restore := useFakeRepo(t, map[string]string{
+		"HEAD":     "ref: refs/heads/master\n",
+		"repo.tar": "ignored",
+	})
+	defer restore()
+	archive, err := findRepoArchive(ipfsRepoPath)
+	checkFatal(t, err)
+	if archive != "" {
+		t.Errorf("expected plain repo to win, got archive %q", archive)
+	}
+}
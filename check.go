@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// the daemon versions the helper is known to work with, from daemonVersionMin up to but not including daemonVersionMax.
+// older ones lack parts of the api (like the pin and name options push uses),
+// newer kubo versions dropped the object commands push builds its trees with.
+const (
+	daemonVersionMin = "0.4.5"
+	daemonVersionMax = "0.33.0"
+)
+
+// strictVersion (GIT_IPFS_STRICT_VERSION=1) refuses to work with a daemon outside the known versions instead of warning
+var strictVersion bool
+
+// parseVersion reads the major, minor and patch number of versions like 0.4.23 or 0.18.0-rc1
+func parseVersion(v string) ([3]int, error) {
+	var n [3]int
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	parts := strings.Split(v, ".")
+	if len(parts) > 3 {
+		return n, errgo.Newf("unknown version format %q", v)
+	}
+	for i, p := range parts {
+		var err error
+		if n[i], err = strconv.Atoi(p); err != nil || n[i] < 0 {
+			return n, errgo.Newf("unknown version format %q", v)
+		}
+	}
+	return n, nil
+}
+
+func versionLess(a, b [3]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// checkDaemonVersion returns an error if the daemon version v isn't one the helper is known to work with
+func checkDaemonVersion(v string) error {
+	have, err := parseVersion(v)
+	if err != nil {
+		return err
+	}
+	min, _ := parseVersion(daemonVersionMin)
+	max, _ := parseVersion(daemonVersionMax)
+	if versionLess(have, min) || !versionLess(have, max) {
+		return errgo.Newf("daemon version %s is not known to work, supported are %s up to %s (excluding)", v, daemonVersionMin, daemonVersionMax)
+	}
+	return nil
+}
+
+// checkDaemon asks the daemon for its version at startup and warns about (or with strictVersion refuses) incompatible ones.
+// a daemon that doesn't answer is left to fail with the first real request.
+func checkDaemon() error {
+	v, _, err := ipfsShell.Version()
+	if err != nil {
+		log.WithField("err", err).Debug("daemon version unknown")
+		return nil
+	}
+	if err := checkDaemonVersion(v); err != nil {
+		if strictVersion {
+			return err
+		}
+		log.WithField("err", err).Warning("this daemon might not work, GIT_IPFS_STRICT_VERSION=1 refuses it")
+		return nil
+	}
+	log.WithField("version", v).Debug("daemon version")
+	return nil
+}
+
+// probe is the outcome of one check
+type probe struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+	err    error
+}
+
+// runProbes checks what the daemon behind ipfsShell supports.
+// remotePath is the ipfs path of the remote to check publishing for, "" if none.
+func runProbes(remotePath string) []probe {
+	var probes []probe
+	add := func(name string, err error, format string, args ...interface{}) {
+		p := probe{Name: name, OK: err == nil, Detail: fmt.Sprintf(format, args...), err: err}
+		if err != nil {
+			p.Detail = err.Error()
+		}
+		probes = append(probes, p)
+	}
+
+	start := time.Now()
+	version, commit, err := ipfsShell.Version()
+	latency := time.Since(start)
+	add("daemon", err, "version %s (%s)", version, commit)
+	if err != nil {
+		// nothing else will work either
+		return probes
+	}
+	add("latency", nil, "%s for a version request", latency)
+	add("version", checkDaemonVersion(version), "%s is within %s up to %s", version, daemonVersionMin, daemonVersionMax)
+
+	pinErr := func() error {
+		dir, err := ipfsShell.NewObject("unixfs-dir")
+		if err != nil {
+			return errgo.Notef(err, "creating a test object failed")
+		}
+		if err := ipfsShell.Pin(dir); err != nil {
+			return errgo.Notef(err, "pin failed")
+		}
+		return errgo.Mask(ipfsShell.Unpin(dir))
+	}()
+	add("pinning", pinErr, "supported")
+
+	id, err := ipfsShell.ID()
+	if err != nil {
+		add("ipns", errgo.Notef(err, "getting the node id failed"), "")
+		return probes
+	}
+	name, _, isIPNS := ipnsName(remotePath)
+	switch {
+	case isIPNS && name != id.ID:
+		add("ipns", errgo.Newf("remote name %s is not the key of this node (%s), publishing would need its key", name, id.ID), "")
+	default:
+		current, err := ipfsShell.Resolve(id.ID)
+		if err != nil {
+			current = "nothing published yet"
+		}
+		add("ipns", nil, "can publish with key %s, currently %s", id.ID, current)
+	}
+	return probes
+}
+
+// printProbes writes one line per probe, or the list as json
+func printProbes(w io.Writer, probes []probe, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(probes)
+	}
+	for _, p := range probes {
+		status := "ok"
+		if !p.OK {
+			status = "FAIL"
+		}
+		if _, err := fmt.Fprintf(w, "%-4s %-8s %s\n", status, p.Name, p.Detail); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkMain is git-remote-ipfs check [-json] [<remote-name>]
+func checkMain(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the results as json")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "usage: git-remote-ipfs check [-json] [<remote-name>]")
+		return exitUsage
+	}
+	thisGitRepo = os.Getenv("GIT_DIR")
+	var remotePath string
+	if flags.NArg() == 1 {
+		thisGitRemote = flags.Arg(0)
+		u, err := gitConfig("remote." + thisGitRemote + ".url")
+		if err != nil || u == "" {
+			fmt.Fprintf(os.Stderr, "remote %s has no url\n", thisGitRemote)
+			return exitUsage
+		}
+		u, _ = cutURLLabel(u)
+		if remotePath, err = parseRepoURL(u); err != nil {
+			fmt.Fprintf(os.Stderr, "parsing url of %s failed: %s\n", thisGitRemote, err)
+			return exitUsage
+		}
+	}
+	api := apiAddress()
+	ipfsShell = newShell(api, defaultMaxIdleConns)
+	fmt.Printf("api: %s\n", api)
+	probes := runProbes(remotePath)
+	if err := printProbes(os.Stdout, probes, *asJSON); err != nil {
+		return exitFailure
+	}
+	for _, p := range probes {
+		if !p.OK {
+			return exitCode(p.err)
+		}
+	}
+	return 0
+}
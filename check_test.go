@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func probeMap(probes []probe) map[string]probe {
+	m := make(map[string]probe)
+	for _, p := range probes {
+		m[p.Name] = p
+	}
+	return m
+}
+
+func TestRunProbes(t *testing.T) {
+	fs, restore := useFakeShell()
+	defer restore()
+
+	probes := probeMap(runProbes("/ipns/" + fakePeerID + "/repo.git"))
+	for _, name := range []string{"daemon", "latency", "pinning", "ipns"} {
+		if p, ok := probes[name]; !ok || !p.OK {
+			t.Errorf("probe %s: want ok, got %+v", name, p)
+		}
+	}
+	if !strings.Contains(probes["daemon"].Detail, "0.4.23") {
+		t.Errorf("daemon version missing: %q", probes["daemon"].Detail)
+	}
+	if len(fs.pins) != 0 {
+		t.Errorf("pin probe left pins behind: %v", fs.pins)
+	}
+
+	fs.failPin = errors.New("pinning disabled")
+	probes = probeMap(runProbes("/ipns/example.com/repo.git"))
+	if probes["pinning"].OK || probes["ipns"].OK {
+		t.Errorf("want failing pin and ipns probes, got %+v", probes)
+	}
+
+	fs.down = true
+	list := runProbes("")
+	if len(list) != 1 || list[0].OK || exitCode(list[0].err) != exitDaemon {
+		t.Errorf("unreachable daemon: got %+v", list)
+	}
+}
+
+func TestPrintProbes(t *testing.T) {
+	probes := []probe{{Name: "daemon", OK: true, Detail: "version 0.4.23"}, {Name: "pinning", Detail: "pin failed"}}
+	var out bytes.Buffer
+	checkFatal(t, printProbes(&out, probes, false))
+	if out.String() != "ok   daemon   version 0.4.23\nFAIL pinning  pin failed\n" {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+	out.Reset()
+	checkFatal(t, printProbes(&out, probes, true))
+	var decoded []probe
+	checkFatal(t, json.Unmarshal(out.Bytes(), &decoded))
+	if len(decoded) != 2 || decoded[1].Name != "pinning" || decoded[1].OK {
+		t.Errorf("unexpected json:\n%s", out.String())
+	}
+}
+
+func TestCheckDaemonVersion(t *testing.T) {
+	fs, restore := useFakeShell()
+	defer restore()
+	defer func(s bool) { strictVersion = s }(strictVersion)
+
+	for v, ok := range map[string]bool{
+		daemonVersionMin: true,
+		"0.4.4":          false,
+		"0.4.23-dev":     true,
+		"v0.18.0-rc1":    true,
+		"0.32.99":        true,
+		daemonVersionMax: false,
+		"0.33.1":         false,
+		"1.0":            false,
+		"0.x.1":          false,
+	} {
+		if err := checkDaemonVersion(v); (err == nil) != ok {
+			t.Errorf("version %s: want ok %v, got %v", v, ok, err)
+		}
+		fs.version = v
+		strictVersion = false
+		if err := checkDaemon(); err != nil {
+			t.Errorf("version %s: only a warning without strict, got %s", v, err)
+		}
+		strictVersion = true
+		if err := checkDaemon(); (err == nil) != ok {
+			t.Errorf("version %s strict: want ok %v, got %v", v, ok, err)
+		}
+	}
+	// a daemon that doesn't answer isn't refused here
+	fs.down = true
+	if err := checkDaemon(); err != nil {
+		t.Errorf("unreachable daemon: %s", err)
+	}
+
+	fs.down = false
+	fs.version = "0.3.11"
+	probes := probeMap(runProbes(""))
+	if probes["version"].OK || !probes["daemon"].OK {
+		t.Errorf("old daemon: want a failing version probe, got %+v", probes)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// pushCheckpoint (GIT_IPFS_PUSH_CHECKPOINT=1) records the cid of every object a push added in a manifest in GIT_DIR,
+// so retrying a push that was interrupted skips adding those again and goes on with the rest.
+// the manifest is removed once a push is published, one written with other add settings is started over.
+// the objects it lists aren't pinned until the push is, a repo gc of the daemon in between loses them.
+var pushCheckpoint bool
+
+// checkpoint is the open manifest of this process and checkpointed the objects it had from an earlier push
+var (
+	checkpoint   *os.File
+	checkpointed map[string]string
+)
+
+// checkpointPath is the manifest of pushes to thisGitRemote
+func checkpointPath() string {
+	return filepath.Join(commonDir(), "ipfs-push-"+url.PathEscape(thisGitRemote)+".checkpoint")
+}
+
+// checkpointKey describes what the cid of an added object depends on besides the object, root is the one the push builds on
+func checkpointKey(root string) string {
+	key := fmt.Sprintf("# %T cid-version=%d prestore=%t", objStore, cidVersionOf(root), PreStore != nil)
+	if pushAdder != nil {
+		key += fmt.Sprintf(" chunker=%s opts=%s", pushAdder.chunker, pushAdder.opts.Encode())
+	}
+	return key
+}
+
+// openCheckpoint reads the manifest left by an earlier push and opens it for the objects added from now on.
+// it returns the objects it has cids for.
+func openCheckpoint(root string) (map[string]string, error) {
+	if checkpoint != nil {
+		return checkpointed, nil
+	}
+	key := checkpointKey(root)
+	checkpointed = make(map[string]string)
+	p := checkpointPath()
+	flags, fresh := os.O_WRONLY|os.O_APPEND|os.O_CREATE, true
+	if data, err := ioutil.ReadFile(p); err == nil {
+		// the part after the last newline is cut short, the push was killed while writing it
+		lines := strings.Split(string(data), "\n")
+		lines = lines[:len(lines)-1]
+		if len(lines) > 0 && lines[0] == key {
+			fresh = false
+			for _, line := range lines[1:] {
+				if fields := strings.Fields(line); len(fields) == 2 && objectNameRe.MatchString(fields[0]) {
+					checkpointed[fields[0]] = fields[1]
+				}
+			}
+		} else {
+			log.WithField("checkpoint", p).Debug("checkpoint of other add settings, starting over")
+			flags |= os.O_TRUNC
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, errgo.Notef(err, "reading checkpoint %s failed", p)
+	}
+	f, err := os.OpenFile(p, flags, 0644)
+	if err != nil {
+		return nil, errgo.Notef(err, "opening checkpoint %s failed", p)
+	}
+	if fresh {
+		if _, err := fmt.Fprintln(f, key); err != nil {
+			f.Close()
+			return nil, errgo.Notef(err, "writing checkpoint %s failed", p)
+		}
+	}
+	checkpoint = f
+	if len(checkpointed) > 0 {
+		progressf("resuming push: %d objects were added before\n", len(checkpointed))
+	}
+	return checkpointed, nil
+}
+
+// recordCheckpoint adds the cid of sha1 to the manifest, a failure only costs adding it again next time
+func recordCheckpoint(sha1, mhash string) {
+	if _, err := fmt.Fprintf(checkpoint, "%s %s\n", sha1, mhash); err != nil {
+		log.WithField("err", err).Warning("writing push checkpoint failed")
+	}
+	checkpointed[sha1] = mhash
+}
+
+// closeCheckpoint closes the manifest, and with remove deletes it once the push is published
+func closeCheckpoint(remove bool) {
+	if checkpoint == nil {
+		return
+	}
+	checkpoint.Close()
+	checkpoint, checkpointed = nil, nil
+	if !remove {
+		return
+	}
+	if err := os.Remove(checkpointPath()); err != nil {
+		log.WithField("err", err).Warning("removing push checkpoint failed")
+	}
+}
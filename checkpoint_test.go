@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"gopkg.in/errgo.v1"
+)
+
+func TestPush_checkpointResume(t *testing.T) {
+	_, restore := useFakeRepo(t, map[string]string{"HEAD": "ref: refs/heads/master\n"})
+	defer restore()
+	head, cleanup := mkLocalRepo(t, "ipfs://"+ipfsRepoPath)
+	defer cleanup()
+	objs, err := gitListObjects(head, nil)
+	checkFatal(t, err)
+	pushCheckpoint = true
+	defer func(old int) { pushCheckpoint, pushConcurrency, PreStore = false, old, nil }(pushConcurrency)
+	// one add at a time, so the objects before the failing one are added and the ones after aren't
+	pushConcurrency = 1
+	var stored []string
+	PreStore = func(data []byte) ([]byte, error) {
+		if bytes.Contains(data, []byte("hello")) {
+			return nil, errgo.New("interrupted")
+		}
+		stored = append(stored, string(data))
+		return data, nil
+	}
+
+	var out bytes.Buffer
+	if err := speakGit(context.Background(), strings.NewReader("push refs/heads/master:refs/heads/master\n\n"), &out); err == nil {
+		t.Fatal("the first push should fail")
+	}
+	added := len(stored)
+	data, err := ioutil.ReadFile(checkpointPath())
+	checkFatal(t, err)
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 1+added || added == 0 || added == len(objs) {
+		t.Fatalf("checkpoint should list the %d objects added before the failure:\n%s", added, data)
+	}
+
+	// like a new process retrying the push
+	closeCheckpoint(false)
+	pushRoot, pushStartTop, pushOldRoot, pushRefs = "", "", "", nil
+	PreStore = func(data []byte) ([]byte, error) {
+		stored = append(stored, string(data))
+		return data, nil
+	}
+	out.Reset()
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("push refs/heads/master:refs/heads/master\n\n"), &out))
+	if out.String() != "ok refs/heads/master\n\n" {
+		t.Fatalf("unexpected push reply %q", out.String())
+	}
+	if again := len(stored) - added; again != len(objs)-added {
+		t.Errorf("resumed push added %d objects, want the %d missing ones", again, len(objs)-added)
+	}
+	if _, err := os.Stat(checkpointPath()); !os.IsNotExist(err) {
+		t.Errorf("the checkpoint should be gone after the push, got %v", err)
+	}
+}
+
+func TestCheckpoint_otherCIDVersion(t *testing.T) {
+	defer useTmpGitDir(t)()
+	defer closeCheckpoint(false)
+	_, err := openCheckpoint(fixtureHash)
+	checkFatal(t, err)
+	recordCheckpoint(fixtureSha, fixtureHash)
+	closeCheckpoint(false)
+
+	done, err := openCheckpoint(fixtureHash)
+	checkFatal(t, err)
+	if done[fixtureSha] != fixtureHash {
+		t.Errorf("checkpoint of the same root not resumed: %v", done)
+	}
+	closeCheckpoint(false)
+	// the adds onto a version 1 root come out with other cids
+	if done, err = openCheckpoint("bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi"); err != nil || len(done) != 0 {
+		t.Errorf("checkpoint of a version 0 root reused for a version 1 one: %v %v", done, err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net"
+
+	"github.com/cryptix/git-remote-ipfs/fetch"
+	"github.com/cryptix/git-remote-ipfs/internal/errkind"
+	"gopkg.in/errgo.v1"
+)
+
+// exit codes of the helper, for scripts driving git
+const (
+	exitFailure     = 1   // everything else
+	exitUsage       = 2   // bad arguments or url
+	exitDaemon      = 3   // ipfs daemon unreachable
+	exitNotRepo     = 4   // the url doesn't point at a git repo
+	exitObjectError = 5   // an object is missing or corrupt
+	exitIncomplete  = 6   // fetched with GIT_IPFS_CONTINUE_ON_MISSING, but some objects were skipped
+	exitInterrupted = 130 // canceled by SIGINT or SIGTERM, like a shell reports a process killed by SIGINT
+	exitGitGone     = 141 // git closed the pipe, like a shell reports a process killed by SIGPIPE
+)
+
+// the kinds of errors fetch, push and list return, errors.Is (or errkind.Of, through errgo's wrappers) finds them
+var (
+	ErrDaemonUnreachable = errgo.New("ipfs daemon unreachable")
+	ErrNotARepo          = errgo.New("not a git repo")
+	ErrObjectMissing     = fetch.ErrObjectMissing
+	ErrObjectCorrupt     = fetch.ErrObjectCorrupt
+	ErrNonFastForward    = errgo.New("non-fast-forward")
+)
+
+// errKinds are all of them, the first one found wins
+var errKinds = []error{ErrDaemonUnreachable, ErrNotARepo, ErrObjectMissing, ErrObjectCorrupt, ErrNonFastForward}
+
+// errKind returns the kind of err, nil if it has none.
+// an unreachable daemon wins, its symptoms (missing refs or objects) would be misleading.
+func errKind(err error) error {
+	for e := err; e != nil; {
+		if _, ok := e.(net.Error); ok {
+			return ErrDaemonUnreachable
+		}
+		w, ok := e.(errgo.Wrapper)
+		if !ok {
+			break
+		}
+		e = w.Underlying()
+	}
+	return errkind.Of(err, errKinds...)
+}
+
+// withKind wraps err with its kind, or with kind if it has none yet
+func withKind(err, kind error, format string, args ...interface{}) error {
+	if k := errKind(err); k != nil {
+		kind = k
+	}
+	return errkind.Wrapf(err, kind, format, args...)
+}
+
+// exitCode picks the exit code for err by its kind
+func exitCode(err error) int {
+	if errgo.Cause(err) == errGitGone {
+		return exitGitGone
+	}
+	if errkind.Of(err, context.Canceled) != nil {
+		return exitInterrupted
+	}
+	switch errKind(err) {
+	case ErrDaemonUnreachable:
+		return exitDaemon
+	case ErrNotARepo:
+		return exitNotRepo
+	case ErrObjectMissing, ErrObjectCorrupt:
+		return exitObjectError
+	}
+	return exitFailure
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+
+	"gopkg.in/errgo.v1"
+)
+
+func TestExitCode(t *testing.T) {
+	refused := &url.Error{Op: "Post", URL: "http://localhost:5001/api/v0/cat", Err: &net.OpError{Op: "dial", Net: "tcp", Err: errgo.New("connection refused")}}
+	cases := map[string]struct {
+		err  error
+		want int
+	}{
+		"other":        {errgo.New("something broke"), exitFailure},
+		"daemon":       {errgo.Notef(errgo.Notef(refused, "cat failed"), "fetch failed"), exitDaemon},
+		"daemon first": {errgo.WithCausef(refused, ErrNotARepo, "no refs"), exitDaemon},
+		"not a repo":   {errgo.Notef(errgo.WithCausef(nil, ErrNotARepo, "no refs"), "list"), exitNotRepo},
+		"object":       {errgo.Notef(errgo.WithCausef(nil, ErrObjectMissing, "bad"), "fetch"), exitObjectError},
+	}
+	for name, c := range cases {
+		if got := exitCode(c.err); got != c.want {
+			t.Errorf("%s: want exit code %d, got %d for %v", name, c.want, got, c.err)
+		}
+	}
+}
+
+func TestExitCode_speakGit(t *testing.T) {
+	_, restore := useFakeRepo(t, map[string]string{"README": "not a repo"})
+	err := speakGit(context.Background(), strings.NewReader("list\n"), &bytes.Buffer{})
+	restore()
+	if got := exitCode(err); got != exitNotRepo {
+		t.Errorf("listing a non repo: want exit code %d, got %d (%v)", exitNotRepo, got, err)
+	}
+
+	_, restore = useFakeRepo(t, map[string]string{"HEAD": "ref: refs/heads/master\n"})
+	defer restore()
+	defer useTmpGitDir(t)()
+	err = speakGit(context.Background(), strings.NewReader("fetch "+fixtureSha+" refs/heads/master\n\n"), &bytes.Buffer{})
+	if got := exitCode(err); got != exitObjectError {
+		t.Errorf("fetching a missing object: want exit code %d, got %d (%v)", exitObjectError, got, err)
+	}
+}
+
+func TestErrKinds(t *testing.T) {
+	_, restore := useFakeRepo(t, map[string]string{"README": "not a repo"})
+	err := speakGit(context.Background(), strings.NewReader("list\n"), &bytes.Buffer{})
+	restore()
+	if errKind(err) != ErrNotARepo {
+		t.Errorf("listing a non repo: want ErrNotARepo, got %v", err)
+	}
+
+	files := map[string]string{"HEAD": "ref: refs/heads/master\n"}
+	commit, objs := fixtureCommit(files, "kinds\n")
+	// the blob is there but with the content of the tree
+	files[objectPath(objs[2])] = files[objectPath(objs[1])]
+	_, restore = useFakeRepo(t, files)
+	defer restore()
+	defer useTmpGitDir(t)()
+	err = fetchRef(context.Background(), fixtureSha, "refs/heads/master")
+	if !errors.Is(err, ErrObjectMissing) || errors.Is(err, ErrObjectCorrupt) {
+		t.Errorf("fetching a missing object: want ErrObjectMissing, got %v", err)
+	}
+	err = fetchRef(context.Background(), commit, "refs/heads/master")
+	if !errors.Is(err, ErrObjectCorrupt) {
+		t.Errorf("fetching a corrupt object: want ErrObjectCorrupt, got %v", err)
+	}
+	// through errgo's wrappers errors.Is gives up, errKind doesn't
+	if wrapped := errgo.Notef(err, "fetch failed"); errKind(wrapped) != ErrObjectCorrupt {
+		t.Errorf("kind lost through errgo.Notef: %v", wrapped)
+	}
+
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errgo.New("connection refused")}
+	if err := withKind(refused, ErrNotARepo, "no refs"); !errors.Is(err, ErrDaemonUnreachable) {
+		t.Errorf("a refused connection should be ErrDaemonUnreachable, got %v", err)
+	}
+}
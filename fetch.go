@@ -1,121 +1,504 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/cryptix/exp/git"
+	"github.com/cryptix/git-remote-ipfs/fetch"
 	"gopkg.in/errgo.v1"
 )
 
-// "fetch $sha1 $ref" method 1 - unpacking loose objects
-//   - look for it in ".git/objects/substr($sha1, 0, 2)/substr($sha, 2)"
-//   - if found, download it and put it in place. (there may be a command for this)
-//   - done \o/
-func fetchObject(sha1 string) error {
-	return recurseCommit(sha1)
-}
+// continueOnMissing (GIT_IPFS_CONTINUE_ON_MISSING=1) makes fetch skip the objects it can't get instead of failing.
+// they end up in missingObjects, reported by reportMissing once the helper is done.
+var (
+	continueOnMissing bool
+	missingObjects    []string
+)
 
-func recurseCommit(sha1 string) error {
-	obj, err := fetchAndWriteObj(sha1)
-	if err != nil {
-		return errgo.Notef(err, "fetchAndWriteObj(%s) commit object failed", sha1)
+// fetchConcurrency is how many refs of a fetch batch are fetched at the same time (IPFS_FETCH_CONCURRENCY)
+var fetchConcurrency = 1
+
+// fetchBatch fetches the "fetch $sha1 $ref" lines of one batch, first and the ones scanner returns up to the blank line ending it.
+// the lines are handed to fetchConcurrency workers as they come in, with at most as many more waiting,
+// so a batch of any size only holds a few lines at a time.
+// every object is fetched once, no matter how many refs of the batch point to it.
+// it returns the fetched refs (name -> sha1) if trackRefs or writeCommitGraph need them, nil otherwise.
+// with GIT_IPFS_LOCAL_WRITE=pack the objects of all of them end up in one pack.
+func fetchBatch(ctx context.Context, first string, scanner *bufio.Scanner) (map[string]string, error) {
+	if localWrite == localWritePack {
+		p, err := newPackWriter(commonDir())
+		if err != nil {
+			return nil, err
+		}
+		localPack = p
+		defer func() {
+			p.discard()
+			localPack = nil
+		}()
+	}
+	workers := fetchConcurrency
+	if continueOnMissing {
+		// salvagePacked goes through missingObjects in the order fetchRef added them
+		workers = 1
 	}
-	commit, ok := obj.Commit()
-	if !ok {
-		return errgo.Newf("sha1<%s> is not a git commit object:%s ", sha1, obj)
+	type job struct{ sha1, name string }
+	jobs := make(chan job, workers)
+	failed := make(chan error, workers)
+	// git asks for the tip of several refs once per ref.
+	// the objects queued or being fetched are kept here, the finished ones are in the local repo.
+	var mu sync.Mutex
+	inFlight := make(map[string]bool)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if err := fetchRef(ctx, j.sha1, j.name); err != nil {
+					failed <- err
+					return
+				}
+				mu.Lock()
+				delete(inFlight, j.sha1)
+				mu.Unlock()
+			}
+		}()
 	}
-	if commit.Parent != "" {
-		if err := recurseCommit(commit.Parent); err != nil {
-			return errgo.Notef(err, "recurseCommit(%s) commit Parent failed", commit.Parent)
+	// the first error stops the batch, the fetches in flight still finish before fetchBatch returns
+	stop := func() error {
+		close(jobs)
+		wg.Wait()
+		select {
+		case err := <-failed:
+			return err
+		default:
+			return nil
 		}
 	}
-	return fetchTree(commit.Tree)
+	var fetched map[string]string
+	if trackRefs || writeCommitGraph {
+		fetched = make(map[string]string)
+	}
+	for text := first; text != ""; {
+		fetchSplit := strings.Split(text, " ")
+		if len(fetchSplit) < 3 {
+			stop()
+			return nil, errgo.Newf("malformed 'fetch' command. %q", text)
+		}
+		mu.Lock()
+		dup := inFlight[fetchSplit[1]] || fetchedLocally(fetchSplit[1])
+		if !dup {
+			inFlight[fetchSplit[1]] = true
+		}
+		mu.Unlock()
+		if dup {
+			log.WithField("sha1", fetchSplit[1]).WithField("name", fetchSplit[2]).Debug("fetched for another ref already")
+		} else {
+			select {
+			case jobs <- job{fetchSplit[1], fetchSplit[2]}:
+			case err := <-failed:
+				stop()
+				return nil, err
+			case <-ctx.Done():
+				stop()
+				return nil, ctx.Err()
+			}
+		}
+		if fetched != nil {
+			fetched[fetchSplit[2]] = fetchSplit[1]
+		}
+		if !scanner.Scan() {
+			stop()
+			return nil, errgo.New("fetch batch not terminated")
+		}
+		text = scanner.Text()
+	}
+	if err := stop(); err != nil {
+		return nil, err
+	}
+	if localPack != nil {
+		if err := localPack.finish(); err != nil {
+			return nil, err
+		}
+	}
+	return fetched, nil
 }
 
-func fetchTree(sha1 string) error {
-	obj, err := fetchAndWriteObj(sha1)
-	if err != nil {
-		return errgo.Notef(err, "fetchAndWriteObj(%s) commit tree failed", sha1)
+// fetchedLocally tells whether an earlier fetch of this batch got sha1 already.
+// git only asks for objects it lacks, so what's there now came with the batch.
+func fetchedLocally(sha1 string) bool {
+	if localPack != nil {
+		return localPack.has(sha1)
 	}
-	entries, ok := obj.Tree()
-	if !ok {
-		return errgo.Newf("sha1<%s> is not a git tree object:%s ", sha1, obj)
+	_, err := os.Stat(filepath.Join(commonDir(), objectPath(sha1)))
+	return err == nil
+}
+
+// fetchRef gets sha1 (the remote's ref name) into the local repo, from loose objects if possible and packs otherwise.
+// for an annotated tag the object it peels to is made sure of too, it might only be in a pack the tag's walk didn't find.
+func fetchRef(ctx context.Context, sha1, name string) error {
+	if err := fetchRefObjects(ctx, sha1, name); err != nil {
+		return err
 	}
-	for _, t := range entries {
-		obj, err := fetchAndWriteObj(t.SHA1Sum.String())
-		if err != nil {
-			return errgo.Notef(err, "fetchAndWriteObj(%s) commit tree failed", sha1)
+	target, ok := peeled[name]
+	if !ok || ref2hash[name] != sha1 || gitHasObject(target) {
+		return nil
+	}
+	log.WithField("tag", name).WithField("peeled", target).Debug("fetching what the tag peels to")
+	return fetchRefObjects(ctx, target, name+"^{}")
+}
+
+func fetchRefObjects(ctx context.Context, sha1, name string) error {
+	f := map[string]interface{}{
+		"sha1": sha1,
+		"name": name,
+	}
+	if smallRepo {
+		// there are no packs to fall back to
+		if err := fetchObject(ctx, sha1); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			return withKind(err, ErrObjectMissing, "fetching %s failed (small remote, loose objects only)", sha1)
 		}
-		if obj.Type != git.BlobT {
-			return errgo.Newf("sha1<%s> is not a git tree object:%s ", t.SHA1Sum.String(), obj)
+		log.WithFields(f).Debug("fetched loose, small remote")
+		return nil
+	}
+	if assumePacked {
+		// loose objects would only 404 one at a time
+		errPacked := fetchPackedObject(ctx, sha1)
+		if errPacked == nil {
+			log.WithFields(f).Debug("fetched packed")
+			return nil
 		}
+		log.WithFields(f).WithField("err", errPacked).Debug("fetchPackedObject failed, trying loose...")
+	}
+	before := len(missingObjects)
+	err := fetchObject(ctx, sha1)
+	if err == nil && len(missingObjects) > before {
+		// what isn't there as loose object might still be in a pack
+		salvagePacked(ctx, before)
+		log.WithFields(f).WithField("missing", len(missingObjects)-before).Debug("fetched with missing objects")
+		return nil
+	}
+	if err == nil {
+		log.WithFields(f).Debug("fetched loose")
+		return nil
+	}
+	if ctx.Err() != nil {
+		// interrupted, not missing
+		return err
+	}
+	log.WithFields(f).WithField("err", err).Debug("fetchLooseObject failed, trying packed...")
+	if errPacked := fetchPackedObject(ctx, sha1); errPacked != nil {
+		log.WithFields(f).WithField("err", errPacked).Debug("fetchPackedObject failed")
+		return withKind(err, ErrObjectMissing, "fetching %s failed, as loose object and from packs (%s)", sha1, errPacked)
 	}
+	log.WithFields(f).Debug("fetched packed")
 	return nil
 }
 
-// fetchAndWriteObj looks for the loose object under 'thisGitRepo' global git dir
-// and usses an io.TeeReader to write it to the local repo
-func fetchAndWriteObj(sha1 string) (*git.Object, error) {
-	p := filepath.Join(ipfsRepoPath, "objects", sha1[:2], sha1[2:])
-	ipfsCat, err := ipfsShell.Cat(p)
+// assumePacked (GIT_IPFS_ASSUME_PACKED=1) makes fetchRef try the packs first, for repos that have no loose objects
+var assumePacked bool
+
+// fetchSince (GIT_IPFS_SINCE) is the commit fetching stops the history at, its parents aren't fetched.
+// git is told through $GIT_DIR/shallow, like after clone --shallow-since.
+var fetchSince string
+
+// sinceReached is set (atomically, the workers of a batch run at the same time) once a fetch got to fetchSince
+var sinceReached int32
+
+// markSinceShallow marks fetchSince shallow if a fetch got to it
+func markSinceShallow() error {
+	if atomic.LoadInt32(&sinceReached) == 0 {
+		return nil
+	}
+	return markShallow(fetchSince)
+}
+
+// markShallow adds sha1 to the shallow commits of the local repo, if it isn't one yet
+func markShallow(sha1 string) error {
+	p := filepath.Join(commonDir(), "shallow")
+	b, err := ioutil.ReadFile(p)
+	if err != nil && !os.IsNotExist(err) {
+		return errgo.Notef(err, "reading %s failed", p)
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if line == sha1 {
+			return nil
+		}
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
-		return nil, errgo.Notef(err, "shell.Cat() commit failed")
+		return errgo.Notef(err, "opening %s failed", p)
 	}
-	targetP := filepath.Join(thisGitRepo, "objects", sha1[:2], sha1[2:])
-	if err := os.MkdirAll(filepath.Join(thisGitRepo, "objects", sha1[:2]), 0700); err != nil {
-		return nil, errgo.Notef(err, "mkDirAll() failed")
+	_, err = fmt.Fprintln(f, sha1)
+	if errClose := f.Close(); err == nil {
+		err = errClose
 	}
-	targetObj, err := os.Create(targetP)
 	if err != nil {
-		return nil, errgo.Notef(err, "os.Create(%s) commit failed", targetP)
+		return errgo.Notef(err, "writing %s failed", p)
 	}
-	obj, err := git.DecodeObject(io.TeeReader(ipfsCat, targetObj))
+	log.WithField("sha1", sha1).Debug("marked shallow")
+	return nil
+}
+
+// smallRepoObjects (GIT_IPFS_SMALL_REPO_OBJECTS) is how many loose objects a remote without packs can have to count as small,
+// 0 turns the check off. fetching from a small remote only walks the loose objects and never looks for packs.
+var smallRepoObjects = 100
+
+// smallRepo is set by list if the remote is small
+var smallRepo bool
+
+// detectSmallRepo tells whether the remote has no packs and at most smallRepoObjects loose objects.
+// every objects/xx directory holds at least one object, so it stops listing as soon as there are too many.
+func detectSmallRepo() bool {
+	if smallRepoObjects <= 0 || assumePacked {
+		return false
+	}
+	if _, ok := objStore.(fileStore); !ok || objectSharding != 1 {
+		return false
+	}
+	objects := inRepo("objects")
+	list, err := ipfsShell.List(objects)
 	if err != nil {
-		return nil, errgo.Notef(err, "git.DecodeObject(commit) failed")
+		log.WithField("err", err).Debug("small repo check: listing objects failed")
+		return false
+	}
+	var dirs []string
+	for _, e := range list {
+		switch {
+		case e.Name == "pack" && isDir(e):
+			packs, err := ipfsShell.List(path.Join(objects, "pack"))
+			if err != nil {
+				return false
+			}
+			for _, p := range packs {
+				if strings.HasSuffix(p.Name, ".pack") || strings.HasSuffix(p.Name, ".idx") {
+					return false
+				}
+			}
+		case len(e.Name) == 2 && isDir(e):
+			dirs = append(dirs, e.Name)
+		}
+	}
+	if len(dirs) > smallRepoObjects {
+		return false
 	}
+	var n int
+	for _, dir := range dirs {
+		loose, err := ipfsShell.List(path.Join(objects, dir))
+		if err != nil {
+			return false
+		}
+		if n += len(loose); n > smallRepoObjects {
+			return false
+		}
+	}
+	log.WithField("objects", n).Debug("small remote, fetching loose objects only")
+	return true
+}
+
+// writeCommitGraph (GIT_IPFS_WRITE_COMMIT_GRAPH=1) updates the local commit-graph after every fetch batch,
+// so log --graph and friends are fast right after a large clone
+var writeCommitGraph bool
 
-	if err := ipfsCat.Close(); err != nil {
-		if errRm := os.Remove(targetObj.Name()); errRm != nil {
-			return nil, errgo.WithCausef(errRm, err, "os.Remove(targetObj) failed while closing ipfs cat")
+// trackRefs (GIT_IPFS_TRACK_REFS=1) records every fetched ref under refs/ipfs/<remote>/ in the local repo
+var trackRefs bool
+
+// trackRefName maps a remote ref like refs/heads/master to refs/ipfs/<remote>/heads/master
+func trackRefName(remote, ref string) string {
+	return "refs/ipfs/" + remote + "/" + strings.TrimPrefix(ref, "refs/")
+}
+
+// trackFetched writes the refs of a finished fetch batch, fetched maps the ref names to their sha1
+func trackFetched(fetched map[string]string) error {
+	if strings.Contains(thisGitRemote, ":") {
+		// git was given a url instead of a remote name, there is no namespace to put them in
+		log.WithField("remote", thisGitRemote).Debug("not tracking refs of an anonymous remote")
+		return nil
+	}
+	for ref, sha1 := range fetched {
+		name := trackRefName(thisGitRemote, ref)
+		if err := gitUpdateRef(name, sha1); err != nil {
+			return errgo.Notef(err, "tracking %s as %s failed", ref, name)
 		}
-		return nil, errgo.Notef(err, "closing ipfs cat failed")
+		log.WithField("ref", name).WithField("sha1", sha1).Debug("tracked fetched ref")
 	}
+	return nil
+}
 
-	if err := targetObj.Close(); err != nil {
-		return nil, errgo.Notef(err, "target file close() failed")
+// salvagePacked looks for missingObjects[from:] in the packs of the remote and keeps only the ones not found
+func salvagePacked(ctx context.Context, from int) {
+	missing := append([]string(nil), missingObjects[from:]...)
+	missingObjects = missingObjects[:from]
+	for _, sha1 := range missing {
+		if _, err := os.Stat(filepath.Join(commonDir(), objectPath(sha1))); err == nil {
+			// came with the pack of an earlier one
+			continue
+		}
+		if err := fetchPackedObject(ctx, sha1); err != nil {
+			log.WithField("sha1", sha1).WithField("err", err).Debug("not in a pack either")
+			missingObjects = append(missingObjects, sha1)
+		}
 	}
+}
 
-	return obj, nil
+// reportMissing prints the objects skipped by GIT_IPFS_CONTINUE_ON_MISSING to w and returns how many there were
+func reportMissing(w io.Writer) int {
+	if len(missingObjects) == 0 {
+		return 0
+	}
+	fmt.Fprintf(w, "warning: %d objects could not be fetched, the local repo is incomplete:\n", len(missingObjects))
+	for _, sha1 := range missingObjects {
+		fmt.Fprintf(w, "  %s\n", sha1)
+	}
+	return len(missingObjects)
+}
+
+// "fetch $sha1 $ref" method 1 - unpacking loose objects
+//   - look for it in ".git/objects/substr($sha1, 0, 2)/substr($sha, 2)"
+//   - if found, download it and put it in place. (there may be a command for this)
+//   - done \o/
+//
+// with the git-raw store the daemon exports the closure of sha1 in one go first,
+// the walk then only reads what the export didn't return. not with fetchSince, the export doesn't stop there.
+func fetchObject(ctx context.Context, sha1 string) error {
+	if _, ok := objStore.(gitRawStore); ok && fetchSince == "" {
+		n, err := exportClosure(ctx, sha1)
+		if err != nil {
+			log.WithField("sha1", sha1).WithField("err", err).Debug("dag export failed, fetching object by object")
+		} else {
+			log.WithField("sha1", sha1).WithField("objects", n).Debug("exported closure")
+		}
+	}
+	var shown bool
+	err := fetch.Fetch(ctx, remoteStore{objStore}, commonDir(), sha1, func(done, total int) {
+		shown = true
+		progressf("\rfetching objects: %d/%d", done, total)
+	})
+	if shown {
+		progressf("\n")
+	}
+	return err
+}
+
+// remoteStore hands the objects of the remote to the fetch package, after PostFetch
+type remoteStore struct {
+	store objectStore
+}
+
+// HandleObject fetches the large objects of lfs pointers
+func (s remoteStore) HandleObject(sha1 string, obj *git.Object) error {
+	if blob, ok := obj.Blob(); ok {
+		return fetchLFSObject(blob)
+	}
+	return nil
+}
+
+// IsShallow cuts the history at fetchSince
+func (s remoteStore) IsShallow(sha1 string) bool {
+	if fetchSince == "" || sha1 != fetchSince {
+		return false
+	}
+	atomic.StoreInt32(&sinceReached, 1)
+	return true
+}
+
+// SymlinksAsFiles is symlinksAsFiles, for snapshot
+func (s remoteStore) SymlinksAsFiles() bool { return symlinksAsFiles }
+
+// HandleMissing records sha1 and lets the walk go on with GIT_IPFS_CONTINUE_ON_MISSING
+func (s remoteStore) HandleMissing(sha1 string, err error) error {
+	if !continueOnMissing {
+		return err
+	}
+	log.WithField("sha1", sha1).WithField("err", err).Warning("skipping missing object")
+	missingObjects = append(missingObjects, sha1)
+	return nil
+}
+
+// WriteObject collects sha1 into localPack with GIT_IPFS_LOCAL_WRITE=pack
+func (s remoteStore) WriteObject(sha1 string, z []byte) error {
+	if localPack != nil {
+		return localPack.add(sha1, z)
+	}
+	return fetch.WriteObject(commonDir(), sha1, z)
+}
+
+func (s remoteStore) GetObject(sha1 string) (io.ReadCloser, error) {
+	if prefetchTips {
+		if data, ok := prefetched.take(sha1); ok {
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		}
+	}
+	data, err := s.read(sha1)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// read gets sha1 from the store, or the alternates of the remote, PostFetch applied
+func (s remoteStore) read(sha1 string) ([]byte, error) {
+	r, err := s.store.getObject(sha1)
+	if err != nil {
+		var errAlt error
+		if r, errAlt = getAlternateObject(sha1); errAlt != nil {
+			log.WithField("sha1", sha1).WithField("err", errAlt).Debug("not in the alternates either")
+			return nil, err
+		}
+	}
+	data, err := ioutil.ReadAll(r)
+	if errClose := r.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return nil, errgo.Notef(err, "reading object %s from ipfs failed", sha1)
+	}
+	if data, err = applyTransform(PostFetch, data); err != nil {
+		return nil, errgo.Notef(err, "PostFetch(%s) failed", sha1)
+	}
+	return data, nil
 }
 
 // "fetch $sha1 $ref" method 2 - unpacking packed objects
 //   - look for it in packfiles by fetching ".git/objects/pack/*.idx"
 //     and looking at each idx with cat <idx> | git show-index  (alternatively can learn to read the format in go)
 //   - if found in an <idx>, download the relevant .pack file,
-//     and feed it into `git index-pack --stdin --fix-thin` which will put it into place.
+//     resolve its (ofs and ref) deltas and write every object into the local repo.
 //   - done \o/
-func fetchPackedObject(sha1 string) error {
+func fetchPackedObject(ctx context.Context, sha1 string) error {
 	// search for all index files
-	packPath := filepath.Join(ipfsRepoPath, "objects", "pack")
+	packPath := inRepo("objects", "pack")
 	links, err := ipfsShell.List(packPath)
 	if err != nil {
 		return errgo.Notef(err, "shell FileList(%q) failed", packPath)
 	}
 	var indexes []string
 	for _, lnk := range links {
-		if lnk.Type == 2 && strings.HasSuffix(lnk.Name, ".idx") {
-			indexes = append(indexes, filepath.Join(packPath, lnk.Name))
+		if isFile(lnk) && strings.HasSuffix(lnk.Name, ".idx") {
+			indexes = append(indexes, path.Join(packPath, lnk.Name))
 		}
 	}
 	if len(indexes) == 0 {
 		return errgo.New("fetchPackedObject: no idx files found")
 	}
 	for _, idx := range indexes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		idxF, err := ipfsShell.Cat(idx)
 		if err != nil {
 			return errgo.Notef(err, "fetchPackedObject: idx<%s> cat(%s) failed", sha1, idx)
@@ -123,7 +506,7 @@ func fetchPackedObject(sha1 string) error {
 		// using external git show-index < idxF for now
 		// TODO: parse index file in go to make this portable
 		var b bytes.Buffer
-		showIdx := exec.Command("git", "show-index")
+		showIdx := gitShowIndex()
 		showIdx.Stdin = idxF
 		showIdx.Stdout = &b
 		showIdx.Stderr = &b
@@ -132,7 +515,7 @@ func fetchPackedObject(sha1 string) error {
 		}
 		cmdOut := b.String()
 		if !strings.Contains(cmdOut, sha1) {
-			log.WithField("idx", filepath.Base(idx)).Debug("git show-index: sha1 not in index, next idx file")
+			log.WithField("idx", path.Base(idx)).Debug("git show-index: sha1 not in index, next idx file")
 			continue
 		}
 		//log.Debug("git show-index:", cmdOut)
@@ -143,17 +526,40 @@ func fetchPackedObject(sha1 string) error {
 		if err != nil {
 			return errgo.Notef(err, "fetchPackedObject: pack<%s> open() failed", sha1)
 		}
-		b.Reset()
-		unpackIdx := exec.Command("git", "unpack-objects")
-		unpackIdx.Dir = thisGitRepo // GIT_DIR
-		unpackIdx.Stdin = packF
-		unpackIdx.Stdout = &b
-		unpackIdx.Stderr = &b
-		if err := unpackIdx.Run(); err != nil {
-			return errgo.Notef(err, "fetchPackedObject: pack<%s> 'git unpack-objects' failed\nOutput: %s", sha1, b.String())
+		err = unpackFetchedPack(packF)
+		packF.Close()
+		if err != nil {
+			return errgo.Notef(err, "fetchPackedObject: pack<%s> unpacking failed", sha1)
 		}
-		log.Debug("git unpack-objects ...:", b.String())
+		log.Debug("unpacked:", pack)
 		return nil
 	}
 	return errgo.Newf("did not find sha1<%s> in %d index files", sha1, len(indexes))
 }
+
+// pack modes selectable with GIT_IPFS_PACK_MODE
+const (
+	// packModeNative resolves the deltas ourselfs and writes everything as loose objects
+	packModeNative = "native"
+	// packModeUnpack hands the pack to git unpack-objects
+	packModeUnpack = "unpack"
+)
+
+var packMode = packModeNative
+
+// unpackFetchedPack puts all objects of the pack r into the local repo
+func unpackFetchedPack(r io.Reader) error {
+	if localPack != nil {
+		// it's a pack already
+		return gitIndexPack(r)
+	}
+	if packMode == packModeUnpack {
+		return gitUnpackObjects(r)
+	}
+	n, err := unpackPack(r, commonDir())
+	if err != nil {
+		return err
+	}
+	log.WithField("objects", n).Debug("unpacked pack")
+	return nil
+}
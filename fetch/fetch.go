@@ -0,0 +1,395 @@
+/*
+Package fetch copies git objects out of a repo kept in ipfs into a local git directory.
+
+It is the object walk behind git-remote-ipfs' fetch command, usable without speaking the remote helper protocol:
+
+	err := fetch.Fetch(ctx, store, ".git", sha1, func(done, total int) {
+		fmt.Printf("\r%d/%d objects", done, total)
+	})
+
+Objects are written as loose objects, after their sha1 (or sha256, for repos using that object format) has been checked.
+FetchObjects writes just the objects it's given, without the walk.
+Verify checks the same objects without writing them, FetchPath reads a single file of a commit without fetching anything else.
+errors.Is tells a missing object (ErrObjectMissing) from a corrupt one (ErrObjectCorrupt).
+*/
+package fetch
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cryptix/exp/git"
+	"github.com/cryptix/git-remote-ipfs/internal/errkind"
+	"github.com/cryptix/git-remote-ipfs/internal/zstd"
+	"gopkg.in/errgo.v1"
+)
+
+// the kinds of errors Fetch returns, errors.Is finds them
+var (
+	// ErrObjectMissing is an object the store couldn't return
+	ErrObjectMissing = errgo.New("object missing")
+	// ErrObjectCorrupt is an object that doesn't match its name or can't be decoded
+	ErrObjectCorrupt = errgo.New("object corrupt")
+)
+
+// Store is where the objects come from
+type Store interface {
+	// GetObject returns the zlib compressed loose object sha1
+	GetObject(sha1 string) (io.ReadCloser, error)
+}
+
+// ObjectHandler can be implemented by a Store to look at every object after it was written
+type ObjectHandler interface {
+	HandleObject(sha1 string, obj *git.Object) error
+}
+
+// ObjectWriter can be implemented by a Store to put the checked objects somewhere else than loose into gitDir,
+// like into a pack
+type ObjectWriter interface {
+	WriteObject(sha1 string, z []byte) error
+}
+
+// Shallower can be implemented by a Store to cut the history short, like a shallow clone:
+// a commit IsShallow says yes to is fetched with its tree, but Fetch doesn't go on to its parents.
+type Shallower interface {
+	IsShallow(sha1 string) bool
+}
+
+// MissingHandler can be implemented by a Store to decide about objects it can't return, or only corrupt.
+// a nil error skips the object (and whatever only it leads to), anything else stops the walk.
+type MissingHandler interface {
+	HandleMissing(sha1 string, err error) error
+}
+
+// Fetch writes sha1 and every object reachable from it to gitDir.
+// objects the repos in gitDir's alternates have (like after clone --reference) are skipped, with everything they reach.
+// progress (may be nil) is called after every object.
+// total counts every object found so far and grows during the walk, done == total only once it's complete.
+// Fetch stops with ctx.Err() when ctx is done.
+func Fetch(ctx context.Context, store Store, gitDir, sha1 string, progress func(done, total int)) error {
+	alt := newAlternates(gitDir)
+	return walk(ctx, sha1, nil, progress, func(sha1 string) (*object, error) {
+		if alt.has(sha1) {
+			return nil, nil
+		}
+		obj, err := fetchObject(store, gitDir, sha1)
+		if s, ok := store.(Shallower); ok && obj != nil && obj.Type == git.CommitT {
+			obj.shallow = s.IsShallow(sha1)
+		}
+		return obj, err
+	})
+}
+
+// FetchObjects writes exactly the objects shas to gitDir, without following their links or looking at refs.
+// they are checked, and handed to the Store's ObjectWriter, ObjectHandler and MissingHandler, like the ones of Fetch.
+// FetchObjects stops with ctx.Err() when ctx is done.
+func FetchObjects(ctx context.Context, store Store, gitDir string, shas []string) error {
+	seen := make(map[string]bool, len(shas))
+	for _, sha1 := range shas {
+		if seen[sha1] {
+			continue
+		}
+		seen[sha1] = true
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := fetchObject(store, gitDir, sha1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchObject gets sha1 from the store, checks and writes it.
+// the object is nil if the store's MissingHandler skipped it.
+func fetchObject(store Store, gitDir, sha1 string) (*object, error) {
+	data, obj, err := readObject(store, sha1)
+	if err != nil {
+		h, ok := store.(MissingHandler)
+		if !ok {
+			return nil, err
+		}
+		return nil, h.HandleMissing(sha1, err)
+	}
+	if w, ok := store.(ObjectWriter); ok {
+		err = w.WriteObject(sha1, data)
+	} else {
+		err = WriteObject(gitDir, sha1, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if h, ok := store.(ObjectHandler); ok {
+		if err := h.HandleObject(sha1, obj.Object); err != nil {
+			return nil, errgo.Notef(err, "handling object %s failed", sha1)
+		}
+	}
+	return obj, nil
+}
+
+// Problem is an object Verify found missing or corrupt
+type Problem struct {
+	SHA1 string
+	Err  error // of the kind ErrObjectMissing or ErrObjectCorrupt
+}
+
+// Verify checks sha1 and every object reachable from it like Fetch does, but writes nothing.
+// seen (may be nil) holds the objects checked so far and is added to, so several refs of one repo are checked only once.
+// the error is only set if ctx is done.
+func Verify(ctx context.Context, store Store, sha1 string, seen map[string]bool) ([]Problem, error) {
+	var problems []Problem
+	err := walk(ctx, sha1, seen, nil, func(sha1 string) (*object, error) {
+		_, obj, err := readObject(store, sha1)
+		if err != nil {
+			problems = append(problems, Problem{SHA1: sha1, Err: err})
+			return nil, nil
+		}
+		return obj, nil
+	})
+	return problems, err
+}
+
+// walk calls visit for start and every object reachable from it that isn't in seen yet, breadth first.
+// visit returns the object to follow the links of, or nil to not go further down.
+func walk(ctx context.Context, start string, seen map[string]bool, progress func(done, total int), visit func(sha1 string) (*object, error)) error {
+	if seen == nil {
+		seen = make(map[string]bool)
+	}
+	if seen[start] {
+		return nil
+	}
+	queue := []string{start}
+	seen[start] = true
+	for done := 0; done < len(queue); done++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		obj, err := visit(queue[done])
+		if err != nil {
+			return err
+		}
+		if obj != nil {
+			for _, next := range links(obj) {
+				if !seen[next] {
+					seen[next] = true
+					queue = append(queue, next)
+				}
+			}
+		}
+		if progress != nil {
+			progress(done+1, len(queue))
+		}
+	}
+	return nil
+}
+
+// gitlinkMode is the tree entry mode of submodules
+const gitlinkMode = "160000"
+
+// links returns the objects obj points to
+func links(obj *object) []string {
+	var l []string
+	switch obj.Type {
+	case git.CommitT:
+		commit, _ := obj.Commit()
+		l = append(l, commit.Tree)
+		if commit.Parent != "" && !obj.shallow {
+			l = append(l, commit.Parent)
+		}
+	case git.TreeT:
+		for _, e := range obj.entries {
+			if e.Mode == gitlinkMode {
+				// a submodule commit, it lives in another repo
+				continue
+			}
+			l = append(l, e.Hash)
+		}
+	case git.TagT:
+		tag, _ := obj.Tag()
+		l = append(l, tag.Object)
+	}
+	return l
+}
+
+// object is a checked object of the store.
+// trees are decoded here instead of by git.DecodeObject, which only knows the 20 byte entries of sha1 repos.
+type object struct {
+	*git.Object
+	entries []treeEntry // of a tree
+	shallow bool        // a commit whose parents aren't followed
+}
+
+// treeEntry is one name of a tree
+type treeEntry struct {
+	Mode string
+	Name string
+	Hash string
+}
+
+// readObject gets sha1 from the store and checks it
+func readObject(store Store, sha1 string) ([]byte, *object, error) {
+	data, raw, err := readRaw(store, sha1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if zstd.IsFrame(data) {
+		// git only reads zlib loose objects
+		if data, err = deflate(raw); err != nil {
+			return nil, nil, errgo.Notef(err, "recompressing object %s failed", sha1)
+		}
+	}
+	obj, err := decodeObject(sha1, data, raw)
+	if err != nil {
+		return nil, nil, errkind.Wrapf(err, ErrObjectCorrupt, "decoding object %s failed", sha1)
+	}
+	return data, obj, nil
+}
+
+// readRaw gets sha1 from the store and returns it as stored and inflated, after checking it
+func readRaw(store Store, sha1 string) ([]byte, []byte, error) {
+	r, err := store.GetObject(sha1)
+	if err != nil {
+		return nil, nil, errkind.Wrapf(err, ErrObjectMissing, "getObject(%s) failed", sha1)
+	}
+	data, err := ioutil.ReadAll(r)
+	if errClose := r.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return nil, nil, errkind.Wrapf(err, ErrObjectMissing, "reading object %s failed", sha1)
+	}
+	raw, err := inflateChecked(sha1, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, raw, nil
+}
+
+// decodeObject decodes the loose object z, raw is its inflated form
+func decodeObject(name string, z, raw []byte) (*object, error) {
+	nul := bytes.IndexByte(raw, 0)
+	if nul < 0 {
+		return nil, errgo.New("missing header")
+	}
+	if !bytes.HasPrefix(raw, []byte("tree ")) {
+		obj, err := git.DecodeObject(bytes.NewReader(z))
+		if err != nil {
+			return nil, err
+		}
+		return &object{Object: obj}, nil
+	}
+	size := len(name) / 2
+	body := raw[nul+1:]
+	obj := &object{Object: &git.Object{Type: git.TreeT, Size: int64(len(body))}}
+	for len(body) > 0 {
+		sp := bytes.IndexByte(body, ' ')
+		end := bytes.IndexByte(body, 0)
+		if sp < 0 || end < sp || len(body) < end+1+size {
+			return nil, errgo.New("bad tree entry")
+		}
+		obj.entries = append(obj.entries, treeEntry{
+			Mode: string(body[:sp]),
+			Name: string(body[sp+1 : end]),
+			Hash: hex.EncodeToString(body[end+1 : end+1+size]),
+		})
+		body = body[end+1+size:]
+	}
+	return obj, nil
+}
+
+// VerifyObject checks that the zlib compressed loose object z really is sha1, the error is an ErrObjectCorrupt.
+// 64 character names are checked as sha256 ones, of repos with objectFormat = sha256.
+func VerifyObject(sha1Want string, z []byte) error {
+	_, err := inflateChecked(sha1Want, z)
+	return err
+}
+
+// inflateChecked returns the inflated object z after checking it hashes to name
+func inflateChecked(name string, z []byte) ([]byte, error) {
+	var h hash.Hash
+	switch len(name) {
+	case 2 * sha1.Size:
+		h = sha1.New()
+	case 2 * sha256.Size:
+		h = sha256.New()
+	default:
+		return nil, errkind.Wrapf(nil, ErrObjectCorrupt, "%q is neither a sha1 nor a sha256 object name", name)
+	}
+	raw, err := inflate(z)
+	if err != nil {
+		return nil, errkind.Wrapf(err, ErrObjectCorrupt, "object %s: inflating failed", name)
+	}
+	h.Write(raw)
+	if got := hex.EncodeToString(h.Sum(nil)); got != name {
+		return nil, errkind.Wrapf(nil, ErrObjectCorrupt, "object %s: content hashes to %s", name, got)
+	}
+	return raw, nil
+}
+
+// inflate decompresses the loose object z, a zlib stream or, from stores written by other tools, a zstd frame
+func inflate(z []byte) ([]byte, error) {
+	if zstd.IsFrame(z) {
+		raw, _, err := zstd.Decode(z)
+		return raw, err
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(z))
+	if err != nil {
+		return nil, errgo.Notef(err, "zlib reader failed")
+	}
+	return ioutil.ReadAll(zr)
+}
+
+// deflate compresses raw the way git writes loose objects
+func deflate(raw []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	if _, err := zw.Write(raw); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteObject puts the zlib compressed loose object z into gitDir, unless it's already there
+func WriteObject(gitDir, sha1 string, z []byte) error {
+	dir := filepath.Join(gitDir, "objects", sha1[:2])
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errgo.Notef(err, "mkDirAll() failed")
+	}
+	target := filepath.Join(dir, sha1[2:])
+	if _, err := os.Stat(target); err == nil {
+		// already there, objects are immutable
+		return nil
+	}
+	// through a temp file, so a concurrent Fetch of the same object never sees half of it
+	tmp, err := ioutil.TempFile(dir, "tmp_obj_")
+	if err != nil {
+		return errgo.Notef(err, "creating temp object failed")
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(z)
+	if errClose := tmp.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0444)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), target)
+	}
+	if err != nil {
+		return errgo.Notef(err, "writing %s failed", target)
+	}
+	return nil
+}
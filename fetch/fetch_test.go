@@ -0,0 +1,527 @@
+package fetch
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cryptix/exp/git"
+)
+
+// memStore serves loose objects from memory
+type memStore map[string][]byte
+
+func (m memStore) GetObject(sha1 string) (io.ReadCloser, error) {
+	z, ok := m[sha1]
+	if !ok {
+		return nil, fmt.Errorf("no such object %s", sha1)
+	}
+	return ioutil.NopCloser(bytes.NewReader(z)), nil
+}
+
+// add puts data as a loose object into m and returns its name
+func (m memStore) add(kind, data string) string {
+	raw := fmt.Sprintf("%s %d\x00%s", kind, len(data), data)
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write([]byte(raw))
+	zw.Close()
+	sha1 := fmt.Sprintf("%x", sha1.Sum([]byte(raw)))
+	m[sha1] = buf.Bytes()
+	return sha1
+}
+
+func entry(mode, name, sha1 string) string {
+	b, _ := hex.DecodeString(sha1)
+	return mode + " " + name + "\x00" + string(b)
+}
+
+// first adds a commit with one file and returns it and all its objects
+func (m memStore) first() (string, []string) {
+	readme := m.add("blob", "hello\n")
+	tree1 := m.add("tree", entry("100644", "README", readme))
+	c1 := m.add("commit", "tree "+tree1+"\nauthor a <a@b> 0 +0000\ncommitter a <a@b> 0 +0000\n\nfirst\n")
+	return c1, []string{c1, tree1, readme}
+}
+
+// history adds two commits, the second with a subdirectory, and returns the head
+func (m memStore) history() string {
+	c1, objs := m.first()
+	readme := objs[2]
+	sub := m.add("tree", entry("100644", "main.go", m.add("blob", "package main\n")))
+	tree2 := m.add("tree", entry("100644", "README", readme)+entry("40000", "cmd", sub))
+	return m.add("commit", "tree "+tree2+"\nparent "+c1+"\nauthor a <a@b> 0 +0000\ncommitter a <a@b> 0 +0000\n\nsecond\n")
+}
+
+func tmpGitDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "fetch-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestFetch(t *testing.T) {
+	store := make(memStore)
+	head := store.history()
+	dir := tmpGitDir(t)
+	defer os.RemoveAll(dir)
+
+	var calls, lastDone, lastTotal int
+	err := Fetch(context.Background(), store, dir, head, func(done, total int) {
+		calls++
+		if done > total || done != calls {
+			t.Errorf("bad progress %d/%d on call %d", done, total, calls)
+		}
+		lastDone, lastTotal = done, total
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastDone != len(store) || lastTotal != len(store) {
+		t.Errorf("progress ended at %d/%d, want %d/%d", lastDone, lastTotal, len(store), len(store))
+	}
+	for sha1, z := range store {
+		got, err := ioutil.ReadFile(filepath.Join(dir, "objects", sha1[:2], sha1[2:]))
+		if err != nil || !bytes.Equal(got, z) {
+			t.Errorf("object %s not written: %v", sha1, err)
+		}
+	}
+}
+
+func TestFetchObjects(t *testing.T) {
+	store := make(memStore)
+	head := store.history()
+	_, objs := store.first()
+	// a tree and a blob, with a duplicate, but neither their commit nor anything else of the history
+	want := []string{objs[1], objs[2], objs[2]}
+	dir := tmpGitDir(t)
+	defer os.RemoveAll(dir)
+	if err := FetchObjects(context.Background(), store, dir, want); err != nil {
+		t.Fatal(err)
+	}
+	var written []string
+	filepath.Walk(filepath.Join(dir, "objects"), func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			written = append(written, filepath.Base(filepath.Dir(p))+info.Name())
+		}
+		return nil
+	})
+	if len(written) != 2 {
+		t.Fatalf("want exactly the 2 objects written, got %v", written)
+	}
+	for _, sha1 := range want {
+		got, err := ioutil.ReadFile(filepath.Join(dir, "objects", sha1[:2], sha1[2:]))
+		if err != nil || !bytes.Equal(got, store[sha1]) {
+			t.Errorf("object %s not written: %v", sha1, err)
+		}
+	}
+
+	if err := FetchObjects(context.Background(), store, dir, []string{head, strings.Repeat("ab", 20)}); err == nil {
+		t.Error("expected an error for an object the store doesn't have")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := FetchObjects(ctx, store, dir, []string{head}); err != context.Canceled {
+		t.Errorf("want context.Canceled, got %v", err)
+	}
+}
+
+func TestFetch_gitlink(t *testing.T) {
+	store := make(memStore)
+	blob := store.add("blob", "[submodule \"lib\"]\n")
+	b, _ := hex.DecodeString(blob)
+	// the submodule commit is not in the store
+	sub, _ := hex.DecodeString("5f4a3e6b1c2d7e8f9a0b1c2d3e4f5a6b7c8d9e0f")
+	tree := store.add("tree", "100644 .gitmodules\x00"+string(b)+"160000 lib\x00"+string(sub))
+	head := store.add("commit", "tree "+tree+"\nauthor a <a@b> 0 +0000\ncommitter a <a@b> 0 +0000\n\nwith submodule\n")
+	dir := tmpGitDir(t)
+	defer os.RemoveAll(dir)
+	if err := Fetch(context.Background(), store, dir, head, nil); err != nil {
+		t.Fatalf("fetching a tree with a gitlink failed: %s", err)
+	}
+}
+
+// shallowStore cuts the history at since
+type shallowStore struct {
+	memStore
+	since string
+}
+
+func (s shallowStore) IsShallow(sha1 string) bool { return sha1 == s.since }
+
+func TestFetch_shallow(t *testing.T) {
+	store := make(memStore)
+	head := store.history()
+	c1, objs := store.first()
+	dir := tmpGitDir(t)
+	defer os.RemoveAll(dir)
+	if err := Fetch(context.Background(), shallowStore{store, head}, dir, head, nil); err != nil {
+		t.Fatal(err)
+	}
+	// everything of the cut commit, but not its parent and what only that has
+	for sha1 := range store {
+		_, err := os.Stat(filepath.Join(dir, "objects", sha1[:2], sha1[2:]))
+		if onlyFirst := sha1 == c1 || sha1 == objs[1]; onlyFirst != (err != nil) {
+			t.Errorf("object %s: fetched %v", sha1, err == nil)
+		}
+	}
+}
+
+// handlerStore records the objects it was handed
+type handlerStore struct {
+	memStore
+	handled map[string]bool
+}
+
+func (h handlerStore) HandleObject(sha1 string, obj *git.Object) error {
+	h.handled[sha1] = true
+	return nil
+}
+
+func TestFetch_objectHandler(t *testing.T) {
+	store := handlerStore{make(memStore), make(map[string]bool)}
+	head := store.history()
+	dir := tmpGitDir(t)
+	defer os.RemoveAll(dir)
+	if err := Fetch(context.Background(), store, dir, head, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.handled) != len(store.memStore) {
+		t.Errorf("handled %d of %d objects", len(store.handled), len(store.memStore))
+	}
+}
+
+func TestFetch_missingObject(t *testing.T) {
+	store := make(memStore)
+	head := store.history()
+	for sha1 := range store {
+		if sha1 != head {
+			delete(store, sha1)
+			break
+		}
+	}
+	dir := tmpGitDir(t)
+	defer os.RemoveAll(dir)
+	if err := Fetch(context.Background(), store, dir, head, nil); err == nil {
+		t.Error("expected an error for the missing object")
+	}
+}
+
+// skipStore skips the objects it doesn't have
+type skipStore struct {
+	memStore
+	missing []string
+}
+
+func (s *skipStore) HandleMissing(sha1 string, err error) error {
+	s.missing = append(s.missing, sha1)
+	return nil
+}
+
+func TestFetch_missingHandler(t *testing.T) {
+	store := &skipStore{memStore: make(memStore)}
+	head := store.history()
+	c1, objs := store.first()
+	// the first commit's tree is gone, the rest has to come through
+	delete(store.memStore, objs[1])
+	dir := tmpGitDir(t)
+	defer os.RemoveAll(dir)
+	if err := Fetch(context.Background(), store, dir, head, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.missing) != 1 || store.missing[0] != objs[1] {
+		t.Errorf("want only %s reported missing, got %v", objs[1], store.missing)
+	}
+	for sha1 := range store.memStore {
+		if _, err := os.Stat(filepath.Join(dir, "objects", sha1[:2], sha1[2:])); err != nil {
+			t.Errorf("object %s was not fetched: %s", sha1, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "objects", c1[:2], c1[2:])); err != nil {
+		t.Errorf("parent commit was not fetched: %s", err)
+	}
+}
+
+func TestFetch_canceled(t *testing.T) {
+	store := make(memStore)
+	head := store.history()
+	dir := tmpGitDir(t)
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	err := Fetch(ctx, store, dir, head, func(done, total int) {
+		if done == 2 {
+			cancel()
+		}
+	})
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "objects", "*", "*"))
+	if len(files) != 2 {
+		t.Errorf("fetch went on after cancel, %d objects written", len(files))
+	}
+}
+
+func TestVerifyLooseObject(t *testing.T) {
+	store := make(memStore)
+	sha1 := store.add("blob", "hello\n")
+	if err := VerifyObject(sha1, store[sha1]); err != nil {
+		t.Fatal(err)
+	}
+	other := store.add("blob", "goodbye\n")
+	if err := VerifyObject(sha1, store[other]); err == nil {
+		t.Error("expected sha1 mismatch")
+	}
+}
+
+// countingStore records which objects were requested
+type countingStore struct {
+	memStore
+	got map[string]int
+}
+
+func (c countingStore) GetObject(sha1 string) (io.ReadCloser, error) {
+	c.got[sha1]++
+	return c.memStore.GetObject(sha1)
+}
+
+func TestFetch_alternates(t *testing.T) {
+	for _, packed := range []bool{false, true} {
+		store := countingStore{make(memStore), make(map[string]int)}
+		head := store.history()
+		c1, borrowed := memStore{}.first()
+
+		// the reference repo has the first commit
+		ref := tmpGitDir(t)
+		if out, err := exec.Command("git", "init", "-q", "--bare", ref).CombinedOutput(); err != nil {
+			t.Fatalf("git init failed: %s\n%s", err, out)
+		}
+		for _, sha1 := range borrowed {
+			if err := WriteObject(ref, sha1, store.memStore[sha1]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if packed {
+			for _, args := range [][]string{{"update-ref", "refs/heads/master", c1}, {"repack", "-a", "-d", "-q"}, {"prune-packed"}} {
+				cmd := exec.Command("git", args...)
+				cmd.Env = append(os.Environ(), "GIT_DIR="+ref)
+				if out, err := cmd.CombinedOutput(); err != nil {
+					t.Fatalf("git %v failed: %s\n%s", args, err, out)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(ref, "objects", c1[:2], c1[2:])); !os.IsNotExist(err) {
+				t.Fatalf("reference repo still has loose objects: %v", err)
+			}
+		}
+
+		dir := tmpGitDir(t)
+		if err := os.MkdirAll(filepath.Join(dir, "objects", "info"), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "objects", "info", "alternates"), []byte(filepath.Join(ref, "objects")+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := Fetch(context.Background(), store, dir, head, nil); err != nil {
+			t.Fatal(err)
+		}
+		for _, sha1 := range borrowed {
+			if store.got[sha1] != 0 {
+				t.Errorf("packed %v: object %s of the reference repo was fetched", packed, sha1)
+			}
+		}
+		if store.got[head] != 1 {
+			t.Errorf("packed %v: head was fetched %d times", packed, store.got[head])
+		}
+		os.RemoveAll(ref)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFetchPath(t *testing.T) {
+	store := countingStore{make(memStore), make(map[string]int)}
+	head := store.history()
+	ctx := context.Background()
+
+	data, err := FetchPath(ctx, store, head, "cmd/main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "package main\n" {
+		t.Errorf("unexpected content %q", data)
+	}
+	// commit, root tree, cmd tree and the blob, not the rest of the history
+	if len(store.got) != 4 {
+		t.Errorf("want 4 objects read, got %d of %d", len(store.got), len(store.memStore))
+	}
+	tag := store.add("tag", "object "+head+"\ntype commit\ntag v1\ntagger a <a@b> 0 +0000\n\nv1\n")
+	if data, err := FetchPath(ctx, store, tag, "/README"); err != nil || string(data) != "hello\n" {
+		t.Errorf("README through a tag: %q %v", data, err)
+	}
+
+	for _, bad := range []string{"nope", "cmd", "README/x", "cmd/main.go/x"} {
+		if _, err := FetchPath(ctx, store, head, bad); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
+
+func TestReadTree(t *testing.T) {
+	store := countingStore{make(memStore), make(map[string]int)}
+	head := store.history()
+	ctx := context.Background()
+
+	entries, err := ReadTree(ctx, store, head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Name != "README" || entries[0].IsDir() || entries[1].Name != "cmd" || !entries[1].IsDir() {
+		t.Fatalf("unexpected root entries %v", entries)
+	}
+	sub, err := ReadTree(ctx, store, entries[1].Hash)
+	if err != nil || len(sub) != 1 || sub[0].Name != "main.go" {
+		t.Fatalf("cmd: %v %v", sub, err)
+	}
+	data, err := ReadBlob(ctx, store, sub[0].Hash)
+	if err != nil || string(data) != "package main\n" {
+		t.Errorf("main.go: %q %v", data, err)
+	}
+	// the two trees on the way and the blob, nothing of the first commit
+	if len(store.got) != 4 {
+		t.Errorf("want 4 objects read, got %d of %d", len(store.got), len(store.memStore))
+	}
+	if _, err := ReadBlob(ctx, store, entries[1].Hash); err == nil {
+		t.Error("expected an error reading a tree as a blob")
+	}
+	if _, err := ReadTree(ctx, store, entries[0].Hash); err == nil {
+		t.Error("expected an error reading a blob as a tree")
+	}
+}
+
+func TestReadCommit(t *testing.T) {
+	store := make(memStore)
+	c1, objs := store.first()
+	side := store.add("commit", "tree "+objs[1]+"\nauthor a <a@b> 0 +0000\ncommitter a <a@b> 5 +0000\n\nside\n")
+	merge := store.add("commit", "tree "+objs[1]+"\nparent "+c1+"\nparent "+side+"\nauthor a <a@b> 7 +0000\ncommitter c <c@d> 1700000000 +0100\n\nparent of nothing\n")
+	ctx := context.Background()
+
+	c, err := ReadCommit(ctx, store, merge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Tree != objs[1] || len(c.Parents) != 2 || c.Parents[0] != c1 || c.Parents[1] != side || c.Time != 1700000000 {
+		t.Errorf("unexpected header of the merge: %+v", c)
+	}
+	if c, err := ReadCommit(ctx, store, objs[1]); c != nil || err != nil {
+		t.Errorf("a tree isn't a commit, got %+v %v", c, err)
+	}
+}
+
+func TestCheckout(t *testing.T) {
+	store := make(memStore)
+	head := store.history()
+	tag := store.add("tag", "object "+head+"\ntype commit\ntag v1\ntagger a <a@b> 0 +0000\n\nv1\n")
+	dir := tmpGitDir(t)
+	defer os.RemoveAll(dir)
+
+	n, err := Checkout(context.Background(), store, tag, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("want 2 files written, got %d", n)
+	}
+	for name, want := range map[string]string{"README": "hello\n", "cmd/main.go": "package main\n"} {
+		if got, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || string(got) != want {
+			t.Errorf("%s: %q %v", name, got, err)
+		}
+	}
+
+	// modes other than plain files and directories
+	sub, _ := hex.DecodeString("5f4a3e6b1c2d7e8f9a0b1c2d3e4f5a6b7c8d9e0f")
+	tree := store.add("tree", entry("100755", "run.sh", store.add("blob", "#!/bin/sh\n"))+
+		entry("120000", "link", store.add("blob", "run.sh"))+
+		"160000 lib\x00"+string(sub))
+	dir2 := tmpGitDir(t)
+	defer os.RemoveAll(dir2)
+	if _, err := Checkout(context.Background(), store, tree, dir2); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(filepath.Join(dir2, "run.sh")); err != nil || fi.Mode().Perm()&0100 == 0 {
+		t.Errorf("run.sh not executable: %v %v", fi, err)
+	}
+	if target, err := os.Readlink(filepath.Join(dir2, "link")); err != nil || target != "run.sh" {
+		t.Errorf("link: %q %v", target, err)
+	}
+	if fi, err := os.Stat(filepath.Join(dir2, "lib")); err != nil || !fi.IsDir() {
+		t.Errorf("submodule lib not an empty directory: %v", err)
+	}
+
+	bad := store.add("tree", entry("100644", "..", store.add("blob", "x")))
+	dir3 := tmpGitDir(t)
+	defer os.RemoveAll(dir3)
+	if _, err := Checkout(context.Background(), store, bad, dir3); err == nil {
+		t.Error("expected an error for a .. entry")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	store := countingStore{make(memStore), make(map[string]int)}
+	head := store.history()
+	c1, objs := store.first()
+	seen := make(map[string]bool)
+	problems, err := Verify(context.Background(), store, head, seen)
+	if err != nil || len(problems) != 0 {
+		t.Fatalf("good history: %v %v", problems, err)
+	}
+	// the first commit was checked with the history already
+	before := len(store.got)
+	if problems, err := Verify(context.Background(), store, c1, seen); err != nil || len(problems) != 0 || len(store.got) != before {
+		t.Errorf("rechecked objects: %v %v, %d reads", problems, err, len(store.got)-before)
+	}
+
+	store.memStore[objs[2]] = store.memStore[objs[1]]
+	problems, err = Verify(context.Background(), store, head, nil)
+	if err != nil || len(problems) != 1 || problems[0].SHA1 != objs[2] || !errors.Is(problems[0].Err, ErrObjectCorrupt) {
+		t.Errorf("want %s reported corrupt, got %v %v", objs[2], problems, err)
+	}
+}
+
+func TestFetch_zstd(t *testing.T) {
+	store := make(memStore)
+	head, objs := store.first()
+	// the same objects as single raw block zstd frames
+	for _, sha1 := range objs {
+		zr, _ := zlib.NewReader(bytes.NewReader(store[sha1]))
+		raw, _ := ioutil.ReadAll(zr)
+		hdr := len(raw)<<3 | 1
+		frame := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 0x58, byte(hdr), byte(hdr >> 8), byte(hdr >> 16)}
+		store[sha1] = append(frame, raw...)
+	}
+	dir := tmpGitDir(t)
+	defer os.RemoveAll(dir)
+	if err := Fetch(context.Background(), store, dir, head, nil); err != nil {
+		t.Fatal(err)
+	}
+	// git only reads zlib loose objects
+	for _, sha1 := range objs {
+		z, err := ioutil.ReadFile(filepath.Join(dir, "objects", sha1[:2], sha1[2:]))
+		if err == nil {
+			err = VerifyObject(sha1, z)
+		}
+		if err != nil || bytes.HasPrefix(z, store[sha1][:4]) {
+			t.Errorf("object %s not written as zlib: %v", sha1, err)
+		}
+	}
+}
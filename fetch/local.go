@@ -0,0 +1,110 @@
+package fetch
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// maxAlternateDepth is how deep alternates of alternates are followed, like git does
+const maxAlternateDepth = 5
+
+// alternates knows the objects of the repos gitDir borrows from (objects/info/alternates, set up by clone --reference).
+// those are complete repos, so everything reachable from an object they have is there too.
+type alternates struct {
+	dirs   []string        // object directories
+	packed map[string]bool // objects in their packs, nil until loaded
+}
+
+func newAlternates(gitDir string) *alternates {
+	a := &alternates{}
+	a.add(filepath.Join(gitDir, "objects"), 0)
+	return a
+}
+
+// add collects the alternates listed in objDir, not objDir itself
+func (a *alternates) add(objDir string, depth int) {
+	if depth >= maxAlternateDepth {
+		return
+	}
+	f, err := os.Open(filepath.Join(objDir, "info", "alternates"))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(objDir, line)
+		}
+		a.dirs = append(a.dirs, line)
+		a.add(line, depth+1)
+	}
+}
+
+// has reports whether one of the alternates has sha1, loose or packed
+func (a *alternates) has(sha1 string) bool {
+	if len(a.dirs) == 0 {
+		return false
+	}
+	for _, dir := range a.dirs {
+		if _, err := os.Stat(filepath.Join(dir, sha1[:2], sha1[2:])); err == nil {
+			return true
+		}
+	}
+	if a.packed == nil {
+		a.packed = make(map[string]bool)
+		for _, dir := range a.dirs {
+			idxs, _ := filepath.Glob(filepath.Join(dir, "pack", "*.idx"))
+			for _, idx := range idxs {
+				// an unreadable index only means fetching more than needed
+				readPackIndex(idx, a.packed)
+			}
+		}
+	}
+	return a.packed[sha1]
+}
+
+// readPackIndex adds the object names in the pack index file p to names
+func readPackIndex(p string, names map[string]bool) error {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return errgo.Notef(err, "reading pack index failed")
+	}
+	// version 2 starts with a magic number, version 1 right away with the fanout table
+	entry, start := 24, 0
+	if bytes.HasPrefix(data, []byte("\xfftOc")) {
+		if len(data) < 8 || binary.BigEndian.Uint32(data[4:8]) != 2 {
+			return errgo.Newf("%s: unsupported index version", p)
+		}
+		entry, start = 20, 8
+	}
+	fanout := start + 255*4
+	if len(data) < fanout+4 {
+		return errgo.Newf("%s: index too short", p)
+	}
+	n := int(binary.BigEndian.Uint32(data[fanout : fanout+4]))
+	names0 := fanout + 4
+	if len(data) < names0+n*entry {
+		return errgo.Newf("%s: index too short for %d objects", p, n)
+	}
+	for i := 0; i < n; i++ {
+		off := names0 + i*entry
+		if entry == 24 {
+			off += 4 // v1 entries are offset + name
+		}
+		names[hex.EncodeToString(data[off:off+20])] = true
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cryptix/exp/git"
+	"gopkg.in/errgo.v1"
+)
+
+// FetchPath returns the content of the file at p (like "dir/file") in commit,
+// reading only the objects on the way there from store instead of everything commit reaches.
+// commit may also be a tag or a tree. nothing is written to a local repo.
+func FetchPath(ctx context.Context, store Store, commit, p string) ([]byte, error) {
+	obj, err := rootTree(ctx, store, commit)
+	if err != nil {
+		return nil, err
+	}
+	walked := ""
+	for _, name := range strings.Split(strings.Trim(p, "/"), "/") {
+		if obj.Type != git.TreeT {
+			return nil, errgo.Newf("%s: %s is not a directory", p, walked)
+		}
+		var found *treeEntry
+		for i := range obj.entries {
+			if obj.entries[i].Name == name {
+				found = &obj.entries[i]
+				break
+			}
+		}
+		walked = strings.TrimPrefix(walked+"/"+name, "/")
+		if found == nil {
+			return nil, errgo.Newf("%s: no such file or directory", walked)
+		}
+		if found.Mode == gitlinkMode {
+			return nil, errgo.Newf("%s: is a submodule", walked)
+		}
+		if obj, err = getChecked(ctx, store, found.Hash); err != nil {
+			return nil, err
+		}
+	}
+	blob, ok := obj.Blob()
+	if !ok {
+		return nil, errgo.Newf("%s: is a directory", p)
+	}
+	return blob, nil
+}
+
+// Entry is one name of a tree as ReadTree returns it, Mode is git's octal mode like 100644 or 40000
+type Entry struct {
+	Mode string
+	Name string
+	Hash string
+}
+
+func (e Entry) IsDir() bool        { return e.Mode == dirMode }
+func (e Entry) IsSubmodule() bool  { return e.Mode == gitlinkMode }
+func (e Entry) IsSymlink() bool    { return e.Mode == symlinkMode }
+func (e Entry) IsExecutable() bool { return e.Mode == executableMode }
+
+// ReadTree returns the entries of the tree sha1, or of the tree the commit or tag sha1 leads to.
+// like FetchPath it reads just what it needs, so a tree can be walked one directory at a time.
+func ReadTree(ctx context.Context, store Store, sha1 string) ([]Entry, error) {
+	tree, err := rootTree(ctx, store, sha1)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, len(tree.entries))
+	for i, e := range tree.entries {
+		entries[i] = Entry(e)
+	}
+	return entries, nil
+}
+
+// ReadBlob returns the content of the blob sha1
+func ReadBlob(ctx context.Context, store Store, sha1 string) ([]byte, error) {
+	obj, err := getChecked(ctx, store, sha1)
+	if err != nil {
+		return nil, err
+	}
+	blob, ok := obj.Blob()
+	if !ok {
+		return nil, errgo.Newf("%s is not a blob", sha1)
+	}
+	return blob, nil
+}
+
+// Commit is the header of a commit as ReadCommit returns it
+type Commit struct {
+	Tree    string
+	Parents []string // all of them, of merges too
+	Time    int64    // the committer's, in unix seconds
+}
+
+// ReadCommit returns the header of the commit sha1, nil if sha1 is another kind of object
+func ReadCommit(ctx context.Context, store Store, sha1 string) (*Commit, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	_, raw, err := readRaw(store, sha1)
+	if err != nil {
+		return nil, err
+	}
+	nul := bytes.IndexByte(raw, 0)
+	if !bytes.HasPrefix(raw, []byte("commit ")) || nul < 0 {
+		return nil, nil
+	}
+	c := &Commit{}
+	for _, line := range strings.Split(string(raw[nul+1:]), "\n") {
+		if line == "" {
+			// the message follows
+			break
+		}
+		key, value := line, ""
+		if sp := strings.IndexByte(line, ' '); sp >= 0 {
+			key, value = line[:sp], line[sp+1:]
+		}
+		switch key {
+		case "tree":
+			c.Tree = value
+		case "parent":
+			c.Parents = append(c.Parents, value)
+		case "committer":
+			// name <email> time zone
+			if f := strings.Fields(value); len(f) >= 2 {
+				c.Time, _ = strconv.ParseInt(f[len(f)-2], 10, 64)
+			}
+		}
+	}
+	return c, nil
+}
+
+// rootTree peels the tag or commit down to its tree
+func rootTree(ctx context.Context, store Store, commit string) (*object, error) {
+	obj, err := getChecked(ctx, store, commit)
+	if err != nil {
+		return nil, err
+	}
+	for obj.Type == git.TagT || obj.Type == git.CommitT {
+		next := ""
+		if tag, ok := obj.Tag(); ok {
+			next = tag.Object
+		} else if c, ok := obj.Commit(); ok {
+			next = c.Tree
+		}
+		if obj, err = getChecked(ctx, store, next); err != nil {
+			return nil, err
+		}
+	}
+	if obj.Type != git.TreeT {
+		return nil, errgo.Newf("%s doesn't lead to a tree", commit)
+	}
+	return obj, nil
+}
+
+// tree entry modes besides gitlinkMode
+const (
+	dirMode        = "40000"
+	executableMode = "100755"
+	symlinkMode    = "120000"
+)
+
+// SymlinkFiler is implemented by stores that make Checkout write symlinks as plain files holding the link target,
+// like git does with core.symlinks=false, for file systems without symlinks
+type SymlinkFiler interface {
+	SymlinksAsFiles() bool
+}
+
+// Checkout writes the files of commit (or a tag or tree) to dir, like a work tree without the repo.
+// only the tree and its blobs are read from store, the history isn't.
+// submodules become empty directories, like git leaves them before they are initialized.
+// symlinks are written as they are, the target isn't followed or checked.
+// it returns the number of files written.
+func Checkout(ctx context.Context, store Store, commit, dir string) (int, error) {
+	tree, err := rootTree(ctx, store, commit)
+	if err != nil {
+		return 0, err
+	}
+	f, ok := store.(SymlinkFiler)
+	return checkoutTree(ctx, store, tree, dir, ok && f.SymlinksAsFiles())
+}
+
+func checkoutTree(ctx context.Context, store Store, tree *object, dir string, linksAsFiles bool) (int, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, errgo.Notef(err, "mkdirAll(%s) failed", dir)
+	}
+	n := 0
+	for _, e := range tree.entries {
+		target := filepath.Join(dir, e.Name)
+		if e.Name == "" || e.Name == "." || e.Name == ".." || strings.ContainsAny(e.Name, "/\\") {
+			return n, errgo.Newf("bad tree entry name %q", e.Name)
+		}
+		if e.Mode == gitlinkMode {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return n, errgo.Notef(err, "mkdirAll(%s) failed", target)
+			}
+			continue
+		}
+		obj, err := getChecked(ctx, store, e.Hash)
+		if err != nil {
+			return n, err
+		}
+		switch {
+		case e.Mode == dirMode:
+			m, err := checkoutTree(ctx, store, obj, target, linksAsFiles)
+			n += m
+			if err != nil {
+				return n, err
+			}
+			continue
+		case obj.Type != git.BlobT:
+			return n, errgo.Newf("%s: %s is not a blob", target, e.Hash)
+		}
+		blob, _ := obj.Blob()
+		switch {
+		case e.Mode == symlinkMode && !linksAsFiles:
+			err = os.Symlink(string(blob), target)
+		case e.Mode == executableMode:
+			err = ioutil.WriteFile(target, blob, 0755)
+		default:
+			err = ioutil.WriteFile(target, blob, 0644)
+		}
+		if err != nil {
+			return n, errgo.Notef(err, "writing %s failed", target)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// getChecked reads and decodes sha1, unless ctx is done
+func getChecked(ctx context.Context, store Store, sha1 string) (*object, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	_, obj, err := readObject(store, sha1)
+	return obj, err
+}
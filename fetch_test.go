@@ -2,16 +2,24 @@ package main
 
 import (
 	"bytes"
+	"compress/zlib"
+	"context"
 	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/ipfs/go-ipfs-shell"
 	"github.com/jbenet/go-random"
 )
 
@@ -72,14 +80,14 @@ func cloneAndCheckout(t *testing.T, repo string, expected map[string]string) (tm
 	return tmpDir
 }
 
-func checkFatal(t *testing.T, err error) {
+func checkFatal(t testing.TB, err error) {
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
 // oh well.. just some rand string
-func mkRandTmpDir(t *testing.T) string {
+func mkRandTmpDir(t testing.TB) string {
 	var buf bytes.Buffer
 	for i := 0; i < 10; i++ {
 		checkFatal(t, random.WriteRandomBytes(20, &buf))
@@ -97,7 +105,7 @@ func mkRandTmpDir(t *testing.T) string {
 	return ""
 }
 
-func rmDir(t *testing.T, dir string) { checkFatal(t, os.RemoveAll(dir)) }
+func rmDir(t testing.TB, dir string) { checkFatal(t, os.RemoveAll(dir)) }
 
 func hashMap(t *testing.T, dir string, files map[string]string) {
 	for fname, want := range files {
@@ -112,3 +120,536 @@ func hashMap(t *testing.T, dir string, files map[string]string) {
 		}
 	}
 }
+
+// looseObject returns the name and zlib compressed loose object form of data
+func looseObject(kind, data string) (string, string) {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	fmt.Fprintf(zw, "%s %d\x00%s", kind, len(data), data)
+	zw.Close()
+	return objectSha1(kind, []byte(data)), buf.String()
+}
+
+// fixtureCommit adds a commit with a one file tree as loose objects to files
+// and returns the commit and all object names
+func fixtureCommit(files map[string]string, content string) (string, []string) {
+	blob, z := looseObject("blob", content)
+	files[objectPath(blob)] = z
+	blobSum, _ := hex.DecodeString(blob)
+	tree, z := looseObject("tree", "100644 file.txt\x00"+string(blobSum))
+	files[objectPath(tree)] = z
+	commit, z := looseObject("commit", "tree "+tree+"\nauthor a <a@b> 0 +0000\ncommitter a <a@b> 0 +0000\n\nfixture\n")
+	files[objectPath(commit)] = z
+	return commit, []string{commit, tree, blob}
+}
+
+// useTmpGitDir points thisGitRepo at a fresh directory for fetched objects
+func useTmpGitDir(t testing.TB) func() {
+	old := thisGitRepo
+	thisGitRepo = mkRandTmpDir(t)
+	dir := thisGitRepo
+	return func() {
+		thisGitRepo = old
+		rmDir(t, dir)
+	}
+}
+
+func TestFetch_deeplyNestedRef(t *testing.T) {
+	files := map[string]string{"HEAD": "ref: refs/heads/master\n"}
+	commit, objs := fixtureCommit(files, "deep\n")
+	files["refs/heads/master"] = commit + "\n"
+	files["refs/heads/feature/team/subteam/name"] = commit + "\n"
+	_, restore := useFakeRepo(t, files)
+	defer restore()
+	defer useTmpGitDir(t)()
+	// the walk cleans paths, the ref names still have to come out right
+	ipfsRepoPath += "/"
+
+	var out bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("list\n"), &out))
+	if !strings.Contains(out.String(), commit+" refs/heads/feature/team/subteam/name\n") {
+		t.Fatalf("nested ref not listed:\n%s", out.String())
+	}
+	out.Reset()
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("fetch "+commit+" refs/heads/master\nfetch "+commit+" refs/heads/feature/team/subteam/name\n\n"), &out))
+	if out.String() != "\n" {
+		t.Errorf("a fetch batch should be answered with one blank line, got %q", out.String())
+	}
+	for _, obj := range objs {
+		if _, err := os.Stat(filepath.Join(thisGitRepo, objectPath(obj))); err != nil {
+			t.Errorf("object %s was not fetched: %s", obj, err)
+		}
+	}
+}
+
+func TestFetch_nestedRepo(t *testing.T) {
+	files := map[string]string{"HEAD": "ref: refs/heads/master\n"}
+	commit, objs := fixtureCommit(files, "nested\n")
+	files["refs/heads/master"] = commit + "\n"
+	files["refs/heads/feature/x"] = commit + "\n"
+	fs, restore := useFakeRepo(t, files)
+	defer restore()
+	defer useTmpGitDir(t)()
+	top, err := fs.PatchLink(fs.mkdir(map[string]string{}), "a/b/c/repo.git", strings.TrimPrefix(ipfsRepoPath, "/ipfs/"), true)
+	checkFatal(t, err)
+	ipfsRepoPath = "/ipfs/" + top + "/a/b/c/repo.git"
+
+	var out bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("list\n"), &out))
+	for _, line := range []string{commit + " refs/heads/master\n", commit + " refs/heads/feature/x\n", commit + " HEAD\n"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("list of the nested repo misses %q:\n%s", line, out.String())
+		}
+	}
+	out.Reset()
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("fetch "+commit+" refs/heads/master\n\n"), &out))
+	for _, obj := range objs {
+		if _, err := os.Stat(filepath.Join(thisGitRepo, objectPath(obj))); err != nil {
+			t.Errorf("object %s was not fetched: %s", obj, err)
+		}
+	}
+}
+
+func TestFetch_batchReply(t *testing.T) {
+	files := map[string]string{"HEAD": "ref: refs/heads/master\n"}
+	var batch string
+	var all []string
+	for i, name := range []string{"master", "dev", "release"} {
+		commit, objs := fixtureCommit(files, fmt.Sprintf("content %d\n", i))
+		files["refs/heads/"+name] = commit + "\n"
+		batch += "fetch " + commit + " refs/heads/" + name + "\n"
+		all = append(all, objs...)
+	}
+	_, restore := useFakeRepo(t, files)
+	defer restore()
+	defer useTmpGitDir(t)()
+
+	var out bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader(batch+"\n"), &out))
+	// the protocol wants one blank line once the whole batch is done, no per object chatter
+	if out.String() != "\n" {
+		t.Errorf("want a single blank line for the batch, got %q", out.String())
+	}
+	for _, obj := range all {
+		if _, err := os.Stat(filepath.Join(thisGitRepo, objectPath(obj))); err != nil {
+			t.Errorf("object %s was not fetched: %s", obj, err)
+		}
+	}
+}
+
+func TestFetch_trackRefs(t *testing.T) {
+	files := map[string]string{"HEAD": "ref: refs/heads/master\n"}
+	master, _ := fixtureCommit(files, "master\n")
+	tag, _ := fixtureCommit(files, "tagged\n")
+	files["refs/heads/master"] = master + "\n"
+	files["refs/tags/v1"] = tag + "\n"
+	_, restore := useFakeRepo(t, files)
+	defer restore()
+	defer useTmpGitDir(t)()
+	if out, err := exec.Command("git", "init", "-q", "--bare", thisGitRepo).CombinedOutput(); err != nil {
+		t.Fatalf("git init failed: %s\n%s", err, out)
+	}
+	oldRemote := thisGitRemote
+	thisGitRemote = "origin"
+	trackRefs = true
+	defer func() { thisGitRemote, trackRefs = oldRemote, false }()
+
+	var out bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("fetch "+master+" refs/heads/master\nfetch "+tag+" refs/tags/v1\n\n"), &out))
+	for name, want := range map[string]string{
+		"refs/ipfs/origin/heads/master": master,
+		"refs/ipfs/origin/tags/v1":      tag,
+	} {
+		got, err := gitRefHash(name)
+		if err != nil || got != want {
+			t.Errorf("%s: want %s, got %q (%v)", name, want, got, err)
+		}
+	}
+}
+
+func TestFetch_continueOnMissing(t *testing.T) {
+	files := map[string]string{"HEAD": "ref: refs/heads/master\n"}
+	commit, objs := fixtureCommit(files, "partial\n")
+	files["refs/heads/master"] = commit + "\n"
+	blob := objs[2]
+	delete(files, objectPath(blob))
+	_, restore := useFakeRepo(t, files)
+	defer restore()
+	defer useTmpGitDir(t)()
+	continueOnMissing = true
+	defer func() { continueOnMissing, missingObjects = false, nil }()
+
+	var out bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("fetch "+commit+" refs/heads/master\n\n"), &out))
+	if out.String() != "\n" {
+		t.Errorf("unexpected fetch reply %q", out.String())
+	}
+	for _, obj := range objs[:2] {
+		if _, err := os.Stat(filepath.Join(thisGitRepo, objectPath(obj))); err != nil {
+			t.Errorf("object %s was not fetched: %s", obj, err)
+		}
+	}
+	var summary bytes.Buffer
+	if n := reportMissing(&summary); n != 1 {
+		t.Errorf("want 1 missing object, got %d", n)
+	}
+	want := "warning: 1 objects could not be fetched, the local repo is incomplete:\n  " + blob + "\n"
+	if summary.String() != want {
+		t.Errorf("unexpected summary:\n%s", summary.String())
+	}
+
+	// without the option the first one stops the fetch
+	continueOnMissing, missingObjects = false, nil
+	checkFatal(t, os.RemoveAll(filepath.Join(thisGitRepo, "objects")))
+	if err := speakGit(context.Background(), strings.NewReader("fetch "+commit+" refs/heads/master\n\n"), &out); err == nil {
+		t.Error("expected the missing object to fail the fetch")
+	}
+	if reportMissing(&summary) != 0 {
+		t.Error("missing objects recorded without GIT_IPFS_CONTINUE_ON_MISSING")
+	}
+}
+
+// countingStore records the loose object reads of the wrapped store
+type countingStore struct {
+	objectStore
+	gets int
+}
+
+func (s *countingStore) getObject(sha1 string) (io.ReadCloser, error) {
+	s.gets++
+	return s.objectStore.getObject(sha1)
+}
+
+func TestFetch_assumePacked(t *testing.T) {
+	pack, err := ioutil.ReadFile(filepath.Join("testdata", "delta-ofs.pack"))
+	checkFatal(t, err)
+	idxFile := filepath.Join(mkRandTmpDir(t), "pack.idx")
+	defer rmDir(t, filepath.Dir(idxFile))
+	if out, err := exec.Command("git", "index-pack", "-o", idxFile, filepath.Join("testdata", "delta-ofs.pack")).CombinedOutput(); err != nil {
+		t.Fatalf("git index-pack failed: %s\n%s", err, out)
+	}
+	idx, err := ioutil.ReadFile(idxFile)
+	checkFatal(t, err)
+	head := deltaPackObjects[0]
+	_, restore := useFakeRepo(t, map[string]string{
+		"HEAD":                     "ref: refs/heads/master\n",
+		"info/refs":                head + "\trefs/heads/master\n",
+		"objects/pack/pack-1.pack": string(pack),
+		"objects/pack/pack-1.idx":  string(idx),
+	})
+	defer restore()
+	defer func(old objectStore) { objStore = old }(objStore)
+
+	for _, assume := range []bool{false, true} {
+		cleanup := useTmpGitDir(t)
+		if out, err := exec.Command("git", "init", "-q", "--bare", thisGitRepo).CombinedOutput(); err != nil {
+			t.Fatalf("git init failed: %s\n%s", err, out)
+		}
+		store := &countingStore{objectStore: fileStore{}}
+		objStore, assumePacked = store, assume
+		checkFatal(t, fetchRef(context.Background(), head, "refs/heads/master"))
+		for _, sha1 := range deltaPackObjects {
+			if !gitHasObject(sha1) {
+				t.Errorf("assume packed %v: object %s not fetched", assume, sha1)
+			}
+		}
+		if assume && store.gets != 0 {
+			t.Errorf("loose objects were tried %d times with GIT_IPFS_ASSUME_PACKED", store.gets)
+		}
+		if !assume && store.gets == 0 {
+			t.Error("expected a loose attempt by default")
+		}
+		cleanup()
+	}
+	assumePacked = false
+}
+
+// batchReader hands out a fetch batch of n lines one line per Read, so produced says how far the reader got
+type batchReader struct {
+	mu       sync.Mutex
+	sha1     string
+	n        int
+	produced int
+}
+
+func (b *batchReader) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.produced < b.n:
+		b.produced++
+		return copy(p, fmt.Sprintf("fetch %s refs/heads/b%d\n", b.sha1, b.produced)), nil
+	case b.produced == b.n:
+		b.produced++
+		return copy(p, "\n"), nil
+	}
+	return 0, io.EOF
+}
+
+func (b *batchReader) count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.produced
+}
+
+// aheadShell records how many more lines the reader produced than fetches were started,
+// every fetch starts with one Cat of the commit
+type aheadShell struct {
+	ipfsAPI
+	commit   string
+	batch    *batchReader
+	mu       sync.Mutex
+	started  int
+	maxAhead int
+}
+
+func (s *aheadShell) Cat(p string) (io.ReadCloser, error) {
+	if strings.HasSuffix(p, objectPath(s.commit)) {
+		s.mu.Lock()
+		s.started++
+		if ahead := s.batch.count() - s.started; ahead > s.maxAhead {
+			s.maxAhead = ahead
+		}
+		s.mu.Unlock()
+	}
+	return s.ipfsAPI.Cat(p)
+}
+
+func TestFetchBatch_streaming(t *testing.T) {
+	files := map[string]string{"HEAD": "ref: refs/heads/master\n"}
+	commit, _ := fixtureCommit(files, "many refs\n")
+	files["refs/heads/master"] = commit + "\n"
+	fs, restore := useFakeRepo(t, files)
+	defer restore()
+	defer func(n int, q bool) { fetchConcurrency, quiet = n, q }(fetchConcurrency, quiet)
+	quiet = true
+
+	for _, workers := range []int{1, 4} {
+		fetchConcurrency = workers
+		cleanup := useTmpGitDir(t)
+		const n = 20000
+		batch := &batchReader{sha1: commit, n: n}
+		shell := &aheadShell{ipfsAPI: fs, commit: commit, batch: batch}
+		ipfsShell = shell
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		var out bytes.Buffer
+		checkFatal(t, speakGit(context.Background(), batch, &out))
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		ipfsShell = fs
+		cleanup()
+
+		// the refs share the commit, it's fetched once and the other lines are skipped without queueing
+		if shell.started != 1 || out.String() != "\n" {
+			t.Errorf("%d workers: commit of %d refs fetched %d times, output %q", workers, n, shell.started, out.String())
+		}
+		// the lines alone take more than 1MB if they pile up
+		if grown := int64(after.HeapAlloc) - int64(before.HeapAlloc); grown > 1<<20 {
+			t.Errorf("%d workers: heap grew by %d bytes during the batch", workers, grown)
+		}
+	}
+}
+
+func TestFetchBatch_duplicates(t *testing.T) {
+	files := map[string]string{"HEAD": "ref: refs/heads/master\n"}
+	commit, objs := fixtureCommit(files, "tip of several refs\n")
+	other, otherObjs := fixtureCommit(files, "another\n")
+	fs, restore := useFakeRepo(t, files)
+	defer restore()
+	defer useTmpGitDir(t)()
+	defer func(q, tr bool) { quiet, trackRefs = q, tr }(quiet, trackRefs)
+	quiet, trackRefs = true, false
+
+	before := fs.calls["Cat"]
+	batch := "fetch " + commit + " refs/heads/master\nfetch " + commit + " refs/heads/release\nfetch " + other + " refs/heads/dev\nfetch " + commit + " refs/tags/v1\n\n"
+	var out bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader(batch), &out))
+	if out.String() != "\n" {
+		t.Errorf("want one blank line for the batch, got %q", out.String())
+	}
+	if cats := fs.calls["Cat"] - before; cats != len(objs)+len(otherObjs) {
+		t.Errorf("want one cat per object, got %d for %d objects", cats, len(objs)+len(otherObjs))
+	}
+}
+
+// packListShell counts the listings of objects/pack
+type packListShell struct {
+	ipfsAPI
+	packLists int
+}
+
+func (s *packListShell) List(p string) ([]*shell.LsEntry, error) {
+	if strings.HasSuffix(p, "objects/pack") {
+		s.packLists++
+	}
+	return s.ipfsAPI.List(p)
+}
+
+func TestFetch_smallRepo(t *testing.T) {
+	defer func(old int) { smallRepoObjects = old }(smallRepoObjects)
+	files := map[string]string{"HEAD": "ref: refs/heads/master\n"}
+	commit, objs := fixtureCommit(files, "small\n")
+	files["info/refs"] = commit + "\trefs/heads/master\n"
+	broken := make(map[string]string, len(files))
+	for p, data := range files {
+		broken[p] = data
+	}
+	delete(broken, objectPath(objs[2]))
+	packed := map[string]string{"objects/pack/pack-1.pack": "PACK"}
+	for p, data := range files {
+		packed[p] = data
+	}
+
+	for _, tc := range []struct {
+		name      string
+		files     map[string]string
+		threshold int
+		small     bool
+		fails     bool
+	}{
+		{"small", files, 100, true, false},
+		{"too many objects", files, len(objs) - 1, false, false},
+		{"has a pack", packed, 100, false, false},
+		// a missing object fails without probing for packs, unless the fast path is off
+		{"small, missing blob", broken, 100, true, true},
+		{"off, missing blob", broken, 0, false, true},
+	} {
+		smallRepoObjects = tc.threshold
+		fs, restore := useFakeRepo(t, tc.files)
+		cleanup := useTmpGitDir(t)
+		s := &packListShell{ipfsAPI: fs}
+		ipfsShell = s
+		var out bytes.Buffer
+		err := speakGit(context.Background(), strings.NewReader("list\nfetch "+commit+" refs/heads/master\n\n"), &out)
+		if smallRepo != tc.small {
+			t.Errorf("%s: small remote is %v", tc.name, smallRepo)
+		}
+		if tc.fails != (err != nil) {
+			t.Errorf("%s: fetch error %v", tc.name, err)
+		}
+		if tc.small && s.packLists != 0 {
+			t.Errorf("%s: listed the packs %d times", tc.name, s.packLists)
+		}
+		if !tc.small && tc.fails && s.packLists == 0 {
+			t.Errorf("%s: expected a look at the packs", tc.name)
+		}
+		cleanup()
+		restore()
+	}
+}
+
+func benchmarkCloneSmall(b *testing.B, threshold int) {
+	defer func(old int) { smallRepoObjects = old }(smallRepoObjects)
+	smallRepoObjects = threshold
+	stderr = ioutil.Discard
+	defer func() { stderr = os.Stderr }()
+	// 10 branches, 30 objects
+	files := map[string]string{"HEAD": "ref: refs/heads/b0\n"}
+	var infoRefs, cmds string
+	for i := 0; i < 10; i++ {
+		commit, _ := fixtureCommit(files, fmt.Sprintf("file %d\n", i))
+		infoRefs += fmt.Sprintf("%s\trefs/heads/b%d\n", commit, i)
+		cmds += fmt.Sprintf("fetch %s refs/heads/b%d\n", commit, i)
+	}
+	files["info/refs"] = infoRefs
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, restore := useFakeRepo(b, files)
+		cleanup := useTmpGitDir(b)
+		var out bytes.Buffer
+		if err := speakGit(context.Background(), strings.NewReader("list\n"+cmds+"\n"), &out); err != nil {
+			b.Fatal(err)
+		}
+		cleanup()
+		restore()
+	}
+}
+
+func BenchmarkCloneSmall_fastPath(b *testing.B) { benchmarkCloneSmall(b, 100) }
+func BenchmarkCloneSmall_off(b *testing.B)      { benchmarkCloneSmall(b, 0) }
+
+// initClone points thisGitRepo at a new empty repo, to fetch into like git clone does
+func initClone(t *testing.T) (string, func()) {
+	dir := mkRandTmpDir(t)
+	if out, err := exec.Command("git", "init", "-q", dir).CombinedOutput(); err != nil {
+		t.Fatalf("git init failed: %s\n%s", err, out)
+	}
+	old := thisGitRepo
+	thisGitRepo = filepath.Join(dir, ".git")
+	return dir, func() {
+		thisGitRepo = old
+		rmDir(t, dir)
+	}
+}
+
+func TestFetch_since(t *testing.T) {
+	first, cleanup := mkLocalRepo(t, "ipfs://ipfs/"+fixtureHash)
+	defer cleanup()
+	stderr = ioutil.Discard
+	defer func() { stderr = os.Stderr }()
+	addFiles(t, 1)
+	since, err := gitRefHash("refs/heads/master")
+	checkFatal(t, err)
+	addFiles(t, 2)
+	head, err := gitRefHash("refs/heads/master")
+	checkFatal(t, err)
+	_, restore := useFakeRepo(t, map[string]string{"HEAD": "ref: refs/heads/master\n"})
+	defer restore()
+	checkFatal(t, push(context.Background(), "refs/heads/master", "refs/heads/master"))
+	root := pushRoot
+	checkFatal(t, pushFinish(context.Background()))
+	ipfsRepoPath = "/ipfs/" + root
+
+	clone, cleanupClone := initClone(t)
+	defer cleanupClone()
+	defer func() { fetchSince, sinceReached = "", 0 }()
+	fetchSince = since
+	var w bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("fetch "+head+" refs/heads/master\n\n"), &w))
+
+	if gitHasObject(first) {
+		t.Error("the parent of the since commit was fetched")
+	}
+	shallow, err := ioutil.ReadFile(filepath.Join(thisGitRepo, "shallow"))
+	if err != nil || string(shallow) != since+"\n" {
+		t.Errorf("shallow file: %q, %v", shallow, err)
+	}
+	// git sees a complete, shallow history
+	revList := exec.Command("git", "rev-list", "--objects", head)
+	revList.Dir = clone
+	if out, err := revList.CombinedOutput(); err != nil {
+		t.Errorf("rev-list of the shallow clone failed: %s\n%s", err, out)
+	}
+	// marking it again doesn't repeat it
+	checkFatal(t, markShallow(since))
+	if shallow, _ := ioutil.ReadFile(filepath.Join(thisGitRepo, "shallow")); string(shallow) != since+"\n" {
+		t.Errorf("shallow file after marking twice: %q", shallow)
+	}
+}
+
+func TestFetch_commitGraph(t *testing.T) {
+	_, cleanup := mkLocalRepo(t, "ipfs://ipfs/"+fixtureHash)
+	defer cleanup()
+	stderr = ioutil.Discard
+	defer func() { stderr = os.Stderr }()
+	addFiles(t, 2)
+	head, err := gitRefHash("refs/heads/master")
+	checkFatal(t, err)
+	_, restore := useFakeRepo(t, map[string]string{"HEAD": "ref: refs/heads/master\n"})
+	defer restore()
+	checkFatal(t, push(context.Background(), "refs/heads/master", "refs/heads/master"))
+	ipfsRepoPath = "/ipfs/" + pushRoot
+	checkFatal(t, pushFinish(context.Background()))
+
+	_, cleanupClone := initClone(t)
+	defer cleanupClone()
+	defer func() { writeCommitGraph = false }()
+	writeCommitGraph = true
+	var w bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("fetch "+head+" refs/heads/master\n\n"), &w))
+	if _, err := os.Stat(filepath.Join(thisGitRepo, "objects", "info", "commit-graph")); err != nil {
+		t.Errorf("no commit-graph written: %s", err)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/cryptix/git-remote-ipfs/fetch"
+	"github.com/cryptix/git-remote-ipfs/internal/errkind"
+)
+
+// fsck checks every object reachable from the refs of the repo at ipfsRepoPath and reports the missing and corrupt ones to w.
+// objects that aren't loose but listed in one of the repo's pack indexes count as present, their content isn't checked.
+// it returns the number of problems.
+func fsck(ctx context.Context, w io.Writer) (int, error) {
+	if err := listInfoRefs(ctx, false); err != nil {
+		log.WithField("err", err).Debug("didn't find info/refs in repo, falling back...")
+		if err := listIterateRefs(ctx, false); err != nil {
+			return 0, withKind(err, ErrNotARepo, "listing refs failed")
+		}
+	}
+	if len(ref2hash) == 0 {
+		return 0, errkind.Wrapf(nil, ErrNotARepo, "no refs in %s", ipfsRepoPath)
+	}
+	refs := make([]string, 0, len(ref2hash))
+	for ref := range ref2hash {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	var packed map[string]bool
+	seen := make(map[string]bool)
+	problems := 0
+	for _, ref := range refs {
+		found, err := fetch.Verify(ctx, remoteStore{objStore}, ref2hash[ref], seen)
+		if err != nil {
+			return problems, err
+		}
+		for _, p := range found {
+			if errors.Is(p.Err, ErrObjectMissing) {
+				if packed == nil {
+					if packed, err = packedObjects(ipfsRepoPath); err != nil {
+						return problems, err
+					}
+				}
+				if packed[p.SHA1] {
+					continue
+				}
+				fmt.Fprintf(w, "missing %s (reachable from %s)\n", p.SHA1, ref)
+			} else {
+				fmt.Fprintf(w, "corrupt %s (reachable from %s): %s\n", p.SHA1, ref, p.Err)
+			}
+			problems++
+		}
+	}
+	fmt.Fprintf(w, "checked %d objects of %d refs, %d problems\n", len(seen), len(refs), problems)
+	return problems, nil
+}
+
+// fsckMain is git-remote-ipfs fsck <url>
+func fsckMain(args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: git-remote-ipfs fsck <url>")
+		return exitUsage
+	}
+	if code := openRemote(flags.Arg(0)); code != 0 {
+		return code
+	}
+	problems, err := fsck(context.Background(), os.Stdout)
+	if err != nil {
+		log.Error("fsck failed:", err)
+		return exitCode(err)
+	}
+	if problems > 0 {
+		return exitObjectError
+	}
+	return 0
+}
+
+// openRemote sets up the shell and object store for the repo at url, for the subcommands that work on a url.
+// it returns a non zero exit code if that failed.
+func openRemote(url string) int {
+	u, _ := cutURLLabel(url)
+	var err error
+	if ipfsRepoPath, err = parseRepoURL(u); err != nil {
+		fmt.Fprintf(os.Stderr, "parsing url failed: %s\n", err)
+		return exitUsage
+	}
+	ipfsShell = newShell(apiAddress(), defaultMaxIdleConns)
+	ipnsResolver = os.Getenv("GIT_IPFS_IPNS_RESOLVER")
+	resolveRepoPath(context.Background())
+	if objStore, err = newObjectStore(os.Getenv("GIT_IPFS_STORE")); err != nil {
+		fmt.Fprintf(os.Stderr, "GIT_IPFS_STORE: %s\n", err)
+		return exitUsage
+	}
+	return 0
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestFsck(t *testing.T) {
+	files := map[string]string{"HEAD": "ref: refs/heads/master\n"}
+	master, objs := fixtureCommit(files, "good\n")
+	files["refs/heads/master"] = master + "\n"
+	files["refs/tags/v1"] = master + "\n"
+	_, restore := useFakeRepo(t, files)
+	var out bytes.Buffer
+	problems, err := fsck(context.Background(), &out)
+	restore()
+	checkFatal(t, err)
+	if problems != 0 || out.String() != "checked 3 objects of 2 refs, 0 problems\n" {
+		t.Errorf("good repo: %d problems\n%s", problems, out.String())
+	}
+
+	// the tree of master is gone and the blob of dev has the content of its commit
+	other, otherObjs := fixtureCommit(files, "other\n")
+	files["refs/heads/dev"] = other + "\n"
+	delete(files, objectPath(objs[1]))
+	files[objectPath(otherObjs[2])] = files[objectPath(other)]
+	_, restore = useFakeRepo(t, files)
+	defer restore()
+	out.Reset()
+	problems, err = fsck(context.Background(), &out)
+	checkFatal(t, err)
+	if problems != 2 {
+		t.Errorf("want 2 problems, got %d\n%s", problems, out.String())
+	}
+	for _, want := range []string{"missing " + objs[1] + " (reachable from refs/heads/master)\n", "corrupt " + otherObjs[2] + " (reachable from refs/heads/dev): "} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report lacks %q:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipfs/go-ipfs-shell"
+	"gopkg.in/errgo.v1"
+)
+
+// what probeEndpoint finds behind the api address
+const (
+	endpointAPI     = "api"
+	endpointGateway = "gateway"
+	endpointUnknown = "unknown"
+)
+
+// emptyDirHash is the empty unixfs directory, every node and gateway has it
+const emptyDirHash = "QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn"
+
+// probeEndpoint tells an api (which answers /api/v0/version) from a gateway (which serves /ipfs/ paths).
+// IPFS_API pointing at a gateway (port 8080) is an easy mistake, requests then fail in confusing ways.
+func probeEndpoint(c *http.Client, addr string) string {
+	base := httpBase(addr)
+	if resp, err := c.Post(base+"/api/v0/version", "", nil); err == nil {
+		var v struct{ Version string }
+		err := json.NewDecoder(resp.Body).Decode(&v)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK && err == nil && v.Version != "" {
+			return endpointAPI
+		}
+	}
+	resp, err := c.Get(base + "/ipfs/" + emptyDirHash + "/")
+	if err != nil {
+		return endpointUnknown
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK || resp.Header.Get("X-Ipfs-Path") != "" {
+		return endpointGateway
+	}
+	return endpointUnknown
+}
+
+// gatewayShell reads files through http gateways, for when the api address turned out to be one
+// or IPFS_GATEWAYS lists some to read from.
+// everything but Cat (and List, without an api) still goes to the api shell, so with only a gateway just fetching works.
+//
+// metadata like info/refs is fetched gzip compressed if the gateway supports it.
+//
+// with several gateways Cat hedges: if the first doesn't answer within hedgeDelay (or fails) the next one is asked too,
+// the first good answer wins and the others are canceled.
+type gatewayShell struct {
+	ipfsAPI
+	bases      []string
+	subdomain  map[string]bool // bases asked as https://<cid>.ipfs.<host>/.. (GIT_IPFS_SUBDOMAIN_GATEWAY)
+	hedgeDelay time.Duration
+	client     *http.Client
+	readOnly   bool // there is no api behind it, only the gateway
+}
+
+func (g *gatewayShell) canWrite() bool { return !g.readOnly }
+
+// gatewayHedgeDelay is how long Cat waits for a gateway before asking the next one (IPFS_GATEWAY_HEDGE_DELAY)
+var gatewayHedgeDelay = 500 * time.Millisecond
+
+func newGatewayShell(api ipfsAPI, addrs []string, c *http.Client) *gatewayShell {
+	g := &gatewayShell{ipfsAPI: api, hedgeDelay: gatewayHedgeDelay, client: c}
+	for _, addr := range addrs {
+		g.bases = append(g.bases, httpBase(addr))
+	}
+	return g
+}
+
+// apiBehind is the backend below the gateways sh reads through, the one with the dag and mfs calls of the api.
+// nil if there's only a gateway.
+func apiBehind(sh ipfsAPI) ipfsAPI {
+	for {
+		g, ok := sh.(*gatewayShell)
+		if !ok {
+			return sh
+		}
+		if g.readOnly {
+			return nil
+		}
+		sh = g.ipfsAPI
+	}
+}
+
+// addSubdomainGateways adds the gateways at hosts (like dweb.link), asked in subdomain form.
+// they get https unless the host says otherwise, what gateways isolating origins like that serve.
+func (g *gatewayShell) addSubdomainGateways(hosts []string) {
+	if g.subdomain == nil {
+		g.subdomain = make(map[string]bool, len(hosts))
+	}
+	for _, host := range hosts {
+		if !strings.HasPrefix(host, "http://") && !strings.HasPrefix(host, "https://") {
+			host = "https://" + host
+		}
+		base := strings.TrimSuffix(host, "/")
+		g.bases = append(g.bases, base)
+		g.subdomain[base] = true
+	}
+}
+
+// gatewayURL is where the gateway at base serves p (/ipfs/<cid>/.. or /ipns/<name>/..)
+func (g *gatewayShell) gatewayURL(base, p string) (string, error) {
+	if !g.subdomain[base] {
+		return base + p, nil
+	}
+	return subdomainURL(base, p)
+}
+
+// subdomainURL turns p into the subdomain form of the gateway at base, https://<cid>.ipfs.<host>/<rest>.
+// a subdomain is case insensitive, so a cid has to be a base32 version 1 one, Qm.. ones are converted.
+// ipns keys become base36 libp2p-key cids (the base32 ones of ed25519 keys are too long for a dns label),
+// dnslink names get their dots inlined as dashes (docs.ipfs.tech -> docs-ipfs-tech).
+func subdomainURL(base, p string) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", errgo.Notef(err, "bad subdomain gateway %q", base)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 3)
+	if len(parts) < 2 || parts[1] == "" {
+		return "", errgo.Newf("%s is no /ipfs/ or /ipns/ path", p)
+	}
+	ns, name := parts[0], parts[1]
+	var rest string
+	if len(parts) == 3 {
+		rest = parts[2]
+	}
+	if i := strings.IndexByte(name, '?'); i >= 0 {
+		// ?format=json right after the root
+		name, rest = name[:i], name[i:]
+	}
+	switch ns {
+	case "ipfs":
+		if name, err = subdomainCID(name); err != nil {
+			return "", err
+		}
+	case "ipns":
+		if name, err = subdomainIPNS(name); err != nil {
+			return "", err
+		}
+	default:
+		return "", errgo.Newf("%s is no /ipfs/ or /ipns/ path", p)
+	}
+	return u.Scheme + "://" + name + "." + ns + "." + u.Host + "/" + rest, nil
+}
+
+// subdomainCID returns the base32 version 1 form of the cid h
+func subdomainCID(h string) (string, error) {
+	switch {
+	case cidVersionOf(h) == 0:
+		return cidV1Of(h)
+	case strings.HasPrefix(h, "b"):
+		return strings.ToLower(h), nil
+	default:
+		return "", errgo.Newf("%s: only base32 version 1 cids fit in a subdomain", h)
+	}
+}
+
+// codecLibp2pKey is the multicodec of a cid naming an ipns key
+const codecLibp2pKey = 0x72
+
+// subdomainIPNS returns the dns label of the ipns name
+func subdomainIPNS(name string) (string, error) {
+	switch {
+	case strings.Contains(name, "."):
+		return strings.Replace(strings.Replace(name, "-", "--", -1), ".", "-", -1), nil
+	case strings.HasPrefix(name, "Qm") || strings.HasPrefix(name, "12D3"):
+		mh, err := decodeBase58(name)
+		if err != nil {
+			return "", err
+		}
+		n := new(big.Int).SetBytes(append([]byte{cidV1, codecLibp2pKey}, mh...))
+		return "k" + n.Text(36), nil
+	case strings.HasPrefix(name, "k"), strings.HasPrefix(name, "b"):
+		return strings.ToLower(name), nil
+	default:
+		return "", errgo.Newf("%s: unknown kind of ipns name", name)
+	}
+}
+
+// parseGateways splits the comma separated IPFS_GATEWAYS
+func parseGateways(s string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(s, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func (g *gatewayShell) Cat(p string) (io.ReadCloser, error) {
+	type result struct {
+		i    int
+		body io.ReadCloser
+		err  error
+	}
+	results := make(chan result, len(g.bases))
+	cancels := make([]context.CancelFunc, len(g.bases))
+	next := 0
+	start := func() {
+		i := next
+		next++
+		ctx, cancel := context.WithCancel(context.Background())
+		cancels[i] = cancel
+		go func() {
+			u, err := g.gatewayURL(g.bases[i], p)
+			if err != nil {
+				results <- result{i: i, err: err}
+				return
+			}
+			req, err := http.NewRequest("GET", u, nil)
+			if err != nil {
+				results <- result{i: i, err: err}
+				return
+			}
+			req.Header.Set("Accept-Encoding", acceptEncoding(p))
+			resp, err := g.client.Do(req.WithContext(ctx))
+			if err != nil {
+				results <- result{i: i, err: err}
+				return
+			}
+			if resp.StatusCode != http.StatusOK {
+				resp.Body.Close()
+				results <- result{i: i, err: errgo.Newf("%s", resp.Status)}
+				return
+			}
+			body, err := decodeBody(resp)
+			results <- result{i: i, body: body, err: err}
+		}()
+	}
+	start()
+	pending := 1
+	hedge := time.NewTimer(g.hedgeDelay)
+	defer hedge.Stop()
+	var errs []string
+	for pending > 0 {
+		select {
+		case <-hedge.C:
+			if next < len(g.bases) {
+				log.WithField("path", p).WithField("gateway", g.bases[next]).Debug("gateway is slow, hedging")
+				start()
+				pending++
+				hedge.Reset(g.hedgeDelay)
+			}
+		case r := <-results:
+			pending--
+			if r.err != nil {
+				cancels[r.i]()
+				errs = append(errs, g.bases[r.i]+": "+r.err.Error())
+				if next < len(g.bases) {
+					// no need to wait for the delay
+					start()
+					pending++
+				}
+				continue
+			}
+			for i, cancel := range cancels {
+				if i != r.i && cancel != nil {
+					cancel()
+				}
+			}
+			// the canceled ones might have answered already
+			go func(n int) {
+				for ; n > 0; n-- {
+					if lost := <-results; lost.err == nil {
+						lost.body.Close()
+					}
+				}
+			}(pending)
+			return cancelOnClose{ReadCloser: r.body, cancel: cancels[r.i]}, nil
+		}
+	}
+	return nil, errgo.Newf("gateway get %s failed: %s", p, strings.Join(errs, ", "))
+}
+
+// gatewayNode is the dag-json form of a unixfs node, what a gateway returns for ?format=json
+type gatewayNode struct {
+	Data struct {
+		Slash struct {
+			Bytes string `json:"bytes"`
+		} `json:"/"`
+	}
+	Links []struct {
+		Hash struct {
+			Slash string `json:"/"`
+		}
+		Name  string
+		Tsize uint64
+	}
+}
+
+// unixfsType reads the type (field 1 of the unixfs protobuf) from the node's data
+func (n *gatewayNode) unixfsType() (int, error) {
+	data, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(n.Data.Slash.Bytes, "="))
+	if err != nil {
+		return 0, errgo.Notef(err, "decoding unixfs data failed")
+	}
+	if len(data) < 2 || data[0] != 0x08 {
+		return 0, errgo.Newf("no unixfs type in %x", data)
+	}
+	typ, n2 := binary.Uvarint(data[1:])
+	if n2 <= 0 {
+		return 0, errgo.Newf("bad unixfs type in %x", data)
+	}
+	return int(typ), nil
+}
+
+// node gets the dag-json form of the node at p
+func (g *gatewayShell) node(p string) (*gatewayNode, error) {
+	rc, err := g.Cat(p + "?format=json")
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var n gatewayNode
+	if err := json.NewDecoder(rc).Decode(&n); err != nil {
+		return nil, errgo.Notef(err, "decoding the json listing of %s failed", p)
+	}
+	return &n, nil
+}
+
+// List reads directories from the gateway's json form if there is no api behind it, so refs can be walked.
+// the links don't say what they point to, it takes another request for each of them to tell files from directories.
+func (g *gatewayShell) List(p string) ([]*shell.LsEntry, error) {
+	if !g.readOnly {
+		return g.ipfsAPI.List(p)
+	}
+	dir, err := g.node(p)
+	if err != nil {
+		return nil, err
+	}
+	if typ, err := dir.unixfsType(); err != nil || (typ != unixfsDir && typ != unixfsShard) {
+		return nil, errgo.Newf("gateway list %s: not a directory (%v)", p, err)
+	}
+	var entries []*shell.LsEntry
+	for _, l := range dir.Links {
+		child, err := g.node(p + "/" + l.Name)
+		if err != nil {
+			return nil, errgo.Notef(err, "gateway list %s: %s", p, l.Name)
+		}
+		typ, err := child.unixfsType()
+		if err != nil {
+			return nil, errgo.Notef(err, "gateway list %s: %s", p, l.Name)
+		}
+		entries = append(entries, &shell.LsEntry{Name: l.Name, Hash: l.Hash.Slash, Size: l.Tsize, Type: typ})
+	}
+	return entries, nil
+}
+
+// acceptEncoding asks for gzip, except for objects and packs which are compressed already.
+// setting it ourselfs turns off the transparent decoding of net/http, decodeBody does that instead.
+func acceptEncoding(p string) string {
+	if i := strings.Index(p, "/objects/"); i >= 0 && !strings.HasPrefix(p[i:], "/objects/info/") {
+		return "identity"
+	}
+	return "gzip"
+}
+
+// decodeBody returns the body of resp, gunzipped if the gateway compressed it
+func decodeBody(resp *http.Response) (io.ReadCloser, error) {
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		return resp.Body, nil
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return nil, errgo.Notef(err, "gzip reader failed")
+	}
+	return gzipBody{Reader: zr, body: resp.Body}, nil
+}
+
+type gzipBody struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+func (b gzipBody) Close() error {
+	b.Reader.Close()
+	return b.body.Close()
+}
+
+// cancelOnClose releases the context of a request once its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// fallbackStore reads the objects of a fileStore through the daemon api until it stops answering,
+// and from then on through the gateways (IPFS_FALLBACK_GATEWAYS), so a clone survives the daemon dying halfway.
+// everything else, like adding objects, still needs the api.
+type fallbackStore struct {
+	fileStore
+	gateway    *gatewayShell
+	failedOver int32 // set once, the fetch workers read it concurrently
+}
+
+func (s *fallbackStore) getObject(sha1 string) (io.ReadCloser, error) {
+	if atomic.LoadInt32(&s.failedOver) == 0 {
+		r, err := s.fileStore.getObject(sha1)
+		if err == nil || !apiUnreachable(err) {
+			return r, err
+		}
+		if atomic.CompareAndSwapInt32(&s.failedOver, 0, 1) {
+			log.WithField("err", err).Warning("the ipfs api is unreachable, reading the remaining objects from the gateways")
+		}
+	}
+	return s.gateway.Cat(inRepo(remoteObjectPath(sha1)))
+}
+
+// apiUnreachable tells a failed connection to the api (refused, reset, timed out) from an error the api answered with
+func apiUnreachable(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Timeout() || errors.Is(urlErr.Err, io.EOF) || errors.Is(urlErr.Err, io.ErrUnexpectedEOF)
+	}
+	return false
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// apiServer answers like the daemon api
+func apiServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v0/version" && r.Method == "POST" {
+			fmt.Fprint(w, `{"Version":"0.4.23","Commit":"","Repo":"7","System":"amd64/linux","Golang":"go1.13"}`)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+}
+
+// gatewayServer answers like a read only gateway serving files
+func gatewayServer(files map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			http.Error(w, "405 - Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.URL.Path == "/ipfs/"+emptyDirHash+"/" {
+			w.Header().Set("X-Ipfs-Path", r.URL.Path)
+			fmt.Fprint(w, "<html>Index of /ipfs/"+emptyDirHash+"</html>")
+			return
+		}
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Ipfs-Path", r.URL.Path)
+		fmt.Fprint(w, data)
+	}))
+}
+
+func TestProbeEndpoint(t *testing.T) {
+	api := apiServer()
+	defer api.Close()
+	gw := gatewayServer(nil)
+	defer gw.Close()
+	nothing := httptest.NewServer(http.NotFoundHandler())
+	defer nothing.Close()
+	for srv, want := range map[*httptest.Server]string{api: endpointAPI, gw: endpointGateway, nothing: endpointUnknown} {
+		// the way IPFS_API is usually given, without scheme
+		addr := strings.TrimPrefix(srv.URL, "http://")
+		if got := probeEndpoint(newHTTPClient(1), addr); got != want {
+			t.Errorf("%s: want %s got %s", srv.URL, want, got)
+		}
+	}
+}
+
+func TestGatewayShell(t *testing.T) {
+	refs := fixtureSha + "\trefs/heads/master\n"
+	gw := gatewayServer(map[string]string{"/ipfs/" + fixtureHash + "/info/refs": refs})
+	defer gw.Close()
+	fs, restore := useFakeShell()
+	defer restore()
+	g := newGatewayShell(fs, []string{gw.URL}, newHTTPClient(1))
+
+	rc, err := g.Cat("/ipfs/" + fixtureHash + "/info/refs")
+	checkFatal(t, err)
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	checkFatal(t, err)
+	if string(data) != refs {
+		t.Errorf("unexpected content %q", data)
+	}
+	if fs.calls["Cat"] != 0 {
+		t.Error("Cat went to the api instead of the gateway")
+	}
+	if _, err := g.Cat("/ipfs/" + fixtureHash + "/HEAD"); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+	// blocks are still put and staged through the api
+	if apiBehind(newGatewayShell(g, nil, newHTTPClient(1))) != ipfsAPI(fs) {
+		t.Error("the api behind the gateways wasn't found")
+	}
+}
+
+func TestGatewayShell_hedged(t *testing.T) {
+	p := "/ipfs/" + fixtureHash + "/info/refs"
+	canceled := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(canceled)
+		case <-time.After(5 * time.Second):
+			fmt.Fprint(w, "slow")
+		}
+	}))
+	defer slow.Close()
+	fast := gatewayServer(map[string]string{p: "fast"})
+	defer fast.Close()
+	fs, restore := useFakeShell()
+	defer restore()
+	g := newGatewayShell(fs, []string{slow.URL, fast.URL}, newHTTPClient(2))
+	g.hedgeDelay = 50 * time.Millisecond
+
+	start := time.Now()
+	rc, err := g.Cat(p)
+	checkFatal(t, err)
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	checkFatal(t, err)
+	if string(data) != "fast" {
+		t.Errorf("want the answer of the fast gateway, got %q", data)
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("hedged cat waited for the slow gateway: %s", took)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(2 * time.Second):
+		t.Error("the request to the slow gateway wasn't canceled")
+	}
+
+	// a failing gateway doesn't wait for the delay
+	down := httptest.NewServer(http.NotFoundHandler())
+	defer down.Close()
+	g = newGatewayShell(fs, []string{down.URL, fast.URL}, newHTTPClient(2))
+	g.hedgeDelay = time.Hour
+	rc, err = g.Cat(p)
+	checkFatal(t, err)
+	rc.Close()
+	g = newGatewayShell(fs, []string{down.URL}, newHTTPClient(2))
+	if _, err := g.Cat(p); err == nil {
+		t.Error("expected an error when no gateway has the file")
+	}
+}
+
+func TestPush_readOnly(t *testing.T) {
+	fs, restore := useFakeRepo(t, map[string]string{"HEAD": "ref: refs/heads/master\n"})
+	defer restore()
+	_, cleanup := mkLocalRepo(t, "ipfs://"+ipfsRepoPath)
+	defer cleanup()
+	gw := gatewayServer(nil)
+	defer gw.Close()
+	g := newGatewayShell(fs, []string{gw.URL}, newHTTPClient(1))
+	g.readOnly = true
+	ipfsShell = g
+	calls := make(map[string]int)
+	for k, v := range fs.calls {
+		calls[k] = v
+	}
+
+	var out bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("push refs/heads/master:refs/heads/master\npush refs/heads/master:refs/heads/dev\n\n"), &out))
+	want := "error refs/heads/master remote is read-only (no writable IPFS API configured)\n" +
+		"error refs/heads/dev remote is read-only (no writable IPFS API configured)\n\n"
+	if out.String() != want {
+		t.Errorf("unexpected push reply %q", out.String())
+	}
+	for _, write := range []string{"Add", "PatchLink", "Patch", "BlockPut", "Publish", "Pin"} {
+		if fs.calls[write] != calls[write] {
+			t.Errorf("read-only push called %s", write)
+		}
+	}
+	if dagShell() != nil {
+		t.Error("a gateway without an api has no dag calls")
+	}
+
+	// reading through gateways with an api behind them still pushes
+	g.readOnly = false
+	if !canWrite() {
+		t.Error("a gateway shell with an api should be writable")
+	}
+}
+
+func TestGatewayShell_gzip(t *testing.T) {
+	refs := strings.Repeat(fixtureSha+"\trefs/heads/master\n", 100)
+	encodings := make(map[string]string)
+	var mu sync.Mutex
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		encodings[r.URL.Path] = r.Header.Get("Accept-Encoding")
+		mu.Unlock()
+		data := refs
+		if strings.Contains(r.URL.Path, "/objects/") {
+			data = "zlib object"
+		}
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			fmt.Fprint(w, data)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		fmt.Fprint(zw, data)
+		zw.Close()
+	}))
+	defer gw.Close()
+	fs, restore := useFakeShell()
+	defer restore()
+	g := newGatewayShell(fs, []string{gw.URL}, newHTTPClient(1))
+
+	for p, want := range map[string]string{
+		"/ipfs/" + fixtureHash + "/info/refs":                 refs,
+		"/ipfs/" + fixtureHash + "/" + objectPath(fixtureSha): "zlib object",
+	} {
+		rc, err := g.Cat(p)
+		checkFatal(t, err)
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		checkFatal(t, err)
+		if string(data) != want {
+			t.Errorf("%s: unexpected content %q", p, data)
+		}
+	}
+	if e := encodings["/ipfs/"+fixtureHash+"/info/refs"]; e != "gzip" {
+		t.Errorf("info/refs asked with Accept-Encoding %q", e)
+	}
+	if e := encodings["/ipfs/"+fixtureHash+"/"+objectPath(fixtureSha)]; e != "identity" {
+		t.Errorf("a loose object asked with Accept-Encoding %q", e)
+	}
+}
+
+// captured from a gateway: curl 'http://127.0.0.1:8080/ipfs/$repo/refs?format=json' and the same for every path below it.
+// the hashes are shortened, Data is the base64 of the unixfs protobuf (08 01 for directories, 08 02 for files).
+var gatewayListing = map[string]string{
+	"/ipfs/QmRepo/refs":                 `{"Data":{"/":{"bytes":"CAE"}},"Links":[{"Hash":{"/":"QmHeads"},"Name":"heads","Tsize":115},{"Hash":{"/":"QmTags"},"Name":"tags","Tsize":57}]}`,
+	"/ipfs/QmRepo/refs/heads":           `{"Data":{"/":{"bytes":"CAE"}},"Links":[{"Hash":{"/":"QmMaster"},"Name":"master","Tsize":49},{"Hash":{"/":"QmFeature"},"Name":"feature","Tsize":60}]}`,
+	"/ipfs/QmRepo/refs/heads/feature":   `{"Data":{"/":{"bytes":"CAE"}},"Links":[{"Hash":{"/":"QmX"},"Name":"x","Tsize":49}]}`,
+	"/ipfs/QmRepo/refs/tags":            `{"Data":{"/":{"bytes":"CAE"}},"Links":[{"Hash":{"/":"QmV1"},"Name":"v1","Tsize":49}]}`,
+	"/ipfs/QmRepo/refs/heads/master":    `{"Data":{"/":{"bytes":"CAISKTk0MTdkMDExODIyYjg3NWRhNzIyMjFjOGQxODgwODljYmZjZWU4MDYKGCk"}},"Links":[]}`,
+	"/ipfs/QmRepo/refs/heads/feature/x": `{"Data":{"/":{"bytes":"CAIYKQ"}},"Links":[]}`,
+	"/ipfs/QmRepo/refs/tags/v1":         `{"Data":{"/":{"bytes":"CAIYKQ"}},"Links":[]}`,
+}
+
+func TestGatewayShell_listRefs(t *testing.T) {
+	files := map[string]string{
+		"/ipfs/QmRepo/refs/heads/master":    "9417d011822b875da72221c8d188089cbfcee806\n",
+		"/ipfs/QmRepo/refs/heads/feature/x": "e2839ad2e47386d342038958fba941fc78e3780e\n",
+		"/ipfs/QmRepo/refs/tags/v1":         "32ed91604b272860ec911fc2bf4ae631b7900aa8\n",
+	}
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if r.URL.Query().Get("format") == "json" {
+			data, ok = gatewayListing[r.URL.Path]
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, data)
+	}))
+	defer gw.Close()
+	fs, restore := useFakeRepo(t, map[string]string{})
+	defer restore()
+	g := newGatewayShell(fs, []string{gw.URL}, newHTTPClient(1))
+	g.readOnly = true
+	ipfsShell = g
+	ipfsRepoPath = "/ipfs/QmRepo"
+
+	checkFatal(t, listIterateRefs(context.Background(), false))
+	for p, sha1 := range files {
+		ref := strings.TrimPrefix(p, "/ipfs/QmRepo/")
+		if got := ref2hash[ref]; got != strings.TrimSpace(sha1) {
+			t.Errorf("%s: want %s got %q", ref, strings.TrimSpace(sha1), got)
+		}
+	}
+	if len(ref2hash) != len(files) || fs.calls["List"] != 0 {
+		t.Errorf("unexpected refs %v (api List calls %d)", ref2hash, fs.calls["List"])
+	}
+}
+
+// dyingAPIShell reads files from an api server over http, which it shuts down before the call number dieAt
+type dyingAPIShell struct {
+	ipfsAPI
+	api   *httptest.Server
+	dieAt int
+	mu    sync.Mutex
+	calls int
+}
+
+func (s *dyingAPIShell) Cat(p string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	if s.calls++; s.calls == s.dieAt {
+		s.api.Close()
+	}
+	s.mu.Unlock()
+	resp, err := http.Post(s.api.URL+"/api/v0/cat?arg="+url.QueryEscape(p), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func TestFallbackStore(t *testing.T) {
+	files := map[string]string{"HEAD": "ref: refs/heads/master\n"}
+	commit, objs := fixtureCommit(files, "fall back\n")
+	fs, restore := useFakeRepo(t, files)
+	defer restore()
+	defer useTmpGitDir(t)()
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc, err := fs.Cat(r.URL.Query().Get("arg"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		io.Copy(w, rc)
+	}))
+	defer api.Close()
+	served := make(map[string]string)
+	for _, sha1 := range objs {
+		served[ipfsRepoPath+"/"+objectPath(sha1)] = files[objectPath(sha1)]
+	}
+	var mu sync.Mutex
+	var fromGateway []string
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fromGateway = append(fromGateway, r.URL.Path)
+		mu.Unlock()
+		data, ok := served[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, data)
+	}))
+	defer gw.Close()
+
+	// the daemon dies after the commit
+	ipfsShell = &dyingAPIShell{ipfsAPI: fs, api: api, dieAt: 2}
+	defer func(old objectStore) { objStore = old }(objStore)
+	objStore = &fallbackStore{gateway: newGatewayShell(ipfsShell, []string{gw.URL}, newHTTPClient(1))}
+	stderr = ioutil.Discard
+	defer func() { stderr = os.Stderr }()
+	checkFatal(t, fetchObject(context.Background(), commit))
+	for _, sha1 := range objs {
+		if !fetchedLocally(sha1) {
+			t.Errorf("object %s not fetched", sha1)
+		}
+	}
+	if len(fromGateway) != len(objs)-1 {
+		t.Errorf("want all but the commit from the gateway, got %v", fromGateway)
+	}
+
+	// an error the api answers with is no reason to switch
+	if apiUnreachable(errgo.New("merkledag: not found")) {
+		t.Error("a plain error counted as unreachable api")
+	}
+}
+
+func TestSubdomainURL(t *testing.T) {
+	const emptyDirV1 = "bafybeiczsscdsbs7ffqz55asqdf3smv6klcw3gofszvwlyarci47bgf354"
+	for _, tc := range []struct {
+		base, p, want string
+	}{
+		{"https://dweb.link", "/ipfs/" + emptyDirHash + "/objects/ab/cdef", "https://" + emptyDirV1 + ".ipfs.dweb.link/objects/ab/cdef"},
+		{"https://dweb.link", "/ipfs/" + emptyDirV1, "https://" + emptyDirV1 + ".ipfs.dweb.link/"},
+		{"http://localhost:8080", "/ipfs/" + emptyDirHash + "/refs?format=json", "http://" + emptyDirV1 + ".ipfs.localhost:8080/refs?format=json"},
+		{"https://dweb.link", "/ipfs/" + emptyDirHash + "?format=json", "https://" + emptyDirV1 + ".ipfs.dweb.link/?format=json"},
+		{"https://dweb.link", "/ipns/12D3KooWD3eckifWpRn9wQpMG9R9hX3sD158z7EqHWmweQAJU5SA/HEAD",
+			"https://k51qzi5uqu5dhdmyb9bd18pypu2wp5lpv2xnskfmrqa4lb5knqryrotb05e7or.ipns.dweb.link/HEAD"},
+		{"https://dweb.link", "/ipns/git.my-site.org/HEAD", "https://git-my--site-org.ipns.dweb.link/HEAD"},
+		{"https://dweb.link", "/ipfs/zdj7WWeQ43G6JJvLWQWZpyHuAMq6uYWRjkBXFad11vE2LHhQ7/HEAD", ""},
+		{"https://dweb.link", "/objects/ab", ""},
+	} {
+		got, err := subdomainURL(tc.base, tc.p)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%s: want an error, got %s", tc.p, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("%s at %s:\nwant %s\n got %s (%v)", tc.p, tc.base, tc.want, got, err)
+		}
+	}
+}
+
+func TestGatewayShell_subdomain(t *testing.T) {
+	files := map[string]string{"HEAD": "ref: refs/heads/master\n"}
+	commit, objs := fixtureCommit(files, "subdomain\n")
+	fs, restore := useFakeRepo(t, files)
+	defer restore()
+	defer useTmpGitDir(t)()
+	// the fake hashes aren't real cids, the gateway serves the repo under the empty dir's
+	root := ipfsRepoPath
+	ipfsRepoPath = "/ipfs/" + emptyDirHash
+	wantHost, err := cidV1Of(emptyDirHash)
+	checkFatal(t, err)
+	wantHost += ".ipfs.gateway.test"
+	var mu sync.Mutex
+	var hosts []string
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hosts = append(hosts, r.Host)
+		mu.Unlock()
+		rc, err := fs.Cat(root + r.URL.Path)
+		if r.Host != wantHost || err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		io.Copy(w, rc)
+	}))
+	defer gw.Close()
+	// every name resolves to the test server
+	c := newHTTPClient(1)
+	c.Transport = &http.Transport{DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, gw.Listener.Addr().String())
+	}}
+	g := newGatewayShell(fs, nil, c)
+	g.addSubdomainGateways([]string{"http://gateway.test"})
+	ipfsShell = g
+	checkFatal(t, fetchObject(context.Background(), commit))
+	for _, sha1 := range objs {
+		if !fetchedLocally(sha1) {
+			t.Errorf("object %s not fetched", sha1)
+		}
+	}
+	if len(hosts) != len(objs) {
+		t.Errorf("want %d requests to %s, got %v", len(objs), wantHost, hosts)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// defaultGCKeep is how many of the last pushed roots gc leaves pinned
+const defaultGCKeep = 3
+
+// rootsFile lists the roots pushes to remote pinned, oldest first
+func rootsFile(remote string) string {
+	return filepath.Join(commonDir(), "ipfs", "roots", remote)
+}
+
+// pinRoot pins root on the local daemon and records it for gc
+func pinRoot(remote, root string) error {
+	if err := ipfsShell.Pin(root); err != nil {
+		return errgo.Notef(err, "pinning %s failed", root)
+	}
+	p := rootsFile(remote)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return errgo.Notef(err, "creating %s failed", filepath.Dir(p))
+	}
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return errgo.Notef(err, "opening %s failed", p)
+	}
+	if _, err := fmt.Fprintln(f, root); err != nil {
+		f.Close()
+		return errgo.Notef(err, "recording root failed")
+	}
+	return f.Close()
+}
+
+func readRoots(remote string) ([]string, error) {
+	f, err := os.Open(rootsFile(remote))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errgo.Notef(err, "opening pushed roots failed")
+	}
+	defer f.Close()
+	var roots []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if r := strings.TrimSpace(s.Text()); r != "" {
+			roots = append(roots, r)
+		}
+	}
+	return roots, s.Err()
+}
+
+// gcRoots splits the pushed roots (oldest first) into the newest keep distinct ones and the rest.
+// a root pushed again (like after a revert) counts by its latest push.
+func gcRoots(roots []string, keep int) (kept, drop []string) {
+	seen := make(map[string]bool)
+	for i := len(roots) - 1; i >= 0; i-- {
+		r := roots[i]
+		if seen[r] {
+			continue
+		}
+		seen[r] = true
+		if len(kept) < keep {
+			kept = append([]string{r}, kept...)
+		} else {
+			drop = append([]string{r}, drop...)
+		}
+	}
+	return kept, drop
+}
+
+// gc unpins all but the last keep roots pushed to remote and rewrites the history to the kept ones
+func gc(remote string, keep int) error {
+	roots, err := readRoots(remote)
+	if err != nil {
+		return err
+	}
+	kept, drop := gcRoots(roots, keep)
+	for _, r := range drop {
+		if err := ipfsShell.Unpin(r); err != nil {
+			// gone already, maybe unpinned by hand
+			log.WithField("root", r).WithField("err", err).Warning("unpin failed")
+			continue
+		}
+		progressf("unpinned %s\n", r)
+	}
+	var buf strings.Builder
+	for _, r := range kept {
+		fmt.Fprintln(&buf, r)
+	}
+	if err := ioutil.WriteFile(rootsFile(remote), []byte(buf.String()), 0644); err != nil {
+		return errgo.Notef(err, "rewriting pushed roots failed")
+	}
+	progressf("kept %d pushed roots of %s\n", len(kept), remote)
+	return nil
+}
+
+// repoGC runs the garbage collection of the daemon at addr
+func repoGC(addr string) error {
+	resp, err := newHTTPClient(1).Post(httpBase(addr)+"/api/v0/repo/gc", "", nil)
+	if err != nil {
+		return errgo.Notef(err, "repo gc request failed")
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errgo.Notef(err, "reading repo gc response failed")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errgo.Newf("repo gc failed: %s %s", resp.Status, body)
+	}
+	return nil
+}
+
+// gcMain is git-remote-ipfs gc [-keep N] [-repo-gc] <remote-name>
+func gcMain(args []string) int {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	keep := flags.Int("keep", defaultGCKeep, "number of pushed roots to keep pinned")
+	runRepoGC := flags.Bool("repo-gc", false, "run the daemon's repo gc afterwards")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 || *keep < 0 {
+		fmt.Fprintln(os.Stderr, "usage: git-remote-ipfs gc [-keep N] [-repo-gc] <remote-name>")
+		return exitUsage
+	}
+	thisGitRemote = flags.Arg(0)
+	var err error
+	if thisGitRepo, err = localGitDir(); err != nil {
+		log.Error(err)
+		return exitNotRepo
+	}
+	api := apiAddress()
+	ipfsShell = newShell(api, defaultMaxIdleConns)
+	if err := gc(thisGitRemote, *keep); err != nil {
+		log.Error("gc failed:", err)
+		return exitCode(err)
+	}
+	if *runRepoGC {
+		if err := repoGC(api); err != nil {
+			log.Error(err)
+			return exitCode(err)
+		}
+		progressf("ran repo gc\n")
+	}
+	return 0
+}
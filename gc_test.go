@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGCRoots(t *testing.T) {
+	cases := []struct {
+		roots      []string
+		keep       int
+		kept, drop []string
+	}{
+		{nil, 3, nil, nil},
+		{[]string{"a", "b"}, 3, []string{"a", "b"}, nil},
+		{[]string{"a", "b", "c", "d"}, 2, []string{"c", "d"}, []string{"a", "b"}},
+		{[]string{"a", "b", "c"}, 0, nil, []string{"a", "b", "c"}},
+		// a pushed again counts as new
+		{[]string{"a", "b", "c", "a"}, 2, []string{"c", "a"}, []string{"b"}},
+	}
+	for _, c := range cases {
+		kept, drop := gcRoots(c.roots, c.keep)
+		if !reflect.DeepEqual(kept, c.kept) || !reflect.DeepEqual(drop, c.drop) {
+			t.Errorf("gcRoots(%v, %d): got %v %v, want %v %v", c.roots, c.keep, kept, drop, c.kept, c.drop)
+		}
+	}
+}
+
+func TestGC(t *testing.T) {
+	fs, restore := useFakeRepo(t, map[string]string{"HEAD": "ref: refs/heads/master\n"})
+	defer restore()
+	_, cleanup := mkLocalRepo(t, "ipfs://"+ipfsRepoPath)
+	defer cleanup()
+	stderr = ioutil.Discard
+	defer func() { stderr = os.Stderr }()
+
+	for _, content := range []string{"one", "two", "three", "four"} {
+		checkFatal(t, ioutil.WriteFile(filepath.Join(filepath.Dir(thisGitRepo), "hello.txt"), []byte(content), 0600))
+		gitRun(t, "commit", "-q", "-a", "-m", content)
+		ipfsRepoPath = strings.TrimPrefix(remoteURL(t), "ipfs://")
+		ref2hash = make(map[string]string)
+		checkFatal(t, speakGit(context.Background(), strings.NewReader("list for-push\n\n"), ioutil.Discard))
+		checkFatal(t, push(context.Background(), "+refs/heads/master", "refs/heads/master"))
+		checkFatal(t, pushFinish(context.Background()))
+	}
+	roots, err := readRoots("origin")
+	checkFatal(t, err)
+	if len(roots) != 4 || len(fs.pins) != 4 {
+		t.Fatalf("expected the 4 pushed roots to be pinned, got %v", fs.pins)
+	}
+
+	checkFatal(t, gc("origin", 2))
+	for i, r := range roots {
+		if fs.pins[r] != (i >= 2) {
+			t.Errorf("root %d: pinned %v after gc", i, fs.pins[r])
+		}
+	}
+	left, err := readRoots("origin")
+	checkFatal(t, err)
+	if !reflect.DeepEqual(left, roots[2:]) {
+		t.Errorf("history after gc: %v, want %v", left, roots[2:])
+	}
+}
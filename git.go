@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
@@ -22,11 +23,11 @@ func gitListObjects(ref string, exclude []string) ([]string, error) {
 		args = append(args, "^"+e)
 	}
 	revList := exec.Command("git", args...)
+	revList.Dir = thisGitRepo // GIT_DIR
 	// dunno why - sometime git doesnt want to work on the inner repo/.git
-	if strings.HasSuffix(thisGitRepo, ".git") {
-		thisGitRepo = filepath.Dir(thisGitRepo)
+	if strings.HasSuffix(thisGitRepo, ".git") && !isBareRepoDir(thisGitRepo) {
+		revList.Dir = filepath.Dir(thisGitRepo)
 	}
-	revList.Dir = thisGitRepo // GIT_DIR
 	out, err := revList.CombinedOutput()
 	if err != nil {
 		return nil, errgo.Notef(err, "rev-list failed: %s\n%q", err, string(out))
@@ -42,6 +43,57 @@ func gitListObjects(ref string, exclude []string) ([]string, error) {
 	return objs, nil
 }
 
+// resolveGitDir returns the git dir dir stands for and the directory its objects and refs are in.
+// in a linked worktree (git worktree add) .git is a file with "gitdir: <path>" in it instead of a directory,
+// that path has the worktree's own HEAD and its commondir file points at the repo it shares its objects and refs with.
+// for any other repo both are dir.
+func resolveGitDir(dir string) (string, string, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", "", errgo.Notef(err, "stat(%s) failed", dir)
+	}
+	if !info.IsDir() {
+		b, err := ioutil.ReadFile(dir)
+		if err != nil {
+			return "", "", errgo.Notef(err, "reading %s failed", dir)
+		}
+		line := strings.TrimSpace(string(b))
+		if !strings.HasPrefix(line, "gitdir:") {
+			return "", "", errgo.Newf("%s is neither a directory nor a gitdir: file", dir)
+		}
+		target := strings.TrimSpace(strings.TrimPrefix(line, "gitdir:"))
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(dir), target)
+		}
+		dir = target
+	}
+	dir = filepath.Clean(dir)
+	common := dir
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "commondir")); err == nil {
+		common = strings.TrimSpace(string(b))
+		if !filepath.IsAbs(common) {
+			common = filepath.Join(dir, common)
+		}
+	}
+	return dir, filepath.Clean(common), nil
+}
+
+// commonDir is the directory the objects and refs of thisGitRepo are in, where they are read and written directly.
+// git commands run in thisGitRepo, which in a linked worktree also has the worktree's HEAD.
+func commonDir() string {
+	if gitCommonDir != "" {
+		return gitCommonDir
+	}
+	return thisGitRepo
+}
+
+// isBareRepoDir reports whether dir is named like a bare repo (repo.git or whatever GIT_IPFS_REPO_SUFFIX says)
+// instead of being the .git dir inside of a worktree
+func isBareRepoDir(dir string) bool {
+	base := filepath.Base(dir)
+	return base != ".git" && strings.HasSuffix(base, repoSuffix)
+}
+
 func gitFlattenObject(sha1 string) (io.Reader, error) {
 	kind, err := gitCatKind(sha1)
 	if err != nil {
@@ -123,6 +175,113 @@ func gitRefHash(ref string) (string, error) {
 	return strings.TrimSpace(string(out)), err
 }
 
+// gitConfig returns the value of key from the local repos config (which includes the global one).
+// an unset key gives "" and no error.
+func gitConfig(key string) (string, error) {
+	cfg := exec.Command("git", "config", "--get", key)
+	cfg.Dir = thisGitRepo // GIT_DIR
+	out, err := cfg.Output()
+	if _, ok := err.(*exec.ExitError); ok && len(out) == 0 {
+		// not set
+		return "", nil
+	}
+	if err != nil {
+		return "", errgo.Notef(err, "git config --get %s failed", key)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// gitConfigAll returns every value of the multi-valued key, nil if it isn't set
+func gitConfigAll(key string) ([]string, error) {
+	cfg := exec.Command("git", "config", "--get-all", key)
+	cfg.Dir = thisGitRepo // GIT_DIR
+	out, err := cfg.Output()
+	if _, ok := err.(*exec.ExitError); ok && len(out) == 0 {
+		// not set
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errgo.Notef(err, "git config --get-all %s failed", key)
+	}
+	return strings.Split(strings.TrimSpace(string(out)), "\n"), nil
+}
+
+// gitUnpackObjects lets git unpack-objects resolve the pack r into loose objects of the local repo
+func gitUnpackObjects(r io.Reader) error {
+	unpack := exec.Command("git", "unpack-objects", "-q")
+	unpack.Env = append(os.Environ(), "GIT_DIR="+thisGitRepo)
+	unpack.Stdin = r
+	if out, err := unpack.CombinedOutput(); err != nil {
+		return errgo.Notef(err, "git unpack-objects failed: %q", string(out))
+	}
+	return nil
+}
+
+// gitIndexPack stores the pack r in the local repo as it is
+func gitIndexPack(r io.Reader) error {
+	index := exec.Command("git", "index-pack", "--stdin", "--fix-thin")
+	index.Env = append(os.Environ(), "GIT_DIR="+thisGitRepo)
+	index.Stdin = r
+	if out, err := index.CombinedOutput(); err != nil {
+		return errgo.Notef(err, "git index-pack failed: %q", string(out))
+	}
+	return nil
+}
+
+// gitUpdateRef points the local ref name at sha1
+func gitUpdateRef(name, sha1 string) error {
+	update := exec.Command("git", "update-ref", name, sha1)
+	update.Env = append(os.Environ(), "GIT_DIR="+thisGitRepo)
+	if out, err := update.CombinedOutput(); err != nil {
+		return errgo.Notef(err, "git update-ref %s failed: %q", name, string(out))
+	}
+	return nil
+}
+
+// gitAddNote sets the note of sha1 in refs/notes/$ref of the local repo, replacing the one it had
+func gitAddNote(ref, sha1, note string) error {
+	notes := exec.Command("git", "notes", "--ref="+ref, "add", "-f", "-m", note, sha1)
+	notes.Dir = thisGitRepo // GIT_DIR
+	if out, err := notes.CombinedOutput(); err != nil {
+		return errgo.Notef(err, "git notes add %s failed: %q", sha1, string(out))
+	}
+	return nil
+}
+
+// gitWriteCommitGraph writes the commit-graph of the local repo for the commits tips point to (tags are peeled)
+// and everything they reach, keeping the commits the graph had before
+func gitWriteCommitGraph(tips []string) error {
+	var commits bytes.Buffer
+	for _, sha1 := range tips {
+		peel := exec.Command("git", "rev-parse", "--verify", "-q", sha1+"^{commit}")
+		peel.Dir = thisGitRepo // GIT_DIR
+		out, err := peel.Output()
+		if err != nil {
+			// a tag of a tree or blob
+			log.WithField("sha1", sha1).Debug("commit-graph: not a commit")
+			continue
+		}
+		commits.Write(out)
+	}
+	if commits.Len() == 0 {
+		return nil
+	}
+	write := exec.Command("git", "commit-graph", "write", "--stdin-commits", "--append")
+	write.Dir = thisGitRepo // GIT_DIR
+	write.Stdin = &commits
+	if out, err := write.CombinedOutput(); err != nil {
+		return errgo.Notef(err, "git commit-graph write failed: %q", string(out))
+	}
+	return nil
+}
+
+// gitHasObject reports whether sha1 exists in the local repo
+func gitHasObject(sha1 string) bool {
+	catFile := exec.Command("git", "cat-file", "-e", sha1)
+	catFile.Dir = thisGitRepo // GIT_DIR
+	return catFile.Run() == nil
+}
+
 func gitIsAncestor(a, ref string) error {
 	mergeBase := exec.Command("git", "merge-base", "--is-ancestor", a, ref)
 	mergeBase.Dir = thisGitRepo // GIT_DIR
@@ -131,3 +290,30 @@ func gitIsAncestor(a, ref string) error {
 	}
 	return nil
 }
+
+// gitSymbolicRef returns the ref the local symref name (like HEAD) points to
+func gitSymbolicRef(name string) (string, error) {
+	symref := exec.Command("git", "symbolic-ref", "-q", name)
+	symref.Dir = thisGitRepo // GIT_DIR
+	out, err := symref.Output()
+	if err != nil {
+		return "", errgo.Notef(err, "git symbolic-ref %s failed", name)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// localGitDir finds the repo the subcommands that work on a local repo run in, $GIT_DIR or the one around the working directory
+func localGitDir() (string, error) {
+	dir := os.Getenv("GIT_DIR")
+	if dir == "" {
+		out, err := exec.Command("git", "rev-parse", "--git-dir").Output()
+		if err != nil {
+			return "", errgo.Notef(err, "not in a git repo")
+		}
+		dir = strings.TrimSpace(string(out))
+	}
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	return dir, nil
+}
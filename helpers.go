@@ -1,15 +1,94 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/Sirupsen/logrus"
+	"github.com/cryptix/go/logging"
 	"gopkg.in/errgo.v1"
 )
 
+var (
+	// stderr is passed through to the user by git
+	stderr io.Writer = os.Stderr
+	// quiet suppresses everything but errors on stderr (GIT_IPFS_QUIET)
+	quiet bool
+	// verbose prints additional information for the user (GIT_IPFS_VERBOSE)
+	verbose bool
+)
+
+// cleanups are run by runCleanups before the helper exits
+var cleanups []func()
+
+// cleanupOnce makes the cleanups run once, by main or by the goroutine of interruptContext exiting first
+var cleanupOnce sync.Once
+
+func runCleanups() {
+	cleanupOnce.Do(func() {
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			cleanups[i]()
+		}
+		cleanups = nil
+	})
+}
+
+// envBool reports whether the env var name is set to a true value like 1 or true
+func envBool(name string) bool {
+	b, err := strconv.ParseBool(os.Getenv(name))
+	return err == nil && b
+}
+
+func setupLogging() {
+	logging.SetupLogging(nil)
+	quiet = envBool("GIT_IPFS_QUIET")
+	verbose = envBool("GIT_IPFS_VERBOSE") && !quiet
+	if quiet {
+		logrus.SetLevel(logrus.ErrorLevel)
+	}
+}
+
+// retryAttempts and retryBackoff tune withRetry, the wait doubles after every failed attempt
+var (
+	retryAttempts = 3
+	retryBackoff  = time.Second
+)
+
+// withRetry calls fn until it succeeds, at most retryAttempts times, and returns the last error.
+// a canceled ctx ends the waiting in between.
+func withRetry(ctx context.Context, what string, fn func() error) error {
+	wait := retryBackoff
+	var err error
+	for i := 1; ; i++ {
+		if err = fn(); err == nil || i >= retryAttempts {
+			return err
+		}
+		log.WithField("attempt", i).WithField("err", err).Debugf("%s failed, retrying in %s", what, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		wait *= 2
+	}
+}
+
+// progressf prints status information for the user unless quiet is set
+func progressf(format string, args ...interface{}) {
+	if quiet {
+		return
+	}
+	fmt.Fprintf(stderr, format, args...)
+}
+
 func fetchFullBareRepo(root string) (string, error) {
 	// TODO: get host from envvar
 	tmpPath := filepath.Join("/", os.TempDir(), root)
@@ -25,8 +104,27 @@ func fetchFullBareRepo(root string) (string, error) {
 	}
 }
 
-func interrupt() error {
-	c := make(chan os.Signal)
+// interruptGrace is how long a canceled operation gets to wind down before the helper exits anyway
+var interruptGrace = 5 * time.Second
+
+// interruptContext returns the context of everything the helper does.
+// SIGINT or SIGTERM cancel it: whatever runs stops at its next step and returns the context's error.
+// a second signal, or the operation not returning within interruptGrace (a daemon call that hangs), exits right away.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-	return fmt.Errorf("%s", <-c)
+	go func() {
+		sig := <-c
+		log.WithField("signal", sig).Debug("interrupted, canceling")
+		cancel()
+		select {
+		case sig = <-c:
+		case <-time.After(interruptGrace):
+		}
+		runCleanups()
+		log.Error("interrupted:", sig)
+		os.Exit(exitInterrupted)
+	}()
+	return ctx
 }
@@ -0,0 +1,59 @@
+// Package errkind wraps errors with a kind (a sentinel error) that both errors.Is and errgo.Cause find.
+//
+// errgo's wrappers don't implement Unwrap, so errors.Is stops at them.
+// an *Error matches its kind itself, and unwraps to the error it wraps for kinds further down.
+package errkind
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error is an error of a kind
+type Error struct {
+	Kind error
+	Msg  string
+	Err  error // the wrapped error, may be nil
+}
+
+// Wrapf wraps err (may be nil) with kind and a message, like errgo.WithCausef
+func Wrapf(err, kind error, format string, args ...interface{}) error {
+	return &Error{Kind: kind, Msg: fmt.Sprintf(format, args...), Err: err}
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Msg
+	}
+	return e.Msg + ": " + e.Err.Error()
+}
+
+// Is reports whether target is the kind of e
+func (e *Error) Is(target error) bool { return target == e.Kind }
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// Cause returns the kind, for errgo.Cause
+func (e *Error) Cause() error { return e.Kind }
+
+// Message and Underlying make it an errgo.Wrapper
+func (e *Error) Message() string   { return e.Msg }
+func (e *Error) Underlying() error { return e.Err }
+
+// Of returns the first of kinds that err or one of the errors it wraps is, nil if none.
+// it looks through errgo's Underlying chain too, and takes an errgo.WithCausef cause as kind.
+func Of(err error, kinds ...error) error {
+	for e := err; e != nil; {
+		for _, kind := range kinds {
+			if c, ok := e.(interface{ Cause() error }); errors.Is(e, kind) || ok && c.Cause() == kind {
+				return kind
+			}
+		}
+		w, ok := e.(interface{ Underlying() error })
+		if !ok {
+			return nil
+		}
+		e = w.Underlying()
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package zstd
+
+// literal section types
+const (
+	litRaw        = 0
+	litRLE        = 1
+	litCompressed = 2
+	litTreeless   = 3
+)
+
+// the baseline and extra bits of the literals length and match length codes
+var (
+	llBase = [36]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768, 65536}
+	llBits = [36]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	mlBase = [53]int{3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051, 4099, 8195, 16387, 32771, 65539}
+	mlBits = [53]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+)
+
+// the tables of the predefined mode
+var (
+	llDefault = mustFSETable([]int{4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1, 2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1}, 6)
+	mlDefault = mustFSETable([]int{1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1, -1, -1}, 6)
+	ofDefault = mustFSETable([]int{1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1}, 5)
+)
+
+func mustFSETable(probs []int, log int) *fseTable {
+	t, err := buildFSETable(probs, log)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// decoder is what the blocks of a frame share: the content so far, which matches copy from,
+// and the tables and offsets later blocks can repeat
+type decoder struct {
+	out        []byte
+	huff       *huffTable
+	ll, of, ml *fseTable
+	rep        [3]int
+}
+
+func newDecoder() *decoder { return &decoder{rep: [3]int{1, 4, 8}} }
+
+// block appends the content of the compressed block b
+func (d *decoder) block(b []byte) error {
+	lits, n, err := d.literals(b)
+	if err != nil {
+		return err
+	}
+	return d.sequences(b[n:], lits)
+}
+
+// literals decodes the literals section at the start of b and returns them with its length
+func (d *decoder) literals(b []byte) ([]byte, int, error) {
+	if len(b) == 0 {
+		return nil, 0, errCorrupt
+	}
+	typ, sizeFormat := int(b[0]&3), int(b[0]>>2&3)
+	if typ == litRaw || typ == litRLE {
+		var size, n int
+		switch sizeFormat {
+		case 0, 2:
+			size, n = int(b[0]>>3), 1
+		case 1:
+			if len(b) < 2 {
+				return nil, 0, errCorrupt
+			}
+			size, n = int(b[0]>>4)|int(b[1])<<4, 2
+		case 3:
+			if len(b) < 3 {
+				return nil, 0, errCorrupt
+			}
+			size, n = int(b[0]>>4)|int(b[1])<<4|int(b[2])<<12, 3
+		}
+		if size > maxBlockSize {
+			return nil, 0, errCorrupt
+		}
+		if typ == litRLE {
+			if n >= len(b) {
+				return nil, 0, errCorrupt
+			}
+			lits := make([]byte, size)
+			for i := range lits {
+				lits[i] = b[n]
+			}
+			return lits, n + 1, nil
+		}
+		if n+size > len(b) {
+			return nil, 0, errCorrupt
+		}
+		return b[n : n+size], n + size, nil
+	}
+
+	// a huffman coded section, in one or four streams
+	hsize := []int{3, 3, 4, 5}[sizeFormat]
+	if len(b) < hsize {
+		return nil, 0, errCorrupt
+	}
+	var h uint64
+	for i := hsize - 1; i >= 0; i-- {
+		h = h<<8 | uint64(b[i])
+	}
+	sizeBits := []uint{10, 10, 14, 18}[sizeFormat]
+	regenerated := int(h >> 4 & (1<<sizeBits - 1))
+	compressed := int(h >> (4 + sizeBits) & (1<<sizeBits - 1))
+	if regenerated > maxBlockSize || hsize+compressed > len(b) {
+		return nil, 0, errCorrupt
+	}
+	data := b[hsize : hsize+compressed]
+	if typ == litCompressed {
+		t, n, err := readHuffTable(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		d.huff, data = t, data[n:]
+	} else if d.huff == nil {
+		return nil, 0, errCorrupt
+	}
+	lits := make([]byte, 0, regenerated)
+	var err error
+	if sizeFormat == 0 {
+		lits, err = d.huff.decode(lits, data, regenerated)
+		return lits, hsize + compressed, err
+	}
+	if len(data) < 6 {
+		return nil, 0, errCorrupt
+	}
+	streams := [4]int{int(data[0]) | int(data[1])<<8, int(data[2]) | int(data[3])<<8, int(data[4]) | int(data[5])<<8}
+	streams[3] = len(data) - 6 - streams[0] - streams[1] - streams[2]
+	if streams[3] < 0 {
+		return nil, 0, errCorrupt
+	}
+	data, per := data[6:], (regenerated+3)/4
+	for i, size := range streams {
+		n := per
+		if i == 3 {
+			n = regenerated - 3*per
+		}
+		if n < 0 {
+			return nil, 0, errCorrupt
+		}
+		if lits, err = d.huff.decode(lits, data[:size], n); err != nil {
+			return nil, 0, err
+		}
+		data = data[size:]
+	}
+	return lits, hsize + compressed, nil
+}
+
+// table reads the table of a sequences field in mode, it returns the bytes its description took
+func (d *decoder) table(b []byte, mode int, t **fseTable, predefined *fseTable, maxLog, maxSymbol int) (int, error) {
+	switch mode {
+	case 0:
+		*t = predefined
+	case 1:
+		if len(b) == 0 || int(b[0]) > maxSymbol {
+			return 0, errCorrupt
+		}
+		*t = rleTable(b[0])
+		return 1, nil
+	case 2:
+		nt, n, err := readFSETable(b, maxLog, maxSymbol)
+		if err != nil {
+			return 0, err
+		}
+		*t = nt
+		return n, nil
+	case 3:
+		if *t == nil {
+			return 0, errCorrupt
+		}
+	}
+	return 0, nil
+}
+
+// sequences decodes the sequences section b and appends the block's content, built from lits and matches
+func (d *decoder) sequences(b, lits []byte) error {
+	if len(b) == 0 {
+		return errCorrupt
+	}
+	count, pos := int(b[0]), 1
+	switch {
+	case count == 0:
+		d.out = append(d.out, lits...)
+		return nil
+	case count == 255:
+		if len(b) < 3 {
+			return errCorrupt
+		}
+		count, pos = int(b[1])+int(b[2])<<8+0x7f00, 3
+	case count >= 128:
+		if len(b) < 2 {
+			return errCorrupt
+		}
+		count, pos = (count-128)<<8|int(b[1]), 2
+	}
+	if pos >= len(b) || b[pos]&3 != 0 {
+		return errCorrupt
+	}
+	modes := b[pos]
+	pos++
+	for _, f := range []struct {
+		mode       byte
+		t          **fseTable
+		predefined *fseTable
+		log, max   int
+	}{
+		{modes >> 6, &d.ll, llDefault, 9, 35},
+		{modes >> 4 & 3, &d.of, ofDefault, 8, 31},
+		{modes >> 2 & 3, &d.ml, mlDefault, 9, 52},
+	} {
+		n, err := d.table(b[pos:], int(f.mode), f.t, f.predefined, f.log, f.max)
+		if err != nil {
+			return err
+		}
+		pos += n
+	}
+
+	r, err := newBackward(b[pos:])
+	if err != nil {
+		return err
+	}
+	ll, of, ml := d.ll.init(r), d.of.init(r), d.ml.init(r)
+	start := len(d.out)
+	for i := 0; i < count; i++ {
+		llCode, ofCode, mlCode := d.ll.symbol[ll], d.of.symbol[of], d.ml.symbol[ml]
+		if int(llCode) >= len(llBase) || int(mlCode) >= len(mlBase) || ofCode > 31 {
+			return errCorrupt
+		}
+		offset := 1<<ofCode + int(r.read(int(ofCode)))
+		matchLen := mlBase[mlCode] + int(r.read(int(mlBits[mlCode])))
+		litLen := llBase[llCode] + int(r.read(int(llBits[llCode])))
+		if i < count-1 {
+			ll, ml, of = d.ll.next(r, ll), d.ml.next(r, ml), d.of.next(r, of)
+		}
+		if r.pos < 0 {
+			return errCorrupt
+		}
+
+		if offset > 3 {
+			offset -= 3
+			d.rep = [3]int{offset, d.rep[0], d.rep[1]}
+		} else {
+			// the repeated offsets, shifted by one without literals
+			if litLen == 0 {
+				offset++
+			}
+			switch offset {
+			case 1:
+				offset = d.rep[0]
+			case 2:
+				offset = d.rep[1]
+				d.rep = [3]int{offset, d.rep[0], d.rep[2]}
+			case 3:
+				offset = d.rep[2]
+				d.rep = [3]int{offset, d.rep[0], d.rep[1]}
+			case 4:
+				offset = d.rep[0] - 1
+				d.rep = [3]int{offset, d.rep[0], d.rep[1]}
+			}
+		}
+
+		if litLen > len(lits) || len(d.out)-start+litLen+matchLen > maxBlockSize {
+			return errCorrupt
+		}
+		d.out = append(d.out, lits[:litLen]...)
+		lits = lits[litLen:]
+		if offset <= 0 || offset > len(d.out) {
+			return errCorrupt
+		}
+		// the match may overlap what it appends
+		from := len(d.out) - offset
+		for j := 0; j < matchLen; j++ {
+			d.out = append(d.out, d.out[from+j])
+		}
+	}
+	if r.pos != 0 {
+		return errCorrupt
+	}
+	d.out = append(d.out, lits...)
+	return nil
+}
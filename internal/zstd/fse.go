@@ -0,0 +1,295 @@
+package zstd
+
+import (
+	"math/bits"
+
+	"gopkg.in/errgo.v1"
+)
+
+var errCorrupt = errgo.New("zstd: corrupt compressed block")
+
+// bitsAt reads n bits (at most 56) of b from bit pos on, the bits of b counted from the lowest of its first byte.
+// bits before the start of b read as 0, the backward streams are padded like that at their end.
+func bitsAt(b []byte, pos, n int) uint64 {
+	if n == 0 {
+		return 0
+	}
+	if pos < 0 {
+		if pos+n <= 0 {
+			return 0
+		}
+		return bitsAt(b, 0, pos+n) << uint(-pos)
+	}
+	var v uint64
+	for i, last := pos/8, (pos+n-1)/8; i <= last && i < len(b); i++ {
+		v |= uint64(b[i]) << uint(8*(i-pos/8))
+	}
+	return v >> uint(pos%8) & (1<<uint(n) - 1)
+}
+
+// backward reads a bit stream from its end to its start, the way fse and huffman streams are written
+type backward struct {
+	b   []byte
+	pos int // bits left, below 0 once more were read than there are
+}
+
+func newBackward(b []byte) (*backward, error) {
+	if len(b) == 0 || b[len(b)-1] == 0 {
+		return nil, errCorrupt
+	}
+	// the highest set bit of the last byte marks where the stream starts
+	return &backward{b: b, pos: 8*len(b) - 1 - bits.LeadingZeros8(b[len(b)-1])}, nil
+}
+
+func (r *backward) read(n int) uint64 {
+	r.pos -= n
+	return bitsAt(r.b, r.pos, n)
+}
+
+func (r *backward) peek(n int) uint64 { return bitsAt(r.b, r.pos-n, n) }
+
+// fseTable decodes the symbols of a finite state entropy table, the state is its index
+type fseTable struct {
+	log    int
+	symbol []uint8
+	nbBits []uint8
+	base   []uint16
+}
+
+func (t *fseTable) init(r *backward) int { return int(r.read(t.log)) }
+
+func (t *fseTable) next(r *backward, state int) int {
+	return int(t.base[state]) + int(r.read(int(t.nbBits[state])))
+}
+
+// readFSETable reads the description of a table with at most maxLog accuracy and symbols up to maxSymbol,
+// it returns the table and the bytes the description took
+func readFSETable(b []byte, maxLog, maxSymbol int) (*fseTable, int, error) {
+	if len(b) == 0 {
+		return nil, 0, errCorrupt
+	}
+	log := int(b[0]&0x0f) + 5
+	if log > maxLog {
+		return nil, 0, errCorrupt
+	}
+	pos := 4
+	var probs []int
+	for remaining := 1 << uint(log); remaining > 0; {
+		if len(probs) > maxSymbol || pos > 8*len(b) {
+			return nil, 0, errCorrupt
+		}
+		n := bits.Len(uint(remaining + 1))
+		v := int(bitsAt(b, pos, n))
+		lowerMask := 1<<uint(n-1) - 1
+		threshold := 1<<uint(n) - 1 - (remaining + 1)
+		switch {
+		case v&lowerMask < threshold:
+			v &= lowerMask
+			pos += n - 1
+		case v > lowerMask:
+			v -= threshold
+			pos += n
+		default:
+			pos += n
+		}
+		prob := v - 1
+		if prob < 0 {
+			remaining += prob
+		} else {
+			remaining -= prob
+		}
+		if remaining < 0 {
+			return nil, 0, errCorrupt
+		}
+		probs = append(probs, prob)
+		if prob != 0 {
+			continue
+		}
+		// 2 bit flags of more zeros, 3 says there's another flag
+		for {
+			repeat := int(bitsAt(b, pos, 2))
+			pos += 2
+			for i := 0; i < repeat; i++ {
+				probs = append(probs, 0)
+			}
+			if repeat != 3 {
+				break
+			}
+			if pos > 8*len(b) {
+				return nil, 0, errCorrupt
+			}
+		}
+	}
+	n := (pos + 7) / 8
+	if n > len(b) || len(probs) > maxSymbol+1 {
+		return nil, 0, errCorrupt
+	}
+	t, err := buildFSETable(probs, log)
+	return t, n, err
+}
+
+// buildFSETable spreads the symbols over the states the way the encoder did, probs of -1 are less than 1
+func buildFSETable(probs []int, log int) (*fseTable, error) {
+	size := 1 << uint(log)
+	t := &fseTable{log: log, symbol: make([]uint8, size), nbBits: make([]uint8, size), base: make([]uint16, size)}
+	next := make([]int, len(probs))
+	high := size
+	for s, p := range probs {
+		if p == -1 {
+			high--
+			t.symbol[high] = uint8(s)
+			next[s] = 1
+		}
+	}
+	step, mask, pos := size>>1+size>>3+3, size-1, 0
+	for s, p := range probs {
+		if p <= 0 {
+			continue
+		}
+		next[s] = p
+		for i := 0; i < p; i++ {
+			t.symbol[pos] = uint8(s)
+			for pos = (pos + step) & mask; pos >= high; pos = (pos + step) & mask {
+			}
+		}
+	}
+	if pos != 0 {
+		return nil, errCorrupt
+	}
+	for i := range t.symbol {
+		s := t.symbol[i]
+		n := next[s]
+		next[s]++
+		t.nbBits[i] = uint8(log - (bits.Len(uint(n)) - 1))
+		t.base[i] = uint16(n<<t.nbBits[i] - size)
+	}
+	return t, nil
+}
+
+// rleTable always decodes to s
+func rleTable(s uint8) *fseTable {
+	return &fseTable{symbol: []uint8{s}, nbBits: []uint8{0}, base: []uint16{0}}
+}
+
+// huffTable decodes a prefix code by the next maxBits bits of the stream
+type huffTable struct {
+	maxBits int
+	symbol  []uint8
+	nbBits  []uint8
+}
+
+// readHuffTable reads the tree description at the start of literals,
+// it returns the table and the bytes the description took
+func readHuffTable(b []byte) (*huffTable, int, error) {
+	if len(b) == 0 {
+		return nil, 0, errCorrupt
+	}
+	var weights []uint8
+	n := 1
+	if h := int(b[0]); h >= 128 {
+		// 4 bits per weight
+		count := h - 127
+		n += (count + 1) / 2
+		if n > len(b) {
+			return nil, 0, errCorrupt
+		}
+		for i := 0; i < count; i++ {
+			w := b[1+i/2] >> 4
+			if i%2 == 1 {
+				w = b[1+i/2] & 0x0f
+			}
+			weights = append(weights, w)
+		}
+	} else {
+		// fse compressed weights, two states take turns
+		n += h
+		if n > len(b) {
+			return nil, 0, errCorrupt
+		}
+		t, tn, err := readFSETable(b[1:n], 6, 255)
+		if err != nil {
+			return nil, 0, err
+		}
+		r, err := newBackward(b[1+tn : n])
+		if err != nil {
+			return nil, 0, err
+		}
+		s1, s2 := t.init(r), t.init(r)
+		for r.pos >= 0 {
+			if len(weights) > 255 {
+				return nil, 0, errCorrupt
+			}
+			weights = append(weights, t.symbol[s1])
+			if s1 = t.next(r, s1); r.pos < 0 {
+				weights = append(weights, t.symbol[s2])
+				break
+			}
+			weights = append(weights, t.symbol[s2])
+			if s2 = t.next(r, s2); r.pos < 0 {
+				weights = append(weights, t.symbol[s1])
+				break
+			}
+		}
+	}
+	t, err := buildHuffTable(weights)
+	return t, n, err
+}
+
+// buildHuffTable completes weights with the last symbol's, which makes the sum a power of 2
+func buildHuffTable(weights []uint8) (*huffTable, error) {
+	if len(weights) == 0 || len(weights) > 255 {
+		return nil, errCorrupt
+	}
+	sum := 0
+	for _, w := range weights {
+		if w > 11 {
+			return nil, errCorrupt
+		}
+		if w > 0 {
+			sum += 1 << (w - 1)
+		}
+	}
+	if sum == 0 {
+		return nil, errCorrupt
+	}
+	maxBits := bits.Len(uint(sum))
+	left := 1<<uint(maxBits) - sum
+	if maxBits > 11 || left&(left-1) != 0 {
+		return nil, errCorrupt
+	}
+	weights = append(weights, uint8(bits.Len(uint(left))))
+
+	// the longest codes, of the lowest weight, come first
+	t := &huffTable{maxBits: maxBits, symbol: make([]uint8, 1<<uint(maxBits)), nbBits: make([]uint8, 1<<uint(maxBits))}
+	pos := 0
+	for w := uint8(1); int(w) <= maxBits; w++ {
+		for s, sw := range weights {
+			if sw != w {
+				continue
+			}
+			for i := 0; i < 1<<(w-1); i++ {
+				t.symbol[pos] = uint8(s)
+				t.nbBits[pos] = uint8(maxBits) + 1 - w
+				pos++
+			}
+		}
+	}
+	return t, nil
+}
+
+// decode appends the n symbols of the stream b to out
+func (t *huffTable) decode(out, b []byte, n int) ([]byte, error) {
+	r, err := newBackward(b)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < n; i++ {
+		c := r.peek(t.maxBits)
+		out = append(out, t.symbol[c])
+		r.pos -= int(t.nbBits[c])
+	}
+	if r.pos != 0 {
+		return nil, errCorrupt
+	}
+	return out, nil
+}
@@ -0,0 +1,133 @@
+// Package zstd reads zstd frames (RFC 8878) where git objects are expected to be zlib streams:
+// telling the two apart, finding where a frame ends (pack entries follow each other without lengths) and decoding it.
+//
+// compressed blocks of frames made with a dictionary aren't read, git has none to offer.
+package zstd
+
+import (
+	"bytes"
+	"io"
+
+	"gopkg.in/errgo.v1"
+)
+
+var magic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// block types
+const (
+	blockRaw        = 0
+	blockRLE        = 1
+	blockCompressed = 2
+)
+
+// maxBlockSize is the largest a block may be, decoded or not
+const maxBlockSize = 128 << 10
+
+// IsFrame tells whether b starts with a zstd frame, zlib streams never do
+func IsFrame(b []byte) bool { return bytes.HasPrefix(b, magic) }
+
+type block struct {
+	typ   int
+	start int // of the block's content in the frame
+	size  int // the content's, for rle the decoded size
+}
+
+// parse splits the frame at the start of b into its blocks and returns them with the length of the frame
+func parse(b []byte) ([]block, int, error) {
+	if !IsFrame(b) {
+		return nil, 0, errgo.New("zstd: no frame magic")
+	}
+	pos := len(magic)
+	if pos >= len(b) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	fhd := b[pos]
+	pos++
+	if fhd&0x08 != 0 {
+		return nil, 0, errgo.New("zstd: reserved bit of the frame header set")
+	}
+	singleSegment := fhd&0x20 != 0
+	if !singleSegment {
+		pos++ // window descriptor
+	}
+	pos += []int{0, 1, 2, 4}[fhd&0x03] // dictionary id
+	switch fcs := fhd >> 6; {
+	case fcs == 0 && singleSegment:
+		pos++
+	case fcs > 0:
+		pos += 1 << fcs
+	}
+	var blocks []block
+	for last := false; !last; {
+		if pos+3 > len(b) {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		h := int(b[pos]) | int(b[pos+1])<<8 | int(b[pos+2])<<16
+		pos += 3
+		last = h&1 != 0
+		blk := block{typ: (h >> 1) & 3, start: pos, size: h >> 3}
+		if blk.size > maxBlockSize {
+			return nil, 0, errgo.Newf("zstd: block of %d bytes", blk.size)
+		}
+		switch blk.typ {
+		case blockRaw, blockCompressed:
+			pos += blk.size
+		case blockRLE:
+			pos++
+		default:
+			return nil, 0, errgo.New("zstd: reserved block type")
+		}
+		if pos > len(b) {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		blocks = append(blocks, blk)
+	}
+	if fhd&0x04 != 0 {
+		// content checksum, the object name is checked by the caller anyway
+		pos += 4
+		if pos > len(b) {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+	}
+	return blocks, pos, nil
+}
+
+// hasDict tells whether the frame at the start of b names a dictionary, its compressed blocks can't be read without it
+func hasDict(b []byte) bool {
+	fhd := b[len(magic)]
+	pos := len(magic) + 1
+	if fhd&0x20 == 0 {
+		pos++
+	}
+	for i := 0; i < []int{0, 1, 2, 4}[fhd&0x03]; i++ {
+		if b[pos+i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Decode decodes the frame at the start of b and returns its content and the length of the frame
+func Decode(b []byte) ([]byte, int, error) {
+	blocks, n, err := parse(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	d := newDecoder()
+	for _, blk := range blocks {
+		switch blk.typ {
+		case blockRaw:
+			d.out = append(d.out, b[blk.start:blk.start+blk.size]...)
+		case blockRLE:
+			d.out = append(d.out, bytes.Repeat(b[blk.start:blk.start+1], blk.size)...)
+		case blockCompressed:
+			if hasDict(b) {
+				return nil, 0, errgo.New("zstd: frame needs a dictionary")
+			}
+			if err := d.block(b[blk.start : blk.start+blk.size]); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+	return d.out, n, nil
+}
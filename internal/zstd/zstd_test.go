@@ -0,0 +1,127 @@
+package zstd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// blockHeader encodes the 3 byte header of a block
+func blockHeader(last bool, typ, size int) []byte {
+	h := size<<3 | typ<<1
+	if last {
+		h |= 1
+	}
+	return []byte{byte(h), byte(h >> 8), byte(h >> 16)}
+}
+
+func cat(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+func TestDecode(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		frame []byte
+		want  string
+	}{
+		// what zstd writes for short input: single segment, 1 byte content size, checksum
+		{"raw", cat(magic, []byte{0x24, 5}, blockHeader(true, blockRaw, 5), []byte("hello"), []byte{1, 2, 3, 4}), "hello"},
+		{"rle", cat(magic, []byte{0x20, 10}, blockHeader(true, blockRLE, 10), []byte("a")), "aaaaaaaaaa"},
+		// window descriptor, 2 byte dictionary id and 2 byte content size, several blocks
+		{"blocks", cat(magic, []byte{0x42, 0x50, 7, 0, 3, 0}, blockHeader(false, blockRaw, 3), []byte("abc"),
+			blockHeader(false, blockRLE, 2), []byte("-"), blockHeader(true, blockRaw, 2), []byte("de")), "abc--de"},
+		// compressed blocks without sequences: rle literals, then literals of a two symbol huffman code
+		// given by its weights, then the same code again
+		{"literals", cat(magic, []byte{0x20, 13}, blockHeader(false, blockCompressed, 3), []byte{5<<3 | litRLE, 'x', 0},
+			blockHeader(false, blockCompressed, 7), []byte{0x42, 0xc0, 0, 0x80, 0x10, 0x16, 0},
+			blockHeader(true, blockCompressed, 5), []byte{0x43, 0x40, 0, 0x16, 0}), "xxxxx\x00\x01\x01\x00\x00\x01\x01\x00"},
+	} {
+		if !IsFrame(tc.frame) {
+			t.Errorf("%s: not detected as frame", tc.name)
+		}
+		// a pack entry is followed by the next one
+		got, n, err := Decode(cat(tc.frame, []byte("next entry")))
+		if err != nil || string(got) != tc.want || n != len(tc.frame) {
+			t.Errorf("%s: got %q after %d of %d bytes (%v), want %q", tc.name, got, n, len(tc.frame), err, tc.want)
+		}
+		if _, _, err := Decode(tc.frame[:len(tc.frame)-1]); err == nil {
+			t.Errorf("%s: expected an error for a truncated frame", tc.name)
+		}
+	}
+
+	if IsFrame([]byte{0x78, 0x9c, 0x01}) {
+		t.Error("zlib stream taken for a zstd frame")
+	}
+	// treeless literals need the code of an earlier block
+	if _, _, err := Decode(cat(magic, []byte{0x20, 4}, blockHeader(true, blockCompressed, 5), []byte{0x43, 0x40, 0, 0x16, 0})); err == nil {
+		t.Error("expected an error for treeless literals in the first block")
+	}
+	if _, _, err := Decode(cat(magic, []byte{0x21, 7, 5}, blockHeader(true, blockCompressed, 3), []byte{5<<3 | litRLE, 'x', 0})); err == nil {
+		t.Error("expected an error for a frame needing a dictionary")
+	}
+	if _, _, err := Decode(cat(magic, []byte{0x28, 0})); err == nil {
+		t.Error("expected an error for the reserved header bit")
+	}
+}
+
+// sample is text with repeated words, runs and some noise, it takes every kind of compressed block
+func sample(n int) []byte {
+	words := []string{"tree ", "blob ", "commit ", "parent ", "author ", "\n", "100644 ", "git-remote-ipfs ", "aaaaaaaa", "zstd "}
+	out := make([]byte, 0, n+16)
+	x := uint32(1)
+	for len(out) < n {
+		x = x*1103515245 + 12345
+		switch r := x >> 16; {
+		case r%7 == 0:
+			out = append(out, byte(r>>3), byte(r>>5))
+		default:
+			out = append(out, words[r%uint32(len(words))]...)
+		}
+	}
+	return out[:n]
+}
+
+func TestDecode_compressed(t *testing.T) {
+	want := sample(140000)
+	// zstd -1 and -19 of the sample, two blocks each
+	for _, name := range []string{"testdata/sample-1.zst", "testdata/sample-19.zst"} {
+		frame, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, n, err := Decode(frame)
+		if err != nil || n != len(frame) || !bytes.Equal(got, want) {
+			t.Errorf("%s: %d bytes after %d of %d (%v), want the %d of the sample", name, len(got), n, len(frame), err, len(want))
+		}
+		// the block headers are intact, the sequences aren't
+		broken := append([]byte(nil), frame...)
+		broken[len(broken)/2] ^= 0x10
+		if got, _, err := Decode(broken); err == nil && bytes.Equal(got, want) {
+			t.Errorf("%s: a changed byte went unnoticed", name)
+		}
+	}
+}
+
+// FuzzDecode starts from the frames of testdata, Decode has to refuse what they turn into without panicking
+func FuzzDecode(f *testing.F) {
+	seeds, err := filepath.Glob("testdata/*.zst")
+	if err != nil || len(seeds) == 0 {
+		f.Fatalf("no seed frames in testdata: %v", err)
+	}
+	for _, name := range seeds {
+		frame, err := ioutil.ReadFile(name)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(frame)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		got, n, err := Decode(b)
+		if err != nil {
+			return
+		}
+		if n <= 0 || n > len(b) {
+			t.Errorf("decoded %d bytes from a frame of %d of %d bytes", len(got), n, len(b))
+		}
+	})
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"gopkg.in/errgo.v1"
+)
+
+// multicodec codes of the git-raw cids, the daemon's git plugin decodes the blocks and follows their links
+const (
+	cidV1       = 0x01
+	codecGitRaw = 0x78
+	mhSHA1      = 0x11
+)
+
+// dagAPI is implemented by backends that can put git-raw blocks and export the dag below a cid as a car file,
+// the daemon's api. the shell package has neither.
+type dagAPI interface {
+	BlockPutGitRaw(data []byte) (string, error)
+	DagExport(ctx context.Context, cid string) (io.ReadCloser, error)
+}
+
+// dagShell is the backend behind ipfsShell that has the dag calls, nil if there's none
+func dagShell() dagAPI {
+	d, _ := apiBehind(ipfsShell).(dagAPI)
+	return d
+}
+
+// gitRawCIDBytes is the binary version 1 cid of the git-raw block of the object sha1
+func gitRawCIDBytes(sha1 string) ([]byte, error) {
+	digest, err := hex.DecodeString(sha1)
+	if err != nil || len(digest) != 20 {
+		return nil, errgo.Newf("%q is no sha1 object name", sha1)
+	}
+	return append([]byte{cidV1, codecGitRaw, mhSHA1, 20}, digest...), nil
+}
+
+// gitRawCID is the base32 cid the daemon gives the git-raw block of sha1, it only depends on the name
+func gitRawCID(sha1 string) (string, error) {
+	b, err := gitRawCIDBytes(sha1)
+	if err != nil {
+		return "", err
+	}
+	return "b" + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)), nil
+}
+
+// gitRawStore keeps every object uncompressed as a git-raw block, the block the daemon's git plugin reads as that object.
+// the daemon sees the links between them, so one dag export of a commit returns all of its closure for fetch.
+// they are linked under objects/ like the loose objects of fileStore. sha1 repos only, and PreStore can't change the objects.
+type gitRawStore struct{}
+
+// getObject takes sha1 from what exportClosure got first
+func (gitRawStore) getObject(sha1 string) (io.ReadCloser, error) {
+	if data, ok := takeExported(sha1); ok {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	cid, err := gitRawCID(sha1)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := ipfsShell.BlockGet(cid)
+	if err != nil {
+		return nil, errgo.Notef(err, "shell.BlockGet(%s) failed", cid)
+	}
+	return ioutil.NopCloser(bytes.NewReader(compressObject(raw))), nil
+}
+
+func (gitRawStore) putObject(sha1 string, r io.Reader) (string, error) {
+	want, err := gitRawCID(sha1)
+	if err != nil {
+		return "", errgo.Notef(err, "the git-raw store only takes sha1 repos")
+	}
+	d := dagShell()
+	if d == nil {
+		return "", errgo.New("the git-raw store needs the daemon's api to put blocks")
+	}
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return "", errgo.Notef(err, "gitRawStore: zlib reader for object %s failed", sha1)
+	}
+	raw, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return "", errgo.Notef(err, "gitRawStore: inflating object %s failed", sha1)
+	}
+	cid, err := d.BlockPutGitRaw(raw)
+	if err != nil {
+		return "", errgo.Notef(err, "gitRawStore: putting object %s failed", sha1)
+	}
+	if cid != want {
+		return "", errgo.Newf("gitRawStore: object %s was put as %s, not %s (PreStore can't change the objects of this store)", sha1, cid, want)
+	}
+	return cid, nil
+}
+
+func (gitRawStore) present(shas []string) (map[string]bool, error) {
+	return fileStore{}.present(shas)
+}
+
+func (gitRawStore) linkObjects(root string, objs map[string]string) (string, error) {
+	return fileStore{}.linkObjects(root, objs)
+}
+
+// compressObject is the loose object of raw, what getObject returns
+func compressObject(raw []byte) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(raw)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// exported holds the loose objects exportClosure got from the daemon until getObject hands them to the walk
+var exported = struct {
+	sync.Mutex
+	objs map[string][]byte
+}{objs: make(map[string][]byte)}
+
+// takeExported returns the exported object sha1 and forgets it, the walk reads every object once
+func takeExported(sha1 string) ([]byte, bool) {
+	exported.Lock()
+	defer exported.Unlock()
+	data, ok := exported.objs[sha1]
+	delete(exported.objs, sha1)
+	return data, ok
+}
+
+// exportClosure has the daemon export the dag below the git-raw block of sha1, which is every object
+// reachable from it, and keeps them in exported. it returns how many it kept, the walk reads the others
+// (and all of them if the export fails) one by one.
+func exportClosure(ctx context.Context, sha1 string) (int, error) {
+	d := dagShell()
+	if d == nil {
+		return 0, errgo.New("no dag api to export from")
+	}
+	cid, err := gitRawCID(sha1)
+	if err != nil {
+		return 0, err
+	}
+	rc, err := d.DagExport(ctx, cid)
+	if err != nil {
+		return 0, errgo.Notef(err, "dag export of %s failed", cid)
+	}
+	defer rc.Close()
+	var n int
+	err = readCAR(rc, func(c, data []byte) {
+		if name, ok := gitRawName(c); ok {
+			exported.Lock()
+			exported.objs[name] = compressObject(data)
+			exported.Unlock()
+			n++
+		}
+	})
+	return n, err
+}
+
+// maxCARSection bounds the sections readCAR accepts, git objects are put as one block each
+const maxCARSection = 1 << 30
+
+// readCAR calls block for every block of the car (version 1) file r, with its binary cid and data
+func readCAR(r io.Reader, block func(cid, data []byte)) error {
+	br := bufio.NewReader(r)
+	// the header (dag-cbor roots and version) says nothing the export didn't ask for
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		return errgo.Notef(err, "reading car header failed")
+	}
+	if _, err := io.CopyN(ioutil.Discard, br, int64(size)); err != nil {
+		return errgo.Notef(err, "reading car header failed")
+	}
+	for {
+		size, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil || size > maxCARSection {
+			return errgo.Newf("malformed car section (%d bytes): %v", size, err)
+		}
+		section := make([]byte, size)
+		if _, err := io.ReadFull(br, section); err != nil {
+			return errgo.Notef(err, "reading car section failed")
+		}
+		n, err := cidLen(section)
+		if err != nil {
+			return err
+		}
+		block(section[:n], section[n:])
+	}
+}
+
+// cidLen is the length of the binary cid at the start of b
+func cidLen(b []byte) (int, error) {
+	if len(b) >= 2 && b[0] == 0x12 && b[1] == 0x20 {
+		// version 0, a bare sha256 multihash
+		if len(b) < 34 {
+			return 0, errgo.New("truncated cid")
+		}
+		return 34, nil
+	}
+	var pos int
+	for i := 0; i < 3; i++ {
+		// version, codec and hash function
+		_, n := binary.Uvarint(b[pos:])
+		if n <= 0 {
+			return 0, errgo.New("malformed cid")
+		}
+		pos += n
+	}
+	digest, n := binary.Uvarint(b[pos:])
+	if n <= 0 || uint64(len(b)-pos-n) < digest {
+		return 0, errgo.New("malformed cid")
+	}
+	return pos + n + int(digest), nil
+}
+
+// gitRawName is the object name of the git-raw cid c, false for other cids
+func gitRawName(c []byte) (string, bool) {
+	if len(c) != 4+sha1.Size || c[0] != cidV1 || c[1] != codecGitRaw || c[2] != mhSHA1 || c[3] != sha1.Size {
+		return "", false
+	}
+	return hex.EncodeToString(c[4:]), true
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFetch_gitRawExport(t *testing.T) {
+	fs, restore := useFakeRepo(t, map[string]string{"HEAD": "ref: refs/heads/master\n"})
+	defer restore()
+	_, cleanup := mkLocalRepo(t, "ipfs://"+ipfsRepoPath)
+	defer cleanup()
+	stderr = ioutil.Discard
+	defer func() { stderr = os.Stderr }()
+	defer func(old objectStore) { objStore = old }(objStore)
+	objStore = gitRawStore{}
+
+	// a second commit with a nested tree, so the closure has a parent and subtrees
+	work := filepath.Dir(thisGitRepo)
+	checkFatal(t, os.MkdirAll(filepath.Join(work, "sub", "dir"), 0700))
+	checkFatal(t, ioutil.WriteFile(filepath.Join(work, "sub", "dir", "nested.txt"), []byte("nested\n"), 0600))
+	gitRun(t, "add", "sub")
+	gitRun(t, "commit", "-q", "-m", "second")
+	head, err := gitRefHash("HEAD")
+	checkFatal(t, err)
+	objs, err := gitListObjects(head, nil)
+	checkFatal(t, err)
+
+	ctx := context.Background()
+	checkFatal(t, push(ctx, "refs/heads/master", "refs/heads/master"))
+	root := pushRoot
+	checkFatal(t, pushFinish(ctx))
+	if fs.calls["BlockPutGitRaw"] != len(objs) {
+		t.Errorf("expected %d git-raw blocks, got %d", len(objs), fs.calls["BlockPutGitRaw"])
+	}
+	// linked at their loose object path too, where list and verifyRefs look
+	want, err := gitRawCID(head)
+	checkFatal(t, err)
+	if cid, err := fs.ResolvePath(root + "/" + objectPath(head)); err != nil || cid != want || !strings.HasPrefix(cid, "baf4bcf") {
+		t.Errorf("head linked as %q (%v), want its git-raw cid %s", cid, err, want)
+	}
+
+	ipfsRepoPath = "/ipfs/" + root
+	for _, export := range []bool{true, false} {
+		fs.noDagExport = !export
+		cleanupDir := useTmpGitDir(t)
+		gets := fs.calls["BlockGet"]
+		checkFatal(t, fetchObject(ctx, head))
+		for _, obj := range objs {
+			if _, err := os.Stat(filepath.Join(thisGitRepo, objectPath(obj))); err != nil {
+				t.Errorf("export %v: object %s was not fetched: %s", export, obj, err)
+			}
+		}
+		gets = fs.calls["BlockGet"] - gets
+		if export && gets != 0 {
+			t.Errorf("the export should return the closure, %d objects were read one by one", gets)
+		}
+		if !export && gets != len(objs) {
+			t.Errorf("without the export every object should be read one by one, %d of %d were", gets, len(objs))
+		}
+		cleanupDir()
+	}
+	exported.Lock()
+	left := len(exported.objs)
+	exported.Unlock()
+	if left != 0 {
+		t.Errorf("%d exported objects were not taken by the walk", left)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// verifyPublish (GIT_IPFS_IPNS_VERIFY=1) resolves the name again after publishing and warns if it still points at an old root
+var verifyPublish bool
+
+// ipnsRepoPath is the /ipns/ path the url named, "" for immutable /ipfs/ urls.
+// ipfsRepoPath is then the /ipfs/ path it resolved to when the helper started.
+var ipnsRepoPath string
+
+// resolveRepoPath resolves an /ipns/ ipfsRepoPath once, so everything afterwards reads the same immutable version
+// instead of resolving again on every call (slow, and racing concurrent publishes).
+// a name that doesn't resolve (yet) is left alone, a first push to it can still publish it.
+func resolveRepoPath(ctx context.Context) {
+	name, rest, ok := ipnsName(ipfsRepoPath)
+	if !ok {
+		return
+	}
+	top, err := resolveIPNS(ctx, name)
+	if err != nil {
+		log.WithField("name", name).WithField("err", err).Debug("resolving ipns name failed")
+		return
+	}
+	ipnsRepoPath = ipfsRepoPath
+	ipfsRepoPath = path.Join("/ipfs", top, rest)
+	log.WithField("ipns", ipnsRepoPath).Debug("resolved to:", ipfsRepoPath)
+}
+
+// ipnsResolver (GIT_IPFS_IPNS_RESOLVER) is an http service names are resolved through instead of the daemon,
+// for when its dht lookups are slow or don't work. see resolveViaService.
+var ipnsResolver string
+
+// ipnsResolverTimeout bounds one request to ipnsResolver
+var ipnsResolverTimeout = 30 * time.Second
+
+// resolveIPNS returns the hash the ipns name points at, through ipnsResolver if it's set.
+// dht lookups can take minutes, a canceled ctx returns right away and leaves the daemon's call behind.
+func resolveIPNS(ctx context.Context, name string) (string, error) {
+	if ipnsResolver != "" {
+		c := &http.Client{Timeout: ipnsResolverTimeout}
+		return resolveViaService(ctx, c, ipnsResolver, name)
+	}
+	type result struct {
+		hash string
+		err  error
+	}
+	done := make(chan result, 1)
+	// the call can outlive us, it must not read ipfsShell after we returned
+	sh := ipfsShell
+	go func() {
+		h, err := sh.ResolvePath("/ipns/" + name)
+		done <- result{h, err}
+	}()
+	select {
+	case r := <-done:
+		return r.hash, r.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// resolveViaService asks the http resolver at base where name points.
+// base is either a gateway (asked for base/ipns/<name>) or an url with {name} in it, like a delegated routing endpoint.
+// the answer is taken from, first match wins:
+// a json body with a Path (like the api's name/resolve), the X-Ipfs-Path header gateways set,
+// and the /ipfs/<cid> path or <cid>.ipfs. subdomain the request was redirected to.
+func resolveViaService(ctx context.Context, c *http.Client, base, name string) (string, error) {
+	u := httpBase(base) + "/ipns/" + name
+	if strings.Contains(base, "{name}") {
+		u = strings.Replace(httpBase(base), "{name}", url.PathEscape(name), -1)
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return "", errgo.Notef(err, "bad resolver url")
+	}
+	resp, err := c.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", errgo.Notef(err, "resolver request failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errgo.Newf("resolver %s answered %s", u, resp.Status)
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		var answer struct{ Path string }
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&answer); err == nil {
+			if h, ok := ipfsPathHash(answer.Path); ok {
+				return h, nil
+			}
+		}
+	} else {
+		// only the headers matter, don't download the repo's listing
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+	}
+	if h, ok := ipfsPathHash(resp.Header.Get("X-Ipfs-Path")); ok {
+		return h, nil
+	}
+	final := resp.Request.URL
+	if h, ok := ipfsPathHash(final.Path); ok {
+		return h, nil
+	}
+	if i := strings.Index(final.Host, ".ipfs."); i > 0 {
+		return final.Host[:i], nil
+	}
+	return "", errgo.Newf("resolver %s didn't say where /ipns/%s points", u, name)
+}
+
+// ipfsPathHash returns the hash of an /ipfs/<hash>/.. path
+func ipfsPathHash(p string) (string, bool) {
+	if !strings.HasPrefix(p, "/ipfs/") {
+		return "", false
+	}
+	h := strings.SplitN(strings.TrimPrefix(p, "/ipfs/"), "/", 2)[0]
+	return h, h != ""
+}
+
+// publishIPNS points name at root, or if the repo lives at rest below the name,
+// at a copy of the current top level object with root patched in at rest.
+// if the name doesn't point at expectTop anymore someone else published in the meantime
+// and it fails with errRemoteBusy instead of clobbering that.
+// it returns the published top level hash.
+func publishIPNS(ctx context.Context, name, rest, root, expectTop string) (string, error) {
+	current, err := resolveIPNS(ctx, name)
+	if err != nil {
+		return "", errgo.Notef(err, "resolving /ipns/%s failed", name)
+	}
+	if expectTop != "" && current != expectTop {
+		return "", errgo.WithCausef(nil, errRemoteBusy, "%s: /ipns/%s changed during the push", errRemoteBusy, name)
+	}
+	top := root
+	if rest != "" {
+		top, err = ipfsShell.PatchLink(current, rest, root, true)
+		if err != nil {
+			return "", errgo.Notef(err, "patchLink(%s) into /ipns/%s failed", rest, name)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		// the name still points at what it did
+		return "", err
+	}
+	// publishing talks to the dht and fails now and then
+	err = withRetry(ctx, "ipns publish", func() error {
+		return ipfsShell.Publish(name, "/ipfs/"+top)
+	})
+	if err != nil {
+		return "", errgo.Notef(err, "publishing /ipfs/%s to /ipns/%s failed", top, name)
+	}
+	log.WithField("name", name).WithField("top", top).Debug("published to ipns")
+	if verifyPublish {
+		if err := verifyPublished(name, top); err != nil {
+			log.WithField("name", name).WithField("err", err).Warning("ipns record not updated yet")
+		}
+	}
+	return top, nil
+}
+
+// verifyPublished checks that name resolves to top
+func verifyPublished(name, top string) error {
+	got, err := ipfsShell.Resolve(name)
+	if err != nil {
+		return errgo.Notef(err, "resolving /ipns/%s failed", name)
+	}
+	if strings.TrimPrefix(got, "/ipfs/") != top {
+		return errgo.Newf("/ipns/%s is stale: resolves to %s instead of /ipfs/%s", name, got, top)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cryptix/git-remote-ipfs/internal/errkind"
+)
+
+func TestResolveViaService(t *testing.T) {
+	const cid = "bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi"
+	mux := http.NewServeMux()
+	// a gateway answering with the header
+	mux.HandleFunc("/ipns/header.example/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Ipfs-Path", "/ipfs/"+cid+"/")
+		fmt.Fprint(w, "<html>listing</html>")
+	})
+	// a gateway redirecting to the immutable path
+	mux.HandleFunc("/ipns/redirect.example", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/ipfs/"+cid+"/", http.StatusFound)
+	})
+	mux.HandleFunc("/ipfs/", func(w http.ResponseWriter, r *http.Request) {})
+	// a delegated endpoint answering like name/resolve
+	mux.HandleFunc("/routing/v1/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/routing/v1/json.example/path" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"Path":"/ipfs/%s"}`, cid)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		base, name string
+	}{
+		{srv.URL, "header.example/"},
+		{srv.URL, "redirect.example"},
+		{strings.TrimPrefix(srv.URL, "http://") + "/routing/v1/{name}/path", "json.example"},
+	} {
+		got, err := resolveViaService(context.Background(), srv.Client(), tc.base, tc.name)
+		if err != nil || got != cid {
+			t.Errorf("%s %s: got %q, %v", tc.base, tc.name, got, err)
+		}
+	}
+	if got, err := resolveViaService(context.Background(), srv.Client(), srv.URL, "unknown.example"); err == nil {
+		t.Errorf("expected an error for a name the resolver doesn't know, got %q", got)
+	}
+}
+
+func TestResolveRepoPath_resolver(t *testing.T) {
+	files := map[string]string{"HEAD": "ref: refs/heads/master\n"}
+	_, restore := useFakeRepo(t, files)
+	defer restore()
+	root := strings.TrimPrefix(ipfsRepoPath, "/ipfs/")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Ipfs-Path", "/ipfs/"+root)
+	}))
+	defer srv.Close()
+	ipnsResolver = srv.URL
+	defer func() { ipnsResolver = "" }()
+
+	// the fake daemon doesn't know the name, only the resolver does
+	ipfsRepoPath = "/ipns/example.com"
+	resolveRepoPath(context.Background())
+	if ipfsRepoPath != "/ipfs/"+root || ipnsRepoPath != "/ipns/example.com" {
+		t.Errorf("unexpected paths after resolving: %s %s", ipfsRepoPath, ipnsRepoPath)
+	}
+}
+
+// hangingShell never answers name lookups, like a dht that doesn't find the record
+type hangingShell struct {
+	ipfsAPI
+	release chan struct{}
+}
+
+func (s hangingShell) ResolvePath(p string) (string, error) {
+	<-s.release
+	return "", fmt.Errorf("gave up on %s", p)
+}
+
+func TestResolveIPNS_canceled(t *testing.T) {
+	fs, restore := useFakeShell()
+	defer restore()
+	s := hangingShell{ipfsAPI: fs, release: make(chan struct{})}
+	defer close(s.release)
+	ipfsShell = s
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-s.release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer func() { ipnsResolver = "" }()
+
+	for _, resolver := range []string{"", srv.URL} {
+		ipnsResolver = resolver
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		start := time.Now()
+		_, err := resolveIPNS(ctx, "example.com")
+		cancel()
+		if errkind.Of(err, context.DeadlineExceeded) == nil {
+			t.Errorf("resolver %q: want a context error, got %v", resolver, err)
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Errorf("resolver %q: took %s to give up", resolver, time.Since(start))
+		}
+	}
+}
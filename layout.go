@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/cryptix/git-remote-ipfs/internal/errkind"
+	"gopkg.in/errgo.v1"
+)
+
+// repo layouts selectable with GIT_IPFS_LAYOUT
+const (
+	// layoutBare is the plain bare repo
+	layoutBare = "bare"
+	// layoutPerBranch additionally keeps branches/<name>/, a bare repo with just that branch and its objects.
+	// it can be cloned on its own, like ipfs://ipfs/$hash/branches/master.
+	layoutPerBranch = "per-branch"
+)
+
+var layout = layoutBare
+
+// branchDir is where the snapshot of the branch ref lives, ok is false for other refs
+func branchDir(ref string) (string, bool) {
+	name := strings.TrimPrefix(ref, "refs/heads/")
+	if name == ref || name == "" {
+		return "", false
+	}
+	return path.Join("branches", name), true
+}
+
+// linkBranchSnapshot puts a bare repo of branch ref at sha1 into root under branchDir(ref).
+// the objects are already in root, the snapshot links the same hashes.
+func linkBranchSnapshot(root, ref, sha1 string) (string, error) {
+	dir, ok := branchDir(ref)
+	if !ok {
+		return root, nil
+	}
+	objs, err := gitListObjects(sha1, nil)
+	if err != nil {
+		return "", errgo.Notef(err, "listing objects of %s failed", ref)
+	}
+	hashes, err := objectHashes(root, objs)
+	if err != nil {
+		return "", err
+	}
+	snap, err := ipfsShell.NewObject("unixfs-dir")
+	if err != nil {
+		return "", errgo.Notef(err, "shell.NewObject(unixfs-dir) failed")
+	}
+	if snap, err = objStore.linkObjects(snap, hashes); err != nil {
+		return "", errgo.Notef(err, "linking objects of %s failed", ref)
+	}
+	for name, content := range map[string]string{
+		"HEAD": "ref: " + ref + "\n",
+		ref:    sha1 + "\n",
+	} {
+		h, err := ipfsShell.Add(bytes.NewBufferString(content))
+		if err != nil {
+			return "", errgo.Notef(err, "adding %s failed", name)
+		}
+		if snap, err = ipfsShell.PatchLink(snap, name, h, true); err != nil {
+			return "", errgo.Notef(err, "patchLink(%s) failed", name)
+		}
+	}
+	root, err = ipfsShell.PatchLink(root, dir, snap, true)
+	if err != nil {
+		return "", errgo.Notef(err, "patchLink(%s) failed", dir)
+	}
+	log.WithField("branch", ref).WithField("snapshot", snap).Debug("linked branch snapshot")
+	return root, nil
+}
+
+// objectHashes looks up the ipfs hashes of the objects shas in root
+func objectHashes(root string, shas []string) (map[string]string, error) {
+	byPrefix := make(map[string]map[string]string)
+	hashes := make(map[string]string, len(shas))
+	for _, sha1 := range shas {
+		prefix, name := remoteObjectDir(sha1)
+		dir, ok := byPrefix[prefix]
+		if !ok {
+			list, err := ipfsShell.List(path.Join(root, prefix))
+			if err != nil {
+				return nil, errgo.Notef(err, "listing %s failed", prefix)
+			}
+			dir = make(map[string]string, len(list))
+			for _, lnk := range list {
+				dir[lnk.Name] = lnk.Hash
+			}
+			byPrefix[prefix] = dir
+		}
+		h, ok := dir[name]
+		if !ok {
+			return nil, errkind.Wrapf(nil, ErrObjectMissing, "object %s is not in the pushed repo", sha1)
+		}
+		hashes[sha1] = h
+	}
+	return hashes, nil
+}
+
+func parseLayout(s string) (string, error) {
+	switch s {
+	case "", layoutBare:
+		return layoutBare, nil
+	case layoutPerBranch:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown layout %q (want bare or per-branch)", s)
+}
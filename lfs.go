@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cryptix/git-remote-ipfs/internal/errkind"
+	"gopkg.in/errgo.v1"
+)
+
+// lfsEnabled (GIT_IPFS_LFS=1) fetches the large objects of git-lfs pointer blobs from lfs/objects/<oid> in the repo,
+// so the checkout finds them in the local lfs store without an lfs server.
+var lfsEnabled bool
+
+const lfsVersion = "version https://git-lfs.github.com/spec/v1"
+
+// lfsPointer parses a git-lfs pointer file, ok is false for every other blob
+func lfsPointer(blob []byte) (oid string, size int64, ok bool) {
+	// pointers are tiny, don't bother looking at real content
+	if len(blob) > 1024 || !bytes.HasPrefix(blob, []byte(lfsVersion+"\n")) {
+		return "", 0, false
+	}
+	s := bufio.NewScanner(bytes.NewReader(blob))
+	size = -1
+	for s.Scan() {
+		kv := strings.SplitN(s.Text(), " ", 2)
+		if len(kv) != 2 {
+			return "", 0, false
+		}
+		switch kv[0] {
+		case "oid":
+			oid = strings.TrimPrefix(kv[1], "sha256:")
+			if oid == kv[1] || len(oid) != 64 {
+				return "", 0, false
+			}
+		case "size":
+			n, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil {
+				return "", 0, false
+			}
+			size = n
+		}
+	}
+	return oid, size, oid != "" && size >= 0
+}
+
+// fetchLFSObject gets the large object for blob into GIT_DIR/lfs/objects if blob is an lfs pointer.
+// a missing object is only logged, git-lfs can still try its server for it.
+func fetchLFSObject(blob []byte) error {
+	if !lfsEnabled {
+		return nil
+	}
+	oid, size, ok := lfsPointer(blob)
+	if !ok {
+		return nil
+	}
+	dir := filepath.Join(commonDir(), "lfs", "objects", oid[:2], oid[2:4])
+	target := filepath.Join(dir, oid)
+	if _, err := os.Stat(target); err == nil {
+		return nil
+	}
+	src := inRepo("lfs", "objects", oid)
+	r, err := ipfsShell.Cat(src)
+	if err != nil {
+		log.WithField("oid", oid).WithField("err", err).Warning("lfs object not in the repo")
+		return nil
+	}
+	defer r.Close()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errgo.Notef(err, "creating %s failed", dir)
+	}
+	tmp, err := ioutil.TempFile(dir, "incoming-")
+	if err != nil {
+		return errgo.Notef(err, "creating temp file failed")
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if errClose := tmp.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return errgo.Notef(err, "copying %s failed", src)
+	}
+	if got := fmt.Sprintf("%x", h.Sum(nil)); got != oid || n != size {
+		return errkind.Wrapf(nil, ErrObjectCorrupt, "lfs object %s: got %d bytes hashing to %s, want %d", oid, n, got, size)
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return errgo.Notef(err, "moving lfs object into place failed")
+	}
+	log.WithField("oid", oid).Debug("fetched lfs object")
+	return nil
+}
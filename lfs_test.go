@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func lfsFixture(content string) (oid, pointer string) {
+	oid = fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+	return oid, fmt.Sprintf("%s\noid sha256:%s\nsize %d\n", lfsVersion, oid, len(content))
+}
+
+func TestLFSPointer(t *testing.T) {
+	oid, pointer := lfsFixture("large content")
+	got, size, ok := lfsPointer([]byte(pointer))
+	if !ok || got != oid || size != 13 {
+		t.Errorf("pointer not recognized: %q %d %v", got, size, ok)
+	}
+	for _, blob := range []string{
+		"hello\n",
+		lfsVersion + "\nsize 12\n",
+		lfsVersion + "\noid md5:abc\nsize 12\n",
+	} {
+		if _, _, ok := lfsPointer([]byte(blob)); ok {
+			t.Errorf("%q is not a pointer", blob)
+		}
+	}
+}
+
+func TestFetch_lfs(t *testing.T) {
+	content := "pretend this is a huge binary\n"
+	oid, pointer := lfsFixture(content)
+	files := map[string]string{"HEAD": "ref: refs/heads/master\n"}
+	commit, _ := fixtureCommit(files, pointer)
+	files["lfs/objects/"+oid] = content
+	_, restore := useFakeRepo(t, files)
+	defer restore()
+	defer func() { lfsEnabled = false }()
+	lfsObject := func() string { return filepath.Join(thisGitRepo, "lfs", "objects", oid[:2], oid[2:4], oid) }
+
+	for _, enabled := range []bool{false, true} {
+		cleanup := useTmpGitDir(t)
+		lfsEnabled = enabled
+		checkFatal(t, fetchObject(context.Background(), commit))
+		got, err := ioutil.ReadFile(lfsObject())
+		if enabled && (err != nil || string(got) != content) {
+			t.Errorf("lfs object not fetched: %v %q", err, got)
+		}
+		if !enabled && !os.IsNotExist(err) {
+			t.Errorf("lfs object fetched although GIT_IPFS_LFS is off: %v", err)
+		}
+		cleanup()
+	}
+
+	// a companion object that doesn't match the pointer
+	files["lfs/objects/"+oid] = "something else\n"
+	_, restore2 := useFakeRepo(t, files)
+	defer restore2()
+	defer useTmpGitDir(t)()
+	lfsEnabled = true
+	if err := fetchObject(context.Background(), commit); err == nil {
+		t.Error("expected an error for a corrupt lfs object")
+	}
+	if _, err := os.Stat(lfsObject()); !os.IsNotExist(err) {
+		t.Errorf("corrupt lfs object was written: %v", err)
+	}
+}
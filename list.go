@@ -3,25 +3,36 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"io/ioutil"
-	"path/filepath"
+	"path"
+	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/ipfs/go-ipfs-shell"
 	"gopkg.in/errgo.v1"
 )
 
-func listInfoRefs(forPush bool) error {
-	refsCat, err := ipfsShell.Cat(filepath.Join(ipfsRepoPath, "info", "refs"))
+func listInfoRefs(ctx context.Context, forPush bool) error {
+	refsCat, err := ipfsShell.Cat(inRepo("info", "refs"))
 	if err != nil {
 		return errgo.Notef(err, "failed to cat info/refs from %s", ipfsRepoPath)
 	}
 	s := bufio.NewScanner(refsCat)
 	for s.Scan() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		hashRef := strings.Split(s.Text(), "\t")
 		if len(hashRef) != 2 {
 			return errgo.Newf("processing info/refs: what is this: %v", hashRef)
 		}
+		if tag := strings.TrimSuffix(hashRef[1], "^{}"); tag != hashRef[1] {
+			// update-server-info lists what annotated tags peel to as <tag>^{}, that's no ref to advertise
+			peeled[tag] = hashRef[0]
+			continue
+		}
 		ref2hash[hashRef[1]] = hashRef[0]
 		log.WithField("ref", hashRef[1]).WithField("sha1", hashRef[0]).Debug("got ref")
 	}
@@ -31,36 +42,201 @@ func listInfoRefs(forPush bool) error {
 	return nil
 }
 
-func listHeadRef() (string, error) {
-	headCat, err := ipfsShell.Cat(filepath.Join(ipfsRepoPath, "HEAD"))
+// readHeadRef returns the ref HEAD of the remote points to
+func readHeadRef() (string, error) {
+	ref, sha1, err := readHead()
+	if err != nil {
+		return "", err
+	}
+	if ref == "" {
+		return "", errgo.Newf("HEAD of %s is detached at %s", ipfsRepoPath, sha1)
+	}
+	return ref, nil
+}
+
+// readHead reads the HEAD file of the remote, either a symref (ref) or a detached object name (sha1)
+func readHead() (ref, sha1 string, err error) {
+	headCat, err := ipfsShell.Cat(inRepo("HEAD"))
 	if err != nil {
-		return "", errgo.Notef(err, "failed to cat HEAD from %s", ipfsRepoPath)
+		return "", "", errgo.Notef(err, "failed to cat HEAD from %s", ipfsRepoPath)
 	}
+	defer headCat.Close()
 	head, err := ioutil.ReadAll(headCat)
 	if err != nil {
-		return "", errgo.Notef(err, "failed to readAll HEAD from %s", ipfsRepoPath)
+		return "", "", errgo.Notef(err, "failed to readAll HEAD from %s", ipfsRepoPath)
+	}
+	if bytes.HasPrefix(head, []byte("ref: ")) {
+		return string(bytes.TrimSpace(head[5:])), "", nil
 	}
-	if !bytes.HasPrefix(head, []byte("ref: ")) {
-		return "", errgo.Newf("illegal HEAD file from %s: %q", ipfsRepoPath, head)
+	if h := string(bytes.TrimSpace(head)); objectNameRe.MatchString(h) {
+		return "", h, nil
 	}
-	headRef := string(bytes.TrimSpace(head[5:]))
-	headHash, ok := ref2hash[headRef]
+	return "", "", errgo.Newf("illegal HEAD file from %s: %q", ipfsRepoPath, head)
+}
+
+// objectNameRe matches sha1 and sha256 object names
+var objectNameRe = regexp.MustCompile("^([0-9a-f]{40}|[0-9a-f]{64})$")
+
+// listHeadRef returns the object HEAD of the remote resolves to.
+// a symref to a ref that doesn't exist (like master in a repo that only has main) falls back to guessHead,
+// a detached HEAD is used as is if the remote has the object.
+func listHeadRef() (string, error) {
+	headRef, headHash, err := readHead()
+	if err != nil {
+		return "", err
+	}
+	if headRef == "" {
+		ok, err := remoteHasObject(headHash)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", errgo.Newf("detached HEAD %s is missing from %s", headHash, ipfsRepoPath)
+		}
+		log.WithField("sha1", headHash).Debug("got detached HEAD")
+		return headHash, nil
+	}
+	if h, ok := ref2hash[headRef]; ok {
+		log.WithField("ref", headRef).WithField("sha1", h).Debug("got HEAD ref")
+		return h, nil
+	}
+	guess, ok := guessHead()
 	if !ok {
-		// use first hash in map?..
 		return "", errgo.Newf("unknown HEAD reference %q", headRef)
 	}
-	log.WithField("ref", headRef).WithField("sha1", headHash).Debug("got HEAD ref")
-	return headHash, headCat.Close()
+	log.WithField("ref", headRef).WithField("guess", guess).Debug("HEAD points at a missing ref, guessed")
+	return ref2hash[guess], nil
+}
+
+// listHeadLine returns the HEAD line of list for the object head, listHeadRef's answer.
+// without one (no readable HEAD) it's a symref to guessHead's branch, or "" if there is none to list either:
+// git takes a line with an empty object name for a broken response.
+func listHeadLine(head string) string {
+	if head != "" {
+		return head + " HEAD"
+	}
+	if guess, ok := guessHead(); ok && refAllowed(guess) {
+		log.WithField("guess", guess).Debug("no HEAD, guessed")
+		return "@" + guess + " HEAD"
+	}
+	log.Debug("no HEAD to list")
+	return ""
+}
+
+// pushHeadLine returns the HEAD line of list for-push, the HEAD the remote stores and never a guess:
+// a symref as @<ref> HEAD if the ref exists, a detached HEAD as its object.
+// it's "" if HEAD can't be read or points to a ref that doesn't exist (yet).
+func pushHeadLine() string {
+	ref, sha1, err := readHead()
+	switch {
+	case err != nil:
+		log.WithField("err", err).Debug("for-push: no HEAD to list")
+		return ""
+	case ref == "":
+		return sha1 + " HEAD"
+	}
+	if _, ok := ref2hash[ref]; !ok {
+		log.WithField("ref", ref).Debug("for-push: HEAD points at a missing ref")
+		return ""
+	}
+	return "@" + ref + " HEAD"
+}
+
+// guessHead picks the default branch from ref2hash: master, main or else the first branch by name
+func guessHead() (string, bool) {
+	for _, ref := range []string{"refs/heads/master", "refs/heads/main"} {
+		if _, ok := ref2hash[ref]; ok {
+			return ref, true
+		}
+	}
+	var branches []string
+	for ref := range ref2hash {
+		if strings.HasPrefix(ref, "refs/heads/") {
+			branches = append(branches, ref)
+		}
+	}
+	if len(branches) == 0 {
+		return "", false
+	}
+	sort.Strings(branches)
+	return branches[0], true
+}
+
+// remoteHasObject checks the store and the packs of the remote for sha1
+func remoteHasObject(sha1 string) (bool, error) {
+	have, err := objStore.present([]string{sha1})
+	if err != nil {
+		return false, err
+	}
+	if have[sha1] {
+		return true, nil
+	}
+	packed, err := packedObjects(ipfsRepoPath)
+	if err != nil {
+		return false, err
+	}
+	return packed[sha1], nil
 }
 
-func listIterateRefs(forPush bool) error {
-	refsDir := filepath.Join(ipfsRepoPath, "refs")
+// listPackedRefs reads the packed-refs file of the remote into ref2hash, git pack-refs (and gc) moves the loose refs there.
+// the ^<sha1> line after an annotated tag is the object it peels to, that goes to peeled.
+// it returns the number of refs found.
+func listPackedRefs() (int, error) {
+	rc, err := ipfsShell.Cat(inRepo("packed-refs"))
+	if err != nil {
+		return 0, errgo.Notef(err, "failed to cat packed-refs from %s", ipfsRepoPath)
+	}
+	defer rc.Close()
+	n := 0
+	last := ""
+	s := bufio.NewScanner(rc)
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			// the header with the traits, like # pack-refs with: peeled fully-peeled sorted
+		case strings.HasPrefix(line, "^"):
+			if last == "" || !objectNameRe.MatchString(line[1:]) {
+				return n, errgo.Newf("processing packed-refs: bad peeled line %q", line)
+			}
+			peeled[last] = line[1:]
+		default:
+			hashRef := strings.SplitN(line, " ", 2)
+			if len(hashRef) != 2 || !objectNameRe.MatchString(hashRef[0]) {
+				return n, errgo.Newf("processing packed-refs: what is this: %q", line)
+			}
+			ref2hash[hashRef[1]] = hashRef[0]
+			last = hashRef[1]
+			n++
+		}
+	}
+	if err := s.Err(); err != nil {
+		return n, errgo.Notef(err, "ipfs.Cat(packed-refs) scanner error")
+	}
+	return n, nil
+}
+
+func listIterateRefs(ctx context.Context, forPush bool) error {
+	packed, err := listPackedRefs()
+	if err != nil {
+		log.WithField("err", err).Debug("no packed refs")
+	}
+	refsDir := inRepo("refs")
+	// Walk joins (and so cleans) the paths, the prefix has to match that
+	repoPrefix := path.Clean(ipfsRepoPath) + "/"
 	return Walk(refsDir, func(p string, info *shell.LsEntry, err error) error {
+		if errCtx := ctx.Err(); errCtx != nil {
+			return errCtx
+		}
 		if err != nil {
+			if info == nil && packed > 0 {
+				// all refs are packed and the empty refs/ didn't make it into ipfs
+				return nil
+			}
 			return errgo.Notef(err, "walk(%s) failed", p)
 		}
 		log.WithField("info", info).Debug("iterateRefs: walked to:", p)
-		if info.Type == 2 {
+		if isFile(info) {
 			rc, err := ipfsShell.Cat(p)
 			if err != nil {
 				return errgo.Notef(err, "walk(%s) cat ref failed", p)
@@ -73,7 +249,12 @@ func listIterateRefs(forPush bool) error {
 				return errgo.Notef(err, "walk(%s) cat close failed", p)
 			}
 			sha1 := strings.TrimSpace(string(data))
-			refName := strings.TrimPrefix(p, ipfsRepoPath+"/")
+			// nested refs like refs/heads/feature/team/name keep their full path
+			refName := strings.TrimPrefix(p, repoPrefix)
+			// a loose ref is newer than the packed one of the same name
+			if ref2hash[refName] != sha1 {
+				delete(peeled, refName)
+			}
 			ref2hash[refName] = sha1
 			log.WithField("refMap", ref2hash).Debug("ref2hash map updated")
 		}
@@ -81,33 +262,45 @@ func listIterateRefs(forPush bool) error {
 	})
 }
 
+// unixfs types of ls entries
+const (
+	unixfsDir  = 1
+	unixfsFile = 2
+	// unixfsShard is a directory the daemon split into a hamt because it has a lot of entries.
+	// ls and path resolution go through the shards, but the type differs.
+	unixfsShard = 5
+)
+
+func isDir(e *shell.LsEntry) bool  { return e.Type == unixfsDir || e.Type == unixfsShard }
+func isFile(e *shell.LsEntry) bool { return e.Type == unixfsFile }
+
 // semi-todo make shell implement http.FileSystem
 // then we can reuse filepath.Walk and make a lot of other stuff simpler
 var SkipDir = errgo.Newf("walk: skipping")
 
 type WalkFunc func(path string, info *shell.LsEntry, err error) error
 
-func walk(path string, info *shell.LsEntry, walkFn WalkFunc) error {
-	err := walkFn(path, info, nil)
+func walk(p string, info *shell.LsEntry, walkFn WalkFunc) error {
+	err := walkFn(p, info, nil)
 	if err != nil {
-		if info.Type == 1 && err == SkipDir {
+		if isDir(info) && err == SkipDir {
 			return nil
 		}
 		return err
 	}
-	if info.Type != 1 {
+	if !isDir(info) {
 		return nil
 	}
-	list, err := ipfsShell.List(path)
+	list, err := ipfsShell.List(p)
 	if err != nil {
 		log.Error("walk list failed", err)
-		return walkFn(path, info, err)
+		return walkFn(p, info, err)
 	}
 	for _, lnk := range list {
-		fname := filepath.Join(path, lnk.Name)
+		fname := path.Join(p, lnk.Name)
 		err = walk(fname, lnk, walkFn)
 		if err != nil {
-			if lnk.Type != 1 || err != SkipDir {
+			if !isDir(lnk) || err != SkipDir {
 				return err
 			}
 		}
@@ -122,10 +315,45 @@ func Walk(root string, walkFn WalkFunc) error {
 		return walkFn(root, nil, err)
 	}
 	for _, l := range list {
-		fname := filepath.Join(root, l.Name)
+		fname := path.Join(root, l.Name)
 		if err := walk(fname, l, walkFn); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// refFilter limits the refs list advertises to fetches (GIT_IPFS_REF_FILTER), nil lists all of them
+var refFilter []*regexp.Regexp
+
+// parseRefFilter compiles comma separated globs like refs/heads/*,refs/tags/v*.
+// a * matches any part of the name, including slashes.
+func parseRefFilter(s string) ([]*regexp.Regexp, error) {
+	var filter []*regexp.Regexp
+	for _, glob := range strings.Split(s, ",") {
+		glob = strings.TrimSpace(glob)
+		if glob == "" {
+			continue
+		}
+		expr := strings.Replace(regexp.QuoteMeta(glob), `\*`, ".*", -1)
+		re, err := regexp.Compile("^" + expr + "$")
+		if err != nil {
+			return nil, errgo.Notef(err, "bad ref filter %q", glob)
+		}
+		filter = append(filter, re)
+	}
+	return filter, nil
+}
+
+// refAllowed reports whether list should advertise ref to a fetch
+func refAllowed(ref string) bool {
+	if refFilter == nil {
+		return true
+	}
+	for _, re := range refFilter {
+		if re.MatchString(ref) {
+			return true
+		}
+	}
+	return false
+}
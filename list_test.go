@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+// emptyBareRepo is what git init --bare leaves behind
+func emptyBareRepo(fs *fakeShell) string {
+	root := fs.addTree(map[string]string{
+		"HEAD":   "ref: refs/heads/master\n",
+		"config": "[core]\n\trepositoryformatversion = 0\n\tbare = true\n",
+	})
+	for _, dir := range []string{"refs/heads", "refs/tags", "objects/info", "objects/pack"} {
+		var err error
+		root, err = fs.PatchLink(root, dir, fs.mkdir(map[string]string{}), true)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return root
+}
+
+func TestList_emptyRepo(t *testing.T) {
+	fs, restore := useFakeRepo(t, map[string]string{})
+	defer restore()
+	ipfsRepoPath = "/ipfs/" + emptyBareRepo(fs)
+
+	var out bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("list\n"), &out))
+	if out.String() != "@refs/heads/master HEAD\n\n" {
+		t.Errorf("unexpected list output for empty repo: %q", out.String())
+	}
+}
+
+func TestList_noRepo(t *testing.T) {
+	_, restore := useFakeRepo(t, map[string]string{"README": "not a repo"})
+	defer restore()
+
+	var out bytes.Buffer
+	if err := speakGit(context.Background(), strings.NewReader("list\n"), &out); err == nil {
+		t.Errorf("expected error listing a directory without HEAD, got %q", out.String())
+	}
+}
+
+func TestList_ipnsResolvedOnce(t *testing.T) {
+	files := map[string]string{"HEAD": "ref: refs/heads/master\n"}
+	commit, _ := fixtureCommit(files, "ipns\n")
+	files["refs/heads/master"] = commit + "\n"
+	fs, restore := useFakeRepo(t, files)
+	defer restore()
+	defer useTmpGitDir(t)()
+	// a name pointing at a directory of several repos
+	top := fs.mkdir(map[string]string{"repo.git": strings.TrimPrefix(ipfsRepoPath, "/ipfs/"), "other.git": fs.mkdir(nil)})
+	fs.names["example.com"] = "/ipfs/" + top
+	ipfsRepoPath = "/ipns/example.com/repo.git"
+	resolveRepoPath(context.Background())
+	if ipfsRepoPath != "/ipfs/"+top+"/repo.git" || ipnsRepoPath != "/ipns/example.com/repo.git" {
+		t.Fatalf("unexpected paths after resolving: %s %s", ipfsRepoPath, ipnsRepoPath)
+	}
+
+	var out bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("list\nfetch "+commit+" refs/heads/master\n\n"), &out))
+	if !strings.Contains(out.String(), commit+" refs/heads/master\n") {
+		t.Errorf("ref not listed:\n%s", out.String())
+	}
+	if n := fs.calls["resolveName"]; n != 1 {
+		t.Errorf("the ipns name was resolved %d times", n)
+	}
+}
+
+func TestList_refFilter(t *testing.T) {
+	files := map[string]string{"HEAD": "ref: refs/heads/master\n"}
+	refs := []string{"refs/heads/master", "refs/heads/feature/x", "refs/tags/v1.0", "refs/tags/old", "refs/pull/1/head"}
+	for _, ref := range refs {
+		files[ref] = fixtureSha + "\n"
+	}
+	_, restore := useFakeRepo(t, files)
+	defer restore()
+	defer func() { refFilter = nil }()
+
+	cases := map[string][]string{
+		"":                           refs,
+		"refs/heads/*":               {"refs/heads/master", "refs/heads/feature/x"},
+		"refs/heads/*, refs/tags/v*": {"refs/heads/master", "refs/heads/feature/x", "refs/tags/v1.0"},
+		"refs/heads/master":          {"refs/heads/master"},
+	}
+	for filter, want := range cases {
+		var err error
+		refFilter, err = parseRefFilter(filter)
+		checkFatal(t, err)
+		ref2hash = make(map[string]string)
+		var out bytes.Buffer
+		checkFatal(t, speakGit(context.Background(), strings.NewReader("list\n"), &out))
+		got := strings.Count(out.String(), "\n") - 2 // HEAD and the blank line
+		if got != len(want) {
+			t.Errorf("filter %q: want %d refs listed, got:\n%s", filter, len(want), out.String())
+		}
+		for _, ref := range want {
+			if !strings.Contains(out.String(), " "+ref+"\n") {
+				t.Errorf("filter %q: %s not listed", filter, ref)
+			}
+		}
+		if !strings.Contains(out.String(), " HEAD\n") {
+			t.Errorf("filter %q: HEAD not listed", filter)
+		}
+	}
+
+	// the filter is for fetches, a push sees all refs
+	var err error
+	refFilter, err = parseRefFilter("refs/heads/master")
+	checkFatal(t, err)
+	ref2hash = make(map[string]string)
+	var out bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("list for-push\n"), &out))
+	for _, ref := range refs {
+		if !strings.Contains(out.String(), " "+ref+"\n") {
+			t.Errorf("list for-push: %s not listed:\n%s", ref, out.String())
+		}
+	}
+}
+
+func TestList_shardedDirs(t *testing.T) {
+	files := map[string]string{"HEAD": "ref: refs/heads/master\n"}
+	commit, objs := fixtureCommit(files, "sharded\n")
+	files["refs/heads/master"] = commit + "\n"
+	files["refs/heads/feature/big"] = commit + "\n"
+	fs, restore := useFakeRepo(t, files)
+	defer restore()
+	defer useTmpGitDir(t)()
+	// refs/, refs/heads/, objects/xx/ and so on all come back as hamt shards
+	fs.sharded = true
+
+	var out bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("list\n"), &out))
+	for _, ref := range []string{"refs/heads/master", "refs/heads/feature/big"} {
+		if !strings.Contains(out.String(), commit+" "+ref+"\n") {
+			t.Errorf("%s missing from the list of a sharded repo:\n%s", ref, out.String())
+		}
+	}
+	have := looseObjects(ipfsRepoPath, objs)
+	if len(have) != len(objs) {
+		t.Errorf("objects in sharded dirs not found: %v", have)
+	}
+	out.Reset()
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("fetch "+commit+" refs/heads/master\n\n"), &out))
+}
+
+func TestList_headForms(t *testing.T) {
+	files := map[string]string{}
+	mainSha, _ := fixtureCommit(files, "main\n")
+	dev, _ := fixtureCommit(files, "dev\n")
+	detached, _ := fixtureCommit(files, "detached\n")
+	files["info/refs"] = mainSha + "\trefs/heads/main\n" + dev + "\trefs/heads/dev\n"
+	for _, tc := range []struct {
+		head, want string
+	}{
+		{"ref: refs/heads/dev\n", dev},
+		// git init --bare defaults to master, the pushed branch is main
+		{"ref: refs/heads/master\n", mainSha},
+		{detached + "\n", detached},
+		{strings.Repeat("ab", 20) + "\n", ""},
+	} {
+		files["HEAD"] = tc.head
+		_, restore := useFakeRepo(t, files)
+		var out bytes.Buffer
+		err := speakGit(context.Background(), strings.NewReader("list\n"), &out)
+		restore()
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("HEAD %q: expected an error for a detached HEAD the remote doesn't have, got %q", tc.head, out.String())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("HEAD %q: list failed: %s", tc.head, err)
+			continue
+		}
+		if !strings.Contains(out.String(), tc.want+" HEAD\n") {
+			t.Errorf("HEAD %q: want HEAD at %s, got:\n%s", tc.head, tc.want, out.String())
+		}
+	}
+}
+
+// packedTagRepo adds a repo with its refs in packed-refs, v1 an annotated tag of master,
+// and returns the tag and the commit it peels to
+func packedTagRepo(files map[string]string) (string, string) {
+	commit, _ := fixtureCommit(files, "release\n")
+	tag, z := looseObject("tag", "object "+commit+"\ntype commit\ntag v1\ntagger a <a@b> 0 +0000\n\nv1\n")
+	files[objectPath(tag)] = z
+	files["HEAD"] = "ref: refs/heads/master\n"
+	files["packed-refs"] = "# pack-refs with: peeled fully-peeled sorted \n" +
+		commit + " refs/heads/master\n" +
+		tag + " refs/tags/v1\n" +
+		"^" + commit + "\n"
+	return tag, commit
+}
+
+func TestList_packedRefs(t *testing.T) {
+	files := make(map[string]string)
+	tag, commit := packedTagRepo(files)
+	_, restore := useFakeRepo(t, files)
+	defer restore()
+	defer useTmpGitDir(t)()
+	gitRun(t, "init", "-q", "--bare", thisGitRepo)
+
+	var out bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("list\n\nfetch "+tag+" refs/tags/v1\n\n"), &out))
+	for _, want := range []string{commit + " refs/heads/master\n", tag + " refs/tags/v1\n", commit + " HEAD\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("list output lacks %q:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "^") {
+		t.Errorf("peeled line listed as a ref:\n%s", out.String())
+	}
+	if peeled["refs/tags/v1"] != commit {
+		t.Errorf("want v1 peeled to %s, got %v", commit, peeled)
+	}
+	for _, sha1 := range []string{tag, commit} {
+		if !gitHasObject(sha1) {
+			t.Errorf("%s not fetched", sha1)
+		}
+	}
+
+	// update-server-info writes the peeled tags as <tag>^{} lines
+	files["info/refs"] = commit + "\trefs/heads/master\n" + tag + "\trefs/tags/v1\n" + commit + "\trefs/tags/v1^{}\n"
+	_, restore = useFakeRepo(t, files)
+	defer restore()
+	out.Reset()
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("list\n\n"), &out))
+	if strings.Contains(out.String(), "^{}") || peeled["refs/tags/v1"] != commit {
+		t.Errorf("info/refs peeled entry: %v\n%s", peeled, out.String())
+	}
+}
+
+func TestList_forPushHead(t *testing.T) {
+	files := map[string]string{}
+	mainSha, _ := fixtureCommit(files, "main\n")
+	detached, _ := fixtureCommit(files, "detached\n")
+	files["info/refs"] = mainSha + "\trefs/heads/main\n"
+	for _, tc := range []struct {
+		head, want string
+	}{
+		{"ref: refs/heads/main\n", "@refs/heads/main HEAD\n"},
+		{detached + "\n", detached + " HEAD\n"},
+		// the unborn default branch and a HEAD the remote doesn't have are not guessed at
+		{"ref: refs/heads/master\n", ""},
+		{strings.Repeat("ab", 20) + "\n", strings.Repeat("ab", 20) + " HEAD\n"},
+	} {
+		files["HEAD"] = tc.head
+		_, restore := useFakeRepo(t, files)
+		var out bytes.Buffer
+		err := speakGit(context.Background(), strings.NewReader("list for-push\n"), &out)
+		restore()
+		if err != nil {
+			t.Errorf("HEAD %q: list for-push failed: %s", tc.head, err)
+			continue
+		}
+		want := mainSha + " refs/heads/main\n" + tc.want + "\n"
+		if out.String() != want {
+			t.Errorf("HEAD %q: want %q, got %q", tc.head, want, out.String())
+		}
+	}
+}
+
+func TestList_forPushEmptyRepo(t *testing.T) {
+	fs, restore := useFakeRepo(t, map[string]string{})
+	defer restore()
+	ipfsRepoPath = "/ipfs/" + emptyBareRepo(fs)
+
+	var out bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("list for-push\n"), &out))
+	if out.String() != "\n" {
+		t.Errorf("unexpected list for-push output for empty repo: %q", out.String())
+	}
+}
+
+func TestList_noHead(t *testing.T) {
+	files := map[string]string{}
+	commit, _ := fixtureCommit(files, "headless\n")
+	for _, tc := range []struct {
+		name  string
+		files map[string]string
+		head  string
+	}{
+		{"no HEAD", map[string]string{"refs/heads/dev": commit + "\n"}, "@refs/heads/dev HEAD"},
+		{"no HEAD, only tags", map[string]string{"refs/tags/v1": commit + "\n"}, ""},
+		{"HEAD at a missing branch, only tags", map[string]string{"HEAD": "ref: refs/heads/master\n", "refs/tags/v1": commit + "\n"}, ""},
+	} {
+		for p, content := range files {
+			tc.files[p] = content
+		}
+		_, restore := useFakeRepo(t, tc.files)
+		var out bytes.Buffer
+		err := speakGit(context.Background(), strings.NewReader("list\n"), &out)
+		restore()
+		if err != nil {
+			t.Errorf("%s: list failed: %s", tc.name, err)
+			continue
+		}
+		lines := strings.Split(out.String(), "\n")
+		if len(lines) < 2 || lines[len(lines)-1] != "" || lines[len(lines)-2] != "" {
+			t.Errorf("%s: list doesn't end with a blank line: %q", tc.name, out.String())
+			continue
+		}
+		var head string
+		for _, line := range lines[:len(lines)-2] {
+			fields := strings.Fields(line)
+			if len(fields) != 2 || (!objectNameRe.MatchString(fields[0]) && !strings.HasPrefix(fields[0], "@refs/")) {
+				t.Errorf("%s: malformed line %q", tc.name, line)
+			}
+			if strings.HasSuffix(line, " HEAD") {
+				head = line
+			}
+		}
+		if head != tc.head {
+			t.Errorf("%s: want HEAD line %q, got %q", tc.name, tc.head, head)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// errRemoteBusy is returned when another push to the same mutable remote is in progress
+var errRemoteBusy = errgo.New("remote is being updated")
+
+// pushLockWait is how long a push waits for another one to finish (GIT_IPFS_PUSH_LOCK_WAIT), 0 fails right away
+var pushLockWait time.Duration
+
+// pushLockPath is the lock we hold in this batch, "" if none
+var pushLockPath string
+
+// lockPush takes the advisory lock for pushing to the ipns remote.
+// pushes to /ipfs/ remotes can't clobber each other and don't need one.
+func lockPush() error {
+	name, _, ok := ipnsName(ipnsRepoPath)
+	if !ok || pushLockPath != "" {
+		return nil
+	}
+	lock := filepath.Join(commonDir(), "ipfs-push-"+name+".lock")
+	deadline := time.Now().Add(pushLockWait)
+	for {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			pushLockPath = lock
+			cleanups = append(cleanups, unlockPush)
+			log.WithField("lock", lock).Debug("push lock taken")
+			return nil
+		}
+		if !os.IsExist(err) {
+			return errgo.Notef(err, "creating push lock %s failed", lock)
+		}
+		if !time.Now().Before(deadline) {
+			log.WithField("lock", lock).Debug("push lock held by someone else")
+			return errgo.WithCausef(nil, errRemoteBusy, "%s (remove %s if no other push is running)", errRemoteBusy, lock)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func unlockPush() {
+	if pushLockPath == "" {
+		return
+	}
+	if err := os.Remove(pushLockPath); err != nil {
+		log.WithField("err", err).Warning("removing push lock failed")
+	}
+	pushLockPath = ""
+}
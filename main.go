@@ -1,21 +1,27 @@
 /*
 git-remote-helper implements a git-remote helper that uses the ipfs transport.
 
-TODO
+# TODO
 
-Currently assumes a IPFS Daemon at localhost:5001
+The IPFS daemon API address is taken from the first of these that is set:
+the IPFS_API env var, the remote.<name>.ipfsApi git config key, the ipfs.api git config key.
+It defaults to localhost:5001.
 
 Not completed: new Push (issue #2), IPNS, URLs like fs:/ipfs/.. (issue #3), embedded IPFS node
 
 ...
 
- $ git clone ipfs://ipfs/$hash/repo.git
- $ cd repo && make $stuff
- $ git commit -a -m 'done!'
- $ git push origin
- => clone-able as ipfs://ipfs/$newHash/repo.git
+	$ git clone ipfs://ipfs/$hash/repo.git
+	$ cd repo && make $stuff
+	$ git commit -a -m 'done!'
+	$ git push origin
+	=> clone-able as ipfs://ipfs/$newHash/repo.git
 
-Links
+Pushing to an ipfs://ipns/$name/.. remote publishes the new root under $name, so the url stays the same.
+The store, layout, transport and the rest are set with GIT_IPFS_* env vars (or the url's ?key=value query),
+README.md lists them together with the exit codes.
+
+# Links
 
 https://ipfs.io
 
@@ -33,13 +39,17 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
-
-	"github.com/cryptix/git-remote-ipfs/internal/path"
+	"syscall"
+	"time"
 
 	"github.com/cryptix/go/logging"
 	"github.com/ipfs/go-ipfs-shell"
@@ -51,9 +61,98 @@ supports:
 
 * ipfs://ipfs/$hash/path..
 * ipfs:///ipfs/$hash/path..
+* ipfs://ipns/$name/path..
+* ipfs:///ipns/$name/path.. (deprecated, use ipfs://ipns/)
+
+$hash or $name may carry an @label (like $hash@2024-01-01), which is ignored apart from logging.
+A ?key=value&.. query sets options for this remote only, like ?store=block&lfs=1.
+The keys are the GIT_IPFS_ env vars in lower case with - instead of _ (store, lfs, layout, chunker, ...).
+
+      git-remote-ipfs gc [-keep N] [-repo-gc] <remote-name>
+unpins all but the last N (default 3) roots pushed to remote-name and optionally runs the daemon's repo gc.
+
+      git-remote-ipfs check [-json] [<remote-name>]
+reports whether the daemon is reachable, its version and latency, and if pinning and publishing the remote's ipns name work.
+
+      git-remote-ipfs fsck <url>
+checks every object reachable from the refs of the repo at url, without fetching it, and lists the missing and corrupt ones.
+
+      git-remote-ipfs snapshot <url> <ref> <destdir>
+writes the files of ref (a branch, tag or object name) to the new or empty destdir, without creating a git repo.
+symlinks are written as links to their unchanged target, with GIT_IPFS_SYMLINKS=file as files holding the target (like core.symlinks=false).
+
+      git-remote-ipfs mount <url> <ref> <mountpoint>
+mounts the files of ref read-only at mountpoint (fuse, linux and darwin), each directory and file is read from the remote
+the first time something looks at it. runs until the mount is unmounted or interrupted.
+
+      git-remote-ipfs resolve [-json] <url> <ref>
+prints the /ipfs/ path of the object ref points to, or with -json the ref, object name, path in the repo and cid.
+
+      git-remote-ipfs refs <url>
+prints HEAD and the refs of the repo at url like git ls-remote does, without needing a local repo.
+
+      git-remote-ipfs verify [-remote name] <url>
+run in a clone of url: builds the repo from the clone's objects and refs (refs/remotes/<name>/.., default origin) like a push
+to an empty remote would, and reports whether that gives url's root cid or which paths differ. exits 1 on a mismatch.
+
+      git-remote-ipfs republish <key>
+publishes the current target of the ipns name of key (like self) again, so the record doesn't expire. meant for cron jobs,
+GIT_IPFS_IPNS_LIFETIME (like 48h) sets how long the new record is valid, unset the daemon decides.
+
+      git-remote-ipfs recover [<push-log>]
+lists the pushes of the push log (default GIT_IPFS_PUSH_LOG) that staged a new root but never published it, and how to finish them.
 
 `
 
+const defaultAPIAddress = "localhost:5001"
+
+// apiAddress returns where the ipfs daemon api is, first match wins:
+// the IPFS_API env var, remote.<name>.ipfsApi and ipfs.api from git config, localhost:5001
+func apiAddress() string {
+	if addr := os.Getenv("IPFS_API"); addr != "" {
+		return addr
+	}
+	for _, key := range []string{"remote." + thisGitRemote + ".ipfsApi", "ipfs.api"} {
+		addr, err := gitConfig(key)
+		if err != nil {
+			log.WithField("key", key).WithField("err", err).Debug("reading git config failed")
+			continue
+		}
+		if addr != "" {
+			return addr
+		}
+	}
+	return defaultAPIAddress
+}
+
+// refspecs are advertised in the capabilities, from remote.<name>.ipfsRefspec
+var refspecs []string
+
+// loadRefspecs reads the refspecs to advertise for thisGitRemote
+func loadRefspecs() error {
+	key := "remote." + thisGitRemote + ".ipfsRefspec"
+	specs, err := gitConfigAll(key)
+	if err != nil {
+		return err
+	}
+	for _, spec := range specs {
+		if !strings.Contains(spec, ":") {
+			return errgo.Newf("%s: refspec %q has no destination", key, spec)
+		}
+	}
+	refspecs = specs
+	return nil
+}
+
+// transports selectable with GIT_IPFS_TRANSPORT
+const (
+	// transportDumb fetches and pushes object by object over the repo file tree
+	transportDumb = "dumb"
+	// transportSmart also advertises connect for pack negotiation.
+	// git-receive-pack is bridged by receivePack, other services are answered with fallback, so git uses fetch.
+	transportSmart = "smart"
+)
+
 func usage() {
 	fmt.Fprint(os.Stderr, usageMsg)
 	os.Exit(2)
@@ -61,10 +160,17 @@ func usage() {
 
 var (
 	ref2hash = make(map[string]string)
-
-	ipfsShell     = shell.NewShell("localhost:5001")
-	ipfsRepoPath  string
-	thisGitRepo   string
+	// peeled maps annotated tags of the remote to the objects they point to, from info/refs and packed-refs
+	peeled = make(map[string]string)
+
+	ipfsShell    ipfsAPI     = shell.NewShell(defaultAPIAddress)
+	objStore     objectStore = fileStore{}
+	ipfsRepoPath string
+	repoSuffix   = ".git"
+	transport    = transportDumb
+	thisGitRepo  string
+	// gitCommonDir holds the objects and refs of thisGitRepo if it's a linked worktree's git dir, see commonDir
+	gitCommonDir  string
 	thisGitRemote string
 	errc          chan<- error
 	log           = logging.Logger("git-remote-ipfs")
@@ -72,7 +178,31 @@ var (
 
 func main() {
 	// logging
-	logging.SetupLogging(nil)
+	setupLogging()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "gc":
+			os.Exit(gcMain(os.Args[2:]))
+		case "check":
+			os.Exit(checkMain(os.Args[2:]))
+		case "fsck":
+			os.Exit(fsckMain(os.Args[2:]))
+		case "snapshot":
+			os.Exit(snapshotMain(os.Args[2:]))
+		case "mount":
+			os.Exit(mountMain(os.Args[2:]))
+		case "resolve":
+			os.Exit(resolveMain(os.Args[2:]))
+		case "republish":
+			os.Exit(republishMain(os.Args[2:]))
+		case "recover":
+			os.Exit(recoverMain(os.Args[2:]))
+		case "refs":
+			os.Exit(refsMain(os.Args[2:]))
+		case "verify":
+			os.Exit(verifyMain(os.Args[2:]))
+		}
+	}
 
 	// env var and arguments
 	thisGitRepo = os.Getenv("GIT_DIR")
@@ -84,7 +214,16 @@ func main() {
 		logging.CheckFatal(err)
 		thisGitRepo = filepath.Join(cwd, ".git")
 	}
+	// a linked worktree's .git is a file pointing at its git dir, which shares the objects and refs of the main one
+	gitDir, common, err := resolveGitDir(thisGitRepo)
+	if err != nil {
+		log.Fatalf("GIT_DIR: %s", err)
+	}
+	thisGitRepo, gitCommonDir = gitDir, common
 	log.Debug("GIT_DIR=", thisGitRepo)
+	if s := os.Getenv("GIT_IPFS_REPO_SUFFIX"); s != "" {
+		repoSuffix = s
+	}
 
 	var u string // repo url
 	v := len(os.Args[1:])
@@ -95,50 +234,310 @@ func main() {
 		log.Debug("remote:", thisGitRemote)
 		log.Debug("url:", u)
 	default:
-		log.Fatalf("usage: unknown # of args: %d\n%v", v, os.Args[1:])
+		log.Errorf("usage: unknown # of args: %d\n%v", v, os.Args[1:])
+		usage()
+	}
+	// options carried by the url, before anything reads their env vars
+	u, opts, err := cutURLQuery(u)
+	if err != nil {
+		log.Errorf("parsing url failed: %s", err)
+		usage()
+	}
+	unknown, err := applyURLOptions(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, key := range unknown {
+		log.WithField("key", key).Warning("ignoring unknown url option")
+	}
+	if len(opts) > 0 {
+		repoURLQuery = "?" + opts.Encode()
+	}
+	if err := loadRefspecs(); err != nil {
+		log.Fatal(err)
+	}
+	if n := os.Getenv("IPFS_FETCH_CONCURRENCY"); n != "" {
+		if fetchConcurrency, err = strconv.Atoi(n); err != nil || fetchConcurrency < 1 {
+			log.Fatalf("IPFS_FETCH_CONCURRENCY: want a number > 0, got %q", n)
+		}
+	}
+	if n := os.Getenv("IPFS_PUSH_CONCURRENCY"); n != "" {
+		if pushConcurrency, err = strconv.Atoi(n); err != nil || pushConcurrency < 1 {
+			log.Fatalf("IPFS_PUSH_CONCURRENCY: want a number > 0, got %q", n)
+		}
+	}
+	maxIdle := defaultMaxIdleConns
+	if n := os.Getenv("GIT_IPFS_MAX_IDLE_CONNS"); n != "" {
+		if maxIdle, err = strconv.Atoi(n); err != nil {
+			log.Fatalf("GIT_IPFS_MAX_IDLE_CONNS: %s", err)
+		}
+	}
+	api := apiAddress()
+	ipfsShell = newShell(api, maxIdle)
+	log.Debug("api:", api)
+	if d := os.Getenv("IPFS_GATEWAY_HEDGE_DELAY"); d != "" {
+		if gatewayHedgeDelay, err = time.ParseDuration(d); err != nil {
+			log.Fatalf("IPFS_GATEWAY_HEDGE_DELAY: %s", err)
+		}
+	}
+	gateways := parseGateways(os.Getenv("IPFS_GATEWAYS"))
+	var readOnly bool
+	switch probeEndpoint(newHTTPClient(1), api) {
+	case endpointGateway:
+		log.WithField("api", api).Warning("the api address is a gateway, only fetching works (set IPFS_API to the api, usually port 5001)")
+		gateways = append([]string{api}, gateways...)
+		readOnly = true
+	case endpointUnknown:
+		log.WithField("api", api).Debug("api address doesn't answer like an api or gateway")
+	}
+	if len(gateways) > 0 {
+		g := newGatewayShell(ipfsShell, gateways, newHTTPClient(maxIdle))
+		g.readOnly = readOnly
+		ipfsShell = g
 	}
 
-	// parse passed URL
-	for _, pref := range []string{"ipfs://ipfs/", "ipfs:///ipfs/"} {
-		if strings.HasPrefix(u, pref) {
-			u = "/ipfs/" + u[len(pref):]
-			log.Debug("prefix cut:", u)
+	// a gateway has no version to ask
+	strictVersion = envBool("GIT_IPFS_STRICT_VERSION")
+	if !readOnly {
+		if err := checkDaemon(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	connectProvider()
+
+	adder := apiAdder{addr: api, client: newHTTPClient(maxIdle)}
+	if c := os.Getenv("GIT_IPFS_CHUNKER"); c != "" {
+		if adder.chunker, err = parseChunker(c); err != nil {
+			log.Fatalf("GIT_IPFS_CHUNKER: %s", err)
+		}
+	}
+	if o := os.Getenv("GIT_IPFS_ADD_OPTS"); o != "" {
+		opts, unknown, err := parseAddOpts(o)
+		if err != nil {
+			log.Fatalf("GIT_IPFS_ADD_OPTS: %s", err)
+		}
+		if len(unknown) > 0 {
+			log.WithField("options", unknown).Warning("GIT_IPFS_ADD_OPTS: passing on unknown add options")
+		}
+		adder.opts = opts
+	}
+	if v := os.Getenv("GIT_IPFS_CID_VERSION"); v != "" {
+		if v != "0" && v != "1" {
+			log.Fatalf("GIT_IPFS_CID_VERSION: want 0 or 1, got %q", v)
+		}
+		if adder.opts == nil {
+			adder.opts = make(url.Values)
 		}
+		adder.opts.Set("cid-version", v)
 	}
-	p, err := path.ParsePath(u)
+	if adder.chunker != "" || len(adder.opts) > 0 {
+		addObject, pushAdder = adder.add, &adder
+	}
+	objectAdder = &adder
+
+	// parse passed URL
+	schemes, err := parseURLSchemes(os.Getenv("GIT_IPFS_URL_SCHEMES"))
 	if err != nil {
-		log.Fatalf("path.ParsePath() failed: %s", err)
+		log.Fatalf("GIT_IPFS_URL_SCHEMES: %s", err)
+	}
+	urlPrefixes = append(schemes, urlPrefixes...)
+	noDeprecation = envBool("GIT_IPFS_NO_DEPRECATION")
+	u, repoLabel = cutURLLabel(u)
+	if repoLabel != "" {
+		log = log.WithField("label", repoLabel)
+		log.Debug("url label:", repoLabel)
+	}
+	ipfsRepoPath, err = parseRepoURL(u)
+	if err != nil {
+		log.Errorf("parsing url failed: %s", err)
+		usage()
+	}
+
+	// canceled by SIGINT and SIGTERM, everything below runs with it
+	ctx := interruptContext()
+
+	ipnsResolver = os.Getenv("GIT_IPFS_IPNS_RESOLVER")
+	resolveRepoPath(ctx)
+	if envBool("GIT_IPFS_UPGRADE_CID") {
+		noteCIDv1URL()
+	}
+
+	// repo published as a tarball? serve it from a local extraction
+	archive, err := findRepoArchive(ipfsRepoPath)
+	if err != nil {
+		log.WithField("err", err).Debug("probing for repo archive failed")
+	}
+	if archive != "" {
+		repoDir, tmpDir, err := extractRepoArchive(archive)
+		if err != nil {
+			log.Fatalf("extracting repo archive failed: %s", err)
+		}
+		cleanups = append(cleanups, func() { os.RemoveAll(tmpDir) })
+		ipfsShell = &dirShell{ipfsAPI: ipfsShell, prefix: ipfsRepoPath, dir: repoDir}
+		log.Debug("serving repo from archive:", archive)
 	}
-	ipfsRepoPath = p.String()
 
-	// interrupt / error handling
-	go func() {
-		if err := interrupt(); err != nil {
-			log.Fatal("interrupted:", err)
+	if n := os.Getenv("GIT_IPFS_BLOCK_THRESHOLD"); n != "" {
+		if blockThreshold, err = strconv.Atoi(n); err != nil || blockThreshold < 0 {
+			log.Fatalf("GIT_IPFS_BLOCK_THRESHOLD: want a number of bytes >= 0, got %q", n)
 		}
-	}()
+	}
+	objStore, err = newObjectStore(os.Getenv("GIT_IPFS_STORE"))
+	if err != nil {
+		log.Fatalf("GIT_IPFS_STORE: %s", err)
+	}
+	fallback := parseGateways(os.Getenv("IPFS_FALLBACK_GATEWAYS"))
+	subdomains := parseGateways(os.Getenv("GIT_IPFS_SUBDOMAIN_GATEWAY"))
+	if len(fallback)+len(subdomains) > 0 {
+		if fs, ok := objStore.(fileStore); ok {
+			g := newGatewayShell(ipfsShell, fallback, newHTTPClient(maxIdle))
+			g.addSubdomainGateways(subdomains)
+			objStore = &fallbackStore{fileStore: fs, gateway: g}
+		} else {
+			log.Warning("IPFS_FALLBACK_GATEWAYS only works with GIT_IPFS_STORE=file")
+		}
+	}
+	protocolTrace, err = openProtocolTrace(os.Getenv("GIT_IPFS_TRACE_PROTOCOL"))
+	if err != nil {
+		log.Fatalf("GIT_IPFS_TRACE_PROTOCOL: %s", err)
+	}
+	lfsEnabled = envBool("GIT_IPFS_LFS")
+	trackRefs = envBool("GIT_IPFS_TRACK_REFS")
+	writeCommitGraph = envBool("GIT_IPFS_WRITE_COMMIT_GRAPH")
+	continueOnMissing = envBool("GIT_IPFS_CONTINUE_ON_MISSING")
+	assumePacked = envBool("GIT_IPFS_ASSUME_PACKED")
+	if fetchSince = os.Getenv("GIT_IPFS_SINCE"); fetchSince != "" && !objectNameRe.MatchString(fetchSince) {
+		log.Fatalf("GIT_IPFS_SINCE: want a full commit name, got %q", fetchSince)
+	}
+	if n := os.Getenv("GIT_IPFS_SMALL_REPO_OBJECTS"); n != "" {
+		if smallRepoObjects, err = strconv.Atoi(n); err != nil || smallRepoObjects < 0 {
+			log.Fatalf("GIT_IPFS_SMALL_REPO_OBJECTS: want a number >= 0, got %q", n)
+		}
+	}
+	if s := os.Getenv("GIT_IPFS_OBJECT_SHARDING"); s != "" {
+		if pushSharding, err = parseSharding(s); err != nil {
+			log.Fatalf("GIT_IPFS_OBJECT_SHARDING: %s", err)
+		}
+	}
+	verifyPublish = envBool("GIT_IPFS_IPNS_VERIFY")
+	wellKnownEnabled = envBool("GIT_IPFS_WELLKNOWN")
+	noteCID = envBool("GIT_IPFS_NOTE_CID")
+	prefetchTips = envBool("GIT_IPFS_PREFETCH")
+	salvageRefs = envBool("GIT_IPFS_SALVAGE")
+	prePushCmd = os.Getenv("GIT_IPFS_PREPUSH_CMD")
+	postPushCmd = os.Getenv("GIT_IPFS_POSTPUSH_CMD")
+	pushRebaseHint = envBool("GIT_IPFS_PUSH_REBASE")
+	keepBase = envBool("GIT_IPFS_KEEP_BASE")
+	pushCheckpoint = envBool("GIT_IPFS_PUSH_CHECKPOINT")
+	defaultBranch = os.Getenv("GIT_IPFS_DEFAULT_BRANCH")
+	repointHead = envBool("GIT_IPFS_REPOINT_HEAD")
+	pushLogPath = os.Getenv("GIT_IPFS_PUSH_LOG")
+	if w := os.Getenv("GIT_IPFS_PUSH_LOCK_WAIT"); w != "" {
+		if pushLockWait, err = time.ParseDuration(w); err != nil {
+			log.Fatalf("GIT_IPFS_PUSH_LOCK_WAIT: %s", err)
+		}
+	}
+	if refFilter, err = parseRefFilter(os.Getenv("GIT_IPFS_REF_FILTER")); err != nil {
+		log.Fatalf("GIT_IPFS_REF_FILTER: %s", err)
+	}
+	if layout, err = parseLayout(os.Getenv("GIT_IPFS_LAYOUT")); err != nil {
+		log.Fatalf("GIT_IPFS_LAYOUT: %s", err)
+	}
+	switch m := os.Getenv("GIT_IPFS_PACK_MODE"); m {
+	case "", packModeNative:
+	case packModeUnpack:
+		packMode = m
+	default:
+		log.Fatalf("GIT_IPFS_PACK_MODE: unknown mode %q (want native or unpack)", m)
+	}
+	switch m := os.Getenv("GIT_IPFS_LOCAL_WRITE"); m {
+	case "", localWriteLoose:
+	case localWritePack:
+		localWrite = m
+	default:
+		log.Fatalf("GIT_IPFS_LOCAL_WRITE: unknown mode %q (want loose or pack)", m)
+	}
+	switch t := os.Getenv("GIT_IPFS_TRANSPORT"); t {
+	case "", transportDumb:
+	case transportSmart:
+		transport = t
+	default:
+		log.Fatalf("GIT_IPFS_TRANSPORT: unknown transport %q (want dumb or smart)", t)
+	}
 
-	if err := speakGit(os.Stdin, os.Stdout); err != nil {
-		log.Fatal("speakGit failed:", err)
+	// a closed stdout should be an error on write, not kill us before the cleanups ran
+	signal.Ignore(syscall.SIGPIPE)
+	err = speakGit(ctx, os.Stdin, os.Stdout)
+	runCleanups()
+	if errgo.Cause(err) == errGitGone {
+		log.Debug("git went away:", err)
+		os.Exit(exitGitGone)
+	}
+	if err != nil {
+		log.Error("speakGit failed:", err)
+		os.Exit(exitCode(err))
+	}
+	if reportMissing(stderr) > 0 {
+		os.Exit(exitIncomplete)
 	}
 }
 
 // speakGit acts like a git-remote-helper
 // see this for more: https://www.kernel.org/pub/software/scm/git/docs/gitremote-helpers.html
-func speakGit(r io.Reader, w io.Writer) error {
-	//debugLog := logging.Logger("git")
-	//r = debug.NewReadLogrus(debugLog, r)
-	//w = debug.NewWriteLogrus(debugLog, w)
+// once ctx is canceled the command running stops at its next step and speakGit returns ctx's error.
+func speakGit(ctx context.Context, r io.Reader, w io.Writer) error {
+	if protocolTrace != nil {
+		r, w = traceProtocol(protocolTrace, r, w)
+	}
+	pw := &pipeWriter{w: w}
+	w = pw
 	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
+		if err := pw.check(); err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		text := scanner.Text()
 		switch {
 
 		case text == "capabilities":
+			if transport == transportSmart {
+				fmt.Fprintln(w, "connect")
+			}
 			fmt.Fprintln(w, "fetch")
 			fmt.Fprintln(w, "push")
+			fmt.Fprintln(w, "option")
+			fmt.Fprintln(w, "object-format")
+			for _, spec := range refspecs {
+				fmt.Fprintf(w, "refspec %s\n", spec)
+			}
 			fmt.Fprintln(w, "")
 
+		case strings.HasPrefix(text, "connect "):
+			service := text[len("connect "):]
+			// branch snapshots link loose objects, a pushed pack has none
+			if service == "git-receive-pack" && layout != layoutPerBranch {
+				// git waits for the answer before it speaks the service protocol, so the scanner has none of it buffered
+				fmt.Fprintln(w, "")
+				return receivePack(ctx, r, w)
+			}
+			// git then uses fetch/push
+			log.WithField("service", service).Debug("connect: falling back")
+			fmt.Fprintln(w, "fallback")
+
+		case strings.HasPrefix(text, "option "):
+			opt := strings.SplitN(text[len("option "):], " ", 2)
+			switch opt[0] {
+			case "object-format":
+				// the format itself comes with the list output
+				objectFormatOption = len(opt) == 2 && opt[1] == "true"
+				fmt.Fprintln(w, "ok")
+			default:
+				fmt.Fprintln(w, "unsupported")
+			}
+
 		case strings.HasPrefix(text, "list"):
 			log.Debug("got list line")
 			var (
@@ -146,64 +545,142 @@ func speakGit(r io.Reader, w io.Writer) error {
 				err     error
 				head    string
 			)
-			if err = listInfoRefs(forPush); err == nil { // try .git/info/refs first
+			if err = listInfoRefs(ctx, forPush); err == nil { // try .git/info/refs first
 				if head, err = listHeadRef(); err != nil {
-					return err
+					if !forPush {
+						return err
+					}
+					// a broken HEAD doesn't stop a push, pushHeadLine leaves it out
+					err = nil
 				}
 			} else { // alternativly iterate over the refs directory like git-remote-dropbox
 				if forPush {
 					log.Info("for-push: should be able to push to non existant.. TODO #2")
 				}
 				log.WithField("err", err).Debug("didn't find info/refs in repo, falling back...")
-				if err = listIterateRefs(forPush); err != nil {
-					return err
+				err = listIterateRefs(ctx, forPush)
+				if err == nil {
+					// read HEAD instead of only guessing master, branch snapshots (GIT_IPFS_LAYOUT=per-branch) point it elsewhere
+					if h, errHead := listHeadRef(); errHead == nil {
+						head = h
+					}
+				}
+			}
+			if errCtx := ctx.Err(); errCtx != nil {
+				// what was listed so far isn't all there is
+				return errCtx
+			}
+			if len(ref2hash) == 0 && salvageRefs && !forPush {
+				objectSharding = detectSharding(false)
+				tips, errSalvage := salvageTips(ctx)
+				if errSalvage != nil {
+					log.WithField("err", errSalvage).Warning("salvaging refs from the objects failed")
+				}
+				for _, tip := range tips {
+					ref2hash[salvagedRef(tip)] = tip
+				}
+				if len(tips) > 0 {
+					progressf("warning: the remote has no refs, offering the %d commits nothing builds on as refs/heads/salvaged/*\n", len(tips))
+					head, err = tips[0], nil
 				}
 			}
 			if len(ref2hash) == 0 {
-				return errgo.New("did not find _any_ refs...")
+				// an empty repo still has a HEAD pointing at an unborn branch
+				headRef, errHead := readHeadRef()
+				if errHead != nil {
+					if err == nil {
+						err = errHead
+					}
+					return withKind(err, ErrNotARepo, "did not find _any_ refs...")
+				}
+				log.WithField("head", headRef).Debug("empty repo")
+				objectFormat = detectObjectFormat()
+				objectSharding = detectSharding(forPush)
+				if objectFormatOption {
+					fmt.Fprintf(w, ":object-format %s\n", objectFormat)
+				}
+				if !forPush {
+					// push has nothing to compare an unborn HEAD with
+					fmt.Fprintf(w, "@%s HEAD\n", headRef)
+				}
+				fmt.Fprintln(w, "")
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			objectFormat = detectObjectFormat()
+			objectSharding = detectSharding(false)
+			if !forPush {
+				smallRepo = detectSmallRepo()
 			}
 			// output
+			if objectFormatOption {
+				fmt.Fprintf(w, ":object-format %s\n", objectFormat)
+			}
+			var tips []string
 			for ref, hash := range ref2hash {
-				if head == "" && strings.HasSuffix(ref, "master") {
-					// guessing head if it isnt set
-					head = hash
+				// a push compares against every ref, a hidden one would look new to it
+				if !forPush && !refAllowed(ref) {
+					continue
 				}
 				fmt.Fprintf(w, "%s %s\n", hash, ref)
+				tips = append(tips, hash)
+			}
+			if forPush {
+				// what git decides about pushing HEAD on has to be what the remote stores, not a guess
+				if line := pushHeadLine(); line != "" {
+					fmt.Fprintln(w, line)
+				}
+			} else if line := listHeadLine(head); line != "" {
+				fmt.Fprintln(w, line)
+			}
+			if prefetchTips && !forPush && !assumePacked {
+				// packed objects aren't there one at a time
+				prefetchDone = startPrefetch(ctx, tips)
 			}
-			fmt.Fprintf(w, "%s HEAD\n", head)
 			fmt.Fprintln(w, "")
 
 		case strings.HasPrefix(text, "fetch "):
-			for scanner.Scan() {
-				fetchSplit := strings.Split(text, " ")
-				if len(fetchSplit) < 2 {
-					return errgo.Newf("malformed 'fetch' command. %q", text)
-				}
-				f := map[string]interface{}{
-					"sha1": fetchSplit[1],
-					"name": fetchSplit[2],
-				}
-				err := fetchObject(fetchSplit[1])
-				if err == nil {
-					log.WithFields(f).Debug("fetched loose")
-					fmt.Fprintln(w, "")
-					continue
+			// a batch of fetch lines ends with a blank one
+			fetched, err := fetchBatch(ctx, text, scanner)
+			if err != nil {
+				return err
+			}
+			// without it the missing parents fail git's connectivity check
+			if err := markSinceShallow(); err != nil {
+				return err
+			}
+			if writeCommitGraph {
+				tips := make([]string, 0, len(fetched))
+				for _, sha1 := range fetched {
+					tips = append(tips, sha1)
 				}
-				log.WithFields(f).WithField("err", err).Debug("fetchLooseObject failed, trying packed...")
-				err = fetchPackedObject(fetchSplit[1])
-				if err != nil {
-					return errgo.Notef(err, "fetchPackedObject() failed")
+				if err := gitWriteCommitGraph(tips); err != nil {
+					// only a cache, git does without it
+					log.WithField("err", err).Warning("writing the commit-graph failed")
 				}
-				log.WithFields(f).Debug("fetched packed")
-				text = scanner.Text()
-				if text == "" {
-					break
+			}
+			if trackRefs {
+				if err := trackFetched(fetched); err != nil {
+					// the objects are there, git can still update its own refs
+					log.WithField("err", err).Warning("tracking fetched refs failed")
 				}
 			}
 			fmt.Fprintln(w, "")
 
 		case strings.HasPrefix(text, "push"):
+			var pushed []string
+			var refused error
+			if !canWrite() {
+				refused = errReadOnly
+			} else if err := prePush(); err != nil {
+				refused = err
+			}
 			for scanner.Scan() {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
 				pushSplit := strings.Split(text, " ")
 				if len(pushSplit) < 2 {
 					return errgo.Newf("malformed 'push' command. %q", text)
@@ -218,20 +695,41 @@ func speakGit(r io.Reader, w io.Writer) error {
 					"dst": dst,
 				}
 				log.WithFields(f).Debug("got push")
-				if src == "" {
-					fmt.Fprintf(w, "error %s %s\n", dst, "delete remote dst: not supported yet - please open an issue on github")
+				if refused != nil {
+					// instead of failing deep in the first add
+					fmt.Fprintf(w, "error %s %s\n", dst, refused)
+				} else if src == "" || src == "+" {
+					if err := pushDelete(ctx, dst); err != nil {
+						fmt.Fprintf(w, "error %s %s\n", dst, err)
+					} else {
+						pushed = append(pushed, dst)
+					}
 				} else {
-					if err := push(src, dst); err != nil {
+					if err := push(ctx, src, dst); err != nil {
 						fmt.Fprintf(w, "error %s %s\n", dst, err)
 						return err
 					}
-					fmt.Fprintln(w, "ok", dst)
+					pushed = append(pushed, dst)
 				}
 				text = scanner.Text()
 				if text == "" {
 					break
 				}
 			}
+			if refused != nil {
+				fmt.Fprintln(w, "")
+				continue
+			}
+			// all refs of the batch go into one new root
+			if err := pushFinish(ctx); err != nil {
+				for _, dst := range pushed {
+					fmt.Fprintf(w, "error %s %s\n", dst, err)
+				}
+				return err
+			}
+			for _, dst := range pushed {
+				fmt.Fprintln(w, "ok", dst)
+			}
 			fmt.Fprintln(w, "")
 
 		case text == "":
@@ -244,5 +742,5 @@ func speakGit(r io.Reader, w io.Writer) error {
 	if err := scanner.Err(); err != nil {
 		return errgo.Notef(err, "scanner.Err()")
 	}
-	return nil
+	return pw.check()
 }
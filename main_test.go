@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const fixtureSha = "9417d011822b875da72221c8d188089cbfcee806"
+
+// useFakeRepo points ipfsRepoPath at a fake repo with the given files and resets ref2hash
+func useFakeRepo(t testing.TB, files map[string]string) (*fakeShell, func()) {
+	fs, restore := useFakeShell()
+	oldPath, oldIPNS := ipfsRepoPath, ipnsRepoPath
+	ipfsRepoPath, ipnsRepoPath = "/ipfs/"+fs.addTree(files), ""
+	ref2hash = make(map[string]string)
+	peeled = make(map[string]string)
+	smallRepo = false
+	remoteAlts = nil
+	// a push some test left unfinished doesn't carry over to the new remote
+	pushRoot, pushStartTop, pushOldRoot, pushRefs = "", "", "", nil
+	return fs, func() {
+		restore()
+		ipfsRepoPath, ipnsRepoPath = oldPath, oldIPNS
+		ref2hash = make(map[string]string)
+	}
+}
+
+func TestSpeakGit_quiet(t *testing.T) {
+	files := map[string]string{"HEAD": "ref: refs/heads/master\n"}
+	commit, _ := fixtureCommit(files, "quiet\n")
+	files["refs/heads/master"] = commit + "\n"
+	files["info/refs"] = commit + "\trefs/heads/master\n"
+	_, restore := useFakeRepo(t, files)
+	defer restore()
+	defer useTmpGitDir(t)()
+
+	// like main does it, then everything it would print goes to errOut
+	defer func(q, v bool, level logrus.Level, out io.Writer) {
+		quiet, verbose, stderr = q, v, os.Stderr
+		logrus.SetLevel(level)
+		log.Logger.Out = out
+		os.Unsetenv("GIT_IPFS_QUIET")
+	}(quiet, verbose, logrus.GetLevel(), log.Logger.Out)
+	os.Setenv("GIT_IPFS_QUIET", "1")
+	setupLogging()
+	var errOut bytes.Buffer
+	stderr, log.Logger.Out = &errOut, &errOut
+
+	var out bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("capabilities\nlist\nfetch "+commit+" refs/heads/master\n\n"), &out))
+	if !strings.Contains(out.String(), commit+" refs/heads/master\n") {
+		t.Errorf("list output is missing the master ref:\n%s", out.String())
+	}
+	if _, err := os.Stat(filepath.Join(thisGitRepo, objectPath(commit))); err != nil {
+		t.Errorf("the commit wasn't fetched: %s", err)
+	}
+
+	_, cleanup := mkLocalRepo(t, "ipfs://"+ipfsRepoPath)
+	defer cleanup()
+	out.Reset()
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("push refs/heads/master:refs/heads/quiet\n\n"), &out))
+	if out.String() != "ok refs/heads/quiet\n\n" {
+		t.Errorf("unexpected push reply %q", out.String())
+	}
+	log.Warning("this should not show up")
+	progressf("this should not show up\n")
+	if errOut.Len() != 0 {
+		t.Errorf("expected empty stderr in quiet mode, got %q", errOut.String())
+	}
+}
+
+func TestSpeakGit_transportCapabilities(t *testing.T) {
+	defer func(old string) { transport = old }(transport)
+	caps := make(map[string]string)
+	for _, mode := range []string{transportDumb, transportSmart} {
+		transport = mode
+		var out bytes.Buffer
+		checkFatal(t, speakGit(context.Background(), strings.NewReader("capabilities\n"), &out))
+		caps[mode] = out.String()
+	}
+	if caps[transportDumb] != "fetch\npush\noption\nobject-format\n\n" {
+		t.Errorf("unexpected dumb capabilities: %q", caps[transportDumb])
+	}
+	if caps[transportSmart] != "connect\nfetch\npush\noption\nobject-format\n\n" {
+		t.Errorf("unexpected smart capabilities: %q", caps[transportSmart])
+	}
+
+	var out bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("connect git-upload-pack\n"), &out))
+	if out.String() != "fallback\n" {
+		t.Errorf("expected connect to fall back, got %q", out.String())
+	}
+}
+
+func TestSpeakGit_refspecCapability(t *testing.T) {
+	_, cleanup := mkLocalRepo(t, "ipfs://ipfs/QmdfTbBqBPQ7VNxZEYEj14VmRuZBkqFbiwReogJgS1zR1n")
+	defer cleanup()
+	defer func() { refspecs = nil }()
+	for _, spec := range []string{"refs/heads/*:refs/ipfs/origin/heads/*", "refs/tags/*:refs/ipfs/origin/tags/*"} {
+		cmd := exec.Command("git", "config", "--add", "remote.origin.ipfsRefspec", spec)
+		cmd.Dir = thisGitRepo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git config failed: %s\n%s", err, out)
+		}
+	}
+	checkFatal(t, loadRefspecs())
+	var out bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("capabilities\n"), &out))
+	want := "fetch\npush\noption\nobject-format\nrefspec refs/heads/*:refs/ipfs/origin/heads/*\nrefspec refs/tags/*:refs/ipfs/origin/tags/*\n\n"
+	if out.String() != want {
+		t.Errorf("unexpected capabilities:\n%q\nwant\n%q", out.String(), want)
+	}
+
+	cmd := exec.Command("git", "config", "--add", "remote.origin.ipfsRefspec", "refs/heads/*")
+	cmd.Dir = thisGitRepo
+	checkFatal(t, cmd.Run())
+	if err := loadRefspecs(); err == nil {
+		t.Error("expected an error for a refspec without destination")
+	}
+}
+
+func TestAPIAddress_precedence(t *testing.T) {
+	_, cleanup := mkLocalRepo(t, "ipfs://ipfs/QmdfTbBqBPQ7VNxZEYEj14VmRuZBkqFbiwReogJgS1zR1n")
+	defer cleanup()
+	defer os.Setenv("IPFS_API", os.Getenv("IPFS_API"))
+	checkFatal(t, os.Unsetenv("IPFS_API"))
+	gitSet := func(key, value string) {
+		cmd := exec.Command("git", "config", key, value)
+		cmd.Dir = thisGitRepo
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git config %s failed: %s\n%s", key, err, out)
+		}
+	}
+
+	if got := apiAddress(); got != defaultAPIAddress {
+		t.Errorf("default: want %q got %q", defaultAPIAddress, got)
+	}
+	gitSet("ipfs.api", "global:5001")
+	if got := apiAddress(); got != "global:5001" {
+		t.Errorf("ipfs.api: want global:5001 got %q", got)
+	}
+	gitSet("remote.origin.ipfsApi", "remote:5001")
+	if got := apiAddress(); got != "remote:5001" {
+		t.Errorf("remote.origin.ipfsApi: want remote:5001 got %q", got)
+	}
+	checkFatal(t, os.Setenv("IPFS_API", "env:5001"))
+	if got := apiAddress(); got != "env:5001" {
+		t.Errorf("IPFS_API: want env:5001 got %q", got)
+	}
+}
+
+// linkedWorktree adds a worktree of the repo at thisGitRepo on a new branch and returns its .git file
+func linkedWorktree(t *testing.T, branch string) string {
+	wt := filepath.Join(filepath.Dir(thisGitRepo), "wt")
+	gitRun(t, "worktree", "add", "-q", "-b", branch, wt)
+	return filepath.Join(wt, ".git")
+}
+
+func TestResolveGitDir_worktree(t *testing.T) {
+	head, cleanup := mkLocalRepo(t, "ipfs://ipfs/"+fixtureHash)
+	defer cleanup()
+	mainGitDir := thisGitRepo
+	dotGit := linkedWorktree(t, "wt")
+	if info, err := os.Stat(dotGit); err != nil || info.IsDir() {
+		t.Fatalf("expected the worktree's .git to be a file: %v", err)
+	}
+	wtGitDir := filepath.Join(mainGitDir, "worktrees", "wt")
+	got, common, err := resolveGitDir(dotGit)
+	checkFatal(t, err)
+	if got != wtGitDir || common != mainGitDir {
+		t.Fatalf("resolved to %s and %s, want %s and %s", got, common, wtGitDir, mainGitDir)
+	}
+
+	// a relative pointer, like git worktree add --relative-paths writes
+	rel, err := filepath.Rel(filepath.Dir(dotGit), wtGitDir)
+	checkFatal(t, err)
+	checkFatal(t, os.Chmod(dotGit, 0600))
+	checkFatal(t, ioutil.WriteFile(dotGit, []byte("gitdir: "+rel+"\n"), 0600))
+	if got, common, err = resolveGitDir(dotGit); err != nil || got != wtGitDir || common != mainGitDir {
+		t.Fatalf("relative gitdir: resolved to %s and %s (%v), want %s and %s", got, common, err, wtGitDir, mainGitDir)
+	}
+	if got, common, err = resolveGitDir(mainGitDir); err != nil || got != mainGitDir || common != mainGitDir {
+		t.Fatalf("main git dir: resolved to %s and %s (%v)", got, common, err)
+	}
+
+	// local refs and objects work through it
+	thisGitRepo, gitCommonDir = wtGitDir, mainGitDir
+	defer func() { gitCommonDir = "" }()
+	sha1, err := gitRefHash("refs/heads/wt")
+	if err != nil || sha1 != head {
+		t.Errorf("worktree branch: got %s (%v), want %s", sha1, err, head)
+	}
+	files := map[string]string{}
+	commit, _ := fixtureCommit(files, "into the worktree\n")
+	_, restore := useFakeRepo(t, files)
+	defer restore()
+	checkFatal(t, fetchObject(context.Background(), commit))
+	if !gitHasObject(commit) {
+		t.Errorf("fetched object %s not in the shared object store", commit)
+	}
+
+	notGit := filepath.Join(filepath.Dir(dotGit), "README")
+	checkFatal(t, ioutil.WriteFile(notGit, []byte("hi\n"), 0600))
+	if _, _, err := resolveGitDir(notGit); err == nil {
+		t.Error("expected an error for a file without gitdir:")
+	}
+}
+
+func TestPush_worktreeDetachedHead(t *testing.T) {
+	fs, restore := useFakeRepo(t, map[string]string{"HEAD": "ref: refs/heads/master\n"})
+	defer restore()
+	mainHead, cleanup := mkLocalRepo(t, "ipfs://"+ipfsRepoPath)
+	defer cleanup()
+	dotGit := linkedWorktree(t, "wt")
+	// the worktree's own HEAD, detached at a commit the main repo's HEAD isn't at
+	gitRun(t, "-C", filepath.Dir(dotGit), "checkout", "-q", "--detach")
+	gitRun(t, "-C", filepath.Dir(dotGit), "commit", "-q", "--allow-empty", "-m", "detached")
+	gitDir, common, err := resolveGitDir(dotGit)
+	checkFatal(t, err)
+	thisGitRepo, gitCommonDir = gitDir, common
+	defer func() { gitCommonDir = "" }()
+	head, err := gitRefHash("HEAD")
+	checkFatal(t, err)
+	if head == mainHead {
+		t.Fatalf("HEAD %s is the main repo's, not the worktree's", head)
+	}
+
+	var out bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("push HEAD:refs/heads/detached\n\n"), &out))
+	if out.String() != "ok refs/heads/detached\n\n" {
+		t.Fatalf("unexpected push reply %q", out.String())
+	}
+	rc, err := fs.Cat(strings.TrimPrefix(remoteURL(t), "ipfs://") + "/refs/heads/detached")
+	checkFatal(t, err)
+	pushed, err := ioutil.ReadAll(rc)
+	checkFatal(t, err)
+	if string(pushed) != head+"\n" {
+		t.Errorf("pushed %q, want the worktree's HEAD %s", pushed, head)
+	}
+}
+
+// interruptingShell cancels on the first Cat or Add, like a SIGINT arriving in the middle of an operation
+type interruptingShell struct {
+	ipfsAPI
+	cancel func()
+	mu     sync.Mutex
+	calls  int // of Cat and Add, the interrupted one included
+}
+
+func (s *interruptingShell) interrupt() {
+	s.mu.Lock()
+	s.calls++
+	s.mu.Unlock()
+	s.cancel()
+}
+
+func (s *interruptingShell) Cat(p string) (io.ReadCloser, error) {
+	s.interrupt()
+	return s.ipfsAPI.Cat(p)
+}
+
+func (s *interruptingShell) Add(r io.Reader) (string, error) {
+	s.interrupt()
+	return s.ipfsAPI.Add(r)
+}
+
+func TestSpeakGit_interrupted(t *testing.T) {
+	files := map[string]string{"HEAD": "ref: refs/heads/master\n"}
+	commit, _ := fixtureCommit(files, "interrupted\n")
+	for _, b := range []string{"master", "a", "b"} {
+		files["refs/heads/"+b] = commit + "\n"
+	}
+	for _, tc := range []struct {
+		name, cmds string
+		maxCalls   int // more would mean it went on after the cancel
+	}{
+		{"list", "list\n", 2},
+		{"fetch", "fetch " + commit + " refs/heads/master\n\n", 1},
+		{"push", "push refs/heads/master:refs/heads/master\n\n", pushConcurrency},
+	} {
+		fs, restore := useFakeRepo(t, files)
+		_, cleanup := mkLocalRepo(t, "ipfs://"+ipfsRepoPath)
+		if tc.name == "fetch" {
+			ref2hash["refs/heads/master"] = commit
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		s := &interruptingShell{ipfsAPI: fs, cancel: cancel}
+		ipfsShell = s
+		patches := fs.calls["PatchLink"]
+
+		start := time.Now()
+		err := speakGit(ctx, strings.NewReader(tc.cmds), ioutil.Discard)
+		if exitCode(err) != exitInterrupted {
+			t.Errorf("%s: want a context error, got %v", tc.name, err)
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Errorf("%s: took %s to stop", tc.name, time.Since(start))
+		}
+		if s.calls > tc.maxCalls {
+			t.Errorf("%s: %d daemon calls after the cancel", tc.name, s.calls-1)
+		}
+		if tc.name == "push" && fs.calls["Publish"]+fs.calls["PatchLink"] > patches {
+			t.Errorf("push: the interrupted push changed the remote")
+		}
+		cancel()
+		cleanup()
+		restore()
+	}
+}
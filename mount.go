@@ -0,0 +1,213 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cryptix/git-remote-ipfs/fetch"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+)
+
+// mountRoot is the worktree of commit (or a tag or tree) as a file system.
+// directories and files are read from the remote when they are looked at first, nothing else is.
+func mountRoot(ctx context.Context, commit string) nodefs.Node {
+	return newMountDir(mountNode{ctx: ctx, hash: commit, mtime: time.Now()})
+}
+
+// mountServer mounts root at dir, Serve serves it until it's unmounted
+func mountServer(dir string, root nodefs.Node) (*fuse.Server, error) {
+	conn := nodefs.NewFileSystemConnector(root, nil)
+	return fuse.NewServer(conn.RawFS(), dir, &fuse.MountOptions{
+		Name:   "git-remote-ipfs",
+		FsName: "git-remote-ipfs",
+		// without fusermount, when we are allowed to mount ourselves
+		DirectMount: true,
+	})
+}
+
+// mountNode is what the nodes of a mount have in common, the object behind them
+type mountNode struct {
+	ctx   context.Context
+	hash  string
+	mtime time.Time
+}
+
+// child is the node of the tree entry e
+func (n mountNode) child(e fetch.Entry) nodefs.Node {
+	c := mountNode{ctx: n.ctx, hash: e.Hash, mtime: n.mtime}
+	switch {
+	case e.IsSubmodule():
+		// an empty directory, like git leaves one before it's initialized
+		c.hash = ""
+		return newMountDir(c)
+	case e.IsDir():
+		return newMountDir(c)
+	case e.IsSymlink():
+		return &mountFile{Node: nodefs.NewDefaultNode(), mountNode: c, link: true}
+	}
+	return &mountFile{Node: nodefs.NewDefaultNode(), mountNode: c, exec: e.IsExecutable()}
+}
+
+type mountDir struct {
+	nodefs.Node
+	mountNode
+	once    sync.Once
+	entries []fetch.Entry
+	err     error
+}
+
+func newMountDir(n mountNode) *mountDir {
+	return &mountDir{Node: nodefs.NewDefaultNode(), mountNode: n}
+}
+
+func (d *mountDir) read() ([]fetch.Entry, error) {
+	d.once.Do(func() {
+		if d.hash == "" {
+			return
+		}
+		if d.entries, d.err = fetch.ReadTree(d.ctx, remoteStore{objStore}, d.hash); d.err != nil {
+			log.WithField("tree", d.hash).WithField("err", d.err).Error("mount: reading tree failed")
+		}
+	})
+	return d.entries, d.err
+}
+
+func (d *mountDir) GetAttr(out *fuse.Attr, _ nodefs.File, _ *fuse.Context) fuse.Status {
+	out.Mode = fuse.S_IFDIR | 0555
+	out.SetTimes(nil, &d.mtime, nil)
+	return fuse.OK
+}
+
+// Lookup is only asked for the names that weren't looked up before
+func (d *mountDir) Lookup(out *fuse.Attr, name string, c *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	entries, err := d.read()
+	if err != nil {
+		return nil, fuse.EIO
+	}
+	for _, e := range entries {
+		if e.Name != name {
+			continue
+		}
+		child := d.child(e)
+		if code := child.GetAttr(out, nil, c); !code.Ok() {
+			return nil, code
+		}
+		return d.Inode().NewChild(name, e.IsDir() || e.IsSubmodule(), child), fuse.OK
+	}
+	return nil, fuse.ENOENT
+}
+
+func (d *mountDir) OpenDir(_ *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	entries, err := d.read()
+	if err != nil {
+		return nil, fuse.EIO
+	}
+	list := make([]fuse.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		mode := uint32(fuse.S_IFREG)
+		switch {
+		case e.IsDir(), e.IsSubmodule():
+			mode = fuse.S_IFDIR
+		case e.IsSymlink():
+			mode = fuse.S_IFLNK
+		}
+		list = append(list, fuse.DirEntry{Name: e.Name, Mode: mode})
+	}
+	return list, fuse.OK
+}
+
+// mountFile is a file or symlink, its blob is read once for its size and kept
+type mountFile struct {
+	nodefs.Node
+	mountNode
+	exec, link bool
+	once       sync.Once
+	data       []byte
+	err        error
+}
+
+func (f *mountFile) readAll() ([]byte, error) {
+	f.once.Do(func() {
+		if f.data, f.err = fetch.ReadBlob(f.ctx, remoteStore{objStore}, f.hash); f.err != nil {
+			log.WithField("blob", f.hash).WithField("err", f.err).Error("mount: reading blob failed")
+		}
+	})
+	return f.data, f.err
+}
+
+func (f *mountFile) GetAttr(out *fuse.Attr, _ nodefs.File, _ *fuse.Context) fuse.Status {
+	data, err := f.readAll()
+	if err != nil {
+		return fuse.EIO
+	}
+	out.Mode, out.Size = fuse.S_IFREG|0444, uint64(len(data))
+	switch {
+	case f.link:
+		out.Mode = fuse.S_IFLNK | 0777
+	case f.exec:
+		out.Mode = fuse.S_IFREG | 0555
+	}
+	out.SetTimes(nil, &f.mtime, nil)
+	return fuse.OK
+}
+
+func (f *mountFile) Open(flags uint32, _ *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EROFS
+	}
+	data, err := f.readAll()
+	if err != nil {
+		return nil, fuse.EIO
+	}
+	return nodefs.NewReadOnlyFile(nodefs.NewDataFile(data)), fuse.OK
+}
+
+func (f *mountFile) Readlink(_ *fuse.Context) ([]byte, fuse.Status) {
+	data, err := f.readAll()
+	if err != nil {
+		return nil, fuse.EIO
+	}
+	return data, fuse.OK
+}
+
+// mountMain is git-remote-ipfs mount <url> <ref> <mountpoint>
+func mountMain(args []string) int {
+	flags := flag.NewFlagSet("mount", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil || flags.NArg() != 3 {
+		fmt.Fprintln(os.Stderr, "usage: git-remote-ipfs mount <url> <ref> <mountpoint>")
+		return exitUsage
+	}
+	if code := openRemote(flags.Arg(0)); code != 0 {
+		return code
+	}
+	ref, dir := flags.Arg(1), flags.Arg(2)
+	commit, err := resolveRef(ref)
+	if err != nil {
+		log.Error("mount failed:", err)
+		return exitCode(err)
+	}
+	ctx := interruptContext()
+	server, err := mountServer(dir, mountRoot(ctx, commit))
+	if err != nil {
+		log.Error("mount failed:", err)
+		return exitFailure
+	}
+	cleanups = append(cleanups, func() { server.Unmount() })
+	go func() {
+		<-ctx.Done()
+		if err := server.Unmount(); err != nil {
+			log.WithField("err", err).Error("unmounting failed")
+		}
+	}()
+	fmt.Fprintf(os.Stderr, "mounted %s (%s) at %s, unmount it or interrupt to stop\n", ref, commit, dir)
+	server.Serve()
+	return 0
+}
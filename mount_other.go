@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+// mountMain is git-remote-ipfs mount, fuse mounts need linux or darwin
+func mountMain(args []string) int {
+	log.Error("mount failed: fuse mounts only work on linux and darwin")
+	return exitFailure
+}
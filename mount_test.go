@@ -0,0 +1,73 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMount(t *testing.T) {
+	files := map[string]string{"HEAD": "ref: refs/heads/master\n"}
+	mainGo, z := looseObject("blob", "package main\n")
+	files[objectPath(mainGo)] = z
+	run, z := looseObject("blob", "#!/bin/sh\n")
+	files[objectPath(run)] = z
+	other, z := looseObject("blob", "never read\n")
+	files[objectPath(other)] = z
+	mainSum, _ := hex.DecodeString(mainGo)
+	runSum, _ := hex.DecodeString(run)
+	otherSum, _ := hex.DecodeString(other)
+	sub, z := looseObject("tree", "100644 main.go\x00"+string(mainSum)+"100644 other.go\x00"+string(otherSum))
+	files[objectPath(sub)] = z
+	subSum, _ := hex.DecodeString(sub)
+	tree, z := looseObject("tree", "40000 cmd\x00"+string(subSum)+"100755 run.sh\x00"+string(runSum))
+	files[objectPath(tree)] = z
+	commit, z := looseObject("commit", "tree "+tree+"\nauthor a <a@b> 0 +0000\ncommitter a <a@b> 0 +0000\n\nmount\n")
+	files[objectPath(commit)] = z
+	files["refs/heads/master"] = commit + "\n"
+	fs, restore := useFakeRepo(t, files)
+	defer restore()
+
+	dir := mkRandTmpDir(t)
+	defer rmDir(t, dir)
+	sha1, err := resolveRef("master")
+	checkFatal(t, err)
+	server, err := mountServer(dir, mountRoot(context.Background(), sha1))
+	if err != nil {
+		t.Skipf("can't mount: %s", err)
+	}
+	served := make(chan struct{})
+	go func() { server.Serve(); close(served) }()
+	checkFatal(t, server.WaitMount())
+	defer func() {
+		checkFatal(t, server.Unmount())
+		select {
+		case <-served:
+		case <-time.After(10 * time.Second):
+			t.Error("serve didn't stop after unmounting")
+		}
+	}()
+
+	cats := fs.callCount("Cat")
+	got, err := ioutil.ReadFile(filepath.Join(dir, "cmd", "main.go"))
+	if err != nil || string(got) != "package main\n" {
+		t.Errorf("cmd/main.go: %q %v", got, err)
+	}
+	// the commit, both trees and one of the blobs
+	if n := fs.callCount("Cat") - cats; n != 4 {
+		t.Errorf("want 4 objects read for one file, got %d", n)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "run.sh")); err != nil || fi.Mode().Perm()&0100 == 0 {
+		t.Errorf("run.sh not executable: %v %v", fi, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cmd", "nope.go")); !os.IsNotExist(err) {
+		t.Errorf("want no such file, got %v", err)
+	}
+}
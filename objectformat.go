@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"hash"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+)
+
+// object formats, extensions.objectFormat of a repo's config
+const (
+	formatSHA1   = "sha1"
+	formatSHA256 = "sha256"
+)
+
+// objectFormat is what the objects of the remote are named with, set by list
+var objectFormat = formatSHA1
+
+// objectFormatOption is set once git asked (option object-format true) to be told the format in the list output
+var objectFormatOption bool
+
+// objectHash returns a new hash of objectFormat
+func objectHash() hash.Hash {
+	if objectFormat == formatSHA256 {
+		return sha256.New()
+	}
+	return sha1.New()
+}
+
+// detectObjectFormat reads extensions.objectFormat from the config of the remote.
+// repos without a config (or without the setting) are told apart by the length of their ref hashes.
+func detectObjectFormat() string {
+	if rc, err := ipfsShell.Cat(inRepo("config")); err == nil {
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if f := configObjectFormat(string(data)); err == nil && f != "" {
+			return f
+		}
+	}
+	for _, h := range ref2hash {
+		if len(h) == 2*sha256.Size {
+			return formatSHA256
+		}
+	}
+	return formatSHA1
+}
+
+// configObjectFormat finds objectformat in the [extensions] section of a git config
+func configObjectFormat(config string) string {
+	var section string
+	for _, line := range strings.Split(config, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			section = strings.ToLower(strings.Trim(line, "[]"))
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if section == "extensions" && len(kv) == 2 && strings.EqualFold(strings.TrimSpace(kv[0]), "objectformat") {
+			return strings.ToLower(strings.TrimSpace(kv[1]))
+		}
+	}
+	return ""
+}
+
+// gitShowIndex is git show-index for pack indexes of objectFormat.
+// outside of a repo it can't tell, the flag is only given for sha256 so older gits still work for sha1 ones.
+func gitShowIndex() *exec.Cmd {
+	if objectFormat == formatSHA256 {
+		return exec.Command("git", "show-index", "--object-format="+formatSHA256)
+	}
+	return exec.Command("git", "show-index")
+}
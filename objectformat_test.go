@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sha256Repo makes a repo with objectFormat = sha256 and returns its files (loose or packed)
+// and the commit of master
+func sha256Repo(t *testing.T, packed bool) (map[string]string, string) {
+	dir := mkRandTmpDir(t)
+	defer rmDir(t, dir)
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Skipf("git %v failed, no sha256 support? %s\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q", "--bare", "--object-format=sha256", ".")
+	git("config", "core.bare", "false")
+	checkFatal(t, os.MkdirAll(filepath.Join(dir, "dir"), 0700))
+	checkFatal(t, ioutil.WriteFile(filepath.Join(dir, "dir", "file.txt"), []byte("sha256\n"), 0600))
+	git("--work-tree=.", "add", "dir")
+	git("--work-tree=.", "commit", "-q", "-m", "sha256")
+	commit := git("rev-parse", "refs/heads/master")
+	if packed {
+		git("repack", "-q", "-a", "-d")
+	}
+	files := map[string]string{"info/refs": commit + "\trefs/heads/master\n"}
+	checkFatal(t, filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		rel, _ := filepath.Rel(dir, p)
+		if err != nil || info.IsDir() || !(rel == "HEAD" || rel == "config" || strings.HasPrefix(rel, "objects/")) {
+			return err
+		}
+		data, err := ioutil.ReadFile(p)
+		files[rel] = string(data)
+		return err
+	}))
+	return files, commit
+}
+
+func TestFetch_sha256(t *testing.T) {
+	defer func() { objectFormat, objectFormatOption = formatSHA1, false }()
+	for _, packed := range []bool{false, true} {
+		files, commit := sha256Repo(t, packed)
+		if len(commit) != 64 {
+			t.Fatalf("not a sha256 commit: %s", commit)
+		}
+		_, restore := useFakeRepo(t, files)
+		cleanup := useTmpGitDir(t)
+		if out, err := exec.Command("git", "init", "-q", "--bare", "--object-format=sha256", thisGitRepo).CombinedOutput(); err != nil {
+			t.Fatalf("git init failed: %s\n%s", err, out)
+		}
+
+		var out bytes.Buffer
+		checkFatal(t, speakGit(context.Background(), strings.NewReader("option object-format true\nlist\n"), &out))
+		if !strings.HasPrefix(out.String(), "ok\n:object-format sha256\n") || !strings.Contains(out.String(), commit+" refs/heads/master\n") {
+			t.Errorf("packed %v: unexpected list output:\n%s", packed, out.String())
+		}
+		out.Reset()
+		checkFatal(t, speakGit(context.Background(), strings.NewReader("fetch "+commit+" refs/heads/master\n\n"), &out))
+		show := exec.Command("git", "--git-dir", thisGitRepo, "cat-file", "-p", commit+":dir/file.txt")
+		if data, err := show.CombinedOutput(); err != nil || string(data) != "sha256\n" {
+			t.Errorf("packed %v: file of the fetched commit: %q %v", packed, data, err)
+		}
+		cleanup()
+		restore()
+	}
+}
+
+func TestConfigObjectFormat(t *testing.T) {
+	for config, want := range map[string]string{
+		"[core]\n\tbare = true\n": "",
+		"[core]\n\trepositoryformatversion = 1\n[extensions]\n\tobjectformat = sha256\n": "sha256",
+		"[Extensions]\n\tobjectFormat = SHA1\n":                                          "sha1",
+		"[other]\n\tobjectformat = sha256\n":                                             "",
+	} {
+		if got := configObjectFormat(config); got != want {
+			t.Errorf("%q: want %q got %q", config, want, got)
+		}
+	}
+}
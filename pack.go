@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/cryptix/git-remote-ipfs/internal/zstd"
+	"gopkg.in/errgo.v1"
+)
+
+// pack object types, see Documentation/technical/pack-format.txt
+const (
+	packCommit   = 1
+	packTree     = 2
+	packBlob     = 3
+	packTag      = 4
+	packOfsDelta = 6
+	packRefDelta = 7
+)
+
+var packTypeNames = map[int]string{
+	packCommit: "commit",
+	packTree:   "tree",
+	packBlob:   "blob",
+	packTag:    "tag",
+}
+
+// errBaseMissing is returned while resolving a REF_DELTA whose base wasn't resolved (yet)
+var errBaseMissing = errgo.New("delta base not resolved")
+
+type packEntry struct {
+	typ     int
+	data    []byte // inflated object or delta instructions
+	baseOff int64  // OFS_DELTA base
+	baseSha string // REF_DELTA base
+
+	// filled by resolve
+	kind     string
+	resolved []byte
+}
+
+// pack holds all the entries of a packfile, keyed by their offset
+type pack struct {
+	entries map[int64]*packEntry
+	offsets []int64          // in pack order
+	bySha   map[string]int64 // sha1 -> offset of resolved entries
+}
+
+// parsePack reads the complete packfile from r and inflates all its entries
+func parsePack(r io.Reader) (*pack, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errgo.Notef(err, "parsePack: reading pack failed")
+	}
+	h := objectHash()
+	if len(data) < 12+h.Size() || string(data[:4]) != "PACK" {
+		return nil, errgo.New("parsePack: not a packfile")
+	}
+	body, trailer := data[:len(data)-h.Size()], data[len(data)-h.Size():]
+	if h.Write(body); !bytes.Equal(h.Sum(nil), trailer) {
+		return nil, errgo.New("parsePack: pack checksum mismatch")
+	}
+	if v := be32(data[4:]); v != 2 && v != 3 {
+		return nil, errgo.Newf("parsePack: unsupported pack version %d", v)
+	}
+	n := be32(data[8:])
+	p := &pack{
+		entries: make(map[int64]*packEntry, n),
+		offsets: make([]int64, 0, n),
+		bySha:   make(map[string]int64, n),
+	}
+	pos := int64(12)
+	for i := uint32(0); i < n; i++ {
+		e, next, err := parsePackEntry(body, pos)
+		if err != nil {
+			return nil, errgo.Notef(err, "parsePack: entry %d at offset %d", i, pos)
+		}
+		p.entries[pos] = e
+		p.offsets = append(p.offsets, pos)
+		pos = next
+	}
+	return p, nil
+}
+
+func be32(b []byte) uint32 {
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+// parsePackEntry parses the entry at off and returns it with the offset of the next one
+func parsePackEntry(data []byte, off int64) (*packEntry, int64, error) {
+	pos := off
+	next := func() (byte, error) {
+		if pos >= int64(len(data)) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		c := data[pos]
+		pos++
+		return c, nil
+	}
+	c, err := next()
+	if err != nil {
+		return nil, 0, err
+	}
+	e := &packEntry{typ: int(c>>4) & 7}
+	size := uint64(c & 0x0f)
+	for shift := uint(4); c&0x80 != 0; shift += 7 {
+		if c, err = next(); err != nil {
+			return nil, 0, err
+		}
+		size |= uint64(c&0x7f) << shift
+	}
+	switch e.typ {
+	case packCommit, packTree, packBlob, packTag:
+	case packOfsDelta:
+		if c, err = next(); err != nil {
+			return nil, 0, err
+		}
+		rel := int64(c & 0x7f)
+		for c&0x80 != 0 {
+			if c, err = next(); err != nil {
+				return nil, 0, err
+			}
+			rel = ((rel + 1) << 7) | int64(c&0x7f)
+		}
+		if rel <= 0 || rel > off {
+			return nil, 0, errgo.Newf("bad OFS_DELTA base offset -%d", rel)
+		}
+		e.baseOff = off - rel
+	case packRefDelta:
+		size := int64(objectHash().Size())
+		if pos+size > int64(len(data)) {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		e.baseSha = fmt.Sprintf("%x", data[pos:pos+size])
+		pos += size
+	default:
+		return nil, 0, errgo.Newf("unknown pack object type %d", e.typ)
+	}
+	var end int64
+	if zstd.IsFrame(data[pos:]) {
+		// packs written with zstd instead of zlib, the frame says where it ends
+		d, n, err := zstd.Decode(data[pos:])
+		if err != nil {
+			return nil, 0, errgo.Notef(err, "zstd decoding failed")
+		}
+		e.data, end = d, pos+int64(n)
+	} else {
+		br := bytes.NewReader(data[pos:])
+		zr, err := zlib.NewReader(br)
+		if err != nil {
+			return nil, 0, errgo.Notef(err, "zlib reader failed")
+		}
+		if e.data, err = ioutil.ReadAll(zr); err != nil {
+			return nil, 0, errgo.Notef(err, "inflating failed")
+		}
+		end = int64(len(data)) - int64(br.Len())
+	}
+	if uint64(len(e.data)) != size {
+		return nil, 0, errgo.Newf("size mismatch: header %d inflated %d", size, len(e.data))
+	}
+	return e, end, nil
+}
+
+// resolve returns the git type and content of the entry at off, applying delta chains recursively
+func (p *pack) resolve(off int64, depth int) (string, []byte, error) {
+	e, ok := p.entries[off]
+	if !ok {
+		return "", nil, errgo.Newf("no pack entry at offset %d", off)
+	}
+	if e.resolved != nil {
+		return e.kind, e.resolved, nil
+	}
+	if depth > 4096 {
+		return "", nil, errgo.New("delta chain too deep (cycle?)")
+	}
+	var (
+		kind string
+		data []byte
+	)
+	switch e.typ {
+	case packOfsDelta, packRefDelta:
+		baseOff := e.baseOff
+		if e.typ == packRefDelta {
+			var ok bool
+			if baseOff, ok = p.bySha[e.baseSha]; !ok {
+				return "", nil, errBaseMissing
+			}
+		}
+		baseKind, base, err := p.resolve(baseOff, depth+1)
+		if err != nil {
+			return "", nil, err
+		}
+		if data, err = applyDelta(base, e.data); err != nil {
+			return "", nil, errgo.Notef(err, "applying delta at offset %d failed", off)
+		}
+		kind = baseKind
+	default:
+		kind, data = packTypeNames[e.typ], e.data
+	}
+	e.kind, e.resolved = kind, data
+	p.bySha[objectSha1(kind, data)] = off
+	return kind, data, nil
+}
+
+// resolveAll resolves every entry. REF_DELTA bases can come later in the pack, so it loops until nothing changes.
+func (p *pack) resolveAll() error {
+	pending := p.offsets
+	for len(pending) > 0 {
+		var left []int64
+		for _, off := range pending {
+			if _, _, err := p.resolve(off, 0); err == errBaseMissing {
+				left = append(left, off)
+			} else if err != nil {
+				return err
+			}
+		}
+		if len(left) == len(pending) {
+			return errgo.Newf("%d deltas reference bases that are not in the pack", len(left))
+		}
+		pending = left
+	}
+	return nil
+}
+
+// applyDelta reconstructs an object from its base and git delta instructions
+func applyDelta(base, delta []byte) ([]byte, error) {
+	srcSize, delta, err := deltaSize(delta)
+	if err != nil {
+		return nil, err
+	}
+	if srcSize != uint64(len(base)) {
+		return nil, errgo.Newf("delta base size mismatch: want %d got %d", srcSize, len(base))
+	}
+	dstSize, delta, err := deltaSize(delta)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, dstSize)
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+		switch {
+		case op&0x80 != 0: // copy from base
+			var off, size uint64
+			for i := uint(0); i < 7; i++ {
+				if op&(1<<i) == 0 {
+					continue
+				}
+				if len(delta) == 0 {
+					return nil, io.ErrUnexpectedEOF
+				}
+				if i < 4 {
+					off |= uint64(delta[0]) << (8 * i)
+				} else {
+					size |= uint64(delta[0]) << (8 * (i - 4))
+				}
+				delta = delta[1:]
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+			if off+size > uint64(len(base)) {
+				return nil, errgo.Newf("delta copy out of bounds: %d+%d > %d", off, size, len(base))
+			}
+			out = append(out, base[off:off+size]...)
+		case op != 0: // insert literal
+			if int(op) > len(delta) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			out = append(out, delta[:op]...)
+			delta = delta[op:]
+		default:
+			return nil, errgo.New("reserved delta opcode 0")
+		}
+	}
+	if uint64(len(out)) != dstSize {
+		return nil, errgo.Newf("delta result size mismatch: want %d got %d", dstSize, len(out))
+	}
+	return out, nil
+}
+
+// deltaSize reads one of the little endian varints at the start of a delta
+func deltaSize(delta []byte) (uint64, []byte, error) {
+	var size uint64
+	for shift := uint(0); ; shift += 7 {
+		if len(delta) == 0 {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		c := delta[0]
+		delta = delta[1:]
+		size |= uint64(c&0x7f) << shift
+		if c&0x80 == 0 {
+			return size, delta, nil
+		}
+	}
+}
+
+// objectSha1 is the git object name of data with the given type, in objectFormat
+func objectSha1(kind string, data []byte) string {
+	h := objectHash()
+	fmt.Fprintf(h, "%s %d\x00", kind, len(data))
+	h.Write(data)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// writeLooseObject puts the object into gitDir/objects and returns its sha1.
+// objects which are already present are left alone.
+func writeLooseObject(gitDir, kind string, data []byte) (string, error) {
+	sha1 := objectSha1(kind, data)
+	dir := filepath.Join(gitDir, "objects", sha1[:2])
+	target := filepath.Join(dir, sha1[2:])
+	if _, err := os.Stat(target); err == nil {
+		return sha1, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", errgo.Notef(err, "mkDirAll() failed")
+	}
+	tmp, err := ioutil.TempFile(dir, "tmp_obj_")
+	if err != nil {
+		return "", errgo.Notef(err, "creating temp object failed")
+	}
+	zw := zlib.NewWriter(tmp)
+	fmt.Fprintf(zw, "%s %d\x00", kind, len(data))
+	_, err = zw.Write(data)
+	if errClose := zw.Close(); err == nil {
+		err = errClose
+	}
+	if errClose := tmp.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), target)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", errgo.Notef(err, "writing object %s failed", sha1)
+	}
+	return sha1, nil
+}
+
+// unpackPack resolves all objects of the pack read from r and writes them as loose objects into gitDir.
+// it returns the number of objects written.
+func unpackPack(r io.Reader, gitDir string) (int, error) {
+	p, err := parsePack(r)
+	if err != nil {
+		return 0, err
+	}
+	if err := p.resolveAll(); err != nil {
+		return 0, errgo.Notef(err, "unpackPack: resolving deltas failed")
+	}
+	for _, off := range p.offsets {
+		e := p.entries[off]
+		if _, err := writeLooseObject(gitDir, e.kind, e.resolved); err != nil {
+			return 0, errgo.Notef(err, "unpackPack: writing object failed")
+		}
+		if e.kind == "blob" {
+			if err := fetchLFSObject(e.resolved); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(p.offsets), nil
+}
+
+// local write modes selectable with GIT_IPFS_LOCAL_WRITE
+const (
+	// localWriteLoose writes every fetched object as a loose object
+	localWriteLoose = "loose"
+	// localWritePack collects the objects of a fetch batch into one pack
+	localWritePack = "pack"
+)
+
+var localWrite = localWriteLoose
+
+// localPack collects the objects of the current fetch batch with GIT_IPFS_LOCAL_WRITE=pack, nil otherwise
+var localPack *packWriter
+
+// packWriter builds a pack from loose objects.
+// the entries go to a temp file until finish knows their number for the header.
+// add may be called by several fetch workers at once.
+type packWriter struct {
+	mu   sync.Mutex
+	tmp  *os.File
+	n    uint32
+	seen map[string]bool
+}
+
+func newPackWriter(gitDir string) (*packWriter, error) {
+	tmp, err := ioutil.TempFile(filepath.Join(gitDir, "objects"), "tmp_pack_")
+	if err != nil {
+		return nil, errgo.Notef(err, "creating temp pack failed")
+	}
+	return &packWriter{tmp: tmp, seen: make(map[string]bool)}, nil
+}
+
+// has tells whether sha1 was added already
+func (p *packWriter) has(sha1 string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.seen[sha1]
+}
+
+// inflateObject decompresses the loose object z, a zlib stream or a zstd frame
+func inflateObject(z []byte) ([]byte, error) {
+	if zstd.IsFrame(z) {
+		raw, _, err := zstd.Decode(z)
+		return raw, err
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(z))
+	if err != nil {
+		return nil, errgo.Notef(err, "zlib reader failed")
+	}
+	return ioutil.ReadAll(zr)
+}
+
+// add appends the loose object z as an undeltified entry
+func (p *packWriter) add(sha1 string, z []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.seen[sha1] {
+		return nil
+	}
+	raw, err := inflateObject(z)
+	if err != nil {
+		return errgo.Notef(err, "object %s: inflating failed", sha1)
+	}
+	nul := bytes.IndexByte(raw, 0)
+	if nul < 0 {
+		return errgo.Newf("object %s: missing header", sha1)
+	}
+	var kind string
+	var size int
+	if _, err := fmt.Sscanf(string(raw[:nul]), "%s %d", &kind, &size); err != nil {
+		return errgo.Notef(err, "object %s: bad header", sha1)
+	}
+	typ := 0
+	for t, name := range packTypeNames {
+		if name == kind {
+			typ = t
+		}
+	}
+	if typ == 0 {
+		return errgo.Newf("object %s: unknown type %q", sha1, kind)
+	}
+	// type and size, 4 bits of it in the first byte and 7 in each following one
+	hdr := []byte{byte(typ<<4 | size&0x0f)}
+	for size >>= 4; size > 0; size >>= 7 {
+		hdr[len(hdr)-1] |= 0x80
+		hdr = append(hdr, byte(size&0x7f))
+	}
+	if _, err := p.tmp.Write(hdr); err != nil {
+		return errgo.Notef(err, "writing temp pack failed")
+	}
+	zw := zlib.NewWriter(p.tmp)
+	_, err = zw.Write(raw[nul+1:])
+	if errClose := zw.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return errgo.Notef(err, "writing temp pack failed")
+	}
+	p.n++
+	p.seen[sha1] = true
+	return nil
+}
+
+// discard removes the temp file, after finish or instead of it
+func (p *packWriter) discard() {
+	p.tmp.Close()
+	os.Remove(p.tmp.Name())
+}
+
+// finish hands the pack to git index-pack
+func (p *packWriter) finish() error {
+	if p.n == 0 {
+		return nil
+	}
+	if _, err := p.tmp.Seek(0, io.SeekStart); err != nil {
+		return errgo.Notef(err, "rewinding temp pack failed")
+	}
+	h := objectHash()
+	pr, pw := io.Pipe()
+	go func() {
+		w := io.MultiWriter(pw, h)
+		hdr := []byte("PACK\x00\x00\x00\x02\x00\x00\x00\x00")
+		hdr[8], hdr[9], hdr[10], hdr[11] = byte(p.n>>24), byte(p.n>>16), byte(p.n>>8), byte(p.n)
+		_, err := w.Write(hdr)
+		if err == nil {
+			_, err = io.Copy(w, p.tmp)
+		}
+		if err == nil {
+			_, err = pw.Write(h.Sum(nil))
+		}
+		pw.CloseWithError(err)
+	}()
+	err := gitIndexPack(pr)
+	pr.Close()
+	if err != nil {
+		return err
+	}
+	log.WithField("objects", p.n).Debug("wrote fetched objects as one pack")
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testdata/delta-{ofs,ref}.pack hold four commits changing one file, packed with --depth=10.
+// the blobs are stored as delta chains of depth 2 using OFS_DELTA and REF_DELTA respectively.
+var deltaPackObjects = []string{
+	"d13ebd38f40a8858fcf1961ae5a70fe18fa002db",
+	"9611b03f0f3b2a6d29506f2dbaa331a54642c253",
+	"f31e7bd2f7cf3ab985b61168abf0fd8d22ba04e3",
+	"9948af68996f11daa7d846dbebf5318f42449132",
+	"14e3d72b28cd48f955cf8a5081194b82ca557881",
+	"c53c632c3aab0153a6131b4c63d860cdbe5a6103",
+	"3d3f4c01f2a91aa6c8e00f3479feaf6dd2c137f7",
+	"8462086c293518b5e9d3e431720768ffc1a6b518",
+	"0055c3c9e59b35da439056b5993dd2e03103df4e",
+	"b414a7417bba6a99758fdbeef7212059ec10e80a",
+	"e9370ff0b8235328e0d36fd995fe8feffcde17e7",
+	"bdc50dd2c8c738decfacaf59b511f27cb25859f9",
+}
+
+func TestUnpackPack_deltas(t *testing.T) {
+	for _, name := range []string{"delta-ofs.pack", "delta-ref.pack"} {
+		f, err := os.Open(filepath.Join("testdata", name))
+		checkFatal(t, err)
+		p, err := parsePack(f)
+		f.Close()
+		checkFatal(t, err)
+		deltas := 0
+		for _, e := range p.entries {
+			if e.typ == packOfsDelta || e.typ == packRefDelta {
+				deltas++
+			}
+		}
+		if deltas == 0 {
+			t.Fatalf("%s: fixture has no deltas", name)
+		}
+
+		gitDir, err := ioutil.TempDir("", "git-remote-ipfs-pack")
+		checkFatal(t, err)
+		f, err = os.Open(filepath.Join("testdata", name))
+		checkFatal(t, err)
+		n, err := unpackPack(f, gitDir)
+		f.Close()
+		checkFatal(t, err)
+		if n != len(deltaPackObjects) {
+			t.Errorf("%s: want %d objects got %d", name, len(deltaPackObjects), n)
+		}
+		// the object names are computed from the reconstructed content
+		for _, sha1 := range deltaPackObjects {
+			if _, err := os.Stat(filepath.Join(gitDir, "objects", sha1[:2], sha1[2:])); err != nil {
+				t.Errorf("%s: object %s not reconstructed: %s", name, sha1, err)
+			}
+		}
+		rmDir(t, gitDir)
+	}
+}
+
+func TestApplyDelta(t *testing.T) {
+	base := []byte("hello world, hello ipfs")
+	// src size 23, dst size 17, copy base[0:6], insert "git ", copy base[19:23], insert "!!!"
+	delta := []byte{23, 17, 0x90, 6, 4, 'g', 'i', 't', ' ', 0x91, 19, 4, 3, '!', '!', '!'}
+	got, err := applyDelta(base, delta)
+	checkFatal(t, err)
+	if string(got) != "hello git ipfs!!!" {
+		t.Errorf("unexpected delta result: %q", got)
+	}
+	if _, err := applyDelta(base[:10], delta); err == nil {
+		t.Error("expected error for wrong base size")
+	}
+}
+
+func TestUnpackFetchedPack_modes(t *testing.T) {
+	defer func(old string) { packMode = old }(packMode)
+	for _, mode := range []string{packModeNative, packModeUnpack} {
+		packMode = mode
+		dir := mkRandTmpDir(t)
+		cmd := exec.Command("git", "init", "-q", "--bare", dir)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git init failed: %s\n%s", err, out)
+		}
+		oldRepo := thisGitRepo
+		thisGitRepo = dir
+		f, err := os.Open(filepath.Join("testdata", "delta-ofs.pack"))
+		checkFatal(t, err)
+		checkFatal(t, unpackFetchedPack(f))
+		f.Close()
+		for _, sha1 := range deltaPackObjects {
+			if !gitHasObject(sha1) {
+				t.Errorf("%s: object %s missing after unpacking", mode, sha1)
+			}
+		}
+		thisGitRepo = oldRepo
+		rmDir(t, dir)
+	}
+}
+
+func TestFetch_localWritePack(t *testing.T) {
+	files := map[string]string{"HEAD": "ref: refs/heads/master\n"}
+	master, objs := fixtureCommit(files, "master\n")
+	dev, devObjs := fixtureCommit(files, "dev\n")
+	objs = append(objs, devObjs...)
+	files["info/refs"] = master + "\trefs/heads/master\n" + dev + "\trefs/heads/dev\n"
+	_, restore := useFakeRepo(t, files)
+	defer restore()
+	defer useTmpGitDir(t)()
+	if out, err := exec.Command("git", "init", "-q", "--bare", thisGitRepo).CombinedOutput(); err != nil {
+		t.Fatalf("git init failed: %s\n%s", err, out)
+	}
+	localWrite = localWritePack
+	defer func() { localWrite = localWriteLoose }()
+
+	var out bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("fetch "+master+" refs/heads/master\nfetch "+dev+" refs/heads/dev\n\n"), &out))
+	packs, err := filepath.Glob(filepath.Join(thisGitRepo, "objects", "pack", "*.pack"))
+	checkFatal(t, err)
+	if len(packs) != 1 {
+		t.Fatalf("want one pack for the batch, got %v", packs)
+	}
+	if out, err := exec.Command("git", "verify-pack", packs[0]).CombinedOutput(); err != nil {
+		t.Fatalf("invalid pack: %s\n%s", err, out)
+	}
+	for _, sha1 := range objs {
+		if _, err := os.Stat(filepath.Join(thisGitRepo, objectPath(sha1))); err == nil {
+			t.Errorf("object %s was written loose", sha1)
+		}
+		if !gitHasObject(sha1) {
+			t.Errorf("object %s is not in the pack", sha1)
+		}
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(thisGitRepo, "objects", "tmp_pack_*")); len(tmp) != 0 {
+		t.Errorf("temp pack left behind: %v", tmp)
+	}
+}
+
+// zstdPack builds a pack of the blobs, the first compressed with zstd (one raw block), the others with zlib
+func zstdPack(blobs ...string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("PACK\x00\x00\x00\x02")
+	buf.Write([]byte{0, 0, 0, byte(len(blobs))})
+	for i, b := range blobs {
+		buf.WriteByte(packBlob<<4 | byte(len(b))) // short blobs, no size continuation
+		if i > 0 {
+			zw := zlib.NewWriter(&buf)
+			zw.Write([]byte(b))
+			zw.Close()
+			continue
+		}
+		hdr := len(b)<<3 | 1 // last raw block
+		buf.Write([]byte{0x28, 0xb5, 0x2f, 0xfd, 0x20, byte(len(b)), byte(hdr), byte(hdr >> 8), byte(hdr >> 16)})
+		buf.WriteString(b)
+	}
+	sum := sha1.Sum(buf.Bytes())
+	buf.Write(sum[:])
+	return buf.Bytes()
+}
+
+func TestUnpackPack_zstd(t *testing.T) {
+	gitDir, err := ioutil.TempDir("", "git-remote-ipfs-pack")
+	checkFatal(t, err)
+	defer rmDir(t, gitDir)
+	checkFatal(t, exec.Command("git", "init", "-q", "--bare", gitDir).Run())
+	n, err := unpackPack(bytes.NewReader(zstdPack("hello\n", "zlib\n")), gitDir)
+	checkFatal(t, err)
+	if n != 2 {
+		t.Fatalf("want 2 objects got %d", n)
+	}
+	for _, b := range []string{"hello\n", "zlib\n"} {
+		sha1 := fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("blob %d\x00%s", len(b), b))))
+		out, err := exec.Command("git", "--git-dir", gitDir, "cat-file", "blob", sha1).Output()
+		if err != nil || string(out) != b {
+			t.Errorf("blob %q not unpacked as %s: %q %v", b, sha1, out, err)
+		}
+	}
+}
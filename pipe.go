@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+
+	"gopkg.in/errgo.v1"
+)
+
+// errGitGone means git closed its end of the protocol pipe, like when the clone was aborted
+var errGitGone = errgo.New("git closed the pipe")
+
+// pipeWriter keeps the first error writing to git, later writes are dropped.
+// that way speakGit can check once per command instead of after every line.
+type pipeWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (p *pipeWriter) Write(b []byte) (int, error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+	n, err := p.w.Write(b)
+	if err != nil {
+		p.err = err
+	}
+	return n, err
+}
+
+// check turns a failed write into an error for speakGit, errGitGone if git went away
+func (p *pipeWriter) check() error {
+	if p.err == nil {
+		return nil
+	}
+	if isBrokenPipe(p.err) {
+		return errgo.WithCausef(p.err, errGitGone, "writing to git failed")
+	}
+	return errgo.Notef(p.err, "writing to git failed")
+}
+
+func isBrokenPipe(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, os.ErrClosed)
+}
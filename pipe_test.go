@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"gopkg.in/errgo.v1"
+)
+
+func TestSpeakGit_gitClosedPipe(t *testing.T) {
+	_, restore := useFakeRepo(t, map[string]string{
+		"HEAD":      "ref: refs/heads/master\n",
+		"info/refs": fixtureSha + "\trefs/heads/master\n",
+	})
+	defer restore()
+	pr, pw, err := os.Pipe()
+	checkFatal(t, err)
+	defer pw.Close()
+	// git answered capabilities and went away
+	pr.Close()
+
+	err = speakGit(context.Background(), strings.NewReader("capabilities\nlist\n\n"), pw)
+	if errgo.Cause(err) != errGitGone {
+		t.Fatalf("want errGitGone, got %v", err)
+	}
+	if code := exitCode(err); code != exitGitGone {
+		t.Errorf("want exit code %d, got %d", exitGitGone, code)
+	}
+
+	// a stdout that is already closed counts the same
+	pr, pw2, err := os.Pipe()
+	checkFatal(t, err)
+	pr.Close()
+	pw2.Close()
+	if err := speakGit(context.Background(), strings.NewReader("capabilities\n"), pw2); errgo.Cause(err) != errGitGone {
+		t.Errorf("writing to a closed file should count as git gone, got %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/cryptix/git-remote-ipfs/fetch"
+	"gopkg.in/errgo.v1"
+)
+
+// prefetchTips (GIT_IPFS_PREFETCH=1) makes list start reading the commits it advertised and their root trees
+// in the background while git decides what to fetch, so the fetch that follows finds them in prefetched
+var prefetchTips bool
+
+// prefetchWorkers is how many tips are read at the same time
+const prefetchWorkers = 4
+
+// objectCache holds objects read ahead of the fetch that wants them, as remoteStore.GetObject returns them.
+// every object is handed out once, fetch writes it to the local repo and doesn't ask again.
+type objectCache struct {
+	mu      sync.Mutex
+	objs    map[string][]byte
+	reading map[string]chan struct{} // closed when the read is done, whether it worked or not
+	taken   map[string]bool          // asked for by fetch, reading them ahead is too late
+}
+
+func newObjectCache() *objectCache {
+	return &objectCache{objs: make(map[string][]byte), reading: make(map[string]chan struct{}), taken: make(map[string]bool)}
+}
+
+// prefetched is what the GIT_IPFS_PREFETCH reads put aside,
+// prefetchDone closes once the reads the last list started are over
+var (
+	prefetched   = newObjectCache()
+	prefetchDone <-chan struct{}
+)
+
+// take returns the data of sha1 if it was read ahead, waiting for a read still going on
+func (c *objectCache) take(sha1 string) ([]byte, bool) {
+	c.mu.Lock()
+	c.taken[sha1] = true
+	done, busy := c.reading[sha1]
+	c.mu.Unlock()
+	if busy {
+		<-done
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.objs[sha1]
+	delete(c.objs, sha1)
+	return data, ok
+}
+
+// errPrefetchLate stops reading ahead of a fetch that got there first
+var errPrefetchLate = errgo.New("fetch got there first")
+
+// readAhead reads sha1 with read and keeps it for take. an object another read is busy with is waited for.
+func (c *objectCache) readAhead(sha1 string, read func(string) ([]byte, error)) ([]byte, error) {
+	c.mu.Lock()
+	if c.taken[sha1] {
+		c.mu.Unlock()
+		return nil, errPrefetchLate
+	}
+	if data, ok := c.objs[sha1]; ok {
+		c.mu.Unlock()
+		return data, nil
+	}
+	if busy, ok := c.reading[sha1]; ok {
+		c.mu.Unlock()
+		<-busy
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if data, ok := c.objs[sha1]; ok {
+			return data, nil
+		}
+		return nil, errPrefetchLate
+	}
+	done := make(chan struct{})
+	c.reading[sha1] = done
+	c.mu.Unlock()
+
+	data, err := read(sha1)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		// a take waiting for it gets it now
+		c.objs[sha1] = data
+	}
+	close(done)
+	delete(c.reading, sha1)
+	return data, err
+}
+
+// prefetchStore reads the objects fetch.ReadTree asks for into the cache
+type prefetchStore struct {
+	remote remoteStore
+	cache  *objectCache
+}
+
+func (s prefetchStore) GetObject(sha1 string) (io.ReadCloser, error) {
+	data, err := s.cache.readAhead(sha1, s.remote.read)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// startPrefetch reads the tips and their root trees into prefetched, in the background.
+// errors only mean the fetch reads those objects itself. the returned channel is closed once it is done.
+func startPrefetch(ctx context.Context, tips []string) <-chan struct{} {
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < prefetchWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store := prefetchStore{remote: remoteStore{objStore}, cache: prefetched}
+			for tip := range work {
+				if gitHasObject(tip) {
+					// git won't ask for it
+					continue
+				}
+				if _, err := fetch.ReadTree(ctx, store, tip); err != nil {
+					log.WithField("tip", tip).WithField("err", err).Debug("prefetch failed")
+				}
+			}
+		}()
+	}
+	go func() {
+		defer close(work)
+		for _, tip := range tips {
+			select {
+			case work <- tip:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	return finished
+}
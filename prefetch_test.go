@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrefetch(t *testing.T) {
+	files := map[string]string{"HEAD": "ref: refs/heads/master\n"}
+	var batch string
+	var tips, all []string
+	for i, name := range []string{"master", "dev"} {
+		commit, objs := fixtureCommit(files, fmt.Sprintf("prefetched %d\n", i))
+		files["refs/heads/"+name] = commit + "\n"
+		batch += "fetch " + commit + " refs/heads/" + name + "\n"
+		tips = append(tips, commit)
+		all = append(all, objs...)
+	}
+	fetchCats := func(prefetch bool) int {
+		fs, restore := useFakeRepo(t, files)
+		defer restore()
+		defer useTmpGitDir(t)()
+		var out bytes.Buffer
+		checkFatal(t, speakGit(context.Background(), strings.NewReader("list\n"), &out))
+		// what list would start, waited for so the counts don't depend on timing
+		prefetched, prefetchTips = newObjectCache(), prefetch
+		defer func() { prefetchTips = false }()
+		if prefetch {
+			<-startPrefetch(context.Background(), tips)
+		}
+		before := fs.calls["Cat"]
+		checkFatal(t, speakGit(context.Background(), strings.NewReader(batch+"\n"), &out))
+		for _, obj := range all {
+			if _, err := os.Stat(filepath.Join(thisGitRepo, objectPath(obj))); err != nil {
+				t.Errorf("prefetch=%v: object %s was not fetched: %s", prefetch, obj, err)
+			}
+		}
+		return fs.calls["Cat"] - before
+	}
+	cold, warm := fetchCats(false), fetchCats(true)
+	// the commits and their trees were read already, only the blobs are left
+	if cold != len(all) || warm != len(all)-2*len(tips) {
+		t.Errorf("expected %d cats cold and %d after prefetching, got %d and %d", len(all), len(all)-2*len(tips), cold, warm)
+	}
+	if len(prefetched.objs) != 0 {
+		t.Errorf("%d prefetched objects were left over", len(prefetched.objs))
+	}
+}
+
+func TestPrefetch_fetchRightAway(t *testing.T) {
+	files := map[string]string{"HEAD": "ref: refs/heads/master\n"}
+	commit, objs := fixtureCommit(files, "raced\n")
+	files["refs/heads/master"] = commit + "\n"
+	_, restore := useFakeRepo(t, files)
+	defer restore()
+	defer useTmpGitDir(t)()
+	prefetched, prefetchTips = newObjectCache(), true
+	defer func() { prefetchTips = false }()
+
+	// the fetch races the prefetch list started, whichever reads an object first the other one gets it too
+	var out bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("list\nfetch "+commit+" refs/heads/master\n\n"), &out))
+	<-prefetchDone
+	for _, obj := range objs {
+		if _, err := os.Stat(filepath.Join(thisGitRepo, objectPath(obj))); err != nil {
+			t.Errorf("object %s was not fetched: %s", obj, err)
+		}
+	}
+}
@@ -2,100 +2,372 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
 	"os/exec"
-	"path/filepath"
+	"path"
+	"sort"
 	"strings"
+	"sync"
 
+	"github.com/cryptix/git-remote-ipfs/internal/errkind"
 	"gopkg.in/errgo.v1"
 )
 
-func push(src, dst string) error {
+// pushStartTop is what the ipns name of the remote pointed to when this batch started
+var pushStartTop string
+
+// pushRoot is the repo root the current batch of push commands builds on, "" before the first one.
+// all refs of one batch (like all the refs of git push --mirror) end up in one new root, published by pushFinish.
+var pushRoot string
+
+// pushOldRoot is the root the current batch started from and pushRefs the refs it changed, for the push log
+var (
+	pushOldRoot string
+	pushRefs    []string
+)
+
+// pushBase returns the root the next push command applies to
+func pushBase(ctx context.Context) (string, error) {
+	if pushRoot != "" {
+		return pushRoot, nil
+	}
+	if name, _, ok := ipnsName(ipnsRepoPath); ok {
+		top, err := resolveIPNS(ctx, name)
+		if err != nil {
+			return "", errgo.Notef(err, "resolvePath(/ipns/%s) failed", name)
+		}
+		pushStartTop = top
+	}
+	root, err := ipfsShell.ResolvePath(ipfsRepoPath)
+	if err != nil {
+		return "", errgo.Notef(err, "resolvePath(%s) failed", ipfsRepoPath)
+	}
+	pushRoot, pushOldRoot = root, root
+	matchCIDVersion(root)
+	return root, nil
+}
+
+func push(ctx context.Context, src, dst string) error {
 	var force = strings.HasPrefix(src, "+")
 	if force {
 		src = src[1:]
 	}
+	srcSha1, err := gitRefHash(src)
+	if err != nil {
+		return errgo.Notef(err, "gitRefHash(%s) failed", src)
+	}
+	if ref2hash[dst] == srcSha1 {
+		log.WithField("dst", dst).Debug("remote ref is up to date")
+		return nil
+	}
+	// rejected before anything is locked, listed or added
+	if h, ok := ref2hash[dst]; ok && !force {
+		if isFF := gitIsAncestor(h, srcSha1); isFF != nil {
+			return nonFastForward(dst, h)
+		}
+	}
+	if err := lockPush(); err != nil {
+		return err
+	}
 	var present []string
 	for _, h := range ref2hash {
-		present = append(present, h)
+		// remote only refs (like the ones a mirror push deletes) are unknown to rev-list
+		if gitHasObject(h) {
+			present = append(present, h)
+		}
 	}
 	// also: track previously pushed branches in 2nd map and extend present with it
 	need2push, err := gitListObjects(src, present)
 	if err != nil {
 		return errgo.Notef(err, "push: git list objects failed %q %v", src, present)
 	}
-	n := len(need2push)
+	// the remote tree might already have some of them, like objects of refs we don't know locally
+	need2push, err = skipPresent(need2push)
+	if err != nil {
+		return errgo.Notef(err, "push: checking remote objects failed")
+	}
+	// the root first, the adds take its cid version
+	root, err := pushBase(ctx)
+	if err != nil {
+		return err
+	}
+	objHash2multi, err := putObjects(ctx, root, need2push)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	root, err = objStore.linkObjects(root, objHash2multi)
+	if err != nil {
+		return errgo.Notef(err, "linkObjects failed")
+	}
+	mhash, err := addObject(bytes.NewBufferString(fmt.Sprintf("%s\n", srcSha1)))
+	if err != nil {
+		return errgo.Notef(err, "shell.Add(%s) failed", srcSha1)
+	}
+	root, err = ipfsShell.PatchLink(root, dst, mhash, true)
+	if err != nil {
+		// TODO:print "fetch first" to git
+		err = errgo.Notef(err, "patchLink(%s) failed", ipfsRepoPath)
+		log.WithField("err", err).Error("shell.PatchLink failed")
+		return fmt.Errorf("fetch first")
+	}
+	if layout == layoutPerBranch {
+		if root, err = linkBranchSnapshot(root, dst, srcSha1); err != nil {
+			return err
+		}
+	}
+	log.WithField("newRoot", root).WithField("dst", dst).WithField("hash", srcSha1).Debug("updated ref")
+	pushRoot = root
+	pushRefs = append(pushRefs, dst)
+	ref2hash[dst] = srcSha1
+	return nil
+}
+
+// pushRebaseHint (GIT_IPFS_PUSH_REBASE=1) makes a non-fast-forward rejection name the remote tip,
+// instead of the bare "non-fast-forward" git turns into its own "fetch first" hint
+var pushRebaseHint bool
+
+// nonFastForward is the error for a push to dst that would drop the remote's commit tip,
+// with pushRebaseHint the object and cid of tip in the remote to fetch and rebase onto
+func nonFastForward(dst, tip string) error {
+	if !pushRebaseHint {
+		return errkind.Wrapf(nil, ErrNonFastForward, "non-fast-forward")
+	}
+	at := tip
+	if cid, err := ipfsShell.ResolvePath(path.Join(ipfsRepoPath, remoteObjectPath(tip))); err == nil {
+		at += " (/ipfs/" + cid + ")"
+	}
+	return errkind.Wrapf(nil, ErrNonFastForward, "non-fast-forward: remote %s is at %s, fetch and rebase onto it first", dst, at)
+}
+
+// pushConcurrency is how many objects push adds at the same time (IPFS_PUSH_CONCURRENCY)
+var pushConcurrency = 8
+
+// putObjects adds the objects shas to the store, pushConcurrency at a time, and returns their ipfs hashes.
+// the order they finish in doesn't matter, linkObjects sorts them.
+// canceling ctx stops handing out objects, the adds in flight still finish.
+// with pushCheckpoint the objects an interrupted push onto root added already aren't added again.
+func putObjects(ctx context.Context, root string, shas []string) (map[string]string, error) {
+	objHash2multi := make(map[string]string, len(shas))
+	if pushCheckpoint {
+		done, err := openCheckpoint(root)
+		if err != nil {
+			return nil, err
+		}
+		var todo []string
+		for _, sha1 := range shas {
+			if mhash, ok := done[sha1]; ok {
+				objHash2multi[sha1] = mhash
+			} else {
+				todo = append(todo, sha1)
+			}
+		}
+		log.WithField("checkpointed", len(shas)-len(todo)).WithField("new", len(todo)).Debug("checked push checkpoint")
+		shas = todo
+	}
 	type pair struct {
 		Sha1  string
 		MHash string
 		Err   error
 	}
+	jobs := make(chan string)
 	added := make(chan pair)
-	objHash2multi := make(map[string]string, n)
-	for _, sha1 := range need2push {
-		go func(sha1 string) {
-			r, err := gitFlattenObject(sha1)
-			if err != nil {
-				added <- pair{Err: errgo.Notef(err, "gitFlattenObject failed")}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	// on an error the adds in flight still finish, nothing outlives the call
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+	go func() {
+		defer close(jobs)
+		for _, sha1 := range shas {
+			select {
+			case jobs <- sha1:
+			case <-done:
 				return
-			}
-			mhash, err := ipfsShell.Add(r)
-			if err != nil {
-				added <- pair{Err: errgo.Notef(err, "shell.Add(%s) failed", sha1)}
+			case <-ctx.Done():
 				return
 			}
-			added <- pair{Sha1: sha1, MHash: mhash}
-		}(sha1)
+		}
+	}()
+	workers := pushConcurrency
+	if workers > len(shas) {
+		workers = len(shas)
 	}
-	for n > 0 {
-		select {
-		// add timeout?
-		case p := <-added:
-			if p.Err != nil {
-				return p.Err
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for sha1 := range jobs {
+				mhash, err := putObject(sha1)
+				select {
+				case added <- pair{Sha1: sha1, MHash: mhash, Err: err}:
+				case <-done:
+					return
+				}
 			}
-			log.WithField("pair", p).Debug("added")
-			objHash2multi[p.Sha1] = p.MHash
-			n--
+		}()
+	}
+	for n := len(shas); n > 0; n-- {
+		var p pair
+		select {
+		case p = <-added:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if p.Err != nil {
+			return nil, p.Err
+		}
+		log.WithField("pair", p).Debug("added")
+		objHash2multi[p.Sha1] = p.MHash
+		if pushCheckpoint {
+			recordCheckpoint(p.Sha1, p.MHash)
 		}
 	}
-	root, err := ipfsShell.ResolvePath(ipfsRepoPath)
+	return objHash2multi, nil
+}
+
+// putObject adds the local object sha1 to the store, after PreStore
+func putObject(sha1 string) (string, error) {
+	r, err := gitFlattenObject(sha1)
 	if err != nil {
-		return errgo.Notef(err, "resolvePath(%s) failed", ipfsRepoPath)
+		return "", errgo.Notef(err, "gitFlattenObject failed")
 	}
-	for sha1, mhash := range objHash2multi {
-		newRoot, err := ipfsShell.PatchLink(root, filepath.Join("objects", sha1[:2], sha1[2:]), mhash, true)
+	if PreStore != nil {
+		data, err := ioutil.ReadAll(r)
+		if err == nil {
+			data, err = PreStore(data)
+		}
 		if err != nil {
-			return errgo.Notef(err, "patchLink failed")
+			return "", errgo.Notef(err, "PreStore(%s) failed", sha1)
 		}
-		root = newRoot
-		log.WithField("newRoot", newRoot).WithField("sha1", sha1).Debug("updated object")
+		r = bytes.NewReader(data)
 	}
-	srcSha1, err := gitRefHash(src)
+	mhash, err := objStore.putObject(sha1, r)
 	if err != nil {
-		return errgo.Notef(err, "gitRefHash(%s) failed", src)
+		return "", errgo.Notef(err, "putObject(%s) failed", sha1)
 	}
-	h, ok := ref2hash[dst]
-	if !ok {
-		return errgo.Newf("writeRef: ref2hash entry missing: %s %+v", dst, ref2hash)
+	return mhash, nil
+}
+
+// skipPresent drops the objects the remote already has, so only new ones get added
+func skipPresent(shas []string) ([]string, error) {
+	if len(shas) == 0 {
+		return shas, nil
 	}
-	isFF := gitIsAncestor(h, srcSha1)
-	if isFF != nil && !force {
-		// TODO: print "non-fast-forward" to git
-		return fmt.Errorf("non-fast-forward")
+	have, err := objStore.present(shas)
+	if err != nil {
+		return nil, err
 	}
-	mhash, err := ipfsShell.Add(bytes.NewBufferString(fmt.Sprintf("%s\n", srcSha1)))
+	missing := shas[:0]
+	for _, sha1 := range shas {
+		if !have[sha1] {
+			missing = append(missing, sha1)
+		}
+	}
+	log.WithField("present", len(shas)-len(missing)).WithField("new", len(missing)).Debug("checked remote objects")
+	return missing, nil
+}
+
+// pushDelete removes the ref dst from the remote.
+// git push --mirror sends these for remote refs that don't exist locally.
+func pushDelete(ctx context.Context, dst string) error {
+	if _, ok := ref2hash[dst]; !ok {
+		return errgo.Newf("remote ref does not exist")
+	}
+	if head, err := readHeadRef(); err == nil && head == dst && !repointHead {
+		// clones would check out nothing, pushHead points HEAD elsewhere with repointHead
+		return errgo.Newf("cannot delete branch pointed to by HEAD")
+	}
+	if err := lockPush(); err != nil {
+		return err
+	}
+	root, err := pushBase(ctx)
 	if err != nil {
-		return errgo.Notef(err, "shell.Add(%s) failed", srcSha1)
+		return err
 	}
-	root, err = ipfsShell.PatchLink(root, dst, mhash, true)
+	// the ref can be a loose file, a line of packed-refs or both
+	loose, rmErr := ipfsShell.Patch(root, "rm-link", dst)
+	if rmErr == nil {
+		root = loose
+	}
+	root, packed, err := withoutPackedRef(root, dst)
 	if err != nil {
-		// TODO:print "fetch first" to git
-		err = errgo.Notef(err, "patchLink(%s) failed", ipfsRepoPath)
-		log.WithField("err", err).Error("shell.PatchLink failed")
-		return fmt.Errorf("fetch first")
+		return err
 	}
-	log.WithField("newRoot", root).WithField("dst", dst).WithField("hash", srcSha1).Debug("updated ref")
+	if rmErr != nil && !packed {
+		return errgo.Notef(rmErr, "rm-link(%s) failed", dst)
+	}
+	if dir, ok := branchDir(dst); ok && layout == layoutPerBranch {
+		if withoutSnap, err := ipfsShell.Patch(root, "rm-link", dir); err == nil {
+			root = withoutSnap
+		} else {
+			// pushed before the layout was switched on
+			log.WithField("dir", dir).WithField("err", err).Debug("no branch snapshot to remove")
+		}
+	}
+	log.WithField("newRoot", root).WithField("dst", dst).Debug("deleted ref")
+	pushRoot = root
+	pushRefs = append(pushRefs, dst)
+	delete(ref2hash, dst)
+	return nil
+}
+
+// withoutPackedRef rewrites the packed-refs file of root without dst and the peeled line after it.
+// it returns root as it is and false if dst isn't in there (or there is no packed-refs).
+func withoutPackedRef(root, dst string) (string, bool, error) {
+	rc, err := ipfsShell.Cat("/ipfs/" + root + "/packed-refs")
+	if err != nil {
+		return root, false, nil
+	}
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return "", false, errgo.Notef(err, "reading packed-refs failed")
+	}
+	var kept bytes.Buffer
+	found, dropping := false, false
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if dropping && strings.HasPrefix(line, "^") {
+			continue
+		}
+		hashRef := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 2)
+		if dropping = len(hashRef) == 2 && hashRef[1] == dst; dropping {
+			found = true
+			continue
+		}
+		kept.WriteString(line)
+	}
+	if !found {
+		return root, false, nil
+	}
+	h, err := addObject(&kept)
+	if err != nil {
+		return "", false, errgo.Notef(err, "adding packed-refs failed")
+	}
+	if root, err = ipfsShell.PatchLink(root, "packed-refs", h, true); err != nil {
+		return "", false, errgo.Notef(err, "patchLink(packed-refs) failed")
+	}
+	return root, true, nil
+}
+
+// pushFinish publishes the root built by one batch of push commands and points the remote at it.
+// the root is staged in the daemon's mfs until then, see stageRoot.
+func pushFinish(ctx context.Context) error {
+	if pushRoot == "" {
+		// every ref was up to date, nothing to publish
+		progressf("Everything up-to-date\n")
+		return nil
+	}
+	defer unlockPush()
+	root, startTop := pushRoot, pushStartTop
+	logged := pushLogEntry{Remote: thisGitRemote, Refs: pushRefs, OldRoot: pushOldRoot}
+	pushRoot, pushStartTop, pushOldRoot, pushRefs = "", "", "", nil
 	// invalidate info/refs and HEAD(?)
 	// TODO: unclean: need to put other revs, too make a soft git update-server-info maybe
 	noInfoRefsHash, err := ipfsShell.Patch(root, "rm-link", "info/refs")
@@ -106,12 +378,204 @@ func push(src, dst string) error {
 		// todo shell.IsNotExists() ?
 		log.WithField("err", err).Warning("shell.Patch rm-link info/refs failed - might be okay... TODO")
 	}
-	newRemoteURL := fmt.Sprintf("ipfs:///ipfs/%s", root)
-	setUrlCmd := exec.Command("git", "remote", "set-url", thisGitRemote, newRemoteURL)
+	if root, err = pushHead(root, logged.Refs); err != nil {
+		return err
+	}
+	if wellKnownEnabled {
+		if root, err = writeWellKnown(root, ref2hash); err != nil {
+			return err
+		}
+	}
+	if err := verifyRefs(root, ref2hash); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		// nothing is published yet, the remote stays as it was
+		return err
+	}
+	root, unstage, err := stageRoot(root)
+	if err != nil {
+		return err
+	}
+	defer unstage()
+	logged.NewRoot = root
+	if name, _, ok := ipnsName(ipnsRepoPath); ok {
+		logged.IPNS = name
+	}
+	logged.State = pushStaged
+	if err := appendPushLog(logged); err != nil {
+		return err
+	}
+	// keep what we pushed around, git-remote-ipfs gc unpins old ones
+	if err := pinRoot(thisGitRemote, root); err != nil {
+		log.WithField("err", err).Warning("pinning the pushed root failed")
+	}
+	var newRemoteURL, cidURL string
+	if name, rest, ok := ipnsName(ipnsRepoPath); ok {
+		top, err := publishIPNS(ctx, name, rest, root, startTop)
+		if errgo.Cause(err) == errRemoteBusy {
+			return err
+		}
+		if err == nil {
+			newRemoteURL = "ipfs://ipns/" + path.Join(name, rest)
+			cidURL = "ipfs:///ipfs/" + path.Join(top, rest)
+		} else {
+			log.WithField("err", err).Warning("ipns publish failed, using the immutable address")
+		}
+	}
+	if cidURL == "" {
+		cidURL, err = pushURL(root)
+		if err != nil {
+			return errgo.Notef(err, "constructing new remote url failed")
+		}
+		newRemoteURL = cidURL
+	}
+	// keep the options of the url
+	setURL := newRemoteURL + repoURLQuery
+	setUrlCmd := exec.Command("git", "remote", "set-url", thisGitRemote, setURL)
+	setUrlCmd.Dir = thisGitRepo // GIT_DIR
 	out, err := setUrlCmd.CombinedOutput()
 	if err != nil {
 		return errgo.Notef(err, "updating remote url failed\nOut:%s", string(out))
 	}
-	log.Info("remote updated - new address:", newRemoteURL)
+	closeCheckpoint(true)
+	logged.State, logged.URL = pushPublished, setURL
+	if err := appendPushLog(logged); err != nil {
+		log.WithField("err", err).Warning("recording the finished push failed")
+	}
+	progressf("remote updated - new address: %s\n", setURL)
+	if verbose && cidURL != newRemoteURL {
+		progressf("immutable address of this push: %s\n", cidURL)
+	}
+	if noteCID {
+		notePush(logged.Refs, cidURL)
+	}
+	postPush(root, setURL)
 	return nil
 }
+
+// noteCID (GIT_IPFS_NOTE_CID=1) records the immutable address of every push as a note in refs/notes/ipfs
+// on the commits it pushed, so git log --notes=ipfs shows where each one was published
+var noteCID bool
+
+// notePush notes cidURL on the commits refs point to now. the push is done already, failing notes only warn.
+func notePush(refs []string, cidURL string) {
+	noted := make(map[string]bool)
+	for _, ref := range refs {
+		sha1, ok := ref2hash[ref]
+		if !ok {
+			// deleted
+			continue
+		}
+		commit, err := gitRefHash(sha1 + "^{commit}")
+		if err != nil {
+			log.WithField("ref", ref).Debug("note: not a commit")
+			continue
+		}
+		if noted[commit] {
+			continue
+		}
+		noted[commit] = true
+		if err := gitAddNote("ipfs", commit, cidURL); err != nil {
+			log.WithField("ref", ref).WithField("err", err).Warning("noting the push on the commit failed")
+		}
+	}
+}
+
+// defaultBranch (GIT_IPFS_DEFAULT_BRANCH) is the branch pushHead points a new remote's HEAD at, if it was pushed
+var defaultBranch string
+
+// repointHead (GIT_IPFS_REPOINT_HEAD=1) lets a push delete the branch HEAD points at,
+// pushHead then points HEAD at another branch the remote still has
+var repointHead bool
+
+// pushHead gives root a HEAD if it has none or only one pointing at a branch that doesn't exist,
+// like the unborn master of git init --bare after pushing main: clones of it would check out nothing.
+// it points at defaultBranch if the remote has it and else at the first branch of pushed,
+// or with repointHead at the first remaining one (when pushed only deleted HEAD's branch).
+// a HEAD that works is left alone.
+func pushHead(root string, pushed []string) (string, error) {
+	if rc, err := ipfsShell.Cat("/ipfs/" + root + "/HEAD"); err == nil {
+		head, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return "", errgo.Notef(err, "reading HEAD failed")
+		}
+		ref := strings.TrimSpace(strings.TrimPrefix(string(head), "ref: "))
+		if _, ok := ref2hash[ref]; ok || !bytes.HasPrefix(head, []byte("ref: ")) {
+			return root, nil
+		}
+	}
+	var branch string
+	if b := defaultBranch; b != "" {
+		if !strings.HasPrefix(b, "refs/") {
+			b = "refs/heads/" + b
+		}
+		if _, ok := ref2hash[b]; ok {
+			branch = b
+		}
+	}
+	for i := 0; branch == "" && i < len(pushed); i++ {
+		if _, ok := ref2hash[pushed[i]]; ok && strings.HasPrefix(pushed[i], "refs/heads/") {
+			branch = pushed[i]
+		}
+	}
+	if branch == "" && repointHead {
+		var branches []string
+		for ref := range ref2hash {
+			if strings.HasPrefix(ref, "refs/heads/") {
+				branches = append(branches, ref)
+			}
+		}
+		if len(branches) > 0 {
+			sort.Strings(branches)
+			branch = branches[0]
+			progressf("warning: HEAD of the remote now points at %s\n", branch)
+		}
+	}
+	if branch == "" {
+		// only tags or deletes, nothing to check out
+		return root, nil
+	}
+	h, err := addObject(bytes.NewBufferString("ref: " + branch + "\n"))
+	if err != nil {
+		return "", errgo.Notef(err, "adding HEAD failed")
+	}
+	if root, err = ipfsShell.PatchLink(root, "HEAD", h, true); err != nil {
+		return "", errgo.Notef(err, "patchLink(HEAD) failed")
+	}
+	log.WithField("branch", branch).Debug("pointed HEAD of the new remote at the pushed branch")
+	return root, nil
+}
+
+// keepBase (GIT_IPFS_KEEP_BASE=1) makes pushURL patch root back in at the path the repo had below the cid it was cloned from,
+// instead of trimming the url down to the repo
+var keepBase bool
+
+// pushURL returns the clone url for the pushed repo root.
+// if the url we started from named the repo directory (like .../repo.git), root gets wrapped in a new directory with that name
+// so the new url keeps the same shape.
+func pushURL(root string) (string, error) {
+	if top, ok := ipfsPathHash(ipfsRepoPath); ok && keepBase {
+		if rest := strings.TrimPrefix(ipfsRepoPath, "/ipfs/"+top+"/"); rest != ipfsRepoPath {
+			newTop, err := ipfsShell.PatchLink(top, rest, root, true)
+			if err != nil {
+				return "", errgo.Notef(err, "patchLink(%s) into %s failed", rest, top)
+			}
+			return "ipfs:///ipfs/" + path.Join(newTop, rest), nil
+		}
+	}
+	name := path.Base(ipfsRepoPath)
+	if !strings.HasSuffix(name, repoSuffix) || name == repoSuffix {
+		return fmt.Sprintf("ipfs:///ipfs/%s", root), nil
+	}
+	parent, err := ipfsShell.NewObject("unixfs-dir")
+	if err != nil {
+		return "", errgo.Notef(err, "shell.NewObject(unixfs-dir) failed")
+	}
+	parent, err = ipfsShell.PatchLink(parent, name, root, false)
+	if err != nil {
+		return "", errgo.Notef(err, "patchLink(%s) failed", name)
+	}
+	return fmt.Sprintf("ipfs:///ipfs/%s/%s", parent, name), nil
+}
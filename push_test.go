@@ -1,11 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"gopkg.in/errgo.v1"
 )
 
 func TestPush(t *testing.T) {
@@ -125,3 +138,890 @@ func TestPush_twice(t *testing.T) {
 	}
 	rmDir(t, cloneAndCheckout(t, nextURL, expectedClone))
 }
+
+func TestPushURL_suffix(t *testing.T) {
+	fs, restore := useFakeShell()
+	defer restore()
+	oldPath, oldSuffix := ipfsRepoPath, repoSuffix
+	defer func() { ipfsRepoPath, repoSuffix = oldPath, oldSuffix }()
+	root := fs.addTree(map[string]string{"HEAD": "ref: refs/heads/master\n"})
+
+	repoSuffix = ".bare"
+	ipfsRepoPath = "/ipfs/QmOld/project.bare"
+	u, err := pushURL(root)
+	checkFatal(t, err)
+	if !strings.HasPrefix(u, "ipfs:///ipfs/") || !strings.HasSuffix(u, "/project.bare") {
+		t.Fatalf("unexpected url for custom suffix: %q", u)
+	}
+	got, err := fs.ResolvePath(strings.TrimPrefix(u, "ipfs://"))
+	checkFatal(t, err)
+	if got != root {
+		t.Errorf("url %q does not resolve to the pushed root", u)
+	}
+
+	// repo.git is just a directory name now
+	ipfsRepoPath = "/ipfs/QmOld/repo.git"
+	u, err = pushURL(root)
+	checkFatal(t, err)
+	if u != "ipfs:///ipfs/"+root {
+		t.Errorf("expected plain root url, got %q", u)
+	}
+}
+
+func TestIsBareRepoDir(t *testing.T) {
+	oldSuffix := repoSuffix
+	defer func() { repoSuffix = oldSuffix }()
+	repoSuffix = ".bare"
+	cases := map[string]bool{
+		"/tmp/project.bare": true,
+		"/tmp/project/.git": false,
+		"/tmp/project.git":  false,
+		"/tmp/project":      false,
+	}
+	for dir, want := range cases {
+		if got := isBareRepoDir(dir); got != want {
+			t.Errorf("isBareRepoDir(%q): want %v got %v", dir, want, got)
+		}
+	}
+}
+
+// mkLocalRepo creates a git repo with one commit and an ipfs remote named origin.
+// it points thisGitRepo and thisGitRemote at it and returns the commit sha1.
+func mkLocalRepo(t testing.TB, remoteURL string) (string, func()) {
+	dir := mkRandTmpDir(t)
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v failed: %s\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q", ".")
+	checkFatal(t, ioutil.WriteFile(filepath.Join(dir, "hello.txt"), []byte("hello\n"), 0600))
+	git("add", "hello.txt")
+	git("commit", "-q", "-m", "first")
+	git("remote", "add", "origin", remoteURL)
+	oldRepo, oldRemote := thisGitRepo, thisGitRemote
+	thisGitRepo, thisGitRemote = filepath.Join(dir, ".git"), "origin"
+	return git("rev-parse", "HEAD"), func() {
+		thisGitRepo, thisGitRemote = oldRepo, oldRemote
+		rmDir(t, dir)
+	}
+}
+
+// gitRun runs git in the work tree of thisGitRepo
+func gitRun(t testing.TB, args ...string) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = filepath.Dir(thisGitRepo)
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %v failed: %s\n%s", args, err, out)
+	}
+}
+
+func remoteURL(t *testing.T) string {
+	cmd := exec.Command("git", "config", "--get", "remote.origin.url")
+	cmd.Dir = thisGitRepo
+	out, err := cmd.CombinedOutput()
+	checkFatal(t, err)
+	return strings.TrimSpace(string(out))
+}
+
+func TestPush_mirrorDeletesRemoteOnlyRefs(t *testing.T) {
+	head := strings.Repeat("0", 40)
+	fs, restore := useFakeRepo(t, map[string]string{
+		"HEAD":              "ref: refs/heads/master\n",
+		"refs/heads/gone":   "32ed91604b272860ec911fc2bf4ae631b7900aa8\n",
+		"refs/heads/stale":  "e2839ad2e47386d342038958fba941fc78e3780e\n",
+		"refs/heads/master": head + "\n",
+	})
+	defer restore()
+	sha1, cleanup := mkLocalRepo(t, "ipfs://"+ipfsRepoPath)
+	defer cleanup()
+	// the remote master is the local one
+	root, err := fs.PatchLink(ipfsRepoPath[len("/ipfs/"):], "refs/heads/master", fs.addFile(sha1+"\n"), false)
+	checkFatal(t, err)
+	objs, err := gitListObjects(sha1, nil)
+	checkFatal(t, err)
+	for _, obj := range objs {
+		root, err = fs.PatchLink(root, objectPath(obj), fs.addFile("old "+obj), true)
+		checkFatal(t, err)
+	}
+	ipfsRepoPath = "/ipfs/" + root
+
+	var out bytes.Buffer
+	in := "list for-push\n" +
+		"push refs/heads/master:refs/heads/master\n" +
+		"push :refs/heads/gone\n" +
+		"push :refs/heads/stale\n\n"
+	checkFatal(t, speakGit(context.Background(), strings.NewReader(in), &out))
+	if !strings.HasSuffix(out.String(), "ok refs/heads/master\nok refs/heads/gone\nok refs/heads/stale\n\n") {
+		t.Errorf("unexpected push replies:\n%s", out.String())
+	}
+
+	newURL := remoteURL(t)
+	heads, err := fs.List(strings.TrimPrefix(newURL, "ipfs://") + "/refs/heads")
+	checkFatal(t, err)
+	if len(heads) != 1 || heads[0].Name != "master" {
+		t.Errorf("mirror push should leave only master, got %v", heads)
+	}
+}
+
+func TestPush_deleteHeadBranch(t *testing.T) {
+	fs, restore := useFakeRepo(t, map[string]string{"HEAD": "ref: refs/heads/master\n"})
+	defer restore()
+	_, cleanup := mkLocalRepo(t, "ipfs://"+ipfsRepoPath)
+	defer cleanup()
+	var out bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("push refs/heads/master:refs/heads/master\npush refs/heads/master:refs/heads/other\n\n"), &out))
+	newURL := remoteURL(t)
+	ipfsRepoPath = strings.TrimPrefix(newURL, "ipfs://")
+
+	out.Reset()
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("push :refs/heads/master\n\n"), &out))
+	if out.String() != "error refs/heads/master cannot delete branch pointed to by HEAD\n\n" || remoteURL(t) != newURL {
+		t.Errorf("deleting the branch of HEAD should be refused, got %q", out.String())
+	}
+
+	repointHead = true
+	defer func() { repointHead = false }()
+	out.Reset()
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("push :refs/heads/master\n\n"), &out))
+	if out.String() != "ok refs/heads/master\n\n" {
+		t.Fatalf("unexpected push reply %q", out.String())
+	}
+	rc, err := fs.Cat(strings.TrimPrefix(remoteURL(t), "ipfs://") + "/HEAD")
+	checkFatal(t, err)
+	head, err := ioutil.ReadAll(rc)
+	checkFatal(t, err)
+	if string(head) != "ref: refs/heads/other\n" {
+		t.Errorf("HEAD should point at the remaining branch, got %q", head)
+	}
+}
+
+func TestPush_deletePackedRef(t *testing.T) {
+	files := make(map[string]string)
+	_, commit := packedTagRepo(files)
+	fs, restore := useFakeRepo(t, files)
+	defer restore()
+	_, cleanup := mkLocalRepo(t, "ipfs://"+ipfsRepoPath)
+	defer cleanup()
+
+	var out bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("list for-push\n\npush :refs/tags/v1\n\n"), &out))
+	if !strings.HasSuffix(out.String(), "\nok refs/tags/v1\n\n") {
+		t.Fatalf("unexpected push reply %q", out.String())
+	}
+	rc, err := fs.Cat(strings.TrimPrefix(remoteURL(t), "ipfs://") + "/packed-refs")
+	checkFatal(t, err)
+	packed, err := ioutil.ReadAll(rc)
+	checkFatal(t, err)
+	// the tag and its peeled line are gone, the rest is kept as it was
+	if want := "# pack-refs with: peeled fully-peeled sorted \n" + commit + " refs/heads/master\n"; string(packed) != want {
+		t.Errorf("want packed-refs %q, got %q", want, packed)
+	}
+}
+
+func TestPush_skipsPresentObjects(t *testing.T) {
+	fs, restore := useFakeRepo(t, map[string]string{
+		"HEAD": "ref: refs/heads/master\n",
+	})
+	defer restore()
+	sha1, cleanup := mkLocalRepo(t, "ipfs://"+ipfsRepoPath)
+	defer cleanup()
+	objs, err := gitListObjects(sha1, nil)
+	checkFatal(t, err)
+	if len(objs) != 3 {
+		t.Fatalf("expected commit, tree and blob, got %v", objs)
+	}
+	// the remote already has everything but the commit
+	root := strings.TrimPrefix(ipfsRepoPath, "/ipfs/")
+	for _, obj := range objs {
+		if obj == sha1 {
+			continue
+		}
+		root, err = fs.PatchLink(root, objectPath(obj), fs.addFile("old "+obj), true)
+		checkFatal(t, err)
+	}
+	ipfsRepoPath = "/ipfs/" + root
+
+	adds := fs.calls["Add"]
+	checkFatal(t, push(context.Background(), "refs/heads/master", "refs/heads/master"))
+	checkFatal(t, pushFinish(context.Background()))
+	// the commit and the ref file
+	if got := fs.calls["Add"] - adds; got != 2 {
+		t.Errorf("expected 2 adds, got %d", got)
+	}
+	newRoot := strings.TrimPrefix(remoteURL(t), "ipfs:///ipfs/")
+	for _, obj := range objs {
+		if _, err := fs.ResolvePath(newRoot + "/" + objectPath(obj)); err != nil {
+			t.Errorf("object %s missing from new root: %s", obj, err)
+		}
+	}
+}
+
+func TestPush_ipnsURL(t *testing.T) {
+	for _, publishFails := range []bool{false, true} {
+		fs, restore := useFakeRepo(t, map[string]string{"HEAD": "ref: refs/heads/master\n"})
+		top, err := fs.PatchLink(fs.mkdir(map[string]string{}), "repo.git", strings.TrimPrefix(ipfsRepoPath, "/ipfs/"), true)
+		checkFatal(t, err)
+		fs.names["example.com"] = "/ipfs/" + top
+		if publishFails {
+			fs.failPublish = fmt.Errorf("no key for example.com")
+		}
+		ipfsRepoPath = "/ipns/example.com/repo.git"
+		resolveRepoPath(context.Background())
+		_, cleanup := mkLocalRepo(t, "ipfs://ipns/example.com/repo.git")
+		var errOut bytes.Buffer
+		stderr, verbose = &errOut, true
+
+		checkFatal(t, push(context.Background(), "refs/heads/master", "refs/heads/master"))
+		checkFatal(t, pushFinish(context.Background()))
+		newURL := remoteURL(t)
+		if publishFails {
+			if !strings.HasPrefix(newURL, "ipfs:///ipfs/") || strings.Contains(errOut.String(), "ipns") {
+				t.Errorf("failed publish should use the cid url, got %q\n%s", newURL, errOut.String())
+			}
+		} else {
+			if newURL != "ipfs://ipns/example.com/repo.git" {
+				t.Errorf("published push should keep the ipns url, got %q", newURL)
+			}
+			if !strings.Contains(errOut.String(), "new address: ipfs://ipns/example.com/repo.git\n") ||
+				!strings.Contains(errOut.String(), "immutable address of this push: ipfs:///ipfs/") {
+				t.Errorf("verbose output should show both addresses:\n%s", errOut.String())
+			}
+			if _, err := fs.ResolvePath("/ipns/example.com/repo.git/refs/heads/master"); err != nil {
+				t.Errorf("published name doesn't have the pushed ref: %s", err)
+			}
+		}
+		stderr, verbose = os.Stderr, false
+		cleanup()
+		restore()
+	}
+}
+
+func TestPush_nestedKeepBase(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		fs, restore := useFakeRepo(t, map[string]string{"HEAD": "ref: refs/heads/master\n"})
+		top, err := fs.PatchLink(fs.mkdir(map[string]string{}), "a/b/c/repo.git", strings.TrimPrefix(ipfsRepoPath, "/ipfs/"), true)
+		checkFatal(t, err)
+		top, err = fs.PatchLink(top, "a/README", fs.addFile("siblings\n"), true)
+		checkFatal(t, err)
+		ipfsRepoPath = "/ipfs/" + top + "/a/b/c/repo.git"
+		keepBase = keep
+		head, cleanup := mkLocalRepo(t, "ipfs://"+ipfsRepoPath)
+
+		checkFatal(t, push(context.Background(), "refs/heads/master", "refs/heads/master"))
+		checkFatal(t, pushFinish(context.Background()))
+		newURL := remoteURL(t)
+		newPath := strings.TrimPrefix(newURL, "ipfs://")
+		if got, want := strings.HasSuffix(newURL, "/a/b/c/repo.git"), keep; got != want {
+			t.Errorf("keepBase=%v: unexpected url %q", keep, newURL)
+		}
+		for _, p := range []string{newPath + "/refs/heads/master", newPath + "/" + remoteObjectPath(head)} {
+			if _, err := fs.ResolvePath(p); err != nil {
+				t.Errorf("keepBase=%v: %s isn't there: %s", keep, p, err)
+			}
+		}
+		if keep {
+			if _, err := fs.ResolvePath(strings.TrimSuffix(newPath, "b/c/repo.git") + "README"); err != nil {
+				t.Errorf("the rest of the cid was lost: %s", err)
+			}
+		}
+		keepBase = false
+		cleanup()
+		restore()
+	}
+}
+
+func TestPush_noteCID(t *testing.T) {
+	_, restore := useFakeRepo(t, map[string]string{"HEAD": "ref: refs/heads/master\n"})
+	defer restore()
+	head, cleanup := mkLocalRepo(t, "ipfs://"+ipfsRepoPath)
+	defer cleanup()
+	// git notes commits
+	t.Setenv("GIT_AUTHOR_NAME", "test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+	noteCID = true
+	defer func() { noteCID = false }()
+
+	checkFatal(t, push(context.Background(), "refs/heads/master", "refs/heads/master"))
+	checkFatal(t, pushFinish(context.Background()))
+	cmd := exec.Command("git", "log", "--notes=ipfs", "--format=%H %N", "-1", "master")
+	cmd.Dir = thisGitRepo
+	out, err := cmd.CombinedOutput()
+	checkFatal(t, err)
+	if got, want := strings.TrimSpace(string(out)), head+" "+remoteURL(t); got != want {
+		t.Errorf("pushed commit should carry the new address as note\nwant %q\ngot  %q", want, got)
+	}
+}
+
+func TestPublishIPNS_retry(t *testing.T) {
+	fs, restore := useFakeShell()
+	defer restore()
+	root := fs.mkdir(map[string]string{})
+	fs.names["example.com"] = "/ipfs/" + fs.mkdir(map[string]string{"old": fs.addFile("old")})
+
+	// fails twice, the third attempt gets through
+	fs.flakyPublish = 2
+	top, err := publishIPNS(context.Background(), "example.com", "", root, "")
+	checkFatal(t, err)
+	if fs.calls["Publish"] != 3 || fs.names["example.com"] != "/ipfs/"+top {
+		t.Errorf("expected a publish after 3 attempts, got %d calls and %s", fs.calls["Publish"], fs.names["example.com"])
+	}
+	checkFatal(t, verifyPublished("example.com", top))
+
+	fs.flakyPublish = retryAttempts
+	if _, err := publishIPNS(context.Background(), "example.com", "", root, ""); err == nil {
+		t.Error("expected an error once every attempt failed")
+	}
+
+	// the publish went through but the record didn't change
+	fs.stalePublish = true
+	newRoot := fs.mkdir(map[string]string{"new": fs.addFile("new")})
+	top, err = publishIPNS(context.Background(), "example.com", "", newRoot, "")
+	checkFatal(t, err)
+	if err := verifyPublished("example.com", top); err == nil || !strings.Contains(err.Error(), "stale") {
+		t.Errorf("expected a stale record, got %v", err)
+	}
+}
+
+func TestPush_concurrent(t *testing.T) {
+	fs, restore := useFakeRepo(t, map[string]string{"HEAD": "ref: refs/heads/master\n"})
+	defer restore()
+	top, err := fs.PatchLink(fs.mkdir(map[string]string{}), "repo.git", strings.TrimPrefix(ipfsRepoPath, "/ipfs/"), true)
+	checkFatal(t, err)
+	fs.names["example.com"] = "/ipfs/" + top
+	ipfsRepoPath = "/ipns/example.com/repo.git"
+	resolveRepoPath(context.Background())
+	_, cleanup := mkLocalRepo(t, "ipfs://ipns/example.com/repo.git")
+	defer cleanup()
+	stderr = ioutil.Discard
+	defer func() { stderr = os.Stderr }()
+
+	// another helper holds the lock
+	lock := filepath.Join(thisGitRepo, "ipfs-push-example.com.lock")
+	checkFatal(t, ioutil.WriteFile(lock, []byte("1\n"), 0600))
+	if err := push(context.Background(), "refs/heads/master", "refs/heads/master"); errgo.Cause(err) != errRemoteBusy {
+		t.Fatalf("push with a held lock should fail with %q, got %v", errRemoteBusy, err)
+	}
+	// waiting for it works once the other one is done
+	pushLockWait = 5 * time.Second
+	defer func() { pushLockWait = 0 }()
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		os.Remove(lock)
+	}()
+	checkFatal(t, push(context.Background(), "refs/heads/master", "refs/heads/master"))
+
+	// the name moved while we were pushing
+	other := "/ipfs/" + fs.mkdir(map[string]string{})
+	fs.names["example.com"] = other
+	if err := pushFinish(context.Background()); errgo.Cause(err) != errRemoteBusy {
+		t.Fatalf("pushFinish after a concurrent publish should fail with %q, got %v", errRemoteBusy, err)
+	}
+	if fs.names["example.com"] != other {
+		t.Errorf("concurrent publish was clobbered")
+	}
+	if len(fs.mfs) != 0 {
+		t.Errorf("the failed publish left %v staged", fs.mfs)
+	}
+	if _, err := os.Stat(lock); !os.IsNotExist(err) {
+		t.Errorf("push lock not released: %v", err)
+	}
+}
+
+func TestPush_gitlink(t *testing.T) {
+	fs, restore := useFakeRepo(t, map[string]string{"HEAD": "ref: refs/heads/master\n"})
+	defer restore()
+	_, cleanup := mkLocalRepo(t, "ipfs://ipfs/"+fixtureHash)
+	defer cleanup()
+	stderr = ioutil.Discard
+	defer func() { stderr = os.Stderr }()
+	// a submodule commit that only exists in the submodule's repo
+	subCommit := "5f4a3e6b1c2d7e8f9a0b1c2d3e4f5a6b7c8d9e0f"
+	gitRun(t, "update-index", "--add", "--cacheinfo", "160000,"+subCommit+",lib")
+	gitRun(t, "commit", "-q", "-m", "add submodule")
+	checkFatal(t, push(context.Background(), "refs/heads/master", "refs/heads/master"))
+	if _, err := fs.ResolvePath(pushRoot + "/" + objectPath(subCommit)); err == nil {
+		t.Error("the submodule commit should not be pushed")
+	}
+	head := ref2hash["refs/heads/master"]
+	checkFatal(t, pushFinish(context.Background()))
+
+	// and it can be fetched again
+	ipfsRepoPath = strings.TrimPrefix(remoteURL(t), "ipfs://")
+	defer useTmpGitDir(t)()
+	checkFatal(t, fetchObject(context.Background(), head))
+}
+
+func TestPush_upToDate(t *testing.T) {
+	fs, restore := useFakeRepo(t, map[string]string{"HEAD": "ref: refs/heads/master\n"})
+	defer restore()
+	head, cleanup := mkLocalRepo(t, "ipfs://"+ipfsRepoPath)
+	defer cleanup()
+	url := remoteURL(t)
+	ref2hash["refs/heads/master"] = head
+	var errOut bytes.Buffer
+	stderr = &errOut
+	defer func() { stderr = os.Stderr }()
+
+	calls := make(map[string]int)
+	for k, v := range fs.calls {
+		calls[k] = v
+	}
+	var out bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("push refs/heads/master:refs/heads/master\n\n"), &out))
+	if out.String() != "ok refs/heads/master\n\n" {
+		t.Errorf("unexpected push reply %q", out.String())
+	}
+	for _, write := range []string{"Add", "PatchLink", "Patch", "NewObject", "BlockPut", "Publish", "Pin"} {
+		if fs.calls[write] != calls[write] {
+			t.Errorf("no-op push called %s %d times", write, fs.calls[write]-calls[write])
+		}
+	}
+	if !strings.Contains(errOut.String(), "Everything up-to-date") {
+		t.Errorf("expected up-to-date note on stderr, got %q", errOut.String())
+	}
+	if remoteURL(t) != url {
+		t.Errorf("no-op push changed the remote url to %s", remoteURL(t))
+	}
+}
+
+func TestPush_deterministicRoot(t *testing.T) {
+	_, cleanup := mkLocalRepo(t, "ipfs://ipfs/"+fixtureHash)
+	defer cleanup()
+	stderr = ioutil.Discard
+	defer func() { stderr = os.Stderr }()
+	defer func(old objectStore) { objStore = old }(objStore)
+
+	for _, mode := range []string{"file", "block"} {
+		var roots []string
+		for i := 0; i < 2; i++ {
+			var err error
+			objStore, err = newObjectStore(mode)
+			checkFatal(t, err)
+			// every push starts from the same empty remote
+			_, restore := useFakeRepo(t, map[string]string{"HEAD": "ref: refs/heads/master\n"})
+			checkFatal(t, push(context.Background(), "refs/heads/master", "refs/heads/master"))
+			roots = append(roots, pushRoot)
+			checkFatal(t, pushFinish(context.Background()))
+			roots = append(roots, remoteURL(t))
+			restore()
+		}
+		if roots[0] != roots[2] || roots[1] != roots[3] {
+			t.Errorf("%s store: pushing the same state twice gave different roots: %v", mode, roots)
+		}
+	}
+}
+
+func TestPush_perBranchLayout(t *testing.T) {
+	fs, restore := useFakeRepo(t, map[string]string{"HEAD": "ref: refs/heads/master\n"})
+	defer restore()
+	_, cleanup := mkLocalRepo(t, "ipfs://"+ipfsRepoPath)
+	defer cleanup()
+	stderr = ioutil.Discard
+	defer func() { stderr = os.Stderr }()
+	defer func() { layout = layoutBare }()
+	layout = layoutPerBranch
+
+	gitRun(t, "checkout", "-q", "-b", "feature/x")
+	checkFatal(t, ioutil.WriteFile(filepath.Join(filepath.Dir(thisGitRepo), "feature.txt"), []byte("feature\n"), 0600))
+	gitRun(t, "add", "feature.txt")
+	gitRun(t, "commit", "-q", "-m", "feature")
+	checkFatal(t, push(context.Background(), "refs/heads/master", "refs/heads/master"))
+	checkFatal(t, push(context.Background(), "refs/heads/feature/x", "refs/heads/feature/x"))
+	heads := map[string]string{"master": ref2hash["refs/heads/master"], "feature/x": ref2hash["refs/heads/feature/x"]}
+	root := pushRoot
+	checkFatal(t, pushFinish(context.Background()))
+
+	for name, head := range heads {
+		ipfsRepoPath = "/ipfs/" + root + "/branches/" + name
+		ref2hash = make(map[string]string)
+		var out bytes.Buffer
+		checkFatal(t, speakGit(context.Background(), strings.NewReader("list\n"), &out))
+		if out.String() != head+" refs/heads/"+name+"\n"+head+" HEAD\n\n" {
+			t.Errorf("branch %s: unexpected listing %q", name, out.String())
+		}
+		cleanupDir := useTmpGitDir(t)
+		checkFatal(t, fetchObject(context.Background(), head))
+		cleanupDir()
+	}
+	// the master snapshot doesn't carry the feature commit
+	if _, err := fs.ResolvePath(root + "/branches/master/" + objectPath(heads["feature/x"])); err == nil {
+		t.Error("master snapshot has objects of feature/x")
+	}
+}
+
+func TestPush_danglingRef(t *testing.T) {
+	_, restore := useFakeRepo(t, map[string]string{"HEAD": "ref: refs/heads/master\n"})
+	defer restore()
+	head, cleanup := mkLocalRepo(t, "ipfs://"+ipfsRepoPath)
+	defer cleanup()
+	url := remoteURL(t)
+	stderr = ioutil.Discard
+	defer func() { stderr = os.Stderr }()
+
+	// a remote ref whose commit never made it into the tree
+	missing := strings.Repeat("ab", 20)
+	ref2hash["refs/heads/broken"] = missing
+	checkFatal(t, push(context.Background(), "refs/heads/master", "refs/heads/master"))
+	root := pushRoot
+	if err := verifyRefs(root, map[string]string{"refs/heads/master": head}); err != nil {
+		t.Errorf("pushed ref failed verification: %s", err)
+	}
+	err := pushFinish(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "refs/heads/broken") || !strings.Contains(err.Error(), missing) {
+		t.Fatalf("expected an error naming the dangling ref, got %v", err)
+	}
+	if exitCode(err) != exitObjectError {
+		t.Errorf("want exit code %d got %d", exitObjectError, exitCode(err))
+	}
+	if remoteURL(t) != url {
+		t.Errorf("a broken root was published as %s", remoteURL(t))
+	}
+}
+
+func TestPush_staging(t *testing.T) {
+	for _, flushFails := range []bool{false, true} {
+		fs, restore := useFakeRepo(t, map[string]string{"HEAD": "ref: refs/heads/master\n"})
+		_, cleanup := mkLocalRepo(t, "ipfs://"+ipfsRepoPath)
+		url := remoteURL(t)
+		stderr = ioutil.Discard
+		if flushFails {
+			fs.failFlush = fmt.Errorf("no space left")
+		}
+
+		checkFatal(t, push(context.Background(), "refs/heads/master", "refs/heads/master"))
+		err := pushFinish(context.Background())
+		if fs.calls["FilesCp"] != 1 || fs.calls["FilesRm"] != 1 {
+			t.Errorf("flush fails %v: the root should be staged and removed once: %v", flushFails, fs.calls)
+		}
+		if len(fs.mfs) != 0 {
+			t.Errorf("flush fails %v: the push left %v staged", flushFails, fs.mfs)
+		}
+		if flushFails {
+			if err == nil || !strings.Contains(err.Error(), "flushing "+stagingDir+"/") {
+				t.Errorf("expected the failed flush of the staging directory, got %v", err)
+			}
+			if remoteURL(t) != url || len(fs.pins) != 0 {
+				t.Errorf("a root that wasn't flushed was published: url %s pins %v", remoteURL(t), fs.pins)
+			}
+		} else {
+			checkFatal(t, err)
+			if root := strings.TrimPrefix(remoteURL(t), "ipfs:///ipfs/"); !fs.pins[root] {
+				t.Errorf("the staged root %s was not pinned: %v", root, fs.pins)
+			}
+		}
+		stderr = os.Stderr
+		cleanup()
+		restore()
+	}
+}
+
+func TestPush_nonFastForward(t *testing.T) {
+	fs, restore := useFakeRepo(t, map[string]string{"HEAD": "ref: refs/heads/master\n"})
+	defer restore()
+	_, cleanup := mkLocalRepo(t, "ipfs://"+ipfsRepoPath)
+	defer cleanup()
+	gitRun(t, "commit", "-q", "--allow-empty", "-m", "second")
+	ahead, err := gitRefHash("HEAD")
+	checkFatal(t, err)
+	gitRun(t, "reset", "-q", "--hard", "HEAD~1")
+	// the remote has the commit the local master lost
+	ref2hash["refs/heads/master"] = ahead
+	adds := fs.calls["Add"]
+
+	err = push(context.Background(), "refs/heads/master", "refs/heads/master")
+	if !errors.Is(err, ErrNonFastForward) || err.Error() != "non-fast-forward" {
+		t.Errorf("want ErrNonFastForward reported as non-fast-forward, got %v", err)
+	}
+	if fs.calls["Add"] != adds || pushRoot != "" {
+		t.Errorf("the rejected push added %d objects onto %q", fs.calls["Add"]-adds, pushRoot)
+	}
+	checkFatal(t, push(context.Background(), "+refs/heads/master", "refs/heads/master"))
+}
+
+func TestPush_nonFastForwardRebaseHint(t *testing.T) {
+	_, restore := useFakeRepo(t, map[string]string{"HEAD": "ref: refs/heads/master\n"})
+	defer restore()
+	_, cleanup := mkLocalRepo(t, "ipfs://"+ipfsRepoPath)
+	defer cleanup()
+	pushRebaseHint = true
+	defer func() { pushRebaseHint = false }()
+	gitRun(t, "commit", "-q", "--allow-empty", "-m", "second")
+	ahead, err := gitRefHash("HEAD")
+	checkFatal(t, err)
+	checkFatal(t, push(context.Background(), "refs/heads/master", "refs/heads/master"))
+	checkFatal(t, pushFinish(context.Background()))
+	ipfsRepoPath = strings.TrimPrefix(remoteURL(t), "ipfs://")
+	cid, err := ipfsShell.ResolvePath(ipfsRepoPath + "/" + objectPath(ahead))
+	checkFatal(t, err)
+	// someone else's second commit, the local one is a different one
+	gitRun(t, "reset", "-q", "--hard", "HEAD~1")
+	gitRun(t, "commit", "-q", "--allow-empty", "-m", "other second")
+
+	err = push(context.Background(), "refs/heads/master", "refs/heads/master")
+	want := "non-fast-forward: remote refs/heads/master is at " + ahead + " (/ipfs/" + cid + "), fetch and rebase onto it first"
+	if !errors.Is(err, ErrNonFastForward) || err == nil || err.Error() != want {
+		t.Errorf("want %q, got %v", want, err)
+	}
+}
+
+// addFiles commits n files to the local repo of mkLocalRepo
+func addFiles(t testing.TB, n int) {
+	dir := filepath.Dir(thisGitRepo)
+	for i := 0; i < n; i++ {
+		checkFatal(t, ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d.txt", i)), []byte(fmt.Sprintf("content %d\n", i)), 0600))
+	}
+	gitRun(t, "add", ".")
+	gitRun(t, "commit", "-q", "-m", "more files")
+}
+
+func TestPush_concurrencyMatchesSerial(t *testing.T) {
+	_, cleanup := mkLocalRepo(t, "ipfs://ipfs/"+fixtureHash)
+	defer cleanup()
+	addFiles(t, 30)
+	stderr = ioutil.Discard
+	defer func() { stderr = os.Stderr }()
+	defer func(old int) { pushConcurrency = old }(pushConcurrency)
+
+	roots := make(map[int]string)
+	for _, n := range []int{1, 8, 100} {
+		pushConcurrency = n
+		_, restore := useFakeRepo(t, map[string]string{"HEAD": "ref: refs/heads/master\n"})
+		checkFatal(t, push(context.Background(), "refs/heads/master", "refs/heads/master"))
+		roots[n] = pushRoot
+		checkFatal(t, pushFinish(context.Background()))
+		restore()
+	}
+	if roots[1] != roots[8] || roots[1] != roots[100] {
+		t.Errorf("concurrent adds gave a different root than the serial ones: %v", roots)
+	}
+
+	// a failing add stops the others without hanging
+	shas, err := gitListObjects("refs/heads/master", nil)
+	checkFatal(t, err)
+	pushConcurrency = 4
+	defer func() { PreStore = nil }()
+	PreStore = func([]byte) ([]byte, error) { return nil, errgo.New("no") }
+	if _, err := putObjects(context.Background(), "", shas); err == nil {
+		t.Error("expected the PreStore error")
+	}
+}
+
+func benchmarkPutObjects(b *testing.B, n int) {
+	_, cleanup := mkLocalRepo(b, "ipfs://ipfs/"+fixtureHash)
+	defer cleanup()
+	addFiles(b, 50)
+	shas, err := gitListObjects("refs/heads/master", nil)
+	checkFatal(b, err)
+	defer func(old int) { pushConcurrency = old }(pushConcurrency)
+	pushConcurrency = n
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, restore := useFakeShell()
+		if _, err := putObjects(context.Background(), "", shas); err != nil {
+			b.Fatal(err)
+		}
+		restore()
+	}
+}
+
+func BenchmarkPutObjects_serial(b *testing.B)     { benchmarkPutObjects(b, 1) }
+func BenchmarkPutObjects_concurrent(b *testing.B) { benchmarkPutObjects(b, 8) }
+
+func TestPush_cidVersion(t *testing.T) {
+	_, cleanup := mkLocalRepo(t, "ipfs://ipfs/"+fixtureHash)
+	defer cleanup()
+	stderr = ioutil.Discard
+	defer func() { stderr = os.Stderr }()
+	fs, restore := useFakeRepo(t, map[string]string{"HEAD": "ref: refs/heads/master\n"})
+	defer restore()
+
+	// v1 gives a node of fs a bafy.. name too, like a root or an object added with cid version 1
+	v1 := func(h string) string {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		alias := "bafy" + strings.TrimPrefix(h, "Qm")
+		fs.nodes[alias] = fs.nodes[h]
+		return alias
+	}
+	// a daemon api adding into fs, counting the cid versions asked for
+	var mu sync.Mutex
+	versions := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h, _ := fs.Add(f)
+		v := r.URL.Query().Get("cid-version")
+		if v == "1" {
+			h = v1(h)
+		}
+		mu.Lock()
+		versions[v]++
+		mu.Unlock()
+		fmt.Fprintf(w, `{"Hash":"%s"}`, h)
+	}))
+	defer srv.Close()
+	defer func(add func(io.Reader) (string, error)) { addObject, objectAdder, pushAdder = add, nil, nil }(addObject)
+	pushes := 0
+	pushOnto := func(root string, opts url.Values) map[string]int {
+		objectAdder = &apiAdder{addr: srv.URL, opts: opts, client: newHTTPClient(1)}
+		ipfsRepoPath = "/ipfs/" + root
+		mu.Lock()
+		versions = make(map[string]int)
+		mu.Unlock()
+		pushes++
+		checkFatal(t, ioutil.WriteFile(filepath.Join(filepath.Dir(thisGitRepo), "pushed.txt"), []byte(fmt.Sprintf("push %d\n", pushes)), 0600))
+		gitRun(t, "add", ".")
+		gitRun(t, "commit", "-q", "-m", "next push")
+		checkFatal(t, push(context.Background(), "refs/heads/master", "refs/heads/master"))
+		pushed := pushRoot
+		checkFatal(t, pushFinish(context.Background()))
+		// the daemon keeps the version of the root it patches
+		if cidVersionOf(root) == 1 {
+			pushed = v1(pushed)
+		}
+		ipfsRepoPath = "/ipfs/" + pushed
+		mu.Lock()
+		defer mu.Unlock()
+		return versions
+	}
+
+	empty := strings.TrimPrefix(ipfsRepoPath, "/ipfs/")
+	root := v1(empty)
+	got := pushOnto(root, nil)
+	if len(got) != 1 || got["1"] == 0 {
+		t.Errorf("push onto a v1 root: want only version 1 adds, got %v", got)
+	}
+	// the next push builds on the root of the first one
+	got = pushOnto(strings.TrimPrefix(ipfsRepoPath, "/ipfs/"), nil)
+	if len(got) != 1 || got["1"] == 0 {
+		t.Errorf("incremental push: want only version 1 adds, got %v", got)
+	}
+	if got := pushOnto(empty, nil); len(got) != 1 || got["0"] == 0 {
+		t.Errorf("push onto a v0 root: want only version 0 adds, got %v", got)
+	}
+	// GIT_IPFS_CID_VERSION wins
+	if got := pushOnto(root, url.Values{"cid-version": {"0"}}); len(got) != 1 || got["0"] == 0 {
+		t.Errorf("explicit version 0 onto a v1 root: got %v", got)
+	}
+}
+
+func TestPush_symlinks(t *testing.T) {
+	_, restore := useFakeRepo(t, map[string]string{"HEAD": "ref: refs/heads/master\n"})
+	defer restore()
+	_, cleanup := mkLocalRepo(t, "ipfs://ipfs/"+fixtureHash)
+	defer cleanup()
+	stderr = ioutil.Discard
+	defer func() { stderr = os.Stderr }()
+	// relative, into a subdirectory, out of the repo, absolute and dangling
+	links := map[string]string{
+		"link":       "hello.txt",
+		"sub/up":     "../hello.txt",
+		"outside":    "../../elsewhere",
+		"abs":        "/etc/hostname",
+		"sub/broken": "missing",
+	}
+	work := filepath.Dir(thisGitRepo)
+	checkFatal(t, os.Mkdir(filepath.Join(work, "sub"), 0755))
+	for name, target := range links {
+		checkFatal(t, os.Symlink(target, filepath.Join(work, name)))
+	}
+	gitRun(t, "add", "-A")
+	gitRun(t, "commit", "-q", "-m", "symlinks")
+	checkFatal(t, push(context.Background(), "refs/heads/master", "refs/heads/master"))
+	head := ref2hash["refs/heads/master"]
+	checkFatal(t, pushFinish(context.Background()))
+	lsTree := func() string {
+		out, err := exec.Command("git", "--git-dir", thisGitRepo, "ls-tree", "-r", head).CombinedOutput()
+		checkFatal(t, err)
+		return string(out)
+	}
+	pushed := lsTree()
+	if strings.Count(pushed, "120000 blob") != len(links) {
+		t.Fatalf("fixture lacks symlinks:\n%s", pushed)
+	}
+
+	// cloned back they are the same links
+	ipfsRepoPath = strings.TrimPrefix(remoteURL(t), "ipfs://")
+	_, done := initClone(t)
+	defer done()
+	checkFatal(t, fetchObject(context.Background(), head))
+	if got := lsTree(); got != pushed {
+		t.Errorf("fetched tree differs:\n%s\nwant\n%s", got, pushed)
+	}
+
+	// a snapshot writes them as links, or as files holding the target
+	for _, asFiles := range []bool{false, true} {
+		symlinksAsFiles = asFiles
+		dir := mkRandTmpDir(t)
+		_, err := snapshot(context.Background(), head, dir)
+		checkFatal(t, err)
+		for name, target := range links {
+			got, err := os.Readlink(filepath.Join(dir, name))
+			if asFiles {
+				var b []byte
+				b, err = ioutil.ReadFile(filepath.Join(dir, name))
+				if fi, errStat := os.Lstat(filepath.Join(dir, name)); errStat != nil || !fi.Mode().IsRegular() {
+					t.Errorf("%s: not written as a file: %v", name, errStat)
+				}
+				got = string(b)
+			}
+			if err != nil || got != target {
+				t.Errorf("snapshot (as files %v) %s: %q %v, want %q", asFiles, name, got, err, target)
+			}
+		}
+		rmDir(t, dir)
+	}
+	symlinksAsFiles = false
+}
+
+func TestPush_newRemoteHead(t *testing.T) {
+	stderr = ioutil.Discard
+	defer func() { stderr = os.Stderr }()
+	defer func() { defaultBranch = "" }()
+	for _, tc := range []struct {
+		name   string
+		remote func(fs *fakeShell) string
+		pushed []string
+		deflt  string
+		want   string
+	}{
+		{"no HEAD", func(fs *fakeShell) string { return fs.mkdir(map[string]string{}) }, []string{"main"}, "", "main"},
+		{"unborn master", emptyBareRepo, []string{"main", "dev"}, "", "main"},
+		{"default branch", emptyBareRepo, []string{"main", "dev"}, "dev", "dev"},
+		{"default branch not pushed", emptyBareRepo, []string{"main"}, "dev", "main"},
+		{"working HEAD", emptyBareRepo, []string{"master", "dev"}, "dev", "master"},
+	} {
+		fs, restore := useFakeRepo(t, nil)
+		ipfsRepoPath = "/ipfs/" + tc.remote(fs)
+		_, cleanup := mkLocalRepo(t, "ipfs://"+ipfsRepoPath)
+		defaultBranch = tc.deflt
+		for _, b := range tc.pushed {
+			checkFatal(t, push(context.Background(), "refs/heads/master", "refs/heads/"+b))
+		}
+		checkFatal(t, pushFinish(context.Background()))
+
+		// what a clone checks out
+		ipfsRepoPath = strings.TrimPrefix(remoteURL(t), "ipfs://")
+		if head, err := readHeadRef(); err != nil || head != "refs/heads/"+tc.want {
+			t.Errorf("%s: want HEAD at %s, got %q %v", tc.name, tc.want, head, err)
+		}
+		cleanup()
+		restore()
+	}
+}
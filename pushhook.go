@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+
+	"gopkg.in/errgo.v1"
+)
+
+// prePushCmd (GIT_IPFS_PREPUSH_CMD) and postPushCmd (GIT_IPFS_POSTPUSH_CMD) are shell commands
+// run before a push batch changes anything and after it published the new root, for pinning services or notifications.
+// a failing pre-push command refuses the batch, a failing post-push one only warns: the push is done by then.
+var prePushCmd, postPushCmd string
+
+// runPushHook runs cmd with sh, args as $1.. and env added to the helper's environment.
+// its output goes to stderr, stdout is git's.
+func runPushHook(kind, cmd string, env []string, args ...string) error {
+	hook := exec.Command("sh", append([]string{"-c", cmd, kind}, args...)...)
+	hook.Env = append(append(os.Environ(), "GIT_IPFS_REMOTE="+thisGitRemote), env...)
+	hook.Stdout, hook.Stderr = stderr, stderr
+	if err := hook.Run(); err != nil {
+		return errgo.Notef(err, "%s command failed", kind)
+	}
+	return nil
+}
+
+// prePush runs prePushCmd with the url the batch is pushed to in GIT_IPFS_URL
+func prePush() error {
+	if prePushCmd == "" {
+		return nil
+	}
+	return runPushHook("pre-push", prePushCmd, []string{"GIT_IPFS_URL=" + repoURL()})
+}
+
+// postPush runs postPushCmd with the new root as $1 and GIT_IPFS_ROOT, and the remote's new url as GIT_IPFS_URL
+func postPush(root, newURL string) {
+	if postPushCmd == "" {
+		return
+	}
+	if err := runPushHook("post-push", postPushCmd, []string{"GIT_IPFS_ROOT=" + root, "GIT_IPFS_URL=" + newURL}, root); err != nil {
+		log.WithField("err", err).Warning("the push is published, but its post-push command failed")
+	}
+}
+
+// repoURL is the url of the remote before the push
+func repoURL() string {
+	if ipnsRepoPath != "" {
+		return "ipfs:/" + ipnsRepoPath + repoURLQuery
+	}
+	return "ipfs:/" + ipfsRepoPath + repoURLQuery
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPushHooks(t *testing.T) {
+	fs, restore := useFakeRepo(t, map[string]string{"HEAD": "ref: refs/heads/master\n"})
+	defer restore()
+	startPath := ipfsRepoPath
+	head, cleanup := mkLocalRepo(t, "ipfs://"+startPath)
+	defer cleanup()
+	out := filepath.Join(thisGitRepo, "hooks.out")
+	prePushCmd = `echo "pre $GIT_IPFS_REMOTE $GIT_IPFS_URL" >> ` + out
+	postPushCmd = `echo "post $1 $GIT_IPFS_ROOT $GIT_IPFS_URL" >> ` + out
+	defer func() { prePushCmd, postPushCmd = "", "" }()
+
+	var reply bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("push refs/heads/master:refs/heads/master\n\n"), &reply))
+	if reply.String() != "ok refs/heads/master\n\n" {
+		t.Fatalf("unexpected push reply %q", reply.String())
+	}
+	newURL := remoteURL(t)
+	root := strings.TrimPrefix(newURL, "ipfs:///ipfs/")
+	data, err := ioutil.ReadFile(out)
+	checkFatal(t, err)
+	if want := "pre origin ipfs:/" + startPath + "\npost " + root + " " + root + " " + newURL + "\n"; string(data) != want {
+		t.Errorf("hooks ran with\n%s\nwant\n%s", data, want)
+	}
+
+	// a failing pre-push command stops the push before anything changes
+	prePushCmd = "exit 3"
+	checkFatal(t, ioutil.WriteFile(out, nil, 0600))
+	reply.Reset()
+	calls := fs.calls["PatchLink"]
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("push +"+head+":refs/heads/other\n\n"), &reply))
+	if !strings.HasPrefix(reply.String(), "error refs/heads/other pre-push command failed") {
+		t.Errorf("refused push should report the pre-push command, got %q", reply.String())
+	}
+	if fs.calls["PatchLink"] != calls || remoteURL(t) != newURL {
+		t.Error("refused push changed the remote")
+	}
+	if data, _ := ioutil.ReadFile(out); len(data) != 0 {
+		t.Errorf("post-push command ran after a refused push: %q", data)
+	}
+}
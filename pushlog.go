@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// pushLogPath is the json lines file every push is recorded in (GIT_IPFS_PUSH_LOG), "" for none.
+// a push writes a staged record once its new root is complete and a published one when the remote points to it,
+// so a staged root without a published record is a push that was interrupted in between, see recover.
+var pushLogPath string
+
+// states of push log records
+const (
+	pushStaged    = "staged"
+	pushPublished = "published"
+)
+
+// pushLogEntry is one line of the push log
+type pushLogEntry struct {
+	Time    time.Time `json:"time"`
+	State   string    `json:"state"`
+	Remote  string    `json:"remote"`
+	Refs    []string  `json:"refs"`
+	OldRoot string    `json:"old_root"`
+	NewRoot string    `json:"new_root"`
+	IPNS    string    `json:"ipns,omitempty"`
+	URL     string    `json:"url,omitempty"` // the new remote url, once published
+}
+
+// appendPushLog adds e to the push log and syncs it, the staged record has to be on disk before anything gets published
+func appendPushLog(e pushLogEntry) error {
+	if pushLogPath == "" {
+		return nil
+	}
+	e.Time = time.Now().UTC()
+	line, err := json.Marshal(e)
+	if err != nil {
+		return errgo.Notef(err, "encoding push log entry failed")
+	}
+	f, err := os.OpenFile(pushLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errgo.Notef(err, "opening push log failed")
+	}
+	_, err = f.Write(append(line, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return errgo.Notef(err, "writing push log %s failed", pushLogPath)
+	}
+	return nil
+}
+
+// incompletePushes reads a push log and returns the staged records no published one of the same root followed
+func incompletePushes(r io.Reader) ([]pushLogEntry, error) {
+	var staged []pushLogEntry
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		var e pushLogEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return nil, errgo.Notef(err, "push log line %d", n)
+		}
+		switch e.State {
+		case pushStaged:
+			staged = append(staged, e)
+		case pushPublished:
+			for i := range staged {
+				if staged[i].NewRoot == e.NewRoot && staged[i].Remote == e.Remote {
+					staged = append(staged[:i], staged[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, errgo.Notef(err, "reading push log failed")
+	}
+	return staged, nil
+}
+
+// recoverMain is git-remote-ipfs recover [<push-log>]
+func recoverMain(args []string) int {
+	flags := flag.NewFlagSet("recover", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil || flags.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "usage: git-remote-ipfs recover [<push-log>]")
+		return exitUsage
+	}
+	p := os.Getenv("GIT_IPFS_PUSH_LOG")
+	if flags.NArg() == 1 {
+		p = flags.Arg(0)
+	}
+	if p == "" {
+		fmt.Fprintln(os.Stderr, "recover: no push log, set GIT_IPFS_PUSH_LOG or name one")
+		return exitUsage
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		log.Error("recover failed:", err)
+		return exitFailure
+	}
+	defer f.Close()
+	incomplete, err := incompletePushes(f)
+	if err != nil {
+		log.Error("recover failed:", err)
+		return exitFailure
+	}
+	if len(incomplete) == 0 {
+		fmt.Println("no incomplete pushes")
+		return 0
+	}
+	for _, e := range incomplete {
+		fmt.Printf("%s: push of %v to %s was staged but not published\n", e.Time.Format(time.RFC3339), e.Refs, e.Remote)
+		fmt.Printf("  new root ipfs:///ipfs/%s (was %s)", e.NewRoot, e.OldRoot)
+		if e.IPNS != "" {
+			fmt.Printf(", not yet published to /ipns/%s", e.IPNS)
+		}
+		fmt.Println()
+		fmt.Printf("  complete it with git remote set-url %s ipfs:///ipfs/%s, to roll back leave it (gc unpins it)\n", e.Remote, e.NewRoot)
+	}
+	return exitFailure
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPushLog(t *testing.T) {
+	_, cleanup := mkLocalRepo(t, "ipfs://ipfs/"+fixtureHash)
+	defer cleanup()
+	stderr = ioutil.Discard
+	defer func() { stderr = os.Stderr }()
+	_, restore := useFakeRepo(t, map[string]string{"HEAD": "ref: refs/heads/master\n"})
+	defer restore()
+	defer func() { pushLogPath = "" }()
+	pushLogPath = filepath.Join(mkRandTmpDir(t), "push.log")
+	defer rmDir(t, filepath.Dir(pushLogPath))
+
+	oldRoot := strings.TrimPrefix(ipfsRepoPath, "/ipfs/")
+	checkFatal(t, push(context.Background(), "refs/heads/master", "refs/heads/master"))
+	checkFatal(t, pushFinish(context.Background()))
+
+	data, err := ioutil.ReadFile(pushLogPath)
+	checkFatal(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("want a staged and a published line, got\n%s", data)
+	}
+	var staged, published pushLogEntry
+	checkFatal(t, json.Unmarshal([]byte(lines[0]), &staged))
+	checkFatal(t, json.Unmarshal([]byte(lines[1]), &published))
+	if staged.State != pushStaged || published.State != pushPublished {
+		t.Errorf("states %q %q", staged.State, published.State)
+	}
+	if staged.OldRoot != oldRoot || staged.NewRoot == "" || staged.NewRoot == oldRoot || staged.Remote != thisGitRemote {
+		t.Errorf("staged entry %+v, old root %s", staged, oldRoot)
+	}
+	if len(staged.Refs) != 1 || staged.Refs[0] != "refs/heads/master" || staged.Time.IsZero() {
+		t.Errorf("staged entry %+v", staged)
+	}
+	if published.NewRoot != staged.NewRoot || !strings.Contains(published.URL, staged.NewRoot) {
+		t.Errorf("published entry %+v", published)
+	}
+	if incomplete, err := incompletePushes(strings.NewReader(string(data))); err != nil || len(incomplete) != 0 {
+		t.Errorf("finished push reported incomplete: %v %v", incomplete, err)
+	}
+
+	// a push that stopped after staging its root
+	cut := lines[0] + "\n" + lines[1] + "\n" + strings.Replace(lines[0], staged.NewRoot, "QmInterrupted", 1) + "\n"
+	incomplete, err := incompletePushes(strings.NewReader(cut))
+	checkFatal(t, err)
+	if len(incomplete) != 1 || incomplete[0].NewRoot != "QmInterrupted" {
+		t.Errorf("want the interrupted push, got %+v", incomplete)
+	}
+	if _, err := incompletePushes(strings.NewReader("not json\n")); err == nil {
+		t.Error("expected an error for a broken log")
+	}
+}
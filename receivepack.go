@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// receivePackCaps are the capabilities of the receive-pack bridge. no-thin makes git send packs
+// that index on their own, without the objects of the remote it only references.
+const receivePackCaps = "report-status delete-refs ofs-delta no-thin"
+
+// refUpdate is one command git's send-pack sent to the receive-pack bridge
+type refUpdate struct {
+	old, new, ref string
+	err           error
+}
+
+// receivePack speaks git-receive-pack (the v0 protocol, see Documentation/technical/pack-protocol.txt) over the connection
+// git handed over with connect: it advertises the refs of the remote, reads the commands and the pack git streams after them,
+// and stores the pack as it is under objects/pack/ of the new root instead of walking and adding every object.
+func receivePack(ctx context.Context, r io.Reader, w io.Writer) error {
+	if err := listForReceivePack(ctx); err != nil {
+		return err
+	}
+	br := bufio.NewReader(r)
+	if err := advertiseRefs(w); err != nil {
+		return err
+	}
+	var cmds []*refUpdate
+	for {
+		line, err := readPktLine(br)
+		if err != nil {
+			return errgo.Notef(err, "receive-pack: reading the commands failed")
+		}
+		if line == "" {
+			break
+		}
+		if i := strings.IndexByte(line, 0); i >= 0 {
+			// the capabilities git picked, we only have report-status to honor and always do
+			line = line[:i]
+		}
+		f := strings.Fields(line)
+		if len(f) != 3 || !objectNameRe.MatchString(f[0]) || !objectNameRe.MatchString(f[1]) {
+			return errgo.Newf("receive-pack: malformed command %q", line)
+		}
+		cmds = append(cmds, &refUpdate{old: f[0], new: f[1], ref: f[2]})
+	}
+	if len(cmds) == 0 {
+		// everything was up to date, git doesn't wait for a report
+		return nil
+	}
+	zero := strings.Repeat("0", 2*objectHash().Size())
+	var updates bool
+	for _, c := range cmds {
+		log.WithField("ref", c.ref).WithField("old", c.old).WithField("new", c.new).Debug("receive-pack: got command")
+		updates = updates || c.new != zero
+	}
+	tmp, err := ioutil.TempDir("", "git-remote-ipfs-receive-pack")
+	if err != nil {
+		return errgo.Notef(err, "receive-pack: creating a temp dir failed")
+	}
+	defer os.RemoveAll(tmp)
+	var (
+		packName  string
+		unpackErr error
+	)
+	if updates {
+		// the pack follows whenever a command isn't a delete, even if it has no objects
+		if packName, err = receivePackfile(br, tmp); err != nil {
+			unpackErr = err
+			log.WithField("err", err).Error("receive-pack: storing the pack failed")
+		}
+	}
+	if unpackErr == nil {
+		if err := updateReceivedRefs(ctx, cmds, tmp, packName, zero); err != nil {
+			for _, c := range cmds {
+				if c.err == nil {
+					c.err = err
+				}
+			}
+			reportStatus(w, nil, cmds)
+			return err
+		}
+	}
+	return reportStatus(w, unpackErr, cmds)
+}
+
+// listForReceivePack reads the refs of the remote into ref2hash, like list for-push does
+func listForReceivePack(ctx context.Context) error {
+	err := listInfoRefs(ctx, true)
+	if err != nil {
+		log.WithField("err", err).Debug("didn't find info/refs in repo, falling back...")
+		err = listIterateRefs(ctx, true)
+	}
+	if errCtx := ctx.Err(); errCtx != nil {
+		return errCtx
+	}
+	if len(ref2hash) == 0 {
+		if _, errHead := readHeadRef(); errHead != nil {
+			if err == nil {
+				err = errHead
+			}
+			return withKind(err, ErrNotARepo, "did not find _any_ refs...")
+		}
+	} else if err != nil {
+		return err
+	}
+	objectFormat = detectObjectFormat()
+	return nil
+}
+
+// advertiseRefs sends the refs of the remote and the capabilities, an empty remote advertises just those
+func advertiseRefs(w io.Writer) error {
+	caps := receivePackCaps + " object-format=" + objectFormat
+	// all of them, GIT_IPFS_REF_FILTER is for fetches
+	var refs []string
+	for ref := range ref2hash {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	if len(refs) == 0 {
+		zero := strings.Repeat("0", 2*objectHash().Size())
+		return writePktLines(w, zero+" capabilities^{}\x00"+caps+"\n", "")
+	}
+	lines := make([]string, 0, len(refs)+1)
+	for i, ref := range refs {
+		line := ref2hash[ref] + " " + ref
+		if i == 0 {
+			line += "\x00" + caps
+		}
+		lines = append(lines, line+"\n")
+	}
+	return writePktLines(w, append(lines, "")...)
+}
+
+// receivePackfile copies the pack git streams into dir and indexes it there with git index-pack.
+// it returns the name both files have without .pack or .idx, "" for a pack without objects.
+func receivePackfile(br *bufio.Reader, dir string) (string, error) {
+	incoming := filepath.Join(dir, "incoming.pack")
+	f, err := os.Create(incoming)
+	if err != nil {
+		return "", errgo.Notef(err, "creating %s failed", incoming)
+	}
+	bw := bufio.NewWriter(f)
+	sum, n, err := copyPack(br, bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return "", errgo.Notef(err, "receiving the pack failed")
+	}
+	if n == 0 {
+		log.Debug("receive-pack: empty pack")
+		return "", nil
+	}
+	name := "pack-" + hex.EncodeToString(sum)
+	packFile := filepath.Join(dir, name+".pack")
+	if err := os.Rename(incoming, packFile); err != nil {
+		return "", errgo.Notef(err, "renaming the pack failed")
+	}
+	// checks every object, without --fix-thin a pack that isn't complete on its own fails here
+	index := exec.Command("git", "index-pack", "-o", filepath.Join(dir, name+".idx"), packFile)
+	index.Env = append(os.Environ(), "GIT_DIR="+thisGitRepo)
+	if out, err := index.CombinedOutput(); err != nil {
+		return "", errgo.Notef(err, "git index-pack failed: %q", string(out))
+	}
+	log.WithField("pack", name).WithField("objects", n).Debug("receive-pack: indexed pack")
+	return name, nil
+}
+
+// updateReceivedRefs links the pack into the root of the push and applies the commands to it.
+// a command that can't be applied gets its err, the others are published together by pushFinish.
+func updateReceivedRefs(ctx context.Context, cmds []*refUpdate, dir, packName, zero string) error {
+	var refused error
+	if !canWrite() {
+		refused = errReadOnly
+	} else if err := prePush(); err != nil {
+		refused = err
+	} else if err := lockPush(); err != nil {
+		refused = err
+	}
+	if refused != nil {
+		for _, c := range cmds {
+			c.err = refused
+		}
+		return nil
+	}
+	root, err := pushBase(ctx)
+	if err != nil {
+		return err
+	}
+	if packName != "" {
+		for _, ext := range []string{".pack", ".idx"} {
+			if root, err = linkFile(root, path.Join("objects", "pack", packName+ext), filepath.Join(dir, packName+ext)); err != nil {
+				return err
+			}
+		}
+		pushRoot = root
+	}
+	for _, c := range cmds {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if old, ok := ref2hash[c.ref]; (ok && old != c.old) || (!ok && c.old != zero) {
+			// git sent an old value the remote doesn't have
+			c.err = errgo.New("stale info")
+			continue
+		}
+		if !strings.HasPrefix(c.ref, "refs/") {
+			c.err = errgo.New("funny refname")
+			continue
+		}
+		if c.new == zero {
+			c.err = pushDelete(ctx, c.ref)
+			continue
+		}
+		mhash, err := addObject(bytes.NewBufferString(c.new + "\n"))
+		if err != nil {
+			return errgo.Notef(err, "shell.Add(%s) failed", c.new)
+		}
+		root, err := ipfsShell.PatchLink(pushRoot, c.ref, mhash, true)
+		if err != nil {
+			c.err = errgo.Notef(err, "patchLink(%s) failed", c.ref)
+			continue
+		}
+		log.WithField("newRoot", root).WithField("dst", c.ref).WithField("hash", c.new).Debug("updated ref")
+		pushRoot = root
+		pushRefs = append(pushRefs, c.ref)
+		ref2hash[c.ref] = c.new
+	}
+	if len(pushRefs) == 0 {
+		// nothing of the pack is reachable from a ref, there is nothing worth publishing
+		pushRoot, pushStartTop, pushOldRoot = "", "", ""
+		unlockPush()
+		return nil
+	}
+	return pushFinish(ctx)
+}
+
+// linkFile adds the local file src and links it into root at p
+func linkFile(root, p, src string) (string, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return "", errgo.Notef(err, "opening %s failed", src)
+	}
+	defer f.Close()
+	mhash, err := addObject(f)
+	if err != nil {
+		return "", errgo.Notef(err, "shell.Add(%s) failed", p)
+	}
+	root, err = ipfsShell.PatchLink(root, p, mhash, true)
+	if err != nil {
+		return "", errgo.Notef(err, "patchLink(%s) failed", p)
+	}
+	return root, nil
+}
+
+// reportStatus tells git what happened to the pack and every command, unpackErr fails them all
+func reportStatus(w io.Writer, unpackErr error, cmds []*refUpdate) error {
+	lines := []string{"unpack ok\n"}
+	if unpackErr != nil {
+		lines[0] = "unpack " + oneLine(unpackErr.Error()) + "\n"
+	}
+	for _, c := range cmds {
+		switch {
+		case unpackErr != nil:
+			lines = append(lines, "ng "+c.ref+" unpacker error\n")
+		case c.err != nil:
+			lines = append(lines, "ng "+c.ref+" "+oneLine(c.err.Error())+"\n")
+		default:
+			lines = append(lines, "ok "+c.ref+"\n")
+		}
+	}
+	return writePktLines(w, append(lines, "")...)
+}
+
+// oneLine keeps the first line of msg, a report-status line can't have more
+func oneLine(msg string) string {
+	if i := strings.IndexByte(msg, '\n'); i >= 0 {
+		return msg[:i]
+	}
+	return msg
+}
+
+// writePktLines writes lines in pkt-line framing, "" writes a flush-pkt
+func writePktLines(w io.Writer, lines ...string) error {
+	for _, line := range lines {
+		var err error
+		if line == "" {
+			_, err = io.WriteString(w, "0000")
+		} else {
+			_, err = fmt.Fprintf(w, "%04x%s", len(line)+4, line)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readPktLine reads one pkt-line without its newline, "" is the flush-pkt
+func readPktLine(br *bufio.Reader) (string, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(br, size[:]); err != nil {
+		return "", err
+	}
+	n, err := strconv.ParseUint(string(size[:]), 16, 16)
+	if err != nil {
+		return "", errgo.Newf("bad pkt-line length %q", size)
+	}
+	if n == 0 {
+		return "", nil
+	}
+	if n < 4 {
+		return "", errgo.Newf("bad pkt-line length %d", n)
+	}
+	data := make([]byte, n-4)
+	if _, err := io.ReadFull(br, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
+
+// copyPack copies one pack from br to w. the pack isn't framed, so it follows the entries:
+// the header tells how many there are and each one's zlib stream where it ends.
+// it returns the checksum the pack ends with and the number of entries.
+func copyPack(br *bufio.Reader, w io.Writer) ([]byte, uint32, error) {
+	h := objectHash()
+	tr := &teeByteReader{r: br, w: io.MultiWriter(w, h)}
+	var hdr [12]byte
+	if _, err := io.ReadFull(tr, hdr[:]); err != nil {
+		return nil, 0, errgo.Notef(err, "reading the pack header failed")
+	}
+	if string(hdr[:4]) != "PACK" {
+		return nil, 0, errgo.New("not a packfile")
+	}
+	if v := be32(hdr[4:]); v != 2 && v != 3 {
+		return nil, 0, errgo.Newf("unsupported pack version %d", v)
+	}
+	n := be32(hdr[8:])
+	for i := uint32(0); i < n; i++ {
+		if err := skipPackEntry(tr); err != nil {
+			return nil, 0, errgo.Notef(err, "pack entry %d of %d", i, n)
+		}
+	}
+	if err := tr.flush(); err != nil {
+		return nil, 0, err
+	}
+	sum := h.Sum(nil)
+	trailer := make([]byte, len(sum))
+	if _, err := io.ReadFull(br, trailer); err != nil {
+		return nil, 0, errgo.Notef(err, "reading the pack checksum failed")
+	}
+	if !bytes.Equal(sum, trailer) {
+		return nil, 0, errgo.New("pack checksum mismatch")
+	}
+	if _, err := w.Write(trailer); err != nil {
+		return nil, 0, err
+	}
+	return trailer, n, nil
+}
+
+// skipPackEntry reads past one entry of a pack, see parsePackEntry for the parts
+func skipPackEntry(tr *teeByteReader) error {
+	c, err := tr.ReadByte()
+	if err != nil {
+		return err
+	}
+	typ := int(c>>4) & 7
+	for c&0x80 != 0 {
+		if c, err = tr.ReadByte(); err != nil {
+			return err
+		}
+	}
+	switch typ {
+	case packCommit, packTree, packBlob, packTag:
+	case packOfsDelta:
+		for c = 0x80; c&0x80 != 0; {
+			if c, err = tr.ReadByte(); err != nil {
+				return err
+			}
+		}
+	case packRefDelta:
+		if _, err := io.ReadFull(tr, make([]byte, objectHash().Size())); err != nil {
+			return err
+		}
+	default:
+		return errgo.Newf("unknown pack object type %d", typ)
+	}
+	// with an io.ByteReader zlib doesn't read past the end of the stream
+	zr, err := zlib.NewReader(tr)
+	if err != nil {
+		return errgo.Notef(err, "zlib.NewReader failed")
+	}
+	if _, err := io.Copy(ioutil.Discard, zr); err != nil {
+		return errgo.Notef(err, "inflating failed")
+	}
+	return zr.Close()
+}
+
+// teeByteReader writes what is read from r to w, in chunks instead of byte by byte
+type teeByteReader struct {
+	r   *bufio.Reader
+	w   io.Writer
+	buf []byte
+}
+
+func (t *teeByteReader) ReadByte() (byte, error) {
+	c, err := t.r.ReadByte()
+	if err == nil {
+		t.buf = append(t.buf, c)
+		if len(t.buf) >= 32<<10 {
+			err = t.flush()
+		}
+	}
+	return c, err
+}
+
+func (t *teeByteReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.buf = append(t.buf, p[:n]...)
+	if len(t.buf) >= 32<<10 {
+		if errFlush := t.flush(); err == nil {
+			err = errFlush
+		}
+	}
+	return n, err
+}
+
+func (t *teeByteReader) flush() error {
+	_, err := t.w.Write(t.buf)
+	t.buf = t.buf[:0]
+	return err
+}
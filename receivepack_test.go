@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// sendPack plays git's send-pack against speakGit: it connects to git-receive-pack, sends cmds and pack
+// and returns the advertised refs and the report
+func sendPack(t *testing.T, cmds []string, pack []byte) (adv, report []string) {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		err := speakGit(context.Background(), inR, outW)
+		outW.Close()
+		errc <- err
+	}()
+	out := bufio.NewReader(outR)
+	io.WriteString(inW, "connect git-receive-pack\n")
+	if line, err := out.ReadString('\n'); err != nil || line != "\n" {
+		t.Fatalf("connect answered with %q (%v)", line, err)
+	}
+	readPkts := func() []string {
+		var lines []string
+		for {
+			line, err := readPktLine(out)
+			checkFatal(t, err)
+			if line == "" {
+				return lines
+			}
+			lines = append(lines, line)
+		}
+	}
+	adv = readPkts()
+	var req bytes.Buffer
+	for i, cmd := range cmds {
+		if i == 0 {
+			cmd += "\x00report-status"
+		}
+		checkFatal(t, writePktLines(&req, cmd))
+	}
+	checkFatal(t, writePktLines(&req, ""))
+	req.Write(pack)
+	go inW.Write(req.Bytes())
+	report = readPkts()
+	checkFatal(t, <-errc)
+	return adv, report
+}
+
+func TestReceivePack(t *testing.T) {
+	fs, restore := useFakeRepo(t, map[string]string{"HEAD": "ref: refs/heads/master\n"})
+	defer restore()
+	head, cleanup := mkLocalRepo(t, "ipfs://"+ipfsRepoPath)
+	defer cleanup()
+	packObjects := exec.Command("git", "pack-objects", "--stdout", "--revs", "-q")
+	packObjects.Dir = thisGitRepo
+	packObjects.Stdin = strings.NewReader(head + "\n")
+	pack, err := packObjects.Output()
+	checkFatal(t, err)
+	zero := strings.Repeat("0", 40)
+
+	adv, report := sendPack(t, []string{zero + " " + head + " refs/heads/master"}, pack)
+	if len(adv) != 1 || !strings.HasPrefix(adv[0], zero+" capabilities^{}\x00") || !strings.Contains(adv[0], "no-thin") {
+		t.Errorf("unexpected advertisement of an empty remote %q", adv)
+	}
+	if strings.Join(report, "|") != "unpack ok|ok refs/heads/master" {
+		t.Fatalf("unexpected report %q", report)
+	}
+	newURL := remoteURL(t)
+	ipfsRepoPath = strings.TrimPrefix(newURL, "ipfs://")
+	links, err := fs.List(ipfsRepoPath + "/objects")
+	checkFatal(t, err)
+	if len(links) != 1 || links[0].Name != "pack" {
+		t.Errorf("the objects should only be in the pack, got %v", links)
+	}
+	packs, err := fs.List(ipfsRepoPath + "/objects/pack")
+	checkFatal(t, err)
+	if len(packs) != 2 {
+		t.Errorf("want a pack and its idx, got %v", packs)
+	}
+
+	// git sent an old value the remote doesn't have
+	ref2hash = make(map[string]string)
+	adv, report = sendPack(t, []string{zero + " " + head + " refs/heads/master"}, pack)
+	if len(adv) != 1 || !strings.HasPrefix(adv[0], head+" refs/heads/master\x00") {
+		t.Errorf("unexpected advertisement %q", adv)
+	}
+	if strings.Join(report, "|") != "unpack ok|ng refs/heads/master stale info" || remoteURL(t) != newURL {
+		t.Errorf("a stale command should be refused, got %q", report)
+	}
+
+	// the packed repo clones
+	ref2hash = make(map[string]string)
+	defer useTmpGitDir(t)()
+	checkFatal(t, exec.Command("git", "init", "-q", "--bare", thisGitRepo).Run())
+	var out bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("list\nfetch "+head+" refs/heads/master\n\n"), &out))
+	if !strings.Contains(out.String(), head+" refs/heads/master\n") {
+		t.Errorf("pushed ref not listed:\n%s", out.String())
+	}
+	fsck := exec.Command("git", "--git-dir", thisGitRepo, "rev-list", "--objects", head)
+	if msg, err := fsck.CombinedOutput(); err != nil {
+		t.Errorf("fetched repo is incomplete: %s\n%s", err, msg)
+	}
+}
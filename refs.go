@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// printRefs prints the refs of the repo at ipfsRepoPath like git ls-remote does: HEAD first, then the refs in order,
+// every annotated tag followed by what it peels to as <tag>^{}.
+// it reads them into a fresh ref2hash, no local repo is needed.
+func printRefs(w io.Writer) error {
+	ref2hash = make(map[string]string)
+	peeled = make(map[string]string)
+	if err := listInfoRefs(context.Background(), false); err != nil {
+		log.WithField("err", err).Debug("didn't find info/refs in repo, falling back...")
+		if err := listIterateRefs(context.Background(), false); err != nil {
+			return withKind(err, ErrNotARepo, "listing refs failed")
+		}
+	}
+	if head, err := listHeadRef(); err == nil && head != "" {
+		fmt.Fprintf(w, "%s\tHEAD\n", head)
+	} else {
+		log.WithField("err", err).Debug("no HEAD to list")
+	}
+	names := make([]string, 0, len(ref2hash))
+	for ref := range ref2hash {
+		if refAllowed(ref) {
+			names = append(names, ref)
+		}
+	}
+	sort.Strings(names)
+	for _, ref := range names {
+		fmt.Fprintf(w, "%s\t%s\n", ref2hash[ref], ref)
+		if target, ok := peeled[ref]; ok {
+			fmt.Fprintf(w, "%s\t%s^{}\n", target, ref)
+		}
+	}
+	return nil
+}
+
+func refsMain(args []string) int {
+	flags := flag.NewFlagSet("refs", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: git-remote-ipfs refs <url>")
+		return exitUsage
+	}
+	if code := openRemote(flags.Arg(0)); code != 0 {
+		return code
+	}
+	if err := printRefs(os.Stdout); err != nil {
+		log.Error("listing refs failed:", err)
+		return exitCode(err)
+	}
+	return 0
+}
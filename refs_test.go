@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestPrintRefs(t *testing.T) {
+	files := make(map[string]string)
+	tag, commit := packedTagRepo(files)
+	dev, _ := fixtureCommit(files, "dev\n")
+	files["refs/heads/dev"] = dev + "\n"
+	_, restore := useFakeRepo(t, files)
+	defer restore()
+	oldRepo := thisGitRepo
+	defer func() { thisGitRepo = oldRepo }()
+	// no local repo
+	thisGitRepo = ""
+
+	var out bytes.Buffer
+	checkFatal(t, printRefs(&out))
+	want := commit + "\tHEAD\n" +
+		dev + "\trefs/heads/dev\n" +
+		commit + "\trefs/heads/master\n" +
+		tag + "\trefs/tags/v1\n" +
+		commit + "\trefs/tags/v1^{}\n"
+	if out.String() != want {
+		t.Errorf("want\n%s\ngot\n%s", want, out.String())
+	}
+
+	_, restoreEmpty := useFakeRepo(t, map[string]string{"README": "not a repo"})
+	defer restoreEmpty()
+	if err := printRefs(&out); !errors.Is(err, ErrNotARepo) {
+		t.Errorf("want ErrNotARepo, got %v", err)
+	}
+}
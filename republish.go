@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// ipnsLifetime is how long the records republish writes stay valid (GIT_IPFS_IPNS_LIFETIME), 0 for the daemon's default
+var ipnsLifetime time.Duration
+
+// republish publishes what the ipns name of key (a key name of the daemon like self, or its id) points to again,
+// so the record gets a new lifetime before it expires. the target doesn't change.
+// it returns the ipns name and the target. the shell has no options for these calls, they go to the api at addr directly.
+func republish(addr, key string, lifetime time.Duration) (string, string, error) {
+	c := newHTTPClient(1)
+	var keys struct{ Keys []struct{ Name, Id string } }
+	if err := apiCall(c, addr, "key/list", nil, nil, &keys); err != nil {
+		return "", "", err
+	}
+	name := ""
+	for _, k := range keys.Keys {
+		if k.Name == key || k.Id == key {
+			name = k.Id
+		}
+	}
+	if name == "" {
+		return "", "", errgo.Newf("the daemon has no key %q", key)
+	}
+	var current struct{ Path string }
+	// the daemon's own record, not one cached from the network
+	q := url.Values{"arg": {"/ipns/" + name}, "nocache": {"true"}}
+	if err := apiCall(c, addr, "name/resolve", q, nil, &current); err != nil {
+		return "", "", errgo.Notef(err, "resolving /ipns/%s failed", name)
+	}
+	q = url.Values{"arg": {current.Path}, "key": {key}, "resolve": {"false"}}
+	if lifetime > 0 {
+		q.Set("lifetime", lifetime.String())
+	}
+	// publishing talks to the dht and fails now and then
+	err := withRetry(context.Background(), "ipns republish", func() error {
+		var published struct{ Name, Value string }
+		return apiCall(c, addr, "name/publish", q, nil, &published)
+	})
+	if err != nil {
+		return "", "", errgo.Notef(err, "republishing %s to /ipns/%s failed", current.Path, name)
+	}
+	return name, current.Path, nil
+}
+
+// republishMain is git-remote-ipfs republish <key>
+func republishMain(args []string) int {
+	flags := flag.NewFlagSet("republish", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: git-remote-ipfs republish <key>")
+		return exitUsage
+	}
+	if l := os.Getenv("GIT_IPFS_IPNS_LIFETIME"); l != "" {
+		var err error
+		if ipnsLifetime, err = time.ParseDuration(l); err != nil || ipnsLifetime <= 0 {
+			fmt.Fprintf(os.Stderr, "GIT_IPFS_IPNS_LIFETIME: want a duration like 48h, got %q\n", l)
+			return exitUsage
+		}
+	}
+	name, target, err := republish(apiAddress(), flags.Arg(0), ipnsLifetime)
+	if err != nil {
+		log.Error("republish failed:", err)
+		return exitCode(err)
+	}
+	fmt.Printf("republished /ipns/%s -> %s\n", name, target)
+	return 0
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRepublish(t *testing.T) {
+	const target = "/ipfs/" + fixtureHash
+	var published []url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		switch r.URL.Path {
+		case "/api/v0/key/list":
+			fmt.Fprintf(w, `{"Keys":[{"Name":"self","Id":"%s"},{"Name":"repos","Id":"QmRepoKey"}]}`, fakePeerID)
+		case "/api/v0/name/resolve":
+			if q.Get("arg") != "/ipns/QmRepoKey" {
+				http.Error(w, "could not resolve name", http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintf(w, `{"Path":"%s"}`, target)
+		case "/api/v0/name/publish":
+			published = append(published, q)
+			fmt.Fprintf(w, `{"Name":"QmRepoKey","Value":"%s"}`, q.Get("arg"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	name, got, err := republish(srv.URL, "repos", 48*time.Hour)
+	checkFatal(t, err)
+	if name != "QmRepoKey" || got != target {
+		t.Errorf("republished %s -> %s", name, got)
+	}
+	if len(published) != 1 {
+		t.Fatalf("want one publish call, got %d", len(published))
+	}
+	for k, want := range map[string]string{"arg": target, "key": "repos", "lifetime": "48h0m0s", "resolve": "false"} {
+		if v := published[0].Get(k); v != want {
+			t.Errorf("publish %s: want %q got %q", k, want, v)
+		}
+	}
+
+	// by id, with the daemon's lifetime
+	if _, _, err := republish(srv.URL, "QmRepoKey", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := published[1]["lifetime"]; ok || published[1].Get("key") != "QmRepoKey" {
+		t.Errorf("want no lifetime, got %v", published[1])
+	}
+
+	if _, _, err := republish(srv.URL, "nope", 0); err == nil {
+		t.Error("expected an error for an unknown key")
+	}
+	// self never published anything
+	if _, _, err := republish(srv.URL, "self", 0); err == nil || len(published) != 2 {
+		t.Errorf("unresolvable name: want an error and no publish, got %v after %d publishes", err, len(published))
+	}
+}
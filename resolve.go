@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cryptix/git-remote-ipfs/internal/errkind"
+)
+
+// resolved is where the object a ref points to is kept in ipfs
+type resolved struct {
+	Ref    string `json:"ref"`
+	Object string `json:"object"` // the git object name
+	Path   string `json:"path"`   // below the repo root, like /ipfs/$root/objects/ab/cdef..
+	CID    string `json:"cid"`
+}
+
+// resolveRef returns the object ref names on the remote.
+// ref is a full ref name, a branch or tag name or an object name.
+func resolveRef(ref string) (string, error) {
+	if objectNameRe.MatchString(ref) {
+		return ref, nil
+	}
+	if err := listInfoRefs(context.Background(), false); err != nil {
+		log.WithField("err", err).Debug("didn't find info/refs in repo, falling back...")
+		if err := listIterateRefs(context.Background(), false); err != nil {
+			return "", withKind(err, ErrNotARepo, "listing refs failed")
+		}
+	}
+	for _, name := range []string{ref, "refs/heads/" + ref, "refs/tags/" + ref} {
+		if h, ok := ref2hash[name]; ok {
+			return h, nil
+		}
+	}
+	if ref == "HEAD" {
+		if h, err := listHeadRef(); err == nil && h != "" {
+			return h, nil
+		}
+	}
+	return "", errkind.Wrapf(nil, ErrObjectMissing, "no ref %s in %s", ref, ipfsRepoPath)
+}
+
+// resolve looks up the ipfs location of the object ref of the repo at ipfsRepoPath points to.
+// both stores link the objects at their loose object path, packed objects have none.
+func resolve(ref string) (resolved, error) {
+	sha1, err := resolveRef(ref)
+	if err != nil {
+		return resolved{}, err
+	}
+	p := inRepo(remoteObjectPath(sha1))
+	cid, err := ipfsShell.ResolvePath(p)
+	if err != nil {
+		return resolved{}, errkind.Wrapf(err, ErrObjectMissing, "%s is no loose object in %s, it might be packed", sha1, ipfsRepoPath)
+	}
+	return resolved{Ref: ref, Object: sha1, Path: p, CID: cid}, nil
+}
+
+// printResolved writes the /ipfs/ path of the object's cid, or everything about it as json
+func printResolved(w io.Writer, r resolved, asJSON bool) error {
+	if asJSON {
+		return json.NewEncoder(w).Encode(r)
+	}
+	_, err := fmt.Fprintf(w, "/ipfs/%s\n", r.CID)
+	return err
+}
+
+// resolveMain is git-remote-ipfs resolve [-json] <url> <ref>
+func resolveMain(args []string) int {
+	flags := flag.NewFlagSet("resolve", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print ref, object name, path and cid as json")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "usage: git-remote-ipfs resolve [-json] <url> <ref>")
+		return exitUsage
+	}
+	if code := openRemote(flags.Arg(0)); code != 0 {
+		return code
+	}
+	r, err := resolve(flags.Arg(1))
+	if err != nil {
+		log.Error("resolve failed:", err)
+		return exitCode(err)
+	}
+	if err := printResolved(os.Stdout, r, *asJSON); err != nil {
+		return exitFailure
+	}
+	return 0
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	files := map[string]string{"HEAD": "ref: refs/heads/master\n"}
+	master, _ := fixtureCommit(files, "resolve me\n")
+	files["refs/heads/master"] = master + "\n"
+	fs, restore := useFakeRepo(t, files)
+	defer restore()
+	want, err := fs.ResolvePath(ipfsRepoPath + "/" + objectPath(master))
+	checkFatal(t, err)
+
+	for _, ref := range []string{"master", "refs/heads/master", "HEAD", master} {
+		r, err := resolve(ref)
+		if err != nil {
+			t.Errorf("%s: %s", ref, err)
+			continue
+		}
+		if r.Object != master || r.CID != want || r.Path != ipfsRepoPath+"/"+objectPath(master) {
+			t.Errorf("%s: got %+v, want object %s with cid %s", ref, r, master, want)
+		}
+	}
+
+	r, err := resolve("master")
+	checkFatal(t, err)
+	var out bytes.Buffer
+	checkFatal(t, printResolved(&out, r, false))
+	if out.String() != "/ipfs/"+want+"\n" {
+		t.Errorf("plain output %q", out.String())
+	}
+	out.Reset()
+	checkFatal(t, printResolved(&out, r, true))
+	var got resolved
+	checkFatal(t, json.Unmarshal(out.Bytes(), &got))
+	if got != r {
+		t.Errorf("json output %s, want %+v", out.String(), r)
+	}
+
+	if _, err := resolve("nope"); !errors.Is(err, ErrObjectMissing) {
+		t.Errorf("unknown ref: want ErrObjectMissing, got %v", err)
+	}
+	if _, err := resolve("0123456789012345678901234567890123456789"); !errors.Is(err, ErrObjectMissing) {
+		t.Errorf("object that isn't there: want ErrObjectMissing, got %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"path"
+	"sort"
+
+	"github.com/cryptix/git-remote-ipfs/fetch"
+	"gopkg.in/errgo.v1"
+)
+
+// salvageRefs (GIT_IPFS_SALVAGE=1) makes list of a remote without any refs look through its loose objects
+// for commits no other commit has as parent and offer them as refs/heads/salvaged/<sha1>,
+// so at least those can be cloned out of a broken repo
+var salvageRefs bool
+
+// salvagedRef is the ref list offers the salvaged tip as
+func salvagedRef(tip string) string {
+	return "refs/heads/salvaged/" + tip[:12]
+}
+
+// salvageTips reads every loose object of the remote and returns the commits that aren't a parent of another one,
+// the one committed last first. packs aren't looked at.
+func salvageTips(ctx context.Context) ([]string, error) {
+	shas, err := listLooseObjects(ctx, inRepo("objects"), "", objectSharding)
+	if err != nil {
+		return nil, err
+	}
+	store := remoteStore{objStore}
+	commits := make(map[string]*fetch.Commit)
+	hasChild := make(map[string]bool)
+	for _, sha1 := range shas {
+		c, err := fetch.ReadCommit(ctx, store, sha1)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			// it's a broken repo after all
+			log.WithField("sha1", sha1).WithField("err", err).Debug("salvage: unreadable object")
+			continue
+		}
+		if c == nil {
+			continue
+		}
+		commits[sha1] = c
+		for _, p := range c.Parents {
+			hasChild[p] = true
+		}
+	}
+	var tips []string
+	for sha1 := range commits {
+		if !hasChild[sha1] {
+			tips = append(tips, sha1)
+		}
+	}
+	sort.Slice(tips, func(i, j int) bool {
+		if ti, tj := commits[tips[i]].Time, commits[tips[j]].Time; ti != tj {
+			return ti > tj
+		}
+		return tips[i] < tips[j]
+	})
+	log.WithField("objects", len(shas)).WithField("commits", len(commits)).WithField("tips", len(tips)).Debug("salvage: scanned")
+	return tips, nil
+}
+
+// listLooseObjects returns the names of the loose objects below dir, levels directories of two hex digits deep.
+// prefix is what the directories above dir add to the names.
+func listLooseObjects(ctx context.Context, dir, prefix string, levels int) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	list, err := ipfsShell.List(dir)
+	if err != nil {
+		return nil, errgo.Notef(err, "listing %s failed", dir)
+	}
+	var shas []string
+	for _, lnk := range list {
+		name := prefix + lnk.Name
+		// skipping info/, pack/ and whatever else isn't an object
+		switch {
+		case levels > 0 && isDir(lnk) && len(lnk.Name) == 2:
+			sub, err := listLooseObjects(ctx, path.Join(dir, lnk.Name), name, levels-1)
+			if err != nil {
+				return nil, err
+			}
+			shas = append(shas, sub...)
+		case levels == 0 && isFile(lnk) && objectNameRe.MatchString(name):
+			shas = append(shas, name)
+		}
+	}
+	return shas, nil
+}
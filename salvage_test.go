@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSalvage(t *testing.T) {
+	// refs/ is gone, the objects are all there
+	files := map[string]string{"HEAD": "ref: refs/heads/master\n", "description": "broken\n"}
+	first, objs := fixtureCommit(files, "first\n")
+	other, _ := fixtureCommit(files, "other\n")
+	tree := objs[1]
+	child, z := looseObject("commit", "tree "+tree+"\nparent "+first+"\nauthor a <a@b> 10 +0000\ncommitter a <a@b> 10 +0000\n\nchild\n")
+	files[objectPath(child)] = z
+	_, restore := useFakeRepo(t, files)
+	defer restore()
+	defer useTmpGitDir(t)()
+	var out bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("list\n"), &out))
+	if out.String() != "@refs/heads/master HEAD\n\n" {
+		t.Fatalf("without GIT_IPFS_SALVAGE the repo should look empty:\n%s", out.String())
+	}
+
+	salvageRefs = true
+	defer func() { salvageRefs = false }()
+	out.Reset()
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("list\n"), &out))
+	listed := out.String()
+	for _, line := range []string{child + " " + salvagedRef(child) + "\n", other + " " + salvagedRef(other) + "\n", child + " HEAD\n"} {
+		if !strings.Contains(listed, line) {
+			t.Errorf("missing %q:\n%s", line, listed)
+		}
+	}
+	if strings.Contains(listed, salvagedRef(first)) {
+		t.Errorf("%s has a child, it's no tip:\n%s", first, listed)
+	}
+	out.Reset()
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("fetch "+child+" "+salvagedRef(child)+"\n\n"), &out))
+	for _, obj := range []string{child, first, tree} {
+		if _, err := os.Stat(filepath.Join(thisGitRepo, objectPath(obj))); err != nil {
+			t.Errorf("object %s was not fetched: %s", obj, err)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base32"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-ipfs-shell"
+	"gopkg.in/errgo.v1"
+)
+
+// ipfsAPI is the part of *shell.Shell the helper uses.
+// keeping it an interface lets the tests run against an in-memory fake instead of a daemon.
+type ipfsAPI interface {
+	Cat(path string) (io.ReadCloser, error)
+	List(path string) ([]*shell.LsEntry, error)
+	Get(hash, outdir string) error
+	Add(r io.Reader) (string, error)
+	ResolvePath(path string) (string, error)
+	PatchLink(root, path, childhash string, create bool) (string, error)
+	Patch(root, action string, args ...string) (string, error)
+	NewObject(template string) (string, error)
+	Publish(node, value string) error
+	BlockPut(block []byte) (string, error)
+	BlockGet(path string) ([]byte, error)
+	Pin(path string) error
+	Unpin(path string) error
+	SwarmConnect(ctx context.Context, addr ...string) error
+	Version() (string, string, error)
+	ID(peer ...string) (*shell.IdOutput, error)
+	Resolve(id string) (string, error)
+}
+
+// writeChecker is implemented by backends that might not be able to write, like a gateway without an api
+type writeChecker interface {
+	canWrite() bool
+}
+
+var errReadOnly = errgo.New("remote is read-only (no writable IPFS API configured)")
+
+// canWrite tells if ipfsShell takes pushes, backends that don't implement writeChecker always do
+func canWrite() bool {
+	if c, ok := ipfsShell.(writeChecker); ok {
+		return c.canWrite()
+	}
+	return true
+}
+
+// defaultMaxIdleConns is how many keep-alive connections to the daemon are kept around, see GIT_IPFS_MAX_IDLE_CONNS.
+// push adds objects concurrently, so this should be at least as big as the number of requests in flight.
+const defaultMaxIdleConns = 16
+
+// newShell connects to the daemon at addr, reusing up to maxIdle connections between requests
+func newShell(addr string, maxIdle int) *apiShell {
+	client := newHTTPClient(maxIdle)
+	return &apiShell{Shell: shell.NewShellWithClient(addr, client), addr: addr, client: client}
+}
+
+// apiShell is the shell with the dag calls of dagAPI and the mfs calls of mfsAPI, which the shell package doesn't have.
+// they go out through the shell's client with apiRequest, like the requests of apiAdder.
+type apiShell struct {
+	*shell.Shell
+	addr   string
+	client *http.Client
+}
+
+// maxBlockSize is the largest block the daemon takes without allow-big-block
+const maxBlockSize = 1 << 20
+
+// BlockPutGitRaw puts data as a git-raw block, hashed with sha1 like git does
+func (s *apiShell) BlockPutGitRaw(data []byte) (string, error) {
+	q := url.Values{"format": {"git-raw"}, "mhtype": {"sha1"}}
+	if len(data) > maxBlockSize {
+		// other daemons may not want to send it around
+		q.Set("allow-big-block", "true")
+	}
+	var put struct{ Key string }
+	if err := apiCall(s.client, s.addr, "block/put", q, bytes.NewReader(data), &put); err != nil {
+		return "", err
+	}
+	return put.Key, nil
+}
+
+// DagExport returns the car file of cid and everything below it, the daemon fetches the blocks it doesn't have
+func (s *apiShell) DagExport(ctx context.Context, cid string) (io.ReadCloser, error) {
+	return apiRequest(ctx, s.client, s.addr, "dag/export", url.Values{"arg": {cid}}, nil)
+}
+
+func (s *apiShell) FilesMkdir(path string) error {
+	return s.files("files/mkdir", url.Values{"arg": {path}, "parents": {"true"}})
+}
+
+func (s *apiShell) FilesCp(src, dst string) error {
+	return s.files("files/cp", url.Values{"arg": {src, dst}})
+}
+
+func (s *apiShell) FilesFlush(path string) error {
+	return s.files("files/flush", url.Values{"arg": {path}})
+}
+
+// FilesStat returns the cid of path
+func (s *apiShell) FilesStat(path string) (string, error) {
+	var stat struct{ Hash string }
+	if err := apiCall(s.client, s.addr, "files/stat", url.Values{"arg": {path}, "hash": {"true"}}, nil, &stat); err != nil {
+		return "", err
+	}
+	return stat.Hash, nil
+}
+
+func (s *apiShell) FilesRm(path string) error {
+	return s.files("files/rm", url.Values{"arg": {path}, "recursive": {"true"}})
+}
+
+// files runs one of the mfs commands that answer with nothing to read
+func (s *apiShell) files(cmd string, q url.Values) error {
+	body, err := apiRequest(context.Background(), s.client, s.addr, cmd, q, nil)
+	if err != nil {
+		return err
+	}
+	return body.Close()
+}
+
+// apiRequest posts the api command cmd (like add or dag/export) with the options q to the daemon at addr
+// and returns the body of its answer. file, if not nil, is sent as the one file of a multipart body.
+func apiRequest(ctx context.Context, c *http.Client, addr, cmd string, q url.Values, file io.Reader) (io.ReadCloser, error) {
+	var body bytes.Buffer
+	var contentType string
+	if file != nil {
+		mw := multipart.NewWriter(&body)
+		fw, err := mw.CreateFormFile("file", "object")
+		if err != nil {
+			return nil, errgo.Notef(err, "creating %s request failed", cmd)
+		}
+		if _, err := io.Copy(fw, file); err != nil {
+			return nil, errgo.Notef(err, "reading object failed")
+		}
+		if err := mw.Close(); err != nil {
+			return nil, errgo.Notef(err, "creating %s request failed", cmd)
+		}
+		contentType = mw.FormDataContentType()
+	}
+	req, err := http.NewRequest("POST", httpBase(addr)+"/api/v0/"+cmd+"?"+q.Encode(), &body)
+	if err != nil {
+		return nil, errgo.Notef(err, "creating %s request failed", cmd)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errgo.Notef(err, "%s request failed", cmd)
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, errgo.Newf("%s failed: %s %s", cmd, resp.Status, msg)
+	}
+	return resp.Body, nil
+}
+
+// apiCall is apiRequest for the commands that answer with json, decoded into out
+func apiCall(c *http.Client, addr, cmd string, q url.Values, file io.Reader, out interface{}) error {
+	body, err := apiRequest(context.Background(), c, addr, cmd, q, file)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if err := json.NewDecoder(body).Decode(out); err != nil {
+		return errgo.Notef(err, "decoding %s response failed", cmd)
+	}
+	return nil
+}
+
+func newHTTPClient(maxIdle int) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:        maxIdle,
+			MaxIdleConnsPerHost: maxIdle,
+			IdleConnTimeout:     90 * time.Second,
+			DisableKeepAlives:   maxIdle <= 0,
+		},
+	}
+}
+
+// connectProvider connects the daemon to the peer at GIT_IPFS_PROVIDER, known to have the repo,
+// so its blocks don't have to be found through the dht first. failing is not fatal.
+func connectProvider() {
+	addr := os.Getenv("GIT_IPFS_PROVIDER")
+	if addr == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := ipfsShell.SwarmConnect(ctx, addr); err != nil {
+		log.WithField("provider", addr).WithField("err", err).Warning("connecting to provider failed")
+		return
+	}
+	log.WithField("provider", addr).Debug("connected to provider")
+}
+
+// httpBase turns an api address like localhost:5001 into a url to put the request path behind
+func httpBase(addr string) string {
+	if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+		addr = "http://" + addr
+	}
+	return strings.TrimSuffix(addr, "/")
+}
+
+// addObject adds the objects of a push, apiAdder.add replaces it if GIT_IPFS_CHUNKER or GIT_IPFS_ADD_OPTS is set
+var addObject = func(r io.Reader) (string, error) { return ipfsShell.Add(r) }
+
+// apiAdder adds files with the chunker (like size-262144 or rabin) and other add options of its choice.
+// the shell's Add has no options, so this talks to /api/v0/add itself.
+type apiAdder struct {
+	addr    string
+	chunker string     // "" for the daemon's default
+	opts    url.Values // from GIT_IPFS_ADD_OPTS
+	client  *http.Client
+}
+
+// knownAddOpts are the options of ipfs add that make sense for single objects
+var knownAddOpts = map[string]bool{
+	"nocopy":       true,
+	"fscache":      true,
+	"inline":       true,
+	"inline-limit": true,
+	"cid-version":  true,
+	"hash":         true,
+	"raw-leaves":   true,
+	"trickle":      true,
+	"pin":          true,
+}
+
+// parseAddOpts reads the space separated key=value options of GIT_IPFS_ADD_OPTS, a bare key means key=true.
+// options it doesn't know are still passed on (for newer daemons) and returned in unknown, so they can be warned about.
+func parseAddOpts(s string) (opts url.Values, unknown []string, err error) {
+	opts = make(url.Values)
+	for _, opt := range strings.Fields(s) {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) == 1 {
+			kv = append(kv, "true")
+		}
+		switch {
+		case kv[0] == "":
+			return nil, nil, errgo.Newf("option without a name: %q", opt)
+		case kv[0] == "chunker" || kv[0] == "progress":
+			// set by the helper itself
+			return nil, nil, errgo.Newf("%s can't be set here", kv[0])
+		case !knownAddOpts[kv[0]]:
+			unknown = append(unknown, kv[0])
+		}
+		opts.Add(kv[0], kv[1])
+	}
+	return opts, unknown, nil
+}
+
+// objectAdder is the adder main sets up for the daemon's api, matchCIDVersion derives the one push adds with from it
+var objectAdder *apiAdder
+
+// pushAdder is the adder addObject is set to, nil while it is the shell's Add
+var pushAdder *apiAdder
+
+// cidVersionOf tells the cid version of the ipfs hash h, the version 0 ones are base58 sha256 multihashes starting with Qm
+func cidVersionOf(h string) int {
+	if strings.HasPrefix(h, "Qm") {
+		return 0
+	}
+	return 1
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// codecDagPB is the multicodec code of the unixfs nodes a version 0 cid names, cidV1 is with the git-raw codes
+const codecDagPB = 0x70
+
+// cidV1Of returns the base32 version 1 cid of the version 0 cid h (Qm..), the same root under the name newer daemons use.
+// a v0 cid is a dag-pb node's base58 sha256 multihash, so that's just a prefix and another encoding, nothing is added again.
+func cidV1Of(h string) (string, error) {
+	if cidVersionOf(h) != 0 {
+		return "", errgo.Newf("%s is not a version 0 cid", h)
+	}
+	mh, err := decodeBase58(h)
+	if err != nil {
+		return "", err
+	}
+	// sha2-256, 32 bytes
+	if len(mh) != 34 || mh[0] != 0x12 || mh[1] != 0x20 {
+		return "", errgo.Newf("%s is not a sha256 multihash", h)
+	}
+	b := append([]byte{cidV1, codecDagPB}, mh...)
+	return "b" + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)), nil
+}
+
+// decodeBase58 decodes s, like a base58 multihash. its leading 1s are zero bytes, the identity hash of a 12D3.. key starts with one.
+func decodeBase58(s string) ([]byte, error) {
+	n := new(big.Int)
+	for _, c := range s {
+		i := strings.IndexRune(base58Alphabet, c)
+		if i < 0 {
+			return nil, errgo.Newf("%s: %q isn't base58", s, c)
+		}
+		n.Mul(n, big.NewInt(58)).Add(n, big.NewInt(int64(i)))
+	}
+	zeros := len(s) - len(strings.TrimLeft(s, "1"))
+	return append(make([]byte, zeros), n.Bytes()...), nil
+}
+
+// matchCIDVersion makes addObject add with the cid version of root, the repo root a push builds on,
+// so the new objects come out like the ones already there and share their blocks.
+// a version set by GIT_IPFS_CID_VERSION or GIT_IPFS_ADD_OPTS is left alone.
+func matchCIDVersion(root string) {
+	if objectAdder == nil || objectAdder.opts.Get("cid-version") != "" {
+		return
+	}
+	a := *objectAdder
+	a.opts = make(url.Values, len(objectAdder.opts)+1)
+	for k, v := range objectAdder.opts {
+		a.opts[k] = v
+	}
+	v := cidVersionOf(root)
+	a.opts.Set("cid-version", strconv.Itoa(v))
+	addObject, pushAdder = a.add, &a
+	log.WithField("root", root).WithField("version", v).Debug("adding with the cid version of the root")
+}
+
+// parseChunker checks that c looks like one of the daemon's chunkers, the details are up to the daemon
+func parseChunker(c string) (string, error) {
+	for _, prefix := range []string{"size-", "rabin", "buzhash"} {
+		if strings.HasPrefix(c, prefix) {
+			return c, nil
+		}
+	}
+	return "", errgo.Newf("unknown chunker %q (want size-<bytes>, rabin[-<min>-<avg>-<max>] or buzhash)", c)
+}
+
+func (a apiAdder) add(r io.Reader) (string, error) {
+	q := url.Values{"progress": {"false"}}
+	for k, v := range a.opts {
+		q[k] = v
+	}
+	if a.chunker != "" {
+		q.Set("chunker", a.chunker)
+	}
+	var added struct{ Hash string }
+	if err := apiCall(a.client, a.addr, "add", q, r, &added); err != nil {
+		return "", err
+	}
+	return added.Hash, nil
+}
@@ -0,0 +1,811 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-ipfs-shell"
+)
+
+// fakeShell is an in-memory stand-in for the ipfs daemon.
+// objects are content addressed like the real thing, so equal content gives equal hashes.
+type fakeShell struct {
+	mu     sync.Mutex
+	nodes  map[string]*fakeNode
+	blocks map[string][]byte
+	calls  map[string]int    // method name -> number of calls
+	names  map[string]string // ipns name -> /ipfs/ path
+	pins   map[string]bool
+	peers  []string // swarm connected addresses
+
+	failPublish  error             // returned by Publish if set
+	flakyPublish int               // number of Publish calls to fail before failPublish applies
+	stalePublish bool              // Publish succeeds but doesn't change the name
+	failPin      error             // returned by Pin if set
+	down         bool              // every daemon info call fails like an unreachable daemon
+	sharded      bool              // List reports directories as hamt shards, like the daemon does for big ones
+	noDagExport  bool              // DagExport fails like a daemon without it
+	mfs          map[string]string // files path -> hash, FilesCp adds them
+	failFlush    error             // returned by FilesFlush if set
+	version      string            // returned by Version if set, 0.4.23 otherwise
+}
+
+type fakeNode struct {
+	data  []byte
+	links map[string]string // name -> hash, nil for files
+}
+
+func newFakeShell() *fakeShell {
+	return &fakeShell{
+		nodes:  make(map[string]*fakeNode),
+		blocks: make(map[string][]byte),
+		calls:  make(map[string]int),
+		names:  make(map[string]string),
+		pins:   make(map[string]bool),
+		mfs:    make(map[string]string),
+	}
+}
+
+// useFakeShell swaps ipfsShell for a fresh fake and returns a func to restore it
+func useFakeShell() (*fakeShell, func()) {
+	old, oldBackoff := ipfsShell, retryBackoff
+	fs := newFakeShell()
+	// the fake fails on purpose, no need to wait for it
+	ipfsShell, retryBackoff = fs, time.Millisecond
+	return fs, func() { ipfsShell, retryBackoff = old, oldBackoff }
+}
+
+func (fs *fakeShell) count(method string) {
+	fs.calls[method]++
+}
+
+// callCount is how often method was called, for tests reading it while the fake serves others
+func (fs *fakeShell) callCount(method string) int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.calls[method]
+}
+
+func (fs *fakeShell) put(n *fakeNode) string {
+	h := sha256.New()
+	if n.links == nil {
+		h.Write([]byte("file\x00"))
+		h.Write(n.data)
+	} else {
+		h.Write([]byte("dir\x00"))
+		for _, name := range sortedNames(n.links) {
+			fmt.Fprintf(h, "%s %s\n", name, n.links[name])
+		}
+	}
+	hash := fmt.Sprintf("Qm%x", h.Sum(nil))
+	fs.nodes[hash] = n
+	return hash
+}
+
+func sortedNames(links map[string]string) []string {
+	names := make([]string, 0, len(links))
+	for name := range links {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mkdir adds a directory with the given links, for building fixtures
+func (fs *fakeShell) mkdir(links map[string]string) string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.put(&fakeNode{links: links})
+}
+
+// addFile adds a file, for building fixtures
+func (fs *fakeShell) addFile(data string) string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.put(&fakeNode{data: []byte(data)})
+}
+
+// addTree adds nested files from a map of slash separated paths to contents and returns the root hash
+func (fs *fakeShell) addTree(files map[string]string) string {
+	root := fs.mkdir(map[string]string{})
+	for p, data := range files {
+		var err error
+		root, err = fs.PatchLink(root, p, fs.addFile(data), true)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return root
+}
+
+func (fs *fakeShell) splitPath(p string) []string {
+	if strings.HasPrefix(p, "/ipns/") {
+		fs.count("resolveName")
+		parts := strings.SplitN(p[len("/ipns/"):], "/", 2)
+		p = fs.names[parts[0]]
+		if len(parts) == 2 {
+			p += "/" + parts[1]
+		}
+	}
+	return splitPath(p)
+}
+
+func splitPath(p string) []string {
+	p = strings.TrimPrefix(p, "/ipfs/")
+	var parts []string
+	for _, s := range strings.Split(p, "/") {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	return parts
+}
+
+func (fs *fakeShell) resolve(p string) (string, *fakeNode, error) {
+	parts := fs.splitPath(p)
+	if len(parts) == 0 {
+		return "", nil, fmt.Errorf("fakeShell: empty path %q", p)
+	}
+	hash := parts[0]
+	n, ok := fs.nodes[hash]
+	if !ok {
+		return "", nil, fmt.Errorf("fakeShell: unknown root %q", hash)
+	}
+	for _, name := range parts[1:] {
+		if n.links == nil {
+			return "", nil, fmt.Errorf("fakeShell: %q is not a directory", p)
+		}
+		hash, ok = n.links[name]
+		if !ok {
+			return "", nil, fmt.Errorf("fakeShell: no link named %q in %q", name, p)
+		}
+		n = fs.nodes[hash]
+	}
+	return hash, n, nil
+}
+
+func (fs *fakeShell) Cat(p string) (io.ReadCloser, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.count("Cat")
+	_, n, err := fs.resolve(p)
+	if err != nil {
+		if data, ok := fs.blocks[strings.TrimPrefix(p, "/ipfs/")]; ok {
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		}
+		return nil, err
+	}
+	if n.links != nil {
+		return nil, fmt.Errorf("fakeShell: %q is a directory", p)
+	}
+	return ioutil.NopCloser(bytes.NewReader(n.data)), nil
+}
+
+func (fs *fakeShell) List(p string) ([]*shell.LsEntry, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.count("List")
+	_, n, err := fs.resolve(p)
+	if err != nil {
+		return nil, err
+	}
+	if n.links == nil {
+		return nil, fmt.Errorf("fakeShell: %q is not a directory", p)
+	}
+	var entries []*shell.LsEntry
+	for _, name := range sortedNames(n.links) {
+		hash := n.links[name]
+		e := &shell.LsEntry{Name: name, Hash: hash, Type: 2}
+		if child, ok := fs.nodes[hash]; ok {
+			if child.links != nil {
+				e.Type = unixfsDir
+				if fs.sharded {
+					e.Type = unixfsShard
+				}
+			}
+			e.Size = uint64(len(child.data))
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (fs *fakeShell) Get(hash, outdir string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.count("Get")
+	_, n, err := fs.resolve(hash)
+	if err != nil {
+		return err
+	}
+	return fs.writeOut(n, outdir)
+}
+
+func (fs *fakeShell) writeOut(n *fakeNode, target string) error {
+	if n.links == nil {
+		return ioutil.WriteFile(target, n.data, 0600)
+	}
+	if err := os.MkdirAll(target, 0700); err != nil {
+		return err
+	}
+	for name, hash := range n.links {
+		if err := fs.writeOut(fs.nodes[hash], filepath.Join(target, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *fakeShell) Add(r io.Reader) (string, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.count("Add")
+	return fs.put(&fakeNode{data: data}), nil
+}
+
+func (fs *fakeShell) ResolvePath(p string) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.count("ResolvePath")
+	hash, _, err := fs.resolve(p)
+	return hash, err
+}
+
+func (fs *fakeShell) PatchLink(root, p, childhash string, create bool) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.count("PatchLink")
+	return fs.patch(root, splitPath(p), childhash, create)
+}
+
+// patch replaces the link at path below root, returning the new root.
+// an empty childhash removes the link.
+func (fs *fakeShell) patch(root string, parts []string, childhash string, create bool) (string, error) {
+	n, ok := fs.nodes[root]
+	if !ok || n.links == nil {
+		return "", fmt.Errorf("fakeShell: %q is not a directory", root)
+	}
+	links := make(map[string]string, len(n.links))
+	for k, v := range n.links {
+		links[k] = v
+	}
+	name := parts[0]
+	if len(parts) == 1 {
+		if childhash == "" {
+			if _, ok := links[name]; !ok {
+				return "", fmt.Errorf("fakeShell: no link named %q", name)
+			}
+			delete(links, name)
+		} else {
+			links[name] = childhash
+		}
+		return fs.put(&fakeNode{links: links}), nil
+	}
+	sub, ok := links[name]
+	if !ok {
+		if !create {
+			return "", fmt.Errorf("fakeShell: no link named %q", name)
+		}
+		sub = fs.put(&fakeNode{links: map[string]string{}})
+	}
+	newSub, err := fs.patch(sub, parts[1:], childhash, create)
+	if err != nil {
+		return "", err
+	}
+	links[name] = newSub
+	return fs.put(&fakeNode{links: links}), nil
+}
+
+func (fs *fakeShell) Patch(root, action string, args ...string) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.count("Patch")
+	switch action {
+	case "rm-link":
+		return fs.patch(root, splitPath(args[0]), "", false)
+	default:
+		return "", fmt.Errorf("fakeShell: unsupported patch action %q", action)
+	}
+}
+
+func (fs *fakeShell) NewObject(template string) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.count("NewObject")
+	if template != "unixfs-dir" {
+		return "", fmt.Errorf("fakeShell: unsupported template %q", template)
+	}
+	return fs.put(&fakeNode{links: map[string]string{}}), nil
+}
+
+func (fs *fakeShell) Publish(node, value string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.count("Publish")
+	if fs.flakyPublish > 0 {
+		fs.flakyPublish--
+		return fmt.Errorf("fakeShell: publish timed out")
+	}
+	if fs.failPublish != nil {
+		return fs.failPublish
+	}
+	if fs.stalePublish {
+		return nil
+	}
+	fs.names[node] = value
+	return nil
+}
+
+func (fs *fakeShell) BlockPut(block []byte) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.count("BlockPut")
+	hash := fmt.Sprintf("zb%x", sha256.Sum256(block))
+	fs.blocks[hash] = append([]byte(nil), block...)
+	// linkable like any other node
+	fs.nodes[hash] = &fakeNode{data: fs.blocks[hash]}
+	return hash, nil
+}
+
+func (fs *fakeShell) BlockGet(p string) ([]byte, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.count("BlockGet")
+	data, ok := fs.blocks[p]
+	if !ok {
+		return nil, fmt.Errorf("fakeShell: no block %q", p)
+	}
+	return data, nil
+}
+
+func (fs *fakeShell) BlockPutGitRaw(data []byte) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.count("BlockPutGitRaw")
+	cid, err := gitRawCID(fmt.Sprintf("%x", sha1.Sum(data)))
+	if err != nil {
+		return "", err
+	}
+	fs.blocks[cid] = append([]byte(nil), data...)
+	fs.nodes[cid] = &fakeNode{data: fs.blocks[cid]}
+	return cid, nil
+}
+
+// DagExport writes the git-raw blocks below cid as a car file, following the links like the daemon's git plugin
+func (fs *fakeShell) DagExport(ctx context.Context, cid string) (io.ReadCloser, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.count("DagExport")
+	if fs.noDagExport {
+		return nil, fmt.Errorf("fakeShell: unknown command dag/export")
+	}
+	var car bytes.Buffer
+	section := func(b ...[]byte) {
+		var n [binary.MaxVarintLen64]byte
+		size := 0
+		for _, p := range b {
+			size += len(p)
+		}
+		car.Write(n[:binary.PutUvarint(n[:], uint64(size))])
+		for _, p := range b {
+			car.Write(p)
+		}
+	}
+	// {"roots": [], "version": 1}
+	section([]byte("\xa2\x65roots\x80\x67version\x01"))
+	seen := make(map[string]bool)
+	var export func(sha1 string) error
+	export = func(sha1 string) error {
+		if seen[sha1] {
+			return nil
+		}
+		seen[sha1] = true
+		c, _ := gitRawCIDBytes(sha1)
+		cid, _ := gitRawCID(sha1)
+		data, ok := fs.blocks[cid]
+		if !ok {
+			return fmt.Errorf("fakeShell: no block %q", cid)
+		}
+		section(c, data)
+		for _, next := range gitRawLinks(data) {
+			if err := export(next); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	sha1, ok := gitRawName(mustCIDBytes(cid))
+	if !ok {
+		return nil, fmt.Errorf("fakeShell: %q is no git-raw cid", cid)
+	}
+	if err := export(sha1); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(&car), nil
+}
+
+func mustCIDBytes(cid string) []byte {
+	b, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(strings.TrimPrefix(cid, "b")))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// gitRawLinks are the objects the git object raw points to, submodule commits aside
+func gitRawLinks(raw []byte) []string {
+	i := bytes.IndexByte(raw, 0)
+	kind, body := strings.SplitN(string(raw[:i]), " ", 2)[0], raw[i+1:]
+	var links []string
+	if kind == "tree" {
+		for len(body) > 0 {
+			sp, nul := bytes.IndexByte(body, ' '), bytes.IndexByte(body, 0)
+			if string(body[:sp]) != "160000" {
+				links = append(links, fmt.Sprintf("%x", body[nul+1:nul+21]))
+			}
+			body = body[nul+21:]
+		}
+		return links
+	}
+	for _, line := range strings.Split(string(body), "\n") {
+		if line == "" {
+			break
+		}
+		if f := strings.Fields(line); len(f) == 2 && (f[0] == "tree" || f[0] == "parent" || f[0] == "object") {
+			links = append(links, f[1])
+		}
+	}
+	return links
+}
+
+func (fs *fakeShell) FilesMkdir(p string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.count("FilesMkdir")
+	return nil
+}
+
+func (fs *fakeShell) FilesCp(src, dst string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.count("FilesCp")
+	hash, _, err := fs.resolve(src)
+	if err != nil {
+		return err
+	}
+	if _, ok := fs.mfs[dst]; ok {
+		return fmt.Errorf("fakeShell: %s already exists", dst)
+	}
+	fs.mfs[dst] = hash
+	return nil
+}
+
+func (fs *fakeShell) FilesFlush(p string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.count("FilesFlush")
+	return fs.failFlush
+}
+
+func (fs *fakeShell) FilesStat(p string) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.count("FilesStat")
+	hash, ok := fs.mfs[p]
+	if !ok {
+		return "", fmt.Errorf("fakeShell: file does not exist: %s", p)
+	}
+	return hash, nil
+}
+
+func (fs *fakeShell) FilesRm(p string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.count("FilesRm")
+	if _, ok := fs.mfs[p]; !ok {
+		return fmt.Errorf("fakeShell: file does not exist: %s", p)
+	}
+	delete(fs.mfs, p)
+	return nil
+}
+
+func TestConnectProvider(t *testing.T) {
+	fs, restore := useFakeShell()
+	defer restore()
+	defer os.Setenv("GIT_IPFS_PROVIDER", os.Getenv("GIT_IPFS_PROVIDER"))
+	os.Unsetenv("GIT_IPFS_PROVIDER")
+	connectProvider()
+	if fs.calls["SwarmConnect"] != 0 {
+		t.Error("connected without GIT_IPFS_PROVIDER")
+	}
+	provider := "/ip4/10.0.0.1/tcp/4001/ipfs/" + fixtureHash
+	os.Setenv("GIT_IPFS_PROVIDER", provider)
+	connectProvider()
+	if len(fs.peers) != 1 || fs.peers[0] != provider {
+		t.Errorf("expected a connect to %s, got %v", provider, fs.peers)
+	}
+}
+
+// catServer counts the connections made to it while answering like /api/v0/cat
+func catServer() (*httptest.Server, *int32) {
+	var conns int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "loose object bytes")
+	}))
+	srv.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.Start()
+	return srv, &conns
+}
+
+func catObjects(c *http.Client, url string, n int) error {
+	for i := 0; i < n; i++ {
+		resp, err := c.Post(url+"/api/v0/cat?arg=objects/"+fmt.Sprint(i), "", nil)
+		if err != nil {
+			return err
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	return nil
+}
+
+func TestHTTPClient_keepAlive(t *testing.T) {
+	for maxIdle, wantConns := range map[int]int32{defaultMaxIdleConns: 1, 0: 20} {
+		srv, conns := catServer()
+		checkFatal(t, catObjects(newHTTPClient(maxIdle), srv.URL, 20))
+		srv.Close()
+		if *conns != wantConns {
+			t.Errorf("maxIdle %d: want %d connections got %d", maxIdle, wantConns, *conns)
+		}
+	}
+}
+
+// compare with: GIT_IPFS_MAX_IDLE_CONNS=0 makes every object a new connection
+func benchmarkCat(b *testing.B, maxIdle int) {
+	srv, _ := catServer()
+	defer srv.Close()
+	c := newHTTPClient(maxIdle)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := catObjects(c, srv.URL, 100); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCat_pooled(b *testing.B)   { benchmarkCat(b, defaultMaxIdleConns) }
+func BenchmarkCat_unpooled(b *testing.B) { benchmarkCat(b, 0) }
+
+func (fs *fakeShell) Pin(p string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.count("Pin")
+	if fs.failPin != nil {
+		return fs.failPin
+	}
+	if _, _, err := fs.resolve(p); err != nil {
+		return err
+	}
+	fs.pins[p] = true
+	return nil
+}
+
+func (fs *fakeShell) Unpin(p string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.count("Unpin")
+	if !fs.pins[p] {
+		return fmt.Errorf("fakeShell: %s is not pinned", p)
+	}
+	delete(fs.pins, p)
+	return nil
+}
+
+func (fs *fakeShell) SwarmConnect(ctx context.Context, addr ...string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.count("SwarmConnect")
+	fs.peers = append(fs.peers, addr...)
+	return nil
+}
+
+// fakePeerID is the identity of the fake daemon
+const fakePeerID = "QmFakePeerFakePeerFakePeerFakePeerFakePeerFak"
+
+var errFakeDown = &net.OpError{Op: "dial", Net: "tcp", Err: fmt.Errorf("connection refused")}
+
+func (fs *fakeShell) Version() (string, string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.count("Version")
+	if fs.down {
+		return "", "", errFakeDown
+	}
+	if fs.version != "" {
+		return fs.version, "fake", nil
+	}
+	return "0.4.23", "fake", nil
+}
+
+func (fs *fakeShell) ID(peer ...string) (*shell.IdOutput, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.count("ID")
+	if fs.down {
+		return nil, errFakeDown
+	}
+	return &shell.IdOutput{ID: fakePeerID, AgentVersion: "go-ipfs/0.4.23/fake"}, nil
+}
+
+func (fs *fakeShell) Resolve(id string) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.count("Resolve")
+	if fs.down {
+		return "", errFakeDown
+	}
+	if v, ok := fs.names[id]; ok {
+		return v, nil
+	}
+	return "", fmt.Errorf("fakeShell: could not resolve name %q", id)
+}
+
+func TestAPIAdder(t *testing.T) {
+	var gotChunker, gotData string
+	var gotQuery url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v0/add" {
+			http.NotFound(w, r)
+			return
+		}
+		gotQuery = r.URL.Query()
+		gotChunker = gotQuery.Get("chunker")
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, _ := ioutil.ReadAll(f)
+		gotData = string(data)
+		fmt.Fprintf(w, `{"Name":"%s","Hash":"%s","Size":"%d"}`, fixtureHash, fixtureHash, len(data))
+	}))
+	defer srv.Close()
+
+	a := apiAdder{addr: srv.URL, chunker: "rabin-262144-524288-1048576", client: newHTTPClient(1)}
+	hash, err := a.add(strings.NewReader("large blob"))
+	checkFatal(t, err)
+	if hash != fixtureHash {
+		t.Errorf("want hash %s got %s", fixtureHash, hash)
+	}
+	if gotChunker != a.chunker || gotData != "large blob" {
+		t.Errorf("chunker option not forwarded: chunker %q data %q", gotChunker, gotData)
+	}
+
+	if _, err := parseChunker("fixed-1024"); err == nil {
+		t.Error("expected an error for an unknown chunker")
+	}
+
+	opts, unknown, err := parseAddOpts("nocopy cid-version=1  future-flag=x")
+	checkFatal(t, err)
+	if len(unknown) != 1 || unknown[0] != "future-flag" {
+		t.Errorf("want future-flag reported as unknown, got %v", unknown)
+	}
+	a = apiAdder{addr: srv.URL, opts: opts, client: newHTTPClient(1)}
+	_, err = a.add(strings.NewReader("blob"))
+	checkFatal(t, err)
+	for k, want := range map[string]string{"nocopy": "true", "cid-version": "1", "future-flag": "x", "progress": "false", "chunker": ""} {
+		if got := gotQuery.Get(k); got != want {
+			t.Errorf("option %s: want %q got %q", k, want, got)
+		}
+	}
+	for _, bad := range []string{"=1", "chunker=rabin"} {
+		if _, _, err := parseAddOpts(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestAPIShell_dag(t *testing.T) {
+	raw := []byte("blob 5\x00hello")
+	cid, err := gitRawCID(fmt.Sprintf("%x", sha1.Sum(raw)))
+	checkFatal(t, err)
+	var gotFormat, gotData string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v0/block/put":
+			q := r.URL.Query()
+			gotFormat = q.Get("format") + "/" + q.Get("mhtype")
+			f, _, err := r.FormFile("file")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			data, _ := ioutil.ReadAll(f)
+			gotData = string(data)
+			fmt.Fprintf(w, `{"Key":"%s","Size":%d}`, cid, len(data))
+		case "/api/v0/dag/export":
+			if r.URL.Query().Get("arg") != cid {
+				http.Error(w, "unknown cid", http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprint(w, "car")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	s := newShell(srv.URL, 1)
+	got, err := s.BlockPutGitRaw(raw)
+	checkFatal(t, err)
+	if got != cid || gotFormat != "git-raw/sha1" || gotData != string(raw) {
+		t.Errorf("block put: cid %s format %s data %q", got, gotFormat, gotData)
+	}
+	rc, err := s.DagExport(context.Background(), cid)
+	checkFatal(t, err)
+	car, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if string(car) != "car" {
+		t.Errorf("dag export returned %q", car)
+	}
+	_, err = s.DagExport(context.Background(), fixtureHash)
+	if err == nil || !strings.Contains(err.Error(), "dag/export failed: 500") || !strings.Contains(err.Error(), "unknown cid") {
+		t.Errorf("a failed export should say so with the daemon's message, got %v", err)
+	}
+}
+
+func TestAPIShell_files(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		got = append(got, strings.TrimPrefix(r.URL.Path, "/api/v0/")+" "+strings.Join(q["arg"], " "))
+		if r.URL.Path == "/api/v0/files/stat" {
+			fmt.Fprintf(w, `{"Hash":"%s","Type":"directory"}`, fixtureHash)
+		}
+	}))
+	defer srv.Close()
+	defer func(old ipfsAPI) { ipfsShell = old }(ipfsShell)
+	ipfsShell = newShell(srv.URL, 1)
+
+	staged, unstage, err := stageRoot(fixtureHash)
+	checkFatal(t, err)
+	unstage()
+	if staged != fixtureHash || len(got) != 5 {
+		t.Fatalf("staged as %s with %q", staged, got)
+	}
+	dir := strings.Fields(got[1])[2]
+	if !strings.HasPrefix(dir, stagingDir+"/") {
+		t.Errorf("staged at %s, not below %s", dir, stagingDir)
+	}
+	want := []string{"files/mkdir " + stagingDir, "files/cp /ipfs/" + fixtureHash + " " + dir, "files/flush " + dir, "files/stat " + dir, "files/rm " + dir}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("want requests\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/cryptix/git-remote-ipfs/fetch"
+	"gopkg.in/errgo.v1"
+)
+
+// snapshot writes the files of ref in the repo at ipfsRepoPath to dir, without a local repo.
+// ref is a full ref name, a branch or tag name or an object name.
+// only loose objects are read, like fsck it doesn't unpack the repo's packs.
+// it returns the number of files written.
+func snapshot(ctx context.Context, ref, dir string) (int, error) {
+	if err := ensureEmptyDir(dir); err != nil {
+		return 0, err
+	}
+	commit, err := resolveRef(ref)
+	if err != nil {
+		return 0, err
+	}
+	log.WithField("ref", ref).WithField("commit", commit).Debug("snapshot")
+	n, err := fetch.Checkout(ctx, remoteStore{objStore}, commit, dir)
+	if err != nil {
+		return n, errgo.Notef(err, "writing %s to %s failed", ref, dir)
+	}
+	return n, nil
+}
+
+// symlinksAsFiles (GIT_IPFS_SYMLINKS=file) makes snapshot write symlinks as files holding their target instead of as links
+var symlinksAsFiles bool
+
+// ensureEmptyDir creates dir or makes sure it has nothing in it, a snapshot never overwrites files
+func ensureEmptyDir(dir string) error {
+	list, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return errgo.Mask(os.MkdirAll(dir, 0755))
+	}
+	if err != nil {
+		return errgo.Notef(err, "reading %s failed", dir)
+	}
+	if len(list) > 0 {
+		return errgo.Newf("%s is not empty", dir)
+	}
+	return nil
+}
+
+// snapshotMain is git-remote-ipfs snapshot <url> <ref> <destdir>
+func snapshotMain(args []string) int {
+	flags := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil || flags.NArg() != 3 {
+		fmt.Fprintln(os.Stderr, "usage: git-remote-ipfs snapshot <url> <ref> <destdir>")
+		return exitUsage
+	}
+	switch s := os.Getenv("GIT_IPFS_SYMLINKS"); s {
+	case "", "link":
+	case "file":
+		symlinksAsFiles = true
+	default:
+		fmt.Fprintf(os.Stderr, "GIT_IPFS_SYMLINKS: unknown mode %q (want link or file)\n", s)
+		return exitUsage
+	}
+	if code := openRemote(flags.Arg(0)); code != 0 {
+		return code
+	}
+	ref, dir := flags.Arg(1), flags.Arg(2)
+	n, err := snapshot(context.Background(), ref, dir)
+	if err != nil {
+		log.Error("snapshot failed:", err)
+		return exitCode(err)
+	}
+	fmt.Fprintf(os.Stderr, "wrote %d files of %s to %s\n", n, ref, dir)
+	return 0
+}
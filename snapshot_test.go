@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	files := map[string]string{"HEAD": "ref: refs/heads/master\n"}
+	master, _ := fixtureCommit(files, "master\n")
+	// v1 is an annotated tag of a commit with a subdirectory
+	readme, z := looseObject("blob", "tagged\n")
+	files[objectPath(readme)] = z
+	mainGo, z := looseObject("blob", "package main\n")
+	files[objectPath(mainGo)] = z
+	mainSum, _ := hex.DecodeString(mainGo)
+	sub, z := looseObject("tree", "100644 main.go\x00"+string(mainSum))
+	files[objectPath(sub)] = z
+	readmeSum, _ := hex.DecodeString(readme)
+	subSum, _ := hex.DecodeString(sub)
+	tree, z := looseObject("tree", "100644 README\x00"+string(readmeSum)+"40000 cmd\x00"+string(subSum))
+	files[objectPath(tree)] = z
+	commit, z := looseObject("commit", "tree "+tree+"\nauthor a <a@b> 0 +0000\ncommitter a <a@b> 0 +0000\n\nv1\n")
+	files[objectPath(commit)] = z
+	tag, z := looseObject("tag", "object "+commit+"\ntype commit\ntag v1\ntagger a <a@b> 0 +0000\n\nv1\n")
+	files[objectPath(tag)] = z
+	files["refs/heads/master"] = master + "\n"
+	files["refs/tags/v1"] = tag + "\n"
+	_, restore := useFakeRepo(t, files)
+	defer restore()
+
+	dir := mkRandTmpDir(t)
+	defer rmDir(t, dir)
+	n, err := snapshot(context.Background(), "v1", dir)
+	checkFatal(t, err)
+	if n != 2 {
+		t.Errorf("want 2 files, got %d", n)
+	}
+	for name, want := range map[string]string{"README": "tagged\n", "cmd/main.go": "package main\n"} {
+		if got, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || string(got) != want {
+			t.Errorf("%s: %q %v", name, got, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); !os.IsNotExist(err) {
+		t.Errorf("snapshot created a repo: %v", err)
+	}
+
+	// the directory isn't empty anymore
+	if _, err := snapshot(context.Background(), "master", dir); err == nil {
+		t.Error("expected an error for a non empty destdir")
+	}
+	byName := filepath.Join(dir, "master")
+	if _, err := snapshot(context.Background(), master, byName); err != nil {
+		t.Errorf("snapshot of an object name failed: %s", err)
+	} else if got, _ := ioutil.ReadFile(filepath.Join(byName, "file.txt")); string(got) != "master\n" {
+		t.Errorf("wrong master content %q", got)
+	}
+	if _, err := snapshot(context.Background(), "nope", filepath.Join(dir, "nope")); err == nil {
+		t.Error("expected an error for a missing ref")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"path"
+
+	"gopkg.in/errgo.v1"
+)
+
+// mfsAPI is implemented by backends with the daemon's files (mfs) calls, which the shell package doesn't have
+type mfsAPI interface {
+	FilesMkdir(path string) error
+	FilesCp(src, dst string) error
+	FilesFlush(path string) error
+	FilesStat(path string) (string, error)
+	FilesRm(path string) error
+}
+
+// stagingDir holds the roots of pushes in progress in the daemon's mfs, one random directory each
+const stagingDir = "/.git-ipfs-staging"
+
+// stageRoot copies the new root of a push to a fresh directory below stagingDir and flushes it.
+// the cid of the flushed directory is what gets pinned and published, so nothing stable points at the push
+// before it is complete. unstage removes the directory again, pushFinish calls it however the push ends.
+// backends without mfs (like a gateway) publish root as it is.
+func stageRoot(root string) (staged string, unstage func(), err error) {
+	m, ok := apiBehind(ipfsShell).(mfsAPI)
+	if !ok {
+		return root, func() {}, nil
+	}
+	var rnd [8]byte
+	if _, err := rand.Read(rnd[:]); err != nil {
+		return "", nil, errgo.Notef(err, "naming the staging directory failed")
+	}
+	dir := path.Join(stagingDir, hex.EncodeToString(rnd[:]))
+	if err := m.FilesMkdir(stagingDir); err != nil {
+		return "", nil, errgo.Notef(err, "creating %s failed", stagingDir)
+	}
+	if err := m.FilesCp("/ipfs/"+root, dir); err != nil {
+		return "", nil, errgo.Notef(err, "staging %s at %s failed", root, dir)
+	}
+	unstage = func() {
+		if err := m.FilesRm(dir); err != nil {
+			log.WithField("dir", dir).WithField("err", err).Warning("removing the staging directory failed")
+		}
+	}
+	if err := m.FilesFlush(dir); err != nil {
+		unstage()
+		return "", nil, errgo.Notef(err, "flushing %s failed", dir)
+	}
+	if staged, err = m.FilesStat(dir); err != nil {
+		unstage()
+		return "", nil, errgo.Notef(err, "reading the cid of %s failed", dir)
+	}
+	log.WithField("dir", dir).WithField("root", staged).Debug("staged the new root")
+	return staged, unstage, nil
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/errgo.v1"
+)
+
+// objectStore decides how the git objects of the remote repo are kept in ipfs.
+// refs, HEAD and packs are always plain unixfs files below ipfsRepoPath.
+type objectStore interface {
+	// getObject returns the zlib compressed loose object sha1
+	getObject(sha1 string) (io.ReadCloser, error)
+	// putObject adds the zlib compressed loose object and returns its ipfs hash
+	putObject(sha1 string, r io.Reader) (string, error)
+	// present returns which of shas the repo at ipfsRepoPath already has
+	present(shas []string) (map[string]bool, error)
+	// linkObjects puts the added objects (sha1 -> ipfs hash) into the repo at root and returns the new root
+	linkObjects(root string, objs map[string]string) (string, error)
+}
+
+// newObjectStore picks the store for GIT_IPFS_STORE
+func newObjectStore(mode string) (objectStore, error) {
+	switch mode {
+	case "", "file":
+		return fileStore{}, nil
+	case "block":
+		return &blockStore{}, nil
+	case "hybrid":
+		return &hybridStore{isBlock: make(map[string]bool)}, nil
+	case "git-raw":
+		return gitRawStore{}, nil
+	default:
+		return nil, errgo.Newf("unknown store mode %q (want file, block, hybrid or git-raw)", mode)
+	}
+}
+
+func objectPath(sha1 string) string {
+	return filepath.Join("objects", sha1[:2], sha1[2:])
+}
+
+// objectSharding is how many levels of two hex digit directories the loose objects of the remote are below objects/,
+// 1 like git (objects/ab/cdef..) or more (2: objects/ab/cd/ef..) to keep huge repos' directories small. set by list.
+var objectSharding = 1
+
+// pushSharding (GIT_IPFS_OBJECT_SHARDING) is the objectSharding a push to a remote without refs starts it with
+var pushSharding = 1
+
+// maxSharding keeps the directory names out of short sha1 prefixes git would still tell apart
+const maxSharding = 4
+
+// shardingPath records the objectSharding of remotes not sharded like git
+var shardingPath = path.Join("objects", "info", "sharding")
+
+// remoteObjectPath is where the remote keeps the loose object sha1, objectPath with objectSharding levels
+func remoteObjectPath(sha1 string) string {
+	dir, name := remoteObjectDir(sha1)
+	return path.Join(dir, name)
+}
+
+// remoteObjectDir splits remoteObjectPath into its directory and the name in it
+func remoteObjectDir(sha1 string) (string, string) {
+	dirs := []string{"objects"}
+	for i := 0; i < objectSharding; i++ {
+		dirs = append(dirs, sha1[2*i:2*i+2])
+	}
+	return path.Join(dirs...), sha1[2*objectSharding:]
+}
+
+// inRepo is elem below the repo, the remote's paths are slash separated however deep ipfsRepoPath is nested
+func inRepo(elem ...string) string {
+	return path.Join(append([]string{ipfsRepoPath}, elem...)...)
+}
+
+// parseSharding checks a GIT_IPFS_OBJECT_SHARDING or shardingPath value
+func parseSharding(s string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < 1 || n > maxSharding {
+		return 0, errgo.Newf("invalid object sharding %q (want 1 to %d)", s, maxSharding)
+	}
+	return n, nil
+}
+
+// detectSharding reads shardingPath of the remote, remotes without one use git's.
+// a push to a remote without refs (fresh) gets pushSharding instead, linkObjects records it.
+func detectSharding(fresh bool) int {
+	rc, err := ipfsShell.Cat(inRepo(shardingPath))
+	if err != nil {
+		if fresh {
+			return pushSharding
+		}
+		return 1
+	}
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		log.WithField("err", err).Warning("reading the object sharding of the remote failed")
+		return 1
+	}
+	n, err := parseSharding(string(data))
+	if err != nil {
+		log.WithField("err", err).Warning("ignoring the object sharding of the remote")
+		return 1
+	}
+	return n
+}
+
+// fileStore keeps every object as a unixfs file, just like a loose object in .git/objects
+type fileStore struct{}
+
+func (fileStore) getObject(sha1 string) (io.ReadCloser, error) {
+	return ipfsShell.Cat(inRepo(remoteObjectPath(sha1)))
+}
+
+func (fileStore) putObject(sha1 string, r io.Reader) (string, error) {
+	return addObject(r)
+}
+
+// present lists only the objects/xx (objects/xx/yy.. with objectSharding) directories the shas fall into
+func (fileStore) present(shas []string) (map[string]bool, error) {
+	return looseObjects(ipfsRepoPath, shas), nil
+}
+
+// looseObjects returns which of shas are loose objects of the repo at repoPath
+func looseObjects(repoPath string, shas []string) map[string]bool {
+	byPrefix := make(map[string][]string)
+	for _, sha1 := range shas {
+		dir, _ := remoteObjectDir(sha1)
+		byPrefix[dir] = append(byPrefix[dir], sha1)
+	}
+	have := make(map[string]bool)
+	for prefix, group := range byPrefix {
+		list, err := ipfsShell.List(path.Join(repoPath, prefix))
+		if err != nil {
+			// no such directory yet
+			log.WithField("prefix", prefix).WithField("err", err).Debug("fileStore: listing objects failed")
+			continue
+		}
+		names := make(map[string]bool, len(list))
+		for _, lnk := range list {
+			names[lnk.Name] = true
+		}
+		for _, sha1 := range group {
+			if _, name := remoteObjectDir(sha1); names[name] {
+				have[sha1] = true
+			}
+		}
+	}
+	return have
+}
+
+func (fileStore) linkObjects(root string, objs map[string]string) (string, error) {
+	// in sha1 order, so the same objects always build the same directories
+	shas := make([]string, 0, len(objs))
+	for sha1 := range objs {
+		shas = append(shas, sha1)
+	}
+	sort.Strings(shas)
+	for _, sha1 := range shas {
+		mhash := objs[sha1]
+		newRoot, err := ipfsShell.PatchLink(root, remoteObjectPath(sha1), mhash, true)
+		if err != nil {
+			return "", errgo.Notef(err, "patchLink failed")
+		}
+		root = newRoot
+		log.WithField("newRoot", newRoot).WithField("sha1", sha1).Debug("updated object")
+	}
+	if objectSharding != 1 && len(objs) > 0 {
+		// so fetches find them
+		mhash, err := addObject(strings.NewReader(fmt.Sprintf("%d\n", objectSharding)))
+		if err != nil {
+			return "", errgo.Notef(err, "adding %s failed", shardingPath)
+		}
+		if root, err = ipfsShell.PatchLink(root, shardingPath, mhash, true); err != nil {
+			return "", errgo.Notef(err, "patchLink(%s) failed", shardingPath)
+		}
+	}
+	return root, nil
+}
+
+// blockIndexPath is the node of a block store repo that maps the objects to their blocks,
+// a unixfs directory with a link named by the sha1 of every object to its raw block
+var blockIndexPath = path.Join("objects", "info", "blocks")
+
+// blockStore keeps every object as a single raw ipfs block, skipping the unixfs chunking.
+// objects/info/blocks links every sha1 to its block so fetch can get them with BlockGet alone,
+// they are linked under objects/ too, where resolve, verifyRefs and gc look for the loose objects.
+type blockStore struct {
+	mu    sync.Mutex        // fetch workers load the index at the same time
+	index map[string]string // sha1 -> block hash, nil until loaded
+	node  string            // the hash of the index node, "" while there is none
+}
+
+// loadIndex lists objects/info/blocks of ipfsRepoPath once.
+// a missing index just means an empty (or new) repo.
+func (s *blockStore) loadIndex() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.index != nil {
+		return nil
+	}
+	s.index = make(map[string]string)
+	node, err := ipfsShell.ResolvePath(inRepo(blockIndexPath))
+	if err != nil {
+		log.WithField("err", err).Debug("blockStore: no index found")
+		return nil
+	}
+	list, err := ipfsShell.List(node)
+	if err != nil {
+		return errgo.Notef(err, "blockStore: listing index %s failed", node)
+	}
+	for _, lnk := range list {
+		s.index[lnk.Name] = lnk.Hash
+	}
+	s.node = node
+	return nil
+}
+
+func (s *blockStore) getObject(sha1 string) (io.ReadCloser, error) {
+	if err := s.loadIndex(); err != nil {
+		return nil, err
+	}
+	mhash, ok := s.index[sha1]
+	if !ok {
+		return nil, errgo.Newf("blockStore: sha1<%s> not in index", sha1)
+	}
+	data, err := ipfsShell.BlockGet(mhash)
+	if err != nil {
+		return nil, errgo.Notef(err, "shell.BlockGet(%s) failed", mhash)
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *blockStore) putObject(sha1 string, r io.Reader) (string, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", errgo.Notef(err, "blockStore: reading object %s failed", sha1)
+	}
+	return ipfsShell.BlockPut(data)
+}
+
+func (s *blockStore) present(shas []string) (map[string]bool, error) {
+	if err := s.loadIndex(); err != nil {
+		return nil, err
+	}
+	have := make(map[string]bool)
+	for _, sha1 := range shas {
+		if _, ok := s.index[sha1]; ok {
+			have[sha1] = true
+		}
+	}
+	return have, nil
+}
+
+func (s *blockStore) linkObjects(root string, objs map[string]string) (string, error) {
+	if err := s.loadIndex(); err != nil {
+		return "", err
+	}
+	root, err := fileStore{}.linkObjects(root, objs)
+	if err != nil {
+		return "", err
+	}
+	return s.writeIndex(root, objs)
+}
+
+// writeIndex links objs into the index node and the new index node into root
+func (s *blockStore) writeIndex(root string, objs map[string]string) (string, error) {
+	node := s.node
+	if node == "" {
+		var err error
+		if node, err = ipfsShell.NewObject("unixfs-dir"); err != nil {
+			return "", errgo.Notef(err, "blockStore: creating index failed")
+		}
+	}
+	shas := make([]string, 0, len(objs))
+	for sha1 := range objs {
+		shas = append(shas, sha1)
+	}
+	sort.Strings(shas)
+	for _, sha1 := range shas {
+		var err error
+		if node, err = ipfsShell.PatchLink(node, sha1, objs[sha1], false); err != nil {
+			return "", errgo.Notef(err, "blockStore: patchLink(index, %s) failed", sha1)
+		}
+		s.index[sha1] = objs[sha1]
+	}
+	s.node = node
+	root, err := ipfsShell.PatchLink(root, blockIndexPath, node, true)
+	if err != nil {
+		return "", errgo.Notef(err, "blockStore: patchLink(index) failed")
+	}
+	return root, nil
+}
+
+// blockThreshold (GIT_IPFS_BLOCK_THRESHOLD) is the size from which hybridStore adds an object as a file instead of a block
+var blockThreshold = 4096
+
+// hybridStore keeps the objects smaller than blockThreshold (commits, trees, small blobs) as raw blocks like blockStore,
+// without the unixfs overhead, and the larger ones as unixfs files like fileStore, chunked so similar blobs share chunks.
+// both are linked under objects/, objects/info/blocks links just the block ones so fetch knows which is which.
+type hybridStore struct {
+	blocks  blockStore
+	mu      sync.Mutex      // push adds objects concurrently
+	isBlock map[string]bool // the objects this push added as blocks
+}
+
+func (s *hybridStore) getObject(sha1 string) (io.ReadCloser, error) {
+	if err := s.blocks.loadIndex(); err != nil {
+		return nil, err
+	}
+	if _, ok := s.blocks.index[sha1]; ok {
+		return s.blocks.getObject(sha1)
+	}
+	return fileStore{}.getObject(sha1)
+}
+
+func (s *hybridStore) putObject(sha1 string, r io.Reader) (string, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", errgo.Notef(err, "hybridStore: reading object %s failed", sha1)
+	}
+	if len(data) >= blockThreshold {
+		return fileStore{}.putObject(sha1, bytes.NewReader(data))
+	}
+	mhash, err := ipfsShell.BlockPut(data)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	s.isBlock[sha1] = true
+	s.mu.Unlock()
+	return mhash, nil
+}
+
+// present finds both kinds, they are all linked under objects/
+func (s *hybridStore) present(shas []string) (map[string]bool, error) {
+	return fileStore{}.present(shas)
+}
+
+func (s *hybridStore) linkObjects(root string, objs map[string]string) (string, error) {
+	if err := s.blocks.loadIndex(); err != nil {
+		return "", err
+	}
+	root, err := fileStore{}.linkObjects(root, objs)
+	if err != nil {
+		return "", err
+	}
+	blocks := make(map[string]string)
+	s.mu.Lock()
+	for sha1, mhash := range objs {
+		if s.isBlock[sha1] {
+			blocks[sha1] = mhash
+		}
+	}
+	s.mu.Unlock()
+	if len(blocks) == 0 && len(s.blocks.index) == 0 {
+		// no index needed for files only
+		return root, nil
+	}
+	return s.blocks.writeIndex(root, blocks)
+}
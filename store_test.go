@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestBlockStore_roundTrip(t *testing.T) {
+	fs, restore := useFakeShell()
+	defer restore()
+	oldPath := ipfsRepoPath
+	defer func() { ipfsRepoPath = oldPath }()
+
+	objs := map[string]string{
+		"9417d011822b875da72221c8d188089cbfcee806": "blob contents A",
+		"e2839ad2e47386d342038958fba941fc78e3780e": "blob contents B",
+	}
+	ipfsRepoPath = "/ipfs/" + fs.mkdir(map[string]string{})
+	s, err := newObjectStore("block")
+	checkFatal(t, err)
+	added := make(map[string]string)
+	for sha1, data := range objs {
+		mhash, err := s.putObject(sha1, strings.NewReader(data))
+		checkFatal(t, err)
+		added[sha1] = mhash
+	}
+	root, err := s.linkObjects(strings.TrimPrefix(ipfsRepoPath, "/ipfs/"), added)
+	checkFatal(t, err)
+	if fs.calls["BlockPut"] != len(objs) {
+		t.Errorf("expected %d BlockPut calls, got %d", len(objs), fs.calls["BlockPut"])
+	}
+
+	// the index node links every object to its block
+	list, err := fs.List(root + "/" + blockIndexPath)
+	checkFatal(t, err)
+	if len(list) != len(objs) {
+		t.Fatalf("index should link the %d objects, got %d links", len(objs), len(list))
+	}
+	for _, lnk := range list {
+		if lnk.Hash != added[lnk.Name] {
+			t.Errorf("index links %s to %s, want its block %s", lnk.Name, lnk.Hash, added[lnk.Name])
+		}
+	}
+
+	// fresh store on the new root has to read the index from ipfs, and the objects are blocks only
+	ipfsRepoPath = "/ipfs/" + root
+	s, err = newObjectStore("block")
+	checkFatal(t, err)
+	cats := fs.calls["Cat"]
+	for sha1, want := range objs {
+		rc, err := s.getObject(sha1)
+		checkFatal(t, err)
+		got, err := ioutil.ReadAll(rc)
+		checkFatal(t, err)
+		if !bytes.Equal(got, []byte(want)) {
+			t.Errorf("object %s: want %q got %q", sha1, want, got)
+		}
+	}
+	if fs.calls["BlockGet"] != len(objs) {
+		t.Errorf("expected %d BlockGet calls, got %d", len(objs), fs.calls["BlockGet"])
+	}
+	if fs.calls["Cat"] != cats {
+		t.Errorf("objects read with %d Cat calls, want BlockGet alone", fs.calls["Cat"]-cats)
+	}
+	if _, err := s.getObject("32ed91604b272860ec911fc2bf4ae631b7900aa8"); err == nil {
+		t.Error("expected error for object missing from the index")
+	}
+}
+
+func TestHybridStore_roundTrip(t *testing.T) {
+	fs, restore := useFakeShell()
+	defer restore()
+	oldPath := ipfsRepoPath
+	defer func() { ipfsRepoPath = oldPath }()
+	defer func(old int) { blockThreshold = old }(blockThreshold)
+	blockThreshold = 16
+
+	small := map[string]string{
+		"9417d011822b875da72221c8d188089cbfcee806": "commit",
+		"e2839ad2e47386d342038958fba941fc78e3780e": "tree",
+	}
+	large := map[string]string{
+		"32ed91604b272860ec911fc2bf4ae631b7900aa8": strings.Repeat("a large blob ", 10),
+	}
+	ipfsRepoPath = "/ipfs/" + fs.mkdir(map[string]string{})
+	s, err := newObjectStore("hybrid")
+	checkFatal(t, err)
+	added := make(map[string]string)
+	for _, objs := range []map[string]string{small, large} {
+		for sha1, data := range objs {
+			mhash, err := s.putObject(sha1, strings.NewReader(data))
+			checkFatal(t, err)
+			added[sha1] = mhash
+		}
+	}
+	root, err := s.linkObjects(strings.TrimPrefix(ipfsRepoPath, "/ipfs/"), added)
+	checkFatal(t, err)
+	if fs.calls["BlockPut"] != len(small) {
+		t.Errorf("expected %d BlockPut calls, got %d", len(small), fs.calls["BlockPut"])
+	}
+
+	// a fresh store on the new root tells them apart by the index
+	ipfsRepoPath = "/ipfs/" + root
+	s, err = newObjectStore("hybrid")
+	checkFatal(t, err)
+	have, err := s.present([]string{"9417d011822b875da72221c8d188089cbfcee806", "32ed91604b272860ec911fc2bf4ae631b7900aa8", fixtureSha[:39] + "0"})
+	checkFatal(t, err)
+	if len(have) != 2 {
+		t.Errorf("present found %v", have)
+	}
+	for _, objs := range []map[string]string{small, large} {
+		for sha1, want := range objs {
+			rc, err := s.getObject(sha1)
+			checkFatal(t, err)
+			got, err := ioutil.ReadAll(rc)
+			checkFatal(t, err)
+			if !bytes.Equal(got, []byte(want)) {
+				t.Errorf("object %s: want %q got %q", sha1, want, got)
+			}
+		}
+	}
+	if fs.calls["BlockGet"] != len(small) {
+		t.Errorf("expected %d BlockGet calls, got %d", len(small), fs.calls["BlockGet"])
+	}
+	idx, err := fs.List(ipfsRepoPath + "/" + blockIndexPath)
+	checkFatal(t, err)
+	if len(idx) != len(small) {
+		t.Errorf("index should link just the blocks, got %d links", len(idx))
+	}
+	for _, lnk := range idx {
+		if _, ok := small[lnk.Name]; !ok {
+			t.Errorf("index links %s, which isn't a block", lnk.Name)
+		}
+	}
+}
+
+func TestNewObjectStore(t *testing.T) {
+	for mode, ok := range map[string]bool{"": true, "file": true, "block": true, "hybrid": true, "git-raw": true, "car": false} {
+		_, err := newObjectStore(mode)
+		if (err == nil) != ok {
+			t.Errorf("newObjectStore(%q): unexpected err %v", mode, err)
+		}
+	}
+}
+
+func TestObjectSharding(t *testing.T) {
+	fs, restore := useFakeRepo(t, map[string]string{"HEAD": "ref: refs/heads/master\n"})
+	defer restore()
+	_, cleanup := mkLocalRepo(t, "ipfs://"+ipfsRepoPath)
+	defer cleanup()
+	defer func() { objectSharding, pushSharding = 1, 1 }()
+	pushSharding = 2
+	addFiles(t, 3)
+	head, err := gitRefHash("HEAD")
+	checkFatal(t, err)
+
+	var out bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("list for-push\n"), &out))
+	if objectSharding != 2 {
+		t.Fatalf("a push to a new remote should use GIT_IPFS_OBJECT_SHARDING, got %d", objectSharding)
+	}
+	checkFatal(t, push(context.Background(), "refs/heads/master", "refs/heads/master"))
+	checkFatal(t, pushFinish(context.Background()))
+	ipfsRepoPath = strings.TrimPrefix(remoteURL(t), "ipfs://")
+	for p, want := range map[string]string{
+		"objects/info/sharding":                                  "2\n",
+		"objects/" + head[:2] + "/" + head[2:4] + "/" + head[4:]: "",
+	} {
+		rc, err := fs.Cat(ipfsRepoPath + "/" + p)
+		if err != nil {
+			t.Errorf("pushed repo has no %s: %s", p, err)
+			continue
+		}
+		got, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		if want != "" && string(got) != want {
+			t.Errorf("%s: want %q got %q", p, want, got)
+		}
+	}
+	if _, err := fs.Cat(ipfsRepoPath + "/" + objectPath(head)); err == nil {
+		t.Errorf("%s is at git's path too", head)
+	}
+
+	// a fetch finds the sharding in the repo, whatever it was pushed with
+	objectSharding, pushSharding = 1, 1
+	ref2hash = make(map[string]string)
+	_, done := initClone(t)
+	defer done()
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("list\n"), &out))
+	if objectSharding != 2 {
+		t.Fatalf("list didn't read objects/info/sharding, sharding is %d", objectSharding)
+	}
+	checkFatal(t, fetchObject(context.Background(), head))
+	if err := exec.Command("git", "--git-dir", thisGitRepo, "fsck", "--no-dangling", head).Run(); err != nil {
+		t.Errorf("fetched objects are incomplete: %s", err)
+	}
+
+	// a remote with refs and no record stays as git does it
+	ipfsRepoPath = "/ipfs/" + fs.mkdir(map[string]string{"HEAD": "ref: refs/heads/master\n", "refs/heads/master": head + "\n"})
+	pushSharding = 2
+	if n := detectSharding(false); n != 1 {
+		t.Errorf("want git's sharding for an existing remote, got %d", n)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// protocolTrace gets a copy of every line exchanged with git if GIT_IPFS_TRACE_PROTOCOL is set
+var protocolTrace io.Writer
+
+// openProtocolTrace interprets GIT_IPFS_TRACE_PROTOCOL like GIT_TRACE does:
+// a true value traces to stderr, an absolute path appends to that file.
+func openProtocolTrace(v string) (io.Writer, error) {
+	if v == "" {
+		return nil, nil
+	}
+	if on, err := strconv.ParseBool(v); err == nil {
+		if on {
+			return stderr, nil
+		}
+		return nil, nil
+	}
+	f, err := os.OpenFile(v, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	cleanups = append(cleanups, func() { f.Close() })
+	return f, nil
+}
+
+// lineTracer writes complete lines to out, each prefixed to show the direction
+type lineTracer struct {
+	mu     *sync.Mutex // shared between both directions so lines don't interleave
+	out    io.Writer
+	prefix string
+	buf    bytes.Buffer
+}
+
+func (lt *lineTracer) trace(p []byte) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	lt.buf.Write(p)
+	for {
+		i := bytes.IndexByte(lt.buf.Bytes(), '\n')
+		if i < 0 {
+			return
+		}
+		line := lt.buf.Next(i + 1)
+		fmt.Fprintf(lt.out, "%s%q\n", lt.prefix, line[:len(line)-1])
+	}
+}
+
+type traceReader struct {
+	r io.Reader
+	*lineTracer
+}
+
+func (tr traceReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	tr.trace(p[:n])
+	return n, err
+}
+
+type traceWriter struct {
+	w io.Writer
+	*lineTracer
+}
+
+func (tw traceWriter) Write(p []byte) (int, error) {
+	n, err := tw.w.Write(p)
+	tw.trace(p[:n])
+	return n, err
+}
+
+// traceProtocol wraps the two sides of the helper protocol so every line is copied to out
+func traceProtocol(out io.Writer, r io.Reader, w io.Writer) (io.Reader, io.Writer) {
+	var mu sync.Mutex
+	return traceReader{r, &lineTracer{mu: &mu, out: out, prefix: "git-remote-ipfs <- git: "}},
+		traceWriter{w, &lineTracer{mu: &mu, out: out, prefix: "git-remote-ipfs -> git: "}}
+}
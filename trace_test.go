@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestTraceProtocol(t *testing.T) {
+	var trace, out bytes.Buffer
+	defer func() { protocolTrace = nil }()
+	protocolTrace = &trace
+
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("capabilities\n"), &out))
+	want := `git-remote-ipfs <- git: "capabilities"
+git-remote-ipfs -> git: "fetch"
+git-remote-ipfs -> git: "push"
+git-remote-ipfs -> git: "option"
+git-remote-ipfs -> git: "object-format"
+git-remote-ipfs -> git: ""
+`
+	if trace.String() != want {
+		t.Errorf("unexpected trace:\n%s\nwant:\n%s", trace.String(), want)
+	}
+	if out.String() != "fetch\npush\noption\nobject-format\n\n" {
+		t.Errorf("tracing changed the protocol output: %q", out.String())
+	}
+}
+
+func TestOpenProtocolTrace(t *testing.T) {
+	for v, on := range map[string]bool{"": false, "0": false, "false": false, "1": true, "true": true} {
+		w, err := openProtocolTrace(v)
+		checkFatal(t, err)
+		if (w != nil) != on {
+			t.Errorf("openProtocolTrace(%q): want tracing %v", v, on)
+		}
+	}
+}
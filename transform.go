@@ -0,0 +1,17 @@
+package main
+
+// PreStore and PostFetch transform the bytes of every git object on their way into and out of ipfs,
+// for example to keep them encrypted at rest.
+// PreStore gets the zlib compressed loose object as git has it and PostFetch has to return exactly that again.
+// nil (the default) leaves the bytes untouched.
+var (
+	PreStore  func([]byte) ([]byte, error)
+	PostFetch func([]byte) ([]byte, error)
+)
+
+func applyTransform(fn func([]byte) ([]byte, error), data []byte) ([]byte, error) {
+	if fn == nil {
+		return data, nil
+	}
+	return fn(data)
+}
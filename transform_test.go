@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/cryptix/git-remote-ipfs/fetch"
+)
+
+func reverse(b []byte) ([]byte, error) {
+	r := make([]byte, len(b))
+	for i, c := range b {
+		r[len(b)-1-i] = c
+	}
+	return r, nil
+}
+
+func identity(b []byte) ([]byte, error) { return b, nil }
+
+func TestTransforms(t *testing.T) {
+	defer func() { PreStore, PostFetch = nil, nil }()
+	for name, fn := range map[string]func([]byte) ([]byte, error){"identity": identity, "reverse": reverse} {
+		sha1, z := looseObject("blob", "transform me\n")
+		stored, err := applyTransform(fn, []byte(z))
+		checkFatal(t, err)
+		_, restore := useFakeRepo(t, map[string]string{objectPath(sha1): string(stored)})
+		cleanup := useTmpGitDir(t)
+
+		PostFetch = fn
+		if err := fetchObject(context.Background(), sha1); err != nil {
+			t.Errorf("%s: fetch failed: %s", name, err)
+		} else if got, _ := fetch.ReadBlob(context.Background(), remoteStore{objStore}, sha1); string(got) != "transform me\n" {
+			t.Errorf("%s: unexpected content %q", name, got)
+		}
+		written, err := ioutil.ReadFile(thisGitRepo + "/" + objectPath(sha1))
+		if err != nil || string(written) != z {
+			t.Errorf("%s: local object differs from the original: %v", name, err)
+		}
+
+		// without the matching PostFetch the integrity check has to catch it
+		PostFetch = nil
+		os.RemoveAll(thisGitRepo + "/objects")
+		if err := fetchObject(context.Background(), sha1); name == "reverse" && err == nil {
+			t.Errorf("%s: expected integrity error without PostFetch", name)
+		}
+		cleanup()
+		restore()
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/cryptix/git-remote-ipfs/internal/path"
+	"gopkg.in/errgo.v1"
+)
+
+// urlPrefix maps a url form git hands us to the ipfs path prefix it stands for.
+// canonical is set for legacy forms that still work, it is the prefix to use instead.
+type urlPrefix struct{ prefix, target, canonical string }
+
+// urlPrefixes are tried in order, GIT_IPFS_URL_SCHEMES puts its own ones in front
+var urlPrefixes = []urlPrefix{
+	{"ipfs://ipfs/", "/ipfs/", ""},
+	{"ipfs:///ipfs/", "/ipfs/", ""},
+	{"ipfs://ipns/", "/ipns/", ""},
+	// push sets ipns remotes to ipfs://ipns/
+	{"ipfs:///ipns/", "/ipns/", "ipfs://ipns/"},
+}
+
+// noDeprecation (GIT_IPFS_NO_DEPRECATION=1) silences the warnings about legacy url forms
+var noDeprecation bool
+
+// deprecationWarned holds the legacy forms warned about already, each one only once
+var deprecationWarned = make(map[string]bool)
+
+// warnDeprecated tells that the legacy url form old still works, but is going away in favor of canonical
+func warnDeprecated(old, canonical string) {
+	if noDeprecation || deprecationWarned[old] {
+		return
+	}
+	deprecationWarned[old] = true
+	progressf("warning: %s urls are deprecated, use %s instead\n", old, canonical)
+}
+
+// parseURLSchemes parses the comma separated prefix=target pairs of GIT_IPFS_URL_SCHEMES,
+// like dweb://=/ipfs/,myorg://=/ipns/repos.example.org/
+func parseURLSchemes(s string) ([]urlPrefix, error) {
+	var prefixes []urlPrefix
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		eq := strings.LastIndex(pair, "=")
+		if eq <= 0 {
+			return nil, errgo.Newf("%q is not a prefix=target pair", pair)
+		}
+		m := urlPrefix{prefix: pair[:eq], target: pair[eq+1:]}
+		if !strings.HasPrefix(m.target, "/ipfs/") && !strings.HasPrefix(m.target, "/ipns/") {
+			return nil, errgo.Newf("target of %q has to start with /ipfs/ or /ipns/", pair)
+		}
+		if !strings.HasSuffix(m.target, "/") {
+			m.target += "/"
+		}
+		prefixes = append(prefixes, m)
+	}
+	return prefixes, nil
+}
+
+// urlOptions maps the query keys a url can carry, like ipfs://ipfs/$hash/repo.git?store=block&lfs=1,
+// to the env vars they stand for
+var urlOptions = map[string]string{
+	"store":               "GIT_IPFS_STORE",
+	"block-threshold":     "GIT_IPFS_BLOCK_THRESHOLD",
+	"lfs":                 "GIT_IPFS_LFS",
+	"track-refs":          "GIT_IPFS_TRACK_REFS",
+	"commit-graph":        "GIT_IPFS_WRITE_COMMIT_GRAPH",
+	"continue-on-missing": "GIT_IPFS_CONTINUE_ON_MISSING",
+	"assume-packed":       "GIT_IPFS_ASSUME_PACKED",
+	"ipns-verify":         "GIT_IPFS_IPNS_VERIFY",
+	"push-lock-wait":      "GIT_IPFS_PUSH_LOCK_WAIT",
+	"push-rebase":         "GIT_IPFS_PUSH_REBASE",
+	"keep-base":           "GIT_IPFS_KEEP_BASE",
+	"push-checkpoint":     "GIT_IPFS_PUSH_CHECKPOINT",
+	"note-cid":            "GIT_IPFS_NOTE_CID",
+	"prefetch":            "GIT_IPFS_PREFETCH",
+	"salvage":             "GIT_IPFS_SALVAGE",
+	"default-branch":      "GIT_IPFS_DEFAULT_BRANCH",
+	"repoint-head":        "GIT_IPFS_REPOINT_HEAD",
+	"ref-filter":          "GIT_IPFS_REF_FILTER",
+	"layout":              "GIT_IPFS_LAYOUT",
+	"object-sharding":     "GIT_IPFS_OBJECT_SHARDING",
+	"pack-mode":           "GIT_IPFS_PACK_MODE",
+	"local-write":         "GIT_IPFS_LOCAL_WRITE",
+	"transport":           "GIT_IPFS_TRANSPORT",
+	"chunker":             "GIT_IPFS_CHUNKER",
+	"add-opts":            "GIT_IPFS_ADD_OPTS",
+	"cid-version":         "GIT_IPFS_CID_VERSION",
+	"max-idle-conns":      "GIT_IPFS_MAX_IDLE_CONNS",
+	"strict-version":      "GIT_IPFS_STRICT_VERSION",
+	"provider":            "GIT_IPFS_PROVIDER",
+	"since":               "GIT_IPFS_SINCE",
+	"upgrade-cid":         "GIT_IPFS_UPGRADE_CID",
+}
+
+// repoURLQuery is the query cut from the url, kept so the url push sets carries the same options
+var repoURLQuery string
+
+// cutURLQuery splits the ?key=value&.. options off u
+func cutURLQuery(u string) (string, url.Values, error) {
+	q := strings.IndexByte(u, '?')
+	if q < 0 {
+		return u, nil, nil
+	}
+	opts, err := url.ParseQuery(u[q+1:])
+	if err != nil {
+		return "", nil, errgo.Notef(err, "parsing url options failed")
+	}
+	return u[:q], opts, nil
+}
+
+// applyURLOptions sets the env vars of the known options in opts, they win over the environment.
+// it returns the unknown keys, sorted.
+func applyURLOptions(opts url.Values) ([]string, error) {
+	var unknown []string
+	for key, values := range opts {
+		env, ok := urlOptions[strings.Replace(strings.ToLower(key), "_", "-", -1)]
+		if !ok {
+			unknown = append(unknown, key)
+			continue
+		}
+		if err := os.Setenv(env, values[len(values)-1]); err != nil {
+			return nil, errgo.Notef(err, "setting %s failed", env)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown, nil
+}
+
+// repoLabel is the @label annotation cut from the url, for bookkeeping only
+var repoLabel string
+
+// cutURLLabel removes a trailing @label from the hash or name of the url, like ipfs://ipfs/$hash@2024-01-01/repo.git.
+// it returns the url without it and the label, "" if there is none.
+func cutURLLabel(u string) (string, string) {
+	for _, m := range urlPrefixes {
+		if !strings.HasPrefix(u, m.prefix) {
+			continue
+		}
+		root := u[len(m.prefix):]
+		end := strings.IndexByte(root, '/')
+		if end < 0 {
+			end = len(root)
+		}
+		at := strings.IndexByte(root[:end], '@')
+		if at < 0 {
+			return u, ""
+		}
+		return m.prefix + root[:at] + root[end:], root[at+1 : end]
+	}
+	return u, ""
+}
+
+// parseRepoURL turns the remote url into the ipfs path of the repo
+func parseRepoURL(u string) (string, error) {
+	for _, m := range urlPrefixes {
+		if strings.HasPrefix(u, m.prefix) {
+			if m.canonical != "" {
+				warnDeprecated(m.prefix, m.canonical)
+			}
+			u = m.target + u[len(m.prefix):]
+			log.Debug("prefix cut:", u)
+			break
+		}
+	}
+	p, err := path.ParsePath(u)
+	if err != nil {
+		return "", errgo.Notef(err, "path.ParsePath() failed")
+	}
+	// a/b//c/ or ./ make the joins with it and the prefix comparisons against ipfs' own (clean) paths disagree
+	p, err = path.FromSegments("/", p.Segments()...)
+	if err != nil {
+		return "", errgo.Notef(err, "repo path %s doesn't stay below its root", u)
+	}
+	return p.String(), nil
+}
+
+// ipnsName splits an /ipns/$name/sub/path repo path into the name and the path below it
+func ipnsName(p string) (name, rest string, ok bool) {
+	if !strings.HasPrefix(p, "/ipns/") {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(p, "/ipns/"), "/", 2)
+	if parts[0] == "" {
+		return "", "", false
+	}
+	if len(parts) == 2 {
+		rest = strings.Trim(parts[1], "/")
+	}
+	return parts[0], rest, true
+}
+
+// noteCIDv1URL prints the url of the repo with its version 0 root spelled as a version 1 cid (GIT_IPFS_UPGRADE_CID=1),
+// for replacing old Qm.. urls. it only informs, the remote url stays as it is.
+func noteCIDv1URL() {
+	if ipnsRepoPath != "" || !strings.HasPrefix(ipfsRepoPath, "/ipfs/") {
+		// an ipns url doesn't name a cid
+		return
+	}
+	rest := strings.TrimPrefix(ipfsRepoPath, "/ipfs/")
+	root := strings.SplitN(rest, "/", 2)[0]
+	if cidVersionOf(root) != 0 {
+		return
+	}
+	v1, err := cidV1Of(root)
+	if err != nil {
+		log.WithField("root", root).WithField("err", err).Warning("converting the root to a version 1 cid failed")
+		return
+	}
+	progressf("%s is %s as version 1 cid, the same repo is ipfs:///ipfs/%s%s\n", root, v1, v1+strings.TrimPrefix(rest, root), repoURLQuery)
+}
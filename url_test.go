@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+const fixtureHash = "QmdfTbBqBPQ7VNxZEYEj14VmRuZBkqFbiwReogJgS1zR1n"
+
+func TestParseRepoURL(t *testing.T) {
+	cases := map[string]string{
+		"ipfs://ipfs/" + fixtureHash + "/repo.git":  "/ipfs/" + fixtureHash + "/repo.git",
+		"ipfs:///ipfs/" + fixtureHash + "/repo.git": "/ipfs/" + fixtureHash + "/repo.git",
+		"ipfs://ipns/example.com/repo.git":          "/ipns/example.com/repo.git",
+		"ipfs:///ipns/" + fixtureHash:               "/ipns/" + fixtureHash,
+		// nested repos come out clean, so joins and prefixes match ipfs' paths
+		"ipfs://ipfs/" + fixtureHash + "/a/b//c/./repo.git/": "/ipfs/" + fixtureHash + "/a/b/c/repo.git",
+		"ipfs://ipfs/" + fixtureHash + "/a/x/../b/repo.git":  "/ipfs/" + fixtureHash + "/a/b/repo.git",
+	}
+	for u, want := range cases {
+		got, err := parseRepoURL(u)
+		if err != nil {
+			t.Errorf("parseRepoURL(%q) failed: %s", u, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("parseRepoURL(%q): want %q got %q", u, want, got)
+		}
+	}
+	if _, err := parseRepoURL("ipfs://ipfs/"); err == nil {
+		t.Error("expected error for url without hash")
+	}
+	if _, err := parseRepoURL("ipfs://ipfs/" + fixtureHash + "/../.."); err == nil {
+		t.Error("expected error for a path above the root")
+	}
+}
+
+func TestParseRepoURL_deprecated(t *testing.T) {
+	var errOut bytes.Buffer
+	oldStderr := stderr
+	stderr = &errOut
+	defer func(warned map[string]bool) { stderr, deprecationWarned, noDeprecation = oldStderr, warned, false }(deprecationWarned)
+	deprecationWarned = make(map[string]bool)
+
+	for _, u := range []string{"ipfs:///ipns/example.com/a.git", "ipfs:///ipns/example.com/b.git", "ipfs://ipns/example.com/c.git"} {
+		if _, err := parseRepoURL(u); err != nil {
+			t.Fatalf("parseRepoURL(%q) failed: %s", u, err)
+		}
+	}
+	if want := "warning: ipfs:///ipns/ urls are deprecated, use ipfs://ipns/ instead\n"; errOut.String() != want {
+		t.Errorf("want the deprecation warning once, got %q", errOut.String())
+	}
+
+	errOut.Reset()
+	deprecationWarned = make(map[string]bool)
+	noDeprecation = true
+	if _, err := parseRepoURL("ipfs:///ipns/example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if errOut.Len() != 0 {
+		t.Errorf("GIT_IPFS_NO_DEPRECATION should silence the warning, got %q", errOut.String())
+	}
+}
+
+func TestCutURLLabel(t *testing.T) {
+	cases := []struct{ u, url, label string }{
+		{"ipfs://ipfs/" + fixtureHash + "@2024-01-01/repo.git", "ipfs://ipfs/" + fixtureHash + "/repo.git", "2024-01-01"},
+		{"ipfs:///ipfs/" + fixtureHash + "@v1", "ipfs:///ipfs/" + fixtureHash, "v1"},
+		{"ipfs://ipns/example.com@before-rewrite/repo.git", "ipfs://ipns/example.com/repo.git", "before-rewrite"},
+		{"ipfs://ipfs/" + fixtureHash + "/repo.git", "ipfs://ipfs/" + fixtureHash + "/repo.git", ""},
+		// only the root is labeled
+		{"ipfs://ipfs/" + fixtureHash + "/repo@2.git", "ipfs://ipfs/" + fixtureHash + "/repo@2.git", ""},
+	}
+	for _, c := range cases {
+		u, label := cutURLLabel(c.u)
+		if u != c.url || label != c.label {
+			t.Errorf("cutURLLabel(%q): got %q %q", c.u, u, label)
+			continue
+		}
+		if _, err := parseRepoURL(u); err != nil {
+			t.Errorf("parseRepoURL(%q) failed: %s", u, err)
+		}
+	}
+}
+
+func TestIPNSName(t *testing.T) {
+	cases := []struct {
+		p, name, rest string
+		ok            bool
+	}{
+		{"/ipns/example.com/repo.git", "example.com", "repo.git", true},
+		{"/ipns/" + fixtureHash, fixtureHash, "", true},
+		{"/ipns/" + fixtureHash + "/a/b/", fixtureHash, "a/b", true},
+		{"/ipfs/" + fixtureHash + "/repo.git", "", "", false},
+		{"/ipns/", "", "", false},
+	}
+	for _, c := range cases {
+		name, rest, ok := ipnsName(c.p)
+		if name != c.name || rest != c.rest || ok != c.ok {
+			t.Errorf("ipnsName(%q): got %q %q %v", c.p, name, rest, ok)
+		}
+	}
+}
+
+func TestParseURLSchemes(t *testing.T) {
+	schemes, err := parseURLSchemes("dweb://=/ipfs/, myorg://=/ipns/repos.example.org")
+	checkFatal(t, err)
+	defer func(old []urlPrefix) { urlPrefixes = old }(urlPrefixes)
+	urlPrefixes = append(schemes, urlPrefixes...)
+	cases := map[string]string{
+		"dweb://" + fixtureHash + "/repo.git": "/ipfs/" + fixtureHash + "/repo.git",
+		"myorg://tools.git":                   "/ipns/repos.example.org/tools.git",
+		// the built-in ones still work
+		"ipfs://ipfs/" + fixtureHash: "/ipfs/" + fixtureHash,
+	}
+	for u, want := range cases {
+		got, err := parseRepoURL(u)
+		if err != nil || got != want {
+			t.Errorf("parseRepoURL(%q): want %q got %q (%v)", u, want, got, err)
+		}
+	}
+	if u, label := cutURLLabel("dweb://" + fixtureHash + "@v2/repo.git"); label != "v2" || u != "dweb://"+fixtureHash+"/repo.git" {
+		t.Errorf("label of a custom scheme not cut: %q %q", u, label)
+	}
+
+	for _, bad := range []string{"dweb://", "dweb://=ipfs/", "=/ipfs/"} {
+		if _, err := parseURLSchemes(bad); err == nil {
+			t.Errorf("parseURLSchemes(%q): expected an error", bad)
+		}
+	}
+}
+
+func TestCutURLQuery(t *testing.T) {
+	u, opts, err := cutURLQuery("ipfs://ipfs/" + fixtureHash + "/repo.git?store=block&LFS=1&pack_mode=unpack&timeout=60s&concurrency=16")
+	checkFatal(t, err)
+	if u != "ipfs://ipfs/"+fixtureHash+"/repo.git" {
+		t.Errorf("query not cut: %q", u)
+	}
+	for _, env := range []string{"GIT_IPFS_STORE", "GIT_IPFS_LFS", "GIT_IPFS_PACK_MODE"} {
+		defer os.Setenv(env, os.Getenv(env))
+	}
+	os.Setenv("GIT_IPFS_STORE", "file")
+	unknown, err := applyURLOptions(opts)
+	checkFatal(t, err)
+	if strings.Join(unknown, ",") != "concurrency,timeout" {
+		t.Errorf("want the unknown keys concurrency and timeout, got %v", unknown)
+	}
+	for env, want := range map[string]string{"GIT_IPFS_STORE": "block", "GIT_IPFS_LFS": "1", "GIT_IPFS_PACK_MODE": "unpack"} {
+		if got := os.Getenv(env); got != want {
+			t.Errorf("%s: want %q got %q", env, want, got)
+		}
+	}
+
+	if u, opts, err := cutURLQuery("ipfs:///ipfs/" + fixtureHash); err != nil || opts != nil || u != "ipfs:///ipfs/"+fixtureHash {
+		t.Errorf("url without options changed: %q %v %v", u, opts, err)
+	}
+	if _, _, err := cutURLQuery("ipfs:///ipfs/" + fixtureHash + "?store=%zz"); err == nil {
+		t.Error("expected an error for a broken query")
+	}
+}
+
+func TestCIDV1Of(t *testing.T) {
+	// the empty directory, known under both names
+	got, err := cidV1Of(emptyDirHash)
+	checkFatal(t, err)
+	if want := "bafybeiczsscdsbs7ffqz55asqdf3smv6klcw3gofszvwlyarci47bgf354"; got != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+	for _, bad := range []string{got, "Qm0OIl", "QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqf"} {
+		if v1, err := cidV1Of(bad); err == nil {
+			t.Errorf("%s: expected an error, got %s", bad, v1)
+		}
+	}
+
+	var out bytes.Buffer
+	oldStderr, oldPath, oldIPNS := stderr, ipfsRepoPath, ipnsRepoPath
+	defer func() { stderr, ipfsRepoPath, ipnsRepoPath = oldStderr, oldPath, oldIPNS }()
+	stderr, ipfsRepoPath, ipnsRepoPath = &out, "/ipfs/"+emptyDirHash+"/repo.git", ""
+	noteCIDv1URL()
+	if !strings.Contains(out.String(), "ipfs:///ipfs/"+got+"/repo.git") {
+		t.Errorf("unexpected note: %q", out.String())
+	}
+}
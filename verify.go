@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/cryptix/git-remote-ipfs/internal/errkind"
+	"gopkg.in/errgo.v1"
+)
+
+// verifyRefs checks that every ref of refs (name -> sha1) points at an object of the repo root,
+// loose or in one of its packs, so a push never publishes a root git can't clone.
+func verifyRefs(root string, refs map[string]string) error {
+	repoPath := "/ipfs/" + root
+	var shas []string
+	for _, sha1 := range refs {
+		shas = append(shas, sha1)
+	}
+	have := looseObjects(repoPath, shas)
+	var packed map[string]bool
+	names := make([]string, 0, len(refs))
+	for ref := range refs {
+		names = append(names, ref)
+	}
+	sort.Strings(names)
+	for _, ref := range names {
+		sha1 := refs[ref]
+		if have[sha1] {
+			continue
+		}
+		if packed == nil {
+			var err error
+			if packed, err = packedObjects(repoPath); err != nil {
+				return err
+			}
+		}
+		if !packed[sha1] {
+			return errkind.Wrapf(nil, ErrObjectMissing, "ref %s points at %s which is missing from the new root %s", ref, sha1, root)
+		}
+	}
+	return nil
+}
+
+// packedObjects returns the names of all objects in the pack indexes of the repo at repoPath
+func packedObjects(repoPath string) (map[string]bool, error) {
+	names := make(map[string]bool)
+	packPath := path.Join(repoPath, "objects", "pack")
+	links, err := ipfsShell.List(packPath)
+	if err != nil {
+		// no packs
+		log.WithField("err", err).Debug("listing packs failed")
+		return names, nil
+	}
+	for _, lnk := range links {
+		if !strings.HasSuffix(lnk.Name, ".idx") {
+			continue
+		}
+		idx, err := ipfsShell.Cat(path.Join(packPath, lnk.Name))
+		if err != nil {
+			return nil, errgo.Notef(err, "cat(%s) failed", lnk.Name)
+		}
+		var out bytes.Buffer
+		showIdx := gitShowIndex()
+		showIdx.Stdin = idx
+		showIdx.Stdout = &out
+		err = showIdx.Run()
+		idx.Close()
+		if err != nil {
+			return nil, errgo.Notef(err, "git show-index %s failed", lnk.Name)
+		}
+		// offset sha1 (crc32)
+		for _, line := range strings.Split(out.String(), "\n") {
+			if fields := strings.Fields(line); len(fields) > 1 {
+				names[fields[1]] = true
+			}
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/ipfs/go-ipfs-shell"
+	"gopkg.in/errgo.v1"
+)
+
+// rebuildRoot builds the repo at ipfsRepoPath again from the local repo, like a push of all its refs to an empty remote does,
+// and returns the root of the source and the rebuilt one. pushes are deterministic, so a clone of a pushed repo gives the same root.
+// the refs are the source's, with the values the local repo has for them:
+// the remote tracking refs of remote (refs/remotes/<remote>/..) for branches, the same names for tags and mirror clones.
+// HEAD points to the branch refs/remotes/<remote>/HEAD (or the local HEAD) names.
+// the rebuild adds to the daemon like a push, what it shares with the source are the blocks already there.
+func rebuildRoot(ctx context.Context, remote string) (source, rebuilt string, err error) {
+	if source, err = ipfsShell.ResolvePath(ipfsRepoPath); err != nil {
+		return "", "", withKind(err, ErrNotARepo, "resolving %s failed", ipfsRepoPath)
+	}
+	ref2hash = make(map[string]string)
+	peeled = make(map[string]string)
+	if err := listInfoRefs(ctx, false); err != nil {
+		log.WithField("err", err).Debug("didn't find info/refs in repo, falling back...")
+		if err := listIterateRefs(ctx, false); err != nil {
+			return "", "", withKind(err, ErrNotARepo, "listing refs failed")
+		}
+	}
+	refs := make([]string, 0, len(ref2hash))
+	for ref := range ref2hash {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	local := make(map[string]string, len(refs))
+	for _, ref := range refs {
+		tracking := ref
+		if b := strings.TrimPrefix(ref, "refs/heads/"); b != ref {
+			tracking = "refs/remotes/" + remote + "/" + b
+		}
+		sha1, err := gitRefHash(tracking)
+		if err != nil && tracking != ref {
+			sha1, err = gitRefHash(ref)
+		}
+		if err != nil {
+			return "", "", errgo.Newf("the local repo has no %s for the remote's %s", tracking, ref)
+		}
+		local[ref] = sha1
+	}
+
+	var objs, tips []string
+	listed := make(map[string]bool)
+	for _, ref := range refs {
+		reached, err := gitListObjects(local[ref], tips)
+		if err != nil {
+			return "", "", err
+		}
+		for _, sha1 := range reached {
+			if !listed[sha1] {
+				listed[sha1] = true
+				objs = append(objs, sha1)
+			}
+		}
+		tips = append(tips, local[ref])
+	}
+	objectSharding = detectSharding(false)
+	matchCIDVersion(source)
+	root, err := ipfsShell.NewObject("unixfs-dir")
+	if err != nil {
+		return "", "", errgo.Notef(err, "shell.NewObject(unixfs-dir) failed")
+	}
+	hashes, err := putObjects(ctx, source, objs)
+	if err != nil {
+		return "", "", err
+	}
+	if root, err = objStore.linkObjects(root, hashes); err != nil {
+		return "", "", errgo.Notef(err, "linkObjects failed")
+	}
+	files := make(map[string]string, len(local)+1)
+	for ref, sha1 := range local {
+		files[ref] = sha1 + "\n"
+	}
+	if head, err := gitSymbolicRef("refs/remotes/" + remote + "/HEAD"); err == nil {
+		files["HEAD"] = "ref: refs/heads/" + strings.TrimPrefix(head, "refs/remotes/"+remote+"/") + "\n"
+	} else if head, err := gitSymbolicRef("HEAD"); err == nil {
+		files["HEAD"] = "ref: " + head + "\n"
+	}
+	for name, content := range files {
+		h, err := addObject(bytes.NewBufferString(content))
+		if err != nil {
+			return "", "", errgo.Notef(err, "adding %s failed", name)
+		}
+		if root, err = ipfsShell.PatchLink(root, name, h, true); err != nil {
+			return "", "", errgo.Notef(err, "patchLink(%s) failed", name)
+		}
+	}
+	return source, root, nil
+}
+
+// treeDiff returns the paths below the directories a and b that differ, going depth levels down
+func treeDiff(a, b, prefix string, depth int) ([]string, error) {
+	entries := func(h string) (map[string]*shell.LsEntry, error) {
+		list, err := ipfsShell.List("/ipfs/" + h)
+		if err != nil {
+			return nil, errgo.Notef(err, "listing %s failed", h)
+		}
+		m := make(map[string]*shell.LsEntry, len(list))
+		for _, e := range list {
+			m[e.Name] = e
+		}
+		return m, nil
+	}
+	inA, err := entries(a)
+	if err != nil {
+		return nil, err
+	}
+	inB, err := entries(b)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range inA {
+		names = append(names, name)
+	}
+	for name := range inB {
+		if _, ok := inA[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var diffs []string
+	for _, name := range names {
+		ea, okA := inA[name]
+		eb, okB := inB[name]
+		p := path.Join(prefix, name)
+		switch {
+		case !okB:
+			diffs = append(diffs, p+" (only in the source)")
+		case !okA:
+			diffs = append(diffs, p+" (only rebuilt)")
+		case ea.Hash == eb.Hash:
+		case depth > 1 && isDir(ea) && isDir(eb):
+			below, err := treeDiff(ea.Hash, eb.Hash, p, depth-1)
+			if err != nil {
+				return nil, err
+			}
+			diffs = append(diffs, below...)
+		default:
+			diffs = append(diffs, p)
+		}
+	}
+	return diffs, nil
+}
+
+// maxDiffs is how many differing paths verify prints
+const maxDiffs = 20
+
+// verifyMain is git-remote-ipfs verify [-remote name] <url>, run in a clone of url
+func verifyMain(args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	remote := flags.String("remote", "origin", "the remote the clone tracks url with")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: git-remote-ipfs verify [-remote name] <url>")
+		return exitUsage
+	}
+	var err error
+	if thisGitRepo, err = localGitDir(); err != nil {
+		log.Error(err)
+		return exitNotRepo
+	}
+	thisGitRemote = *remote
+	if code := openRemote(flags.Arg(0)); code != 0 {
+		return code
+	}
+	source, rebuilt, err := rebuildRoot(context.Background(), *remote)
+	if err != nil {
+		log.Error("rebuilding the repo failed:", err)
+		return exitCode(err)
+	}
+	return reportVerify(os.Stdout, source, rebuilt)
+}
+
+// reportVerify prints whether the roots match and if not where they differ, it returns the exit code
+func reportVerify(w io.Writer, source, rebuilt string) int {
+	if source == rebuilt {
+		fmt.Fprintf(w, "match: the local repo rebuilds to %s\n", source)
+		return 0
+	}
+	fmt.Fprintf(w, "mismatch: the source is %s, the local repo rebuilds to %s\n", source, rebuilt)
+	diffs, err := treeDiff(source, rebuilt, "", 3)
+	if err != nil {
+		log.WithField("err", err).Warning("comparing the roots failed")
+	}
+	for i, p := range diffs {
+		if i == maxDiffs {
+			fmt.Fprintf(w, "  ... and %d more\n", len(diffs)-maxDiffs)
+			break
+		}
+		fmt.Fprintf(w, "  %s\n", p)
+	}
+	return exitFailure
+}
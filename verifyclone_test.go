@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestRebuildRoot(t *testing.T) {
+	fs, restore := useFakeRepo(t, map[string]string{})
+	defer restore()
+	_, cleanup := mkLocalRepo(t, "ipfs://"+ipfsRepoPath)
+	defer cleanup()
+	stderr = ioutil.Discard
+	defer func() { stderr = os.Stderr }()
+	addFiles(t, 2)
+	gitRun(t, "tag", "-a", "-m", "v1", "v1")
+	checkFatal(t, push(context.Background(), "refs/heads/master", "refs/heads/master"))
+	checkFatal(t, push(context.Background(), "refs/tags/v1", "refs/tags/v1"))
+	checkFatal(t, pushFinish(context.Background()))
+	source := strings.TrimPrefix(remoteURL(t), "ipfs://")
+
+	// a clone: the objects, origin's tracking refs and the tags
+	ipfsRepoPath = source
+	ref2hash = make(map[string]string)
+	clone, done := initClone(t)
+	defer done()
+	var out bytes.Buffer
+	checkFatal(t, speakGit(context.Background(), strings.NewReader("list\n"), &out))
+	for ref, sha1 := range ref2hash {
+		checkFatal(t, fetchObject(context.Background(), sha1))
+		checkFatal(t, gitUpdateRef(strings.Replace(ref, "refs/heads/", "refs/remotes/origin/", 1), sha1))
+	}
+	sym := exec.Command("git", "symbolic-ref", "refs/remotes/origin/HEAD", "refs/remotes/origin/master")
+	sym.Dir = clone
+	checkFatal(t, sym.Run())
+
+	src, rebuilt, err := rebuildRoot(context.Background(), "origin")
+	checkFatal(t, err)
+	out.Reset()
+	if code := reportVerify(&out, src, rebuilt); code != 0 || src != strings.TrimPrefix(source, "/ipfs/") {
+		t.Errorf("clean clone doesn't match %s:\n%s", source, out.String())
+	}
+
+	// a source with something a push doesn't write
+	extra, err := fs.PatchLink(src, "description", fs.addFile("unnamed\n"), true)
+	checkFatal(t, err)
+	ipfsRepoPath = "/ipfs/" + extra
+	src, rebuilt, err = rebuildRoot(context.Background(), "origin")
+	checkFatal(t, err)
+	out.Reset()
+	if code := reportVerify(&out, src, rebuilt); code == 0 || !strings.Contains(out.String(), "  description (only in the source)\n") {
+		t.Errorf("want a mismatch at description, got:\n%s", out.String())
+	}
+}
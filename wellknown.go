@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// wellKnownEnabled (GIT_IPFS_WELLKNOWN=1) makes push write wellKnownPath into the repo root
+var wellKnownEnabled bool
+
+// wellKnownPath is where tools find the description of a repo in ipfs
+const wellKnownPath = ".well-known/git-ipfs.json"
+
+// wellKnownVersion is the version of the wellKnown schema, bumped on incompatible changes
+const wellKnownVersion = 1
+
+// wellKnown describes the repo for tools reading it from ipfs, without knowing git's repo layout
+type wellKnown struct {
+	Version       int    `json:"version"`
+	DefaultBranch string `json:"default_branch,omitempty"` // the ref HEAD points to
+	ObjectFormat  string `json:"object_format"`            // sha1 or sha256
+	// CloneURL is the ipns url of the repo, an immutable root can't name its own hash
+	CloneURL string         `json:"clone_url,omitempty"`
+	Refs     []wellKnownRef `json:"refs"`
+}
+
+type wellKnownRef struct {
+	Name   string `json:"name"`
+	Object string `json:"object"`        // the git object name
+	CID    string `json:"cid,omitempty"` // of the object in the repo, unset if it's only in a pack
+}
+
+// writeWellKnown puts the description of refs, as the repo at root has them, into root and returns the new root
+func writeWellKnown(root string, refs map[string]string) (string, error) {
+	doc := wellKnown{Version: wellKnownVersion, ObjectFormat: objectFormat, Refs: []wellKnownRef{}}
+	if head, err := ipfsShell.Cat("/ipfs/" + root + "/HEAD"); err == nil {
+		b, err := ioutil.ReadAll(head)
+		head.Close()
+		if err == nil && bytes.HasPrefix(b, []byte("ref: ")) {
+			doc.DefaultBranch = string(bytes.TrimSpace(b[5:]))
+		}
+	}
+	if name, rest, ok := ipnsName(ipnsRepoPath); ok {
+		doc.CloneURL = "ipfs://ipns/" + path.Join(name, rest)
+	}
+	names := make([]string, 0, len(refs))
+	for ref := range refs {
+		names = append(names, ref)
+	}
+	sort.Strings(names)
+	for _, ref := range names {
+		r := wellKnownRef{Name: ref, Object: refs[ref]}
+		if cid, err := ipfsShell.ResolvePath("/ipfs/" + root + "/" + remoteObjectPath(r.Object)); err == nil {
+			r.CID = cid
+		}
+		doc.Refs = append(doc.Refs, r)
+	}
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return "", errgo.Notef(err, "encoding %s failed", wellKnownPath)
+	}
+	mhash, err := addObject(strings.NewReader(string(b) + "\n"))
+	if err != nil {
+		return "", errgo.Notef(err, "adding %s failed", wellKnownPath)
+	}
+	newRoot, err := ipfsShell.PatchLink(root, wellKnownPath, mhash, true)
+	if err != nil {
+		return "", errgo.Notef(err, "patchLink(%s) failed", wellKnownPath)
+	}
+	log.WithField("newRoot", newRoot).Debug("wrote ", wellKnownPath)
+	return newRoot, nil
+}
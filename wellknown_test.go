@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestWriteWellKnown(t *testing.T) {
+	files := map[string]string{"HEAD": "ref: refs/heads/main\n"}
+	commit, _ := fixtureCommit(files, "well known\n")
+	files["refs/heads/main"] = commit + "\n"
+	// only in a pack
+	packedOnly := strings.Repeat("cd", 20)
+	fs, restore := useFakeRepo(t, files)
+	defer restore()
+	root := strings.TrimPrefix(ipfsRepoPath, "/ipfs/")
+	ipnsRepoPath = "/ipns/example.com/repo.git"
+
+	newRoot, err := writeWellKnown(root, map[string]string{"refs/heads/main": commit, "refs/tags/v1": packedOnly})
+	checkFatal(t, err)
+	r, err := fs.Cat("/ipfs/" + newRoot + "/" + wellKnownPath)
+	checkFatal(t, err)
+	b, err := ioutil.ReadAll(r)
+	checkFatal(t, err)
+	var doc wellKnown
+	checkFatal(t, json.Unmarshal(b, &doc))
+
+	cid, err := fs.ResolvePath(ipfsRepoPath + "/" + objectPath(commit))
+	checkFatal(t, err)
+	want := wellKnown{
+		Version:       1,
+		DefaultBranch: "refs/heads/main",
+		ObjectFormat:  formatSHA1,
+		CloneURL:      "ipfs://ipns/example.com/repo.git",
+		Refs: []wellKnownRef{
+			{Name: "refs/heads/main", Object: commit, CID: cid},
+			{Name: "refs/tags/v1", Object: packedOnly},
+		},
+	}
+	if doc.Version != want.Version || doc.DefaultBranch != want.DefaultBranch || doc.ObjectFormat != want.ObjectFormat ||
+		doc.CloneURL != want.CloneURL || len(doc.Refs) != 2 || doc.Refs[0] != want.Refs[0] || doc.Refs[1] != want.Refs[1] {
+		t.Errorf("unexpected document:\n%s\nwant %+v", b, want)
+	}
+	// the rest of the repo is untouched
+	if _, err := fs.ResolvePath("/ipfs/" + newRoot + "/" + objectPath(commit)); err != nil {
+		t.Errorf("objects lost: %s", err)
+	}
+	if !strings.Contains(string(b), `"default_branch": "refs/heads/main"`) {
+		t.Errorf("unexpected field names:\n%s", b)
+	}
+}